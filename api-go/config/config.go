@@ -2,6 +2,8 @@ package config
 
 import (
     "os"
+    "strconv"
+    "strings"
 )
 
 type Config struct {
@@ -11,6 +13,78 @@ type Config struct {
     Port           string
     ClaudeAPIKey   string
     ClaudeModel    string
+
+    // AllowRegistration lets anyone create an account via /api/auth/register
+    AllowRegistration bool
+    // AdminUsers are the usernames allowed to use server-wide admin
+    // endpoints such as /api/admin/fsck
+    AdminUsers []string
+    // CORSAllowedOrigins is a comma-separated origin allow list, or "*"
+    CORSAllowedOrigins string
+
+    // OpenID Connect single sign-on, enabled when OIDCIssuerURL is set
+    OIDCIssuerURL       string
+    OIDCClientID        string
+    OIDCClientSecret    string
+    OIDCRedirectURL     string
+    OIDCScopes          []string
+    OIDCPostLoginURL    string
+    OIDCAutoCreateUsers bool
+
+    // StorageBackend is "local" (files under HSADir) or "s3"
+    StorageBackend string
+    // StoragePresignedDownloads redirects receipt downloads to presigned
+    // URLs when the backend supports them, instead of proxying the bytes
+    StoragePresignedDownloads bool
+    // S3-compatible object storage (AWS S3, MinIO, ...), used when
+    // StorageBackend is "s3"
+    S3Endpoint        string
+    S3Region          string
+    S3Bucket          string
+    S3AccessKeyID     string
+    S3SecretAccessKey string
+    S3ForcePathStyle  bool
+
+    // OCRProvider selects the extractor: "http" (the OCR service at
+    // OCRServiceURL), "text" (built-in parser for plain-text receipts) or
+    // "fixture" (replays recorded results from OCRFixtureDir)
+    OCRProvider   string
+    OCRFixtureDir string
+    // OCRFixtureRecord saves OCR service results for receipts without a
+    // fixture, to build a fixture set from real uploads
+    OCRFixtureRecord bool
+    // OCRWorkers is the number of background workers processing OCR jobs
+    OCRWorkers int
+    // OCRMaxAttempts is how often an OCR job is tried before it is
+    // dead-lettered and its receipt marked ocr_failed
+    OCRMaxAttempts int
+
+    // DuplicateImageCheck flags uploads that look like an earlier receipt's
+    // image, e.g. a second photo of the same paper receipt
+    DuplicateImageCheck bool
+    // DuplicateImageDistance is how many of the 64 perceptual hash bits may
+    // differ for two images to count as the same receipt
+    DuplicateImageDistance int
+
+    // MaxUploadSize is the largest upload request accepted, in MB, and
+    // MaxUploadFileSize the largest file in one, ZIP archives included
+    MaxUploadSize     int
+    MaxUploadFileSize int
+
+    // InboxUser enables the watched inbox folder (inbox/ under HSADir):
+    // files dropped there are imported as this user's receipts, in
+    // InboxHouseholdID or, when it is 0, the user's default household
+    InboxUser        string
+    InboxHouseholdID int
+    // InboxPollInterval is how often, in seconds, the inbox is scanned
+    InboxPollInterval int
+
+    // SMTPAddr enables the receiver for emailed receipts on this address,
+    // e.g. ":2525"; mail to <member token>@SMTPDomain becomes receipts
+    SMTPAddr   string
+    SMTPDomain string
+    // SMTPMaxMessageSize is the largest message accepted, in MB
+    SMTPMaxMessageSize int
 }
 
 func Load() *Config {
@@ -21,6 +95,47 @@ func Load() *Config {
         Port:           getEnv("PORT", "8080"),
         ClaudeAPIKey:   getEnv("CLAUDE_API_KEY", "YOUR-CLAUDE-API-KEY"),
         ClaudeModel:    getEnv("CLAUDE_MODEL", "claude-3-5-haiku-20241022"),
+
+        AllowRegistration:  getEnvBool("ALLOW_REGISTRATION", true),
+        AdminUsers:         getEnvList("ADMIN_USERS"),
+        CORSAllowedOrigins: getEnv("CORS_ALLOWED_ORIGINS", "*"),
+
+        OIDCIssuerURL:       getEnv("OIDC_ISSUER_URL", ""),
+        OIDCClientID:        getEnv("OIDC_CLIENT_ID", ""),
+        OIDCClientSecret:    getEnv("OIDC_CLIENT_SECRET", ""),
+        OIDCRedirectURL:     getEnv("OIDC_REDIRECT_URL", "http://localhost:8080/api/auth/oidc/callback"),
+        OIDCScopes:          strings.Fields(getEnv("OIDC_SCOPES", "openid email profile")),
+        OIDCPostLoginURL:    getEnv("OIDC_POST_LOGIN_URL", "http://localhost:3000/login"),
+        OIDCAutoCreateUsers: getEnvBool("OIDC_AUTO_CREATE_USERS", true),
+
+        StorageBackend:            getEnv("STORAGE_BACKEND", "local"),
+        StoragePresignedDownloads: getEnvBool("STORAGE_PRESIGNED_DOWNLOADS", false),
+        S3Endpoint:                getEnv("S3_ENDPOINT", ""),
+        S3Region:                  getEnv("S3_REGION", "us-east-1"),
+        S3Bucket:                  getEnv("S3_BUCKET", ""),
+        S3AccessKeyID:             getEnv("S3_ACCESS_KEY_ID", ""),
+        S3SecretAccessKey:         getEnv("S3_SECRET_ACCESS_KEY", ""),
+        S3ForcePathStyle:          getEnvBool("S3_FORCE_PATH_STYLE", false),
+
+        OCRProvider:      getEnv("OCR_PROVIDER", "http"),
+        OCRFixtureDir:    getEnv("OCR_FIXTURE_DIR", ""),
+        OCRFixtureRecord: getEnvBool("OCR_FIXTURE_RECORD", false),
+        OCRWorkers:       getEnvInt("OCR_WORKERS", 2),
+        OCRMaxAttempts:   getEnvInt("OCR_MAX_ATTEMPTS", 5),
+
+        DuplicateImageCheck:    getEnvBool("DUPLICATE_IMAGE_CHECK", true),
+        DuplicateImageDistance: getEnvInt("DUPLICATE_IMAGE_DISTANCE", 10),
+
+        MaxUploadSize:     getEnvInt("MAX_UPLOAD_SIZE", 200),
+        MaxUploadFileSize: getEnvInt("MAX_UPLOAD_FILE_SIZE", 50),
+
+        InboxUser:         getEnv("INBOX_USER", ""),
+        InboxHouseholdID:  getEnvInt("INBOX_HOUSEHOLD_ID", 0),
+        InboxPollInterval: getEnvInt("INBOX_POLL_INTERVAL", 30),
+
+        SMTPAddr:           getEnv("SMTP_ADDR", ""),
+        SMTPDomain:         getEnv("SMTP_DOMAIN", ""),
+        SMTPMaxMessageSize: getEnvInt("SMTP_MAX_MESSAGE_SIZE", 25),
     }
 }
 
@@ -29,4 +144,25 @@ func getEnv(key, defaultValue string) string {
         return value
     }
     return defaultValue
+}
+
+func getEnvBool(key string, defaultValue bool) bool {
+    if value, err := strconv.ParseBool(os.Getenv(key)); err == nil {
+        return value
+    }
+    return defaultValue
+}
+
+func getEnvInt(key string, defaultValue int) int {
+    if value, err := strconv.Atoi(os.Getenv(key)); err == nil && value > 0 {
+        return value
+    }
+    return defaultValue
+}
+
+// getEnvList splits a comma- or space-separated variable
+func getEnvList(key string) []string {
+    return strings.FieldsFunc(os.Getenv(key), func(r rune) bool {
+        return r == ',' || r == ' '
+    })
 }
\ No newline at end of file
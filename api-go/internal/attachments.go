@@ -0,0 +1,351 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Attachment document types
+const (
+	AttachmentReceipt = "receipt" // the receipt itself, itemized or not
+	AttachmentEOB     = "eob"     // the insurer's Explanation of Benefits
+	AttachmentLMN     = "lmn"     // a Letter of Medical Necessity
+	AttachmentOther   = "other"
+)
+
+var attachmentTypes = map[string]bool{
+	AttachmentReceipt: true,
+	AttachmentEOB:     true,
+	AttachmentLMN:     true,
+	AttachmentOther:   true,
+}
+
+// attachmentColumns is the column list scanned by scanAttachment
+const attachmentColumns = `
+        a.id, a.receipt_id, a.document_type, a.is_primary, a.file_hash, a.storage_key, a.mime_type,
+        a.original_filename, a.uploaded_by, a.created_at`
+
+func scanAttachment(row rowScanner) (*Attachment, error) {
+	var a Attachment
+	err := row.Scan(&a.ID, &a.ReceiptID, &a.DocumentType, &a.Primary, &a.FileHash, &a.StorageKey, &a.MimeType,
+		&a.OriginalName, &a.UploadedBy, &a.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+func scanAttachments(rows *sql.Rows) ([]Attachment, error) {
+	defer rows.Close()
+
+	attachments := []Attachment{}
+	for rows.Next() {
+		a, err := scanAttachment(rows)
+		if err != nil {
+			return nil, err
+		}
+		attachments = append(attachments, *a)
+	}
+	return attachments, rows.Err()
+}
+
+// insertPrimaryAttachment records a new receipt's file as its primary
+// attachment
+func insertPrimaryAttachment(q queryRower, receipt *Receipt) error {
+	var id int
+	return q.QueryRow(`
+        INSERT INTO receipt_attachments (receipt_id, document_type, is_primary, file_hash, storage_key, mime_type,
+                                         original_filename, uploaded_by, created_at)
+        VALUES ($1, $2, true, $3, $4, $5, $6, $7, $8)
+        RETURNING id
+    `, receipt.ID, AttachmentReceipt, receipt.ImageHash, receipt.ImagePath, ContentTypeForKey(receipt.ImagePath),
+		receipt.OriginalName, receipt.UserID, receipt.CreatedAt).Scan(&id)
+}
+
+// GetReceiptAttachments returns a receipt's attachments, the primary one
+// first
+func (db *Database) GetReceiptAttachments(receiptID int) ([]Attachment, error) {
+	rows, err := db.conn.Query(`
+        SELECT `+attachmentColumns+`
+        FROM receipt_attachments a
+        WHERE a.receipt_id = $1
+        ORDER BY a.is_primary DESC, a.id
+    `, receiptID)
+	if err != nil {
+		return nil, err
+	}
+	return scanAttachments(rows)
+}
+
+// GetSecondaryAttachments returns the attachments other than receipt files,
+// ordered by receipt. householdID 0 means every household.
+func (db *Database) GetSecondaryAttachments(householdID int) ([]Attachment, error) {
+	rows, err := db.conn.Query(`
+        SELECT `+attachmentColumns+`
+        FROM receipt_attachments a
+        JOIN receipts r ON r.id = a.receipt_id
+        WHERE NOT a.is_primary AND ($1 = 0 OR r.household_id = $1)
+        ORDER BY a.receipt_id, a.id
+    `, householdID)
+	if err != nil {
+		return nil, err
+	}
+	return scanAttachments(rows)
+}
+
+// GetAttachment returns one of a receipt's attachments, or sql.ErrNoRows
+func (db *Database) GetAttachment(receiptID int, id int) (*Attachment, error) {
+	return scanAttachment(db.conn.QueryRow(`
+        SELECT `+attachmentColumns+`
+        FROM receipt_attachments a
+        WHERE a.id = $1 AND a.receipt_id = $2
+    `, id, receiptID))
+}
+
+// GetAttachmentByHash returns the receipt's attachment with the given file
+// hash, or nil when the file is not attached
+func (db *Database) GetAttachmentByHash(receiptID int, hash string) (*Attachment, error) {
+	a, err := scanAttachment(db.conn.QueryRow(`
+        SELECT `+attachmentColumns+`
+        FROM receipt_attachments a
+        WHERE a.receipt_id = $1 AND a.file_hash = $2
+    `, receiptID, hash))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return a, err
+}
+
+func (db *Database) CreateAttachment(a *Attachment) error {
+	return db.conn.QueryRow(`
+        INSERT INTO receipt_attachments (receipt_id, document_type, is_primary, file_hash, storage_key, mime_type,
+                                         original_filename, uploaded_by, created_at)
+        VALUES ($1, $2, false, $3, $4, $5, $6, $7, NOW())
+        RETURNING id, created_at
+    `, a.ReceiptID, a.DocumentType, a.FileHash, a.StorageKey, a.MimeType, a.OriginalName, a.UploadedBy,
+	).Scan(&a.ID, &a.CreatedAt)
+}
+
+// DeleteAttachment deletes an attachment other than the receipt file. It
+// returns sql.ErrNoRows when there is no such attachment.
+func (db *Database) DeleteAttachment(receiptID int, id int) error {
+	result, err := db.conn.Exec(
+		"DELETE FROM receipt_attachments WHERE id = $1 AND receipt_id = $2 AND NOT is_primary", id, receiptID)
+	if err != nil {
+		return err
+	}
+
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// copyAttachments attaches a receipt's documents other than its own file to
+// another receipt within tx, e.g. one split from or merged out of it. Files
+// already attached there are skipped.
+func copyAttachments(tx *sql.Tx, fromReceiptID int, toReceiptID int) error {
+	_, err := tx.Exec(`
+        INSERT INTO receipt_attachments (receipt_id, document_type, is_primary, file_hash, storage_key, mime_type,
+                                         original_filename, uploaded_by, created_at)
+        SELECT $2, document_type, false, file_hash, storage_key, mime_type, original_filename, uploaded_by, created_at
+        FROM receipt_attachments
+        WHERE receipt_id = $1 AND NOT is_primary
+        ORDER BY id
+        ON CONFLICT (receipt_id, file_hash) DO NOTHING
+    `, fromReceiptID, toReceiptID)
+	return err
+}
+
+// DeleteReceiptFiles removes a deleted receipt's file and the files of its
+// other attachments, each unless another receipt or attachment still
+// references it. attachments are the receipt's, read before it was deleted.
+func (s *Server) DeleteReceiptFiles(receipt *Receipt, attachments []Attachment) {
+	keys := []string{receipt.ImagePath}
+	for _, a := range attachments {
+		if !a.Primary {
+			keys = append(keys, a.StorageKey)
+		}
+	}
+	for _, key := range keys {
+		if err := s.DeleteReceiptFile(key); err != nil {
+			log.Printf("Warning: Failed to delete file %s: %v", key, err)
+		}
+	}
+}
+
+// ReceiptAttachmentsHandler lists a receipt's attachments (GET) or attaches
+// a document to it (POST, multipart: file, and document_type receipt, eob,
+// lmn or other). Attachments are kept for an audit and are not read by OCR.
+func (s *Server) ReceiptAttachmentsHandler(w http.ResponseWriter, r *http.Request, receiptID int) {
+	membership := CurrentMembership(r)
+	if _, err := s.DB.GetReceiptByID(membership.HouseholdID, receiptID); err != nil {
+		http.Error(w, "Receipt not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		attachments, err := s.DB.GetReceiptAttachments(receiptID)
+		if err != nil {
+			log.Printf("Failed to get receipt attachments: %v", err)
+			http.Error(w, "Failed to get attachments", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(attachments)
+	case http.MethodPost:
+		if !membership.CanWrite() {
+			http.Error(w, "Viewers cannot change receipts", http.StatusForbidden)
+			return
+		}
+		s.uploadAttachment(w, r, receiptID)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) uploadAttachment(w http.ResponseWriter, r *http.Request, receiptID int) {
+	if !s.ParseUploadForm(w, r) {
+		return
+	}
+
+	documentType := strings.ToLower(strings.TrimSpace(r.FormValue("document_type")))
+	if documentType == "" {
+		documentType = AttachmentOther
+	}
+	if !attachmentTypes[documentType] {
+		http.Error(w, "document_type must be receipt, eob, lmn or other", http.StatusBadRequest)
+		return
+	}
+
+	if len(r.MultipartForm.File["file"]) == 0 {
+		http.Error(w, "Failed to get file from request", http.StatusBadRequest)
+		return
+	}
+	header := r.MultipartForm.File["file"][0]
+
+	filename := path.Base(strings.ReplaceAll(header.Filename, "\\", "/"))
+	mimeType := ContentTypeForKey(filename)
+	if mimeType == "application/octet-stream" {
+		http.Error(w, "Attachments must be PDF, JPEG, PNG or HEIC files", http.StatusBadRequest)
+		return
+	}
+
+	data, err := s.ReadUploadFile(header)
+	if err == ErrUploadTooLarge {
+		http.Error(w, fmt.Sprintf("File is larger than %d MB", s.MaxUploadFileSize>>20), http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
+		log.Printf("Failed to read attachment %s: %v", filename, err)
+		http.Error(w, "Failed to read file", http.StatusInternalServerError)
+		return
+	}
+	if len(data) == 0 {
+		http.Error(w, "File is empty", http.StatusBadRequest)
+		return
+	}
+
+	hash := sha256.Sum256(data)
+	fileHash := hex.EncodeToString(hash[:])
+	if existing, err := s.DB.GetAttachmentByHash(receiptID, fileHash); err != nil {
+		log.Printf("Failed to check receipt attachments: %v", err)
+		http.Error(w, "Failed to save attachment", http.StatusInternalServerError)
+		return
+	} else if existing != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message":    "This file is already attached to the receipt",
+			"attachment": existing,
+		})
+		return
+	}
+
+	key, unlock, err := s.StoreReceiptFile(fileHash, filename, data)
+	if err != nil {
+		log.Printf("Failed to save attachment file: %v", err)
+		http.Error(w, "Failed to save attachment", http.StatusInternalServerError)
+		return
+	}
+	defer unlock()
+
+	attachment := &Attachment{
+		ReceiptID:    receiptID,
+		DocumentType: documentType,
+		FileHash:     fileHash,
+		StorageKey:   key,
+		MimeType:     mimeType,
+		OriginalName: filename,
+		UploadedBy:   CurrentUser(r).Username,
+	}
+	if err := s.DB.CreateAttachment(attachment); err != nil {
+		log.Printf("Failed to save attachment: %v", err)
+		http.Error(w, "Failed to save attachment", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("User %s attached %s (%s) to receipt %d", attachment.UploadedBy, filename, documentType, receiptID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(attachment)
+}
+
+// ReceiptAttachmentHandler downloads (GET) or deletes (DELETE) one of a
+// receipt's attachments. The primary attachment is the receipt's own file
+// and goes only with the receipt.
+func (s *Server) ReceiptAttachmentHandler(w http.ResponseWriter, r *http.Request, receiptID int, attachmentID int) {
+	membership := CurrentMembership(r)
+	if _, err := s.DB.GetReceiptByID(membership.HouseholdID, receiptID); err != nil {
+		http.Error(w, "Receipt not found", http.StatusNotFound)
+		return
+	}
+
+	attachment, err := s.DB.GetAttachment(receiptID, attachmentID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Attachment not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Failed to get attachment: %v", err)
+		http.Error(w, "Failed to get attachment", http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		s.ServeStoredFile(w, r, s.ReceiptKey(attachment.StorageKey), attachment.MimeType, attachment.OriginalName)
+	case http.MethodDelete:
+		if !membership.CanWrite() {
+			http.Error(w, "Viewers cannot change receipts", http.StatusForbidden)
+			return
+		}
+		if attachment.Primary {
+			http.Error(w, "This is the receipt's own file; delete the receipt instead", http.StatusConflict)
+			return
+		}
+
+		if err := s.DB.DeleteAttachment(receiptID, attachmentID); err == sql.ErrNoRows {
+			http.Error(w, "Attachment not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Printf("Failed to delete attachment: %v", err)
+			http.Error(w, "Failed to delete attachment", http.StatusInternalServerError)
+			return
+		}
+		if err := s.DeleteReceiptFile(attachment.StorageKey); err != nil {
+			log.Printf("Warning: Failed to delete file %s: %v", attachment.StorageKey, err)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"message": "Attachment deleted successfully"})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,474 @@
+package internal
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	sessionTTL       = 30 * 24 * time.Hour
+	pbkdf2Iterations = 600000
+	minPasswordLen   = 8
+)
+
+type contextKey string
+
+const (
+	userContextKey       contextKey = "user"
+	scopesContextKey     contextKey = "scopes"
+	membershipContextKey contextKey = "membership"
+)
+
+// HashPassword derives a PBKDF2-HMAC-SHA256 hash encoded as
+// pbkdf2-sha256$<iterations>$<salt>$<hash>
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := pbkdf2SHA256([]byte(password), salt, pbkdf2Iterations, 32)
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", pbkdf2Iterations,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// VerifyPassword checks password against a hash produced by HashPassword
+func VerifyPassword(password, encoded string) bool {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false
+	}
+
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations <= 0 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	expected, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+
+	key := pbkdf2SHA256([]byte(password), salt, iterations, len(expected))
+	return subtle.ConstantTimeCompare(key, expected) == 1
+}
+
+// pbkdf2SHA256 implements PBKDF2 (RFC 8018) with HMAC-SHA256
+func pbkdf2SHA256(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	hashLen := prf.Size()
+	numBlocks := (keyLen + hashLen - 1) / hashLen
+
+	var buf [4]byte
+	dk := make([]byte, 0, numBlocks*hashLen)
+	u := make([]byte, hashLen)
+	for block := 1; block <= numBlocks; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(buf[:], uint32(block))
+		prf.Write(buf[:])
+		dk = prf.Sum(dk)
+		t := dk[len(dk)-hashLen:]
+		copy(u, t)
+
+		for n := 2; n <= iterations; n++ {
+			prf.Reset()
+			prf.Write(u)
+			u = u[:0]
+			u = prf.Sum(u)
+			for i := range u {
+				t[i] ^= u[i]
+			}
+		}
+	}
+
+	return dk[:keyLen]
+}
+
+// NewToken returns a random hex token and the SHA-256 hash stored for it
+func NewToken() (token string, tokenHash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token = hex.EncodeToString(b)
+	return token, HashToken(token), nil
+}
+
+// HashToken is the lookup key stored for a session token
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// requestToken extracts a session or API token from the Authorization
+// header. GET requests for stored files may also pass ?token= so <img> and
+// download links work.
+func requestToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		if strings.HasPrefix(auth, "Bearer ") {
+			return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+		}
+		return ""
+	}
+	if r.Method == http.MethodGet && fileDownloadPath(r.URL.Path) {
+		return r.URL.Query().Get("token")
+	}
+	return ""
+}
+
+// fileDownloadPath reports whether a route serves a stored file: a receipt's
+// file or one of its attachments
+func fileDownloadPath(path string) bool {
+	if strings.HasPrefix(path, "/receipts/file/") {
+		return true
+	}
+	if !strings.HasPrefix(path, "/api/receipts/") {
+		return false
+	}
+	parts := strings.Split(strings.TrimPrefix(path, "/api/receipts/"), "/")
+	return len(parts) == 3 && parts[1] == "attachments"
+}
+
+// publicPaths are reachable without authentication
+var publicPaths = map[string]bool{
+	"/api/health":             true,
+	"/api/auth/register":      true,
+	"/api/auth/login":         true,
+	"/api/auth/oidc":          true,
+	"/api/auth/oidc/login":    true,
+	"/api/auth/oidc/callback": true,
+}
+
+// accountPath reports whether a route acts on the caller's account rather
+// than a household, so it works for users who belong to no household
+func accountPath(path string) bool {
+	switch {
+	case path == "/api/auth/me", path == "/api/auth/logout", path == "/api/households":
+		return true
+	case strings.HasPrefix(path, "/api/households/"), strings.HasPrefix(path, "/api/tokens"),
+		strings.HasPrefix(path, "/api/invitations"):
+		return true
+	default:
+		return false
+	}
+}
+
+// requiredScope maps a request to the API token scope it needs
+func requiredScope(r *http.Request) string {
+	path := r.URL.Path
+	switch {
+	case path == "/api/receipts/upload":
+		return ScopeUpload
+	case path == "/api/receipts/merge" && r.Method == http.MethodPost:
+		return ScopeUpload
+	case strings.HasPrefix(path, "/api/receipts/") && r.Method == http.MethodPost &&
+		(strings.HasSuffix(path, "/ocr") || strings.HasSuffix(path, "/split") || strings.HasSuffix(path, "/attachments")):
+		return ScopeUpload
+	case path == "/api/receipts/deduct":
+		return ScopeDeduct
+	case strings.HasPrefix(path, "/api/reimbursements") && r.Method != http.MethodGet && r.Method != http.MethodHead:
+		return ScopeDeduct
+	case strings.HasPrefix(path, "/api/tokens"), strings.HasPrefix(path, "/api/admin/"):
+		return ScopeAdmin
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		return ScopeRead
+	default:
+		return ScopeAdmin
+	}
+}
+
+// IsAdmin reports whether user is one of the server administrators named in
+// ADMIN_USERS
+func (s *Server) IsAdmin(user *User) bool {
+	if user == nil {
+		return false
+	}
+	for _, name := range s.AdminUsers {
+		if strings.EqualFold(name, user.Username) {
+			return true
+		}
+	}
+	return false
+}
+
+// CurrentUser returns the user attached to the request by Authenticate
+func CurrentUser(r *http.Request) *User {
+	user, _ := r.Context().Value(userContextKey).(*User)
+	return user
+}
+
+// HasScope reports whether the request's credential grants scope
+func HasScope(r *http.Request, scope string) bool {
+	scopes, _ := r.Context().Value(scopesContextKey).([]string)
+	return hasScope(scopes, scope)
+}
+
+// authenticateToken resolves a session or API token to its user and scopes.
+// It returns a nil user for unknown, expired or revoked tokens.
+func (s *Server) authenticateToken(token string) (*User, []string, error) {
+	if !strings.HasPrefix(token, apiTokenPrefix) {
+		user, err := s.DB.GetUserBySession(HashToken(token))
+		return user, AllScopes, err
+	}
+
+	apiToken, err := s.DB.GetActiveAPIToken(HashToken(token))
+	if err != nil || apiToken == nil {
+		return nil, nil, err
+	}
+
+	user, err := s.DB.GetUserByID(apiToken.UserID)
+	if err != nil || user == nil {
+		return nil, nil, err
+	}
+
+	if err := s.DB.TouchAPIToken(apiToken.ID); err != nil {
+		log.Printf("Warning: Failed to update API token last use: %v", err)
+	}
+
+	return user, apiToken.Scopes, nil
+}
+
+// Authenticate sits in front of the router. Every route except publicPaths
+// needs a session or API token; the token must carry the scope the route
+// needs (see requiredScope). The authenticated user, their scopes and their
+// membership in the selected household (see requestHouseholdID) are attached
+// to the request context. Account routes (see accountPath) have no
+// membership, so they keep working for users without a household.
+func (s *Server) Authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if publicPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		token := requestToken(r)
+		if token == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="hsa"`)
+			http.Error(w, "Authentication required", http.StatusUnauthorized)
+			return
+		}
+
+		user, scopes, err := s.authenticateToken(token)
+		if err != nil {
+			log.Printf("Failed to authenticate token: %v", err)
+			http.Error(w, "Failed to authenticate", http.StatusInternalServerError)
+			return
+		}
+		if user == nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="hsa", error="invalid_token"`)
+			http.Error(w, "Invalid, expired or revoked token", http.StatusUnauthorized)
+			return
+		}
+
+		if scope := requiredScope(r); !hasScope(scopes, scope) {
+			http.Error(w, fmt.Sprintf("Token lacks the %q scope", scope), http.StatusForbidden)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), userContextKey, user)
+		ctx = context.WithValue(ctx, scopesContextKey, scopes)
+		if accountPath(r.URL.Path) {
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+
+		householdID, err := requestHouseholdID(r)
+		if err != nil {
+			http.Error(w, "Invalid household ID", http.StatusBadRequest)
+			return
+		}
+		membership, err := s.DB.GetMembership(user.ID, householdID)
+		if err != nil {
+			log.Printf("Failed to look up household membership: %v", err)
+			http.Error(w, "Failed to authenticate", http.StatusInternalServerError)
+			return
+		}
+		if membership == nil {
+			http.Error(w, "Not a member of this household", http.StatusForbidden)
+			return
+		}
+
+		ctx = context.WithValue(ctx, membershipContextKey, membership)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+type credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+func (c *credentials) normalize() {
+	c.Username = strings.ToLower(strings.TrimSpace(c.Username))
+}
+
+func (s *Server) RegisterHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.AllowRegistration {
+		http.Error(w, "Registration is disabled", http.StatusForbidden)
+		return
+	}
+
+	var req credentials
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.normalize()
+
+	if len(req.Username) < 3 || len(req.Username) > 100 || reservedUsername(req.Username) {
+		http.Error(w, "Username must be 3-100 characters", http.StatusBadRequest)
+		return
+	}
+	if len(req.Password) < minPasswordLen {
+		http.Error(w, fmt.Sprintf("Password must be at least %d characters", minPasswordLen), http.StatusBadRequest)
+		return
+	}
+
+	if existing, err := s.DB.GetUserByUsername(req.Username); err != nil {
+		log.Printf("Failed to look up user: %v", err)
+		http.Error(w, "Failed to register", http.StatusInternalServerError)
+		return
+	} else if existing != nil {
+		http.Error(w, "Username already taken", http.StatusConflict)
+		return
+	}
+
+	hash, err := HashPassword(req.Password)
+	if err != nil {
+		log.Printf("Failed to hash password: %v", err)
+		http.Error(w, "Failed to register", http.StatusInternalServerError)
+		return
+	}
+
+	user := &User{Username: req.Username, PasswordHash: hash}
+	if err := s.DB.CreateUser(user); err != nil {
+		log.Printf("Failed to create user: %v", err)
+		http.Error(w, "Failed to register", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Registered user %s (id=%d)", user.Username, user.ID)
+
+	member, err := s.DB.CreatePersonalHousehold(user)
+	if err != nil {
+		log.Printf("Failed to create household: %v", err)
+		http.Error(w, "Failed to register", http.StatusInternalServerError)
+		return
+	}
+
+	// The first account takes over receipts uploaded before accounts existed
+	if count, err := s.DB.CountUsers(); err == nil && count == 1 {
+		if adopted, err := s.DB.AdoptLegacyReceipts(user.Username, member); err != nil {
+			log.Printf("Warning: Failed to adopt legacy receipts: %v", err)
+		} else if adopted > 0 {
+			log.Printf("User %s adopted %d legacy receipts", user.Username, adopted)
+		}
+	}
+
+	s.startSession(w, user, http.StatusCreated)
+}
+
+func (s *Server) LoginHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req credentials
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	req.normalize()
+
+	user, err := s.DB.GetUserByUsername(req.Username)
+	if err != nil {
+		log.Printf("Failed to look up user: %v", err)
+		http.Error(w, "Failed to log in", http.StatusInternalServerError)
+		return
+	}
+	if user == nil || !VerifyPassword(req.Password, user.PasswordHash) {
+		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
+		return
+	}
+
+	s.startSession(w, user, http.StatusOK)
+}
+
+// startSession issues a new session token for user and writes it to w
+func (s *Server) startSession(w http.ResponseWriter, user *User, status int) {
+	token, tokenHash, err := NewToken()
+	if err != nil {
+		log.Printf("Failed to generate session token: %v", err)
+		http.Error(w, "Failed to create session", http.StatusInternalServerError)
+		return
+	}
+
+	expiresAt := time.Now().Add(sessionTTL)
+	if err := s.DB.CreateSession(user.ID, tokenHash, expiresAt); err != nil {
+		log.Printf("Failed to create session: %v", err)
+		http.Error(w, "Failed to create session", http.StatusInternalServerError)
+		return
+	}
+
+	if err := s.DB.DeleteExpiredSessions(); err != nil {
+		log.Printf("Warning: Failed to prune expired sessions: %v", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"token":      token,
+		"expires_at": expiresAt,
+		"user":       user,
+	})
+}
+
+func (s *Server) LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// API tokens are revoked through /api/tokens, not by logging out
+	token := requestToken(r)
+	if strings.HasPrefix(token, apiTokenPrefix) {
+		http.Error(w, "API tokens cannot log out", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.DB.DeleteSession(HashToken(token)); err != nil {
+		log.Printf("Failed to delete session: %v", err)
+		http.Error(w, "Failed to log out", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Logged out"})
+}
+
+func (s *Server) MeHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(CurrentUser(r))
+}
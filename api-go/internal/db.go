@@ -2,9 +2,9 @@ package internal
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
-	"os"
 	"time"
 
 	_ "github.com/lib/pq"
@@ -27,128 +27,264 @@ func NewDatabase(connStr string) (*Database, error) {
 	return &Database{conn: db}, nil
 }
 
-func (db *Database) GetEligibleReceipts(userID string) ([]Receipt, error) {
-	query := `
-        SELECT id, user_id, vendor, total_amount, date, hsa_qualified, hsa_status,
-               image_path, image_hash, raw_text, used, used_date, use_reason, created_at
-        FROM receipts
-        WHERE user_id = $1 AND used = false AND (hsa_status = 'Yes' OR hsa_status = 'Partially')
-        ORDER BY date DESC
-    `
+// receiptColumns is the column list scanned by scanReceipt
+const receiptColumns = `
+        r.id, r.user_id, r.household_id, r.member_id, r.vendor, r.original_total, r.qualified_amount, r.remaining_amount,
+        r.tax_amount, r.discount_amount, r.currency, r.date, r.hsa_qualified, r.hsa_status, r.image_path,
+        r.original_filename, COALESCE(r.page_count, 1), r.image_hash, r.perceptual_hash, r.raw_text, r.ocr_status,
+        r.used, r.used_date, r.use_reason, r.created_at`
 
-	rows, err := db.conn.Query(query, userID)
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanReceipt(row rowScanner) (*Receipt, error) {
+	var r Receipt
+	err := row.Scan(&r.ID, &r.UserID, &r.HouseholdID, &r.MemberID, &r.Vendor, &r.OriginalTotal, &r.QualifiedAmount, &r.RemainingAmount,
+		&r.TaxAmount, &r.DiscountAmount, &r.Currency, &r.Date, &r.HSAQualified, &r.HSAStatus, &r.ImagePath,
+		&r.OriginalName, &r.PageCount, &r.ImageHash, &r.PerceptualHash, &r.RawText, &r.OCRStatus,
+		&r.Used, &r.UsedDate, &r.UseReason, &r.CreatedAt)
 	if err != nil {
 		return nil, err
 	}
+	return &r, nil
+}
+
+func scanReceipts(rows *sql.Rows) ([]Receipt, error) {
 	defer rows.Close()
 
 	var receipts []Receipt
 	for rows.Next() {
-		var r Receipt
-		err := rows.Scan(&r.ID, &r.UserID, &r.Vendor, &r.TotalAmount,
-			&r.Date, &r.HSAQualified, &r.HSAStatus, &r.ImagePath, &r.ImageHash, &r.RawText,
-			&r.Used, &r.UsedDate, &r.UseReason, &r.CreatedAt)
+		r, err := scanReceipt(rows)
+		if err != nil {
+			return nil, err
+		}
+		receipts = append(receipts, *r)
+	}
+
+	return receipts, rows.Err()
+}
+
+// GetEligibleReceipts returns HSA-qualified receipts with a remaining balance
+// in one currency in a household. Receipts dated outside their member's
+// eligibility window are skipped. memberID 0 means every member; a nil from
+// or until leaves that end of the date range open.
+func (db *Database) GetEligibleReceipts(householdID int, memberID int, currency string, from, until *time.Time) ([]Receipt, error) {
+	query := `
+        SELECT ` + receiptColumns + `
+        FROM receipts r
+        LEFT JOIN household_members m ON m.id = r.member_id
+        WHERE r.household_id = $1 AND r.used = false AND r.remaining_amount > 0
+          AND (r.hsa_status = 'Yes' OR r.hsa_status = 'Partially')
+          AND ($2 = 0 OR r.member_id = $2)
+          AND r.currency = $3
+          AND (m.eligible_from IS NULL OR r.date >= m.eligible_from)
+          AND (m.eligible_until IS NULL OR r.date <= m.eligible_until)
+          AND ($4::date IS NULL OR r.date >= $4)
+          AND ($5::date IS NULL OR r.date <= $5)
+        ORDER BY r.date DESC
+    `
+
+	rows, err := db.conn.Query(query, householdID, memberID, currency, from, until)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanReceipts(rows)
+}
+
+// ErrInsufficientBalance is returned by MarkUsed when an allocation exceeds
+// the receipt's remaining balance
+var ErrInsufficientBalance = errors.New("applied amount exceeds the receipt's remaining balance")
+
+// markUsed claims each allocation's amount from its receipt within tx,
+// recording a receipt_applications row per receipt, optionally linked to a
+// reimbursement. A receipt becomes used when its remaining balance reaches
+// zero. The updated receipts are returned in allocation order.
+func markUsed(tx *sql.Tx, householdID int, reimbursementID *int, allocations []ReceiptAllocation, useReason *string) ([]Receipt, error) {
+	update, err := tx.Prepare(`
+        UPDATE receipts r
+        SET remaining_amount = r.remaining_amount - $1,
+            used = r.remaining_amount = $1,
+            used_date = CASE WHEN r.remaining_amount = $1 THEN NOW() ELSE r.used_date END,
+            use_reason = COALESCE($4, r.use_reason)
+        WHERE r.id = $2 AND r.household_id = $3 AND r.remaining_amount >= $1
+        RETURNING ` + receiptColumns)
+	if err != nil {
+		return nil, err
+	}
+	defer update.Close()
+
+	insert, err := tx.Prepare(`
+        INSERT INTO receipt_applications (receipt_id, reimbursement_id, applied_amount, use_reason)
+        VALUES ($1, $2, $3, $4)
+    `)
+	if err != nil {
+		return nil, err
+	}
+	defer insert.Close()
+
+	receipts := make([]Receipt, 0, len(allocations))
+	for _, a := range allocations {
+		if a.AppliedAmount <= 0 {
+			return nil, fmt.Errorf("applied amount for receipt %d must be positive", a.ReceiptID)
+		}
+
+		r, err := scanReceipt(update.QueryRow(a.AppliedAmount, a.ReceiptID, householdID, useReason))
+		if err == sql.ErrNoRows {
+			return nil, ErrInsufficientBalance
+		}
 		if err != nil {
 			return nil, err
 		}
-		receipts = append(receipts, r)
+
+		if _, err := insert.Exec(a.ReceiptID, reimbursementID, a.AppliedAmount, useReason); err != nil {
+			return nil, err
+		}
+		receipts = append(receipts, *r)
 	}
 
 	return receipts, nil
 }
 
-func (db *Database) MarkUsed(receipts []Receipt) error {
-	tx, err := db.conn.Begin()
+// ErrReceiptReimbursed is returned when releasing a receipt part of which
+// belongs to a reimbursement, which has to be undone instead
+var ErrReceiptReimbursed = errors.New("receipt is part of a reimbursement; undo the reimbursement instead")
+
+// releaseReceipt deletes every application against a receipt within tx and
+// restores its full balance
+func releaseReceipt(tx *sql.Tx, householdID int, id int) error {
+	var reimbursed bool
+	err := tx.QueryRow(`
+        SELECT EXISTS (SELECT 1 FROM receipt_applications WHERE receipt_id = $1 AND reimbursement_id IS NOT NULL)
+    `, id).Scan(&reimbursed)
 	if err != nil {
 		return err
 	}
-	defer tx.Rollback()
+	if reimbursed {
+		return ErrReceiptReimbursed
+	}
 
-	stmt, err := tx.Prepare("UPDATE receipts SET used = true, used_date = NOW() WHERE id = $1")
+	result, err := tx.Exec(`
+        UPDATE receipts SET remaining_amount = qualified_amount, used = false, used_date = NULL
+        WHERE id = $1 AND household_id = $2
+    `, id, householdID)
 	if err != nil {
 		return err
 	}
-	defer stmt.Close()
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return sql.ErrNoRows
+	}
 
-	for _, r := range receipts {
-		if _, err := stmt.Exec(r.ID); err != nil {
-			return err
-		}
+	_, err = tx.Exec("DELETE FROM receipt_applications WHERE receipt_id = $1", id)
+	return err
+}
+
+// queryRower is satisfied by *sql.DB and *sql.Tx
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func (db *Database) CreateReceipt(receipt *Receipt) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
 	}
+	defer tx.Rollback()
 
+	if err := insertReceipt(tx, receipt); err != nil {
+		return err
+	}
 	return tx.Commit()
 }
 
-func (db *Database) CreateReceipt(receipt *Receipt) error {
+// insertReceipt saves a new receipt and, when it has a file, its primary
+// attachment. q should be a transaction, so neither is saved without the
+// other.
+func insertReceipt(q queryRower, receipt *Receipt) error {
 	query := `
-        INSERT INTO receipts (user_id, vendor, total_amount, date, hsa_qualified, hsa_status,
-                             image_path, image_hash, raw_text, used, created_at)
-        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, NOW())
+        INSERT INTO receipts (user_id, household_id, member_id, vendor, original_total, qualified_amount,
+                             tax_amount, discount_amount, currency, date, hsa_qualified, hsa_status,
+                             image_path, image_hash, perceptual_hash, raw_text, used, remaining_amount,
+                             original_filename, ocr_status, page_count, created_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, NOW())
         RETURNING id, created_at
     `
 
-	err := db.conn.QueryRow(
+	// Receipts created with only a qualified amount qualify in full
+	if receipt.OriginalTotal < receipt.QualifiedAmount {
+		receipt.OriginalTotal = receipt.QualifiedAmount
+	}
+	receipt.RemainingAmount = receipt.QualifiedAmount
+	if receipt.Used {
+		receipt.RemainingAmount = 0
+	}
+	if receipt.OCRStatus == "" {
+		receipt.OCRStatus = OCRStatusReady
+	}
+	if receipt.PageCount < 1 {
+		receipt.PageCount = 1
+	}
+
+	err := q.QueryRow(
 		query,
 		receipt.UserID,
+		receipt.HouseholdID,
+		receipt.MemberID,
 		receipt.Vendor,
-		receipt.TotalAmount,
+		receipt.OriginalTotal,
+		receipt.QualifiedAmount,
+		receipt.TaxAmount,
+		receipt.DiscountAmount,
+		receipt.Currency,
 		receipt.Date,
 		receipt.HSAQualified,
 		receipt.HSAStatus,
 		receipt.ImagePath,
 		receipt.ImageHash,
+		receipt.PerceptualHash,
 		receipt.RawText,
 		receipt.Used,
+		receipt.RemainingAmount,
+		receipt.OriginalName,
+		receipt.OCRStatus,
+		receipt.PageCount,
 	).Scan(&receipt.ID, &receipt.CreatedAt)
+	if err != nil {
+		return err
+	}
 
-	return err
+	if receipt.ImagePath == "" {
+		return nil
+	}
+	return insertPrimaryAttachment(q, receipt)
 }
 
-func (db *Database) GetAllReceipts(userID string) ([]Receipt, error) {
+// GetAllReceipts returns a household's receipts. memberID 0 means every member.
+func (db *Database) GetAllReceipts(householdID int, memberID int) ([]Receipt, error) {
 	query := `
-        SELECT id, user_id, vendor, total_amount, date, hsa_qualified, hsa_status,
-               image_path, image_hash, raw_text, used, used_date, use_reason, created_at
-        FROM receipts
-        WHERE user_id = $1
-        ORDER BY date DESC
+        SELECT ` + receiptColumns + `
+        FROM receipts r
+        WHERE r.household_id = $1 AND ($2 = 0 OR r.member_id = $2)
+        ORDER BY r.date DESC
     `
 
-	rows, err := db.conn.Query(query, userID)
+	rows, err := db.conn.Query(query, householdID, memberID)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
 
-	var receipts []Receipt
-	for rows.Next() {
-		var r Receipt
-		err := rows.Scan(&r.ID, &r.UserID, &r.Vendor, &r.TotalAmount,
-			&r.Date, &r.HSAQualified, &r.HSAStatus, &r.ImagePath, &r.ImageHash, &r.RawText,
-			&r.Used, &r.UsedDate, &r.UseReason, &r.CreatedAt)
-		if err != nil {
-			return nil, err
-		}
-		receipts = append(receipts, r)
-	}
-
-	return receipts, nil
+	return scanReceipts(rows)
 }
 
-func (db *Database) GetReceiptByID(id int) (*Receipt, error) {
+func (db *Database) GetReceiptByID(householdID int, id int) (*Receipt, error) {
 	query := `
-        SELECT id, user_id, vendor, total_amount, date, hsa_qualified, hsa_status,
-               image_path, image_hash, raw_text, used, used_date, use_reason, created_at
-        FROM receipts
-        WHERE id = $1
+        SELECT ` + receiptColumns + `
+        FROM receipts r
+        WHERE r.id = $1 AND r.household_id = $2
     `
 
-	var r Receipt
-	err := db.conn.QueryRow(query, id).Scan(
-		&r.ID, &r.UserID, &r.Vendor, &r.TotalAmount,
-		&r.Date, &r.HSAQualified, &r.HSAStatus, &r.ImagePath, &r.ImageHash, &r.RawText,
-		&r.Used, &r.UsedDate, &r.UseReason, &r.CreatedAt,
-	)
-
+	r, err := scanReceipt(db.conn.QueryRow(query, id, householdID))
 	if err != nil {
 		return nil, err
 	}
@@ -156,24 +292,18 @@ func (db *Database) GetReceiptByID(id int) (*Receipt, error) {
 	// Add this logging
 	log.Printf("GetReceiptByID(%d): Read from DB - used=%v, image_path=%s", id, r.Used, r.ImagePath)
 
-	return &r, nil
+	return r, nil
 }
 
-func (db *Database) GetReceiptByImageHash(hash string) (*Receipt, error) {
+func (db *Database) GetReceiptByImageHash(householdID int, hash string) (*Receipt, error) {
 	query := `
-        SELECT id, user_id, vendor, total_amount, date, hsa_qualified, hsa_status,
-               image_path, image_hash, raw_text, used, used_date, use_reason, created_at
-        FROM receipts
-        WHERE image_hash = $1
+        SELECT ` + receiptColumns + `
+        FROM receipts r
+        WHERE r.image_hash = $1 AND r.household_id = $2
+        LIMIT 1
     `
 
-	var r Receipt
-	err := db.conn.QueryRow(query, hash).Scan(
-		&r.ID, &r.UserID, &r.Vendor, &r.TotalAmount,
-		&r.Date, &r.HSAQualified, &r.HSAStatus, &r.ImagePath, &r.ImageHash, &r.RawText,
-		&r.Used, &r.UsedDate, &r.UseReason, &r.CreatedAt,
-	)
-
+	r, err := scanReceipt(db.conn.QueryRow(query, hash, householdID))
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
@@ -181,92 +311,197 @@ func (db *Database) GetReceiptByImageHash(hash string) (*Receipt, error) {
 		return nil, err
 	}
 
-	return &r, nil
+	return r, nil
 }
 
-func (db *Database) GetDuplicateReceipt(vendor string, amount float64, date time.Time) (*Receipt, error) {
+// ErrQualifiedBelowClaimed is returned when a receipt's new qualified
+// amount is less than what has already been claimed from it
+var ErrQualifiedBelowClaimed = errors.New("qualified_amount is less than the amount already claimed from the receipt")
+
+// setQualifiedAmount changes a receipt's qualified amount within tx and
+// moves its remaining balance by the same amount, so whatever was already
+// claimed stays claimed. As in markUsed, the receipt is used exactly when
+// its balance is zero, though a receipt that qualifies for nothing is never
+// used. It returns the updated receipt, ErrQualifiedBelowClaimed, or
+// sql.ErrNoRows.
+func setQualifiedAmount(tx *sql.Tx, householdID int, id int, qualified Money) (*Receipt, error) {
 	query := `
-        SELECT id, user_id, vendor, total_amount, date, hsa_qualified, hsa_status,
-               image_path, image_hash, raw_text, used, used_date, use_reason, created_at
-        FROM receipts
-        WHERE vendor = $1 
-          AND ABS(total_amount - $2) < 0.01
-          AND date = $3
-        LIMIT 1
-    `
-
-	var r Receipt
-	err := db.conn.QueryRow(query, vendor, amount, date).Scan(
-		&r.ID, &r.UserID, &r.Vendor, &r.TotalAmount,
-		&r.Date, &r.HSAQualified, &r.HSAStatus, &r.ImagePath, &r.ImageHash, &r.RawText,
-		&r.Used, &r.UsedDate, &r.UseReason, &r.CreatedAt,
-	)
-
-	if err == sql.ErrNoRows {
-		return nil, nil
+        UPDATE receipts r
+        SET qualified_amount = $1,
+            remaining_amount = r.remaining_amount + ($1 - r.qualified_amount),
+            used = $1 > 0 AND r.remaining_amount + ($1 - r.qualified_amount) = 0,
+            used_date = CASE WHEN $1 = 0 OR r.remaining_amount + ($1 - r.qualified_amount) > 0 THEN NULL
+                             WHEN r.used THEN r.used_date
+                             ELSE NOW() END
+        WHERE r.id = $2 AND r.household_id = $3 AND r.remaining_amount + ($1 - r.qualified_amount) >= 0
+        RETURNING ` + receiptColumns
+
+	updated, err := scanReceipt(tx.QueryRow(query, qualified, id, householdID))
+	if err != sql.ErrNoRows {
+		return updated, err
 	}
+
+	var exists bool
+	err = tx.QueryRow("SELECT EXISTS (SELECT 1 FROM receipts WHERE id = $1 AND household_id = $2)",
+		id, householdID).Scan(&exists)
 	if err != nil {
 		return nil, err
 	}
+	if exists {
+		return nil, ErrQualifiedBelowClaimed
+	}
+	return nil, sql.ErrNoRows
+}
 
-	return &r, nil
+// BalanceChange is what UpdateReceipt does to a receipt's claims
+type BalanceChange struct {
+	// Release deletes every application first, restoring the full balance
+	Release bool
+	// Apply claims this much of the remaining balance afterwards; ApplyAll
+	// claims all of it
+	Apply    Money
+	ApplyAll bool
 }
 
-func (db *Database) UpdateReceipt(receipt *Receipt) error {
+// UpdateReceipt saves a receipt's editable fields and applies change in one
+// transaction. The qualified amount is changed by setQualifiedAmount. Used,
+// used_date and remaining_amount are never taken from receipt; it is
+// refreshed from the saved row instead.
+func (db *Database) UpdateReceipt(receipt *Receipt, change BalanceChange) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if change.Release {
+		if err := releaseReceipt(tx, receipt.HouseholdID, receipt.ID); err != nil {
+			return err
+		}
+	}
+
 	query := `
         UPDATE receipts
-        SET vendor = $1, total_amount = $2, date = $3, hsa_qualified = $4, hsa_status = $5,
-            used = $6, used_date = $7, use_reason = $8, image_path = $9
-        WHERE id = $10
+        SET vendor = $1, original_total = $2, tax_amount = $3, discount_amount = $4, date = $5,
+            hsa_qualified = $6, hsa_status = $7, use_reason = $8, member_id = $9, currency = $10
+        WHERE id = $11 AND household_id = $12
     `
 
-	_, err := db.conn.Exec(
+	result, err := tx.Exec(
 		query,
 		receipt.Vendor,
-		receipt.TotalAmount,
+		receipt.OriginalTotal,
+		receipt.TaxAmount,
+		receipt.DiscountAmount,
 		receipt.Date,
 		receipt.HSAQualified,
 		receipt.HSAStatus,
-		receipt.Used,
-		receipt.UsedDate,
 		receipt.UseReason,
-		receipt.ImagePath,
+		receipt.MemberID,
+		receipt.Currency,
 		receipt.ID,
+		receipt.HouseholdID,
 	)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return sql.ErrNoRows
+	}
 
-	return err
-}
+	updated, err := setQualifiedAmount(tx, receipt.HouseholdID, receipt.ID, receipt.QualifiedAmount)
+	if err != nil {
+		return err
+	}
 
-func (db *Database) DeleteReceipt(id int) error {
-	query := "DELETE FROM receipts WHERE id = $1"
-	_, err := db.conn.Exec(query, id)
-	return err
+	apply := change.Apply
+	if change.ApplyAll {
+		apply = updated.RemainingAmount
+	}
+	if apply > 0 {
+		allocation := ReceiptAllocation{ReceiptID: receipt.ID, AppliedAmount: apply}
+		marked, err := markUsed(tx, receipt.HouseholdID, nil, []ReceiptAllocation{allocation}, receipt.UseReason)
+		if err != nil {
+			return err
+		}
+		updated = &marked[0]
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	receipt.Used = updated.Used
+	receipt.UsedDate = updated.UsedDate
+	receipt.RemainingAmount = updated.RemainingAmount
+	return nil
 }
 
-// RunMigrations executes all migration files in order
-func (db *Database) RunMigrations(migrationsDir string) error {
-	log.Println("Running database migrations...")
+// GetReceiptsWithFiles returns every receipt that has a stored file, oldest
+// first. householdID 0 means every household.
+func (db *Database) GetReceiptsWithFiles(householdID int) ([]Receipt, error) {
+	query := `
+        SELECT ` + receiptColumns + `
+        FROM receipts r
+        WHERE ($1 = 0 OR r.household_id = $1) AND COALESCE(r.image_path, '') <> ''
+        ORDER BY r.id
+    `
 
-	migrations := []string{
-		"001_init.sql",
+	rows, err := db.conn.Query(query, householdID)
+	if err != nil {
+		return nil, err
 	}
 
-	for _, migration := range migrations {
-		migrationPath := fmt.Sprintf("%s/%s", migrationsDir, migration)
-		log.Printf("Applying migration: %s", migration)
+	return scanReceipts(rows)
+}
 
-		content, err := os.ReadFile(migrationPath)
-		if err != nil {
-			return fmt.Errorf("failed to read migration %s: %v", migration, err)
-		}
+// SetReceiptImagePath points a receipt, and its primary attachment, at a
+// new storage key
+func (db *Database) SetReceiptImagePath(id int, imagePath string) error {
+	_, err := db.conn.Exec(`
+        WITH receipt AS (UPDATE receipts SET image_path = $1 WHERE id = $2)
+        UPDATE receipt_attachments SET storage_key = $1 WHERE receipt_id = $2 AND is_primary
+    `, imagePath, id)
+	return err
+}
 
-		if _, err := db.conn.Exec(string(content)); err != nil {
-			return fmt.Errorf("failed to execute migration %s: %v", migration, err)
-		}
+// ImagePathInUse reports whether any receipt or attachment, in any
+// household, still references the stored file
+func (db *Database) ImagePathInUse(imagePath string) (bool, error) {
+	var inUse bool
+	err := db.conn.QueryRow(`
+        SELECT EXISTS (SELECT 1 FROM receipts WHERE image_path = $1)
+            OR EXISTS (SELECT 1 FROM receipt_attachments WHERE storage_key = $1)
+    `, imagePath).Scan(&inUse)
+	return inUse, err
+}
+
+// LockStoredFile serializes the users of one stored file across replicas
+// with a transaction-level advisory lock, held until unlock is called.
+// Reusing a blob and saving the row that references it, and finding a blob
+// unreferenced and deleting it, each happen under the lock, so a delete
+// never removes a blob that an upload has just decided to reuse.
+func (db *Database) LockStoredFile(key string) (unlock func(), err error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext($1))", key); err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("failed to lock stored file %s: %v", key, err)
+	}
+	return func() { tx.Rollback() }, nil
+}
 
-		log.Printf("Successfully applied migration: %s", migration)
+func (db *Database) DeleteReceipt(householdID int, id int) error {
+	query := "DELETE FROM receipts WHERE id = $1 AND household_id = $2"
+	result, err := db.conn.Exec(query, id, householdID)
+	if err != nil {
+		return err
 	}
 
-	log.Println("All migrations completed successfully")
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return sql.ErrNoRows
+	}
 	return nil
-}
\ No newline at end of file
+}
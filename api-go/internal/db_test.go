@@ -0,0 +1,145 @@
+package internal
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// testDatabase connects to the database named by TEST_DATABASE_URL and
+// migrates it, or skips the test when that is unset. It returns a new
+// household for the test, deleted with everything in it afterwards.
+func testDatabase(t *testing.T) (*Database, int) {
+	t.Helper()
+
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	db, err := NewDatabase(url)
+	if err != nil {
+		t.Fatalf("failed to connect to the test database: %v", err)
+	}
+	t.Cleanup(func() { db.conn.Close() })
+	if err := db.RunMigrations("../migrations"); err != nil {
+		t.Fatalf("failed to migrate the test database: %v", err)
+	}
+
+	var householdID int
+	err = db.conn.QueryRow("INSERT INTO households (name) VALUES ($1) RETURNING id", t.Name()).Scan(&householdID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if _, err := db.conn.Exec("DELETE FROM households WHERE id = $1", householdID); err != nil {
+			t.Errorf("failed to delete test household %d: %v", householdID, err)
+		}
+	})
+	return db, householdID
+}
+
+// createTestReceipt saves a Yes receipt qualifying for amount in full
+func createTestReceipt(t *testing.T, db *Database, householdID int, amount Money) *Receipt {
+	t.Helper()
+
+	receipt := &Receipt{
+		UserID:          "test",
+		HouseholdID:     householdID,
+		Vendor:          "Pharmacy",
+		OriginalTotal:   amount,
+		QualifiedAmount: amount,
+		Currency:        DefaultCurrency,
+		Date:            time.Now(),
+		HSAQualified:    true,
+		HSAStatus:       HSAStatusYes,
+	}
+	if err := db.CreateReceipt(receipt); err != nil {
+		t.Fatal(err)
+	}
+	return receipt
+}
+
+// isEligible reports whether GetEligibleReceipts offers the receipt
+func isEligible(t *testing.T, db *Database, receipt *Receipt) bool {
+	t.Helper()
+
+	receipts, err := db.GetEligibleReceipts(receipt.HouseholdID, 0, receipt.Currency, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range receipts {
+		if r.ID == receipt.ID {
+			return true
+		}
+	}
+	return false
+}
+
+// checkBalance fails the test unless the saved receipt has the given
+// amounts, and is used exactly when nothing remains
+func checkBalance(t *testing.T, db *Database, receipt *Receipt, qualified, remaining Money) {
+	t.Helper()
+
+	saved, err := db.GetReceiptByID(receipt.HouseholdID, receipt.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.QualifiedAmount != qualified || saved.RemainingAmount != remaining {
+		t.Fatalf("qualified %s, remaining %s; want %s, %s",
+			saved.QualifiedAmount, saved.RemainingAmount, qualified, remaining)
+	}
+	if wantUsed := qualified > 0 && remaining == 0; saved.Used != wantUsed || (saved.UsedDate != nil) != wantUsed {
+		t.Fatalf("remaining %s but used=%v, used_date=%v", remaining, saved.Used, saved.UsedDate)
+	}
+	if eligible := isEligible(t, db, saved); eligible != (remaining > 0) {
+		t.Fatalf("remaining %s but eligible=%v", remaining, eligible)
+	}
+}
+
+func TestUpdateReceiptQualifiedAmountKeepsClaims(t *testing.T) {
+	db, householdID := testDatabase(t)
+	receipt := createTestReceipt(t, db, householdID, 5000)
+
+	if err := db.UpdateReceipt(receipt, BalanceChange{ApplyAll: true}); err != nil {
+		t.Fatal(err)
+	}
+	checkBalance(t, db, receipt, 5000, 0)
+
+	// Raising a used receipt's qualified amount gives it a balance again
+	receipt.OriginalTotal, receipt.QualifiedAmount = 8000, 8000
+	if err := db.UpdateReceipt(receipt, BalanceChange{}); err != nil {
+		t.Fatalf("raising the qualified amount: %v", err)
+	}
+	checkBalance(t, db, receipt, 8000, 3000)
+
+	if err := db.UpdateReceipt(receipt, BalanceChange{Apply: 1000}); err != nil {
+		t.Fatal(err)
+	}
+	checkBalance(t, db, receipt, 8000, 2000)
+
+	// Lowering it to exactly what was claimed uses the receipt up
+	receipt.OriginalTotal, receipt.QualifiedAmount = 6000, 6000
+	if err := db.UpdateReceipt(receipt, BalanceChange{}); err != nil {
+		t.Fatalf("lowering the qualified amount to the claimed amount: %v", err)
+	}
+	checkBalance(t, db, receipt, 6000, 0)
+
+	// and below it is refused, leaving the receipt as it was
+	receipt.OriginalTotal, receipt.QualifiedAmount = 5999, 5999
+	if err := db.UpdateReceipt(receipt, BalanceChange{}); err != ErrQualifiedBelowClaimed {
+		t.Fatalf("lowering the qualified amount below the claimed amount: %v", err)
+	}
+	checkBalance(t, db, receipt, 6000, 0)
+
+	// unless the same update releases the claims
+	receipt.OriginalTotal, receipt.QualifiedAmount = 1000, 1000
+	if err := db.UpdateReceipt(receipt, BalanceChange{Release: true}); err != nil {
+		t.Fatalf("lowering the qualified amount with a release: %v", err)
+	}
+	checkBalance(t, db, receipt, 1000, 1000)
+
+	receipt.ID = -1
+	if err := db.UpdateReceipt(receipt, BalanceChange{}); err == nil || err == ErrQualifiedBelowClaimed {
+		t.Errorf("updating a missing receipt: %v", err)
+	}
+}
@@ -0,0 +1,327 @@
+package internal
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Deduction strategies accepted by /api/receipts/deduct
+const (
+	// StrategyClosest picks the sum closest to the amount without exceeding it
+	StrategyClosest = "closest"
+	// StrategyOldestFirst uses receipts oldest first, skipping any that no
+	// longer fit
+	StrategyOldestFirst = "oldest_first"
+	// StrategyFewest reaches the closest sum with as few receipts as possible
+	StrategyFewest = "fewest"
+	// StrategyMost reaches the closest sum with as many receipts as possible
+	StrategyMost = "most"
+	// StrategyClosestAbove picks the smallest sum at or above the amount and
+	// splits one receipt so exactly the amount is claimed
+	StrategyClosestAbove = "closest_above"
+)
+
+// DeductionStrategies lists every strategy, default first
+var DeductionStrategies = []string{StrategyClosest, StrategyOldestFirst, StrategyFewest, StrategyMost, StrategyClosestAbove}
+
+// DeductionRequest is the body of POST /api/receipts/deduct. Every field but
+// Amount is optional.
+type DeductionRequest struct {
+	Amount         Money    `json:"amount"`
+	Currency       string   `json:"currency"`
+	Strategy       string   `json:"strategy"`
+	MemberID       int      `json:"member_id"`
+	StartDate      *string  `json:"start_date"`
+	EndDate        *string  `json:"end_date"`
+	TaxYear        int      `json:"tax_year"`
+	ExcludeVendors []string `json:"exclude_vendors"`
+	MaxReceipts    int      `json:"max_receipts"`
+	// AllowSplit lets any strategy cover a shortfall with part of one more
+	// receipt; closest_above always splits
+	AllowSplit bool `json:"allow_split"`
+}
+
+// normalize validates the request and resolves its defaults, returning the
+// receipt date range implied by start_date, end_date and tax_year
+func (req *DeductionRequest) normalize() (from, until *time.Time, err error) {
+	if req.Amount <= 0 {
+		return nil, nil, fmt.Errorf("amount must be greater than zero")
+	}
+	if req.MaxReceipts < 0 {
+		return nil, nil, fmt.Errorf("max_receipts must not be negative")
+	}
+
+	req.Strategy = strings.ToLower(strings.TrimSpace(req.Strategy))
+	if req.Strategy == "" {
+		req.Strategy = StrategyClosest
+	}
+	known := false
+	for _, s := range DeductionStrategies {
+		known = known || s == req.Strategy
+	}
+	if !known {
+		return nil, nil, fmt.Errorf("unknown strategy %q, expected one of %s", req.Strategy, strings.Join(DeductionStrategies, ", "))
+	}
+
+	if req.Currency, err = NormalizeCurrency(req.Currency); err != nil {
+		return nil, nil, err
+	}
+
+	if from, err = parseDate(req.StartDate); err != nil {
+		return nil, nil, err
+	}
+	if until, err = parseDate(req.EndDate); err != nil {
+		return nil, nil, err
+	}
+
+	// A tax year narrows whatever range was given explicitly
+	if req.TaxYear != 0 {
+		if req.TaxYear < 1900 || req.TaxYear > 9999 {
+			return nil, nil, fmt.Errorf("invalid tax_year %d", req.TaxYear)
+		}
+		yearStart := time.Date(req.TaxYear, time.January, 1, 0, 0, 0, 0, time.UTC)
+		yearEnd := time.Date(req.TaxYear, time.December, 31, 0, 0, 0, 0, time.UTC)
+		if from == nil || from.Before(yearStart) {
+			from = &yearStart
+		}
+		if until == nil || until.After(yearEnd) {
+			until = &yearEnd
+		}
+	}
+
+	if from != nil && until != nil && from.After(*until) {
+		return nil, nil, fmt.Errorf("start_date must not be after end_date")
+	}
+
+	return from, until, nil
+}
+
+// excludesVendor reports whether vendor contains any of the excluded names,
+// ignoring case, so "cvs" excludes "CVS Pharmacy #1234"
+func (req *DeductionRequest) excludesVendor(vendor string) bool {
+	vendor = strings.ToLower(vendor)
+	for _, excluded := range req.ExcludeVendors {
+		excluded = strings.ToLower(strings.TrimSpace(excluded))
+		if excluded != "" && strings.Contains(vendor, excluded) {
+			return true
+		}
+	}
+	return false
+}
+
+// ReceiptAllocation is the part of a receipt's remaining balance claimed by
+// a deduction, and what is left of the balance afterwards
+type ReceiptAllocation struct {
+	ReceiptID       int   `json:"receipt_id"`
+	AppliedAmount   Money `json:"applied_amount"`
+	RemainingAmount Money `json:"remaining_amount"`
+}
+
+// DeductionPlan is the receipts chosen for a deduction, with the amount
+// applied from each. Achieved is the sum of the applied amounts and Shortfall
+// what is left of Target. Split points at the one allocation that claims only
+// part of its receipt, if any. Optimal is false when the problem was too
+// large to solve exactly and a heuristic result is returned instead.
+type DeductionPlan struct {
+	Strategy    string              `json:"strategy"`
+	Currency    string              `json:"currency"`
+	Target      Money               `json:"target"`
+	Achieved    Money               `json:"achieved"`
+	Shortfall   Money               `json:"shortfall"`
+	Optimal     bool                `json:"optimal"`
+	Receipts    []Receipt           `json:"receipts"`
+	Allocations []ReceiptAllocation `json:"allocations"`
+	Split       *ReceiptAllocation  `json:"split,omitempty"`
+}
+
+// PlanDeduction chooses receipts for req from the eligible candidates,
+// working on each receipt's remaining balance. The member, date and currency
+// constraints are expected to be applied by the query that loaded
+// candidates; vendor exclusions and the receipt cap are applied here.
+func PlanDeduction(candidates []Receipt, req DeductionRequest) *DeductionPlan {
+	var receipts []Receipt
+	for _, r := range candidates {
+		if r.RemainingAmount > 0 && !req.excludesVendor(r.Vendor) {
+			receipts = append(receipts, r)
+		}
+	}
+
+	amounts := make([]Money, len(receipts))
+	for i, r := range receipts {
+		amounts[i] = r.RemainingAmount
+	}
+
+	var result SubsetSumResult
+	switch req.Strategy {
+	case StrategyOldestFirst:
+		result = oldestFirst(receipts, req.Amount, req.MaxReceipts)
+	case StrategyFewest:
+		result = SolveSubsetSumByCount(amounts, req.Amount, true, req.MaxReceipts)
+	case StrategyMost:
+		result = SolveSubsetSumByCount(amounts, req.Amount, false, req.MaxReceipts)
+	case StrategyClosestAbove:
+		result = closestAbove(amounts, req.Amount, req.MaxReceipts)
+	default:
+		if req.MaxReceipts > 0 {
+			result = SolveSubsetSumByCount(amounts, req.Amount, true, req.MaxReceipts)
+		} else {
+			result = SolveSubsetSum(amounts, req.Amount)
+		}
+	}
+
+	if req.AllowSplit && req.Strategy != StrategyClosestAbove && result.Sum < req.Amount &&
+		(req.MaxReceipts <= 0 || len(result.Indices) < req.MaxReceipts) {
+		if idx := splitCandidate(receipts, result.Indices, req.Amount-result.Sum, req.Strategy == StrategyOldestFirst); idx >= 0 {
+			result.Indices = append(result.Indices, idx)
+			result.Sum += amounts[idx]
+		}
+	}
+
+	plan := &DeductionPlan{
+		Strategy:    req.Strategy,
+		Currency:    req.Currency,
+		Target:      req.Amount,
+		Optimal:     result.Exact,
+		Receipts:    make([]Receipt, len(result.Indices)),
+		Allocations: make([]ReceiptAllocation, len(result.Indices)),
+	}
+	for i, idx := range result.Indices {
+		r := receipts[idx]
+		plan.Receipts[i] = r
+		plan.Allocations[i] = ReceiptAllocation{ReceiptID: r.ID, AppliedAmount: r.RemainingAmount}
+	}
+
+	// Claim only part of one receipt when the selection overshoots: the
+	// added split receipt if there is one, otherwise the largest
+	if overshoot := result.Sum - req.Amount; overshoot > 0 {
+		split := len(plan.Allocations) - 1
+		if req.Strategy == StrategyClosestAbove {
+			for i, a := range plan.Allocations {
+				if a.AppliedAmount > plan.Allocations[split].AppliedAmount {
+					split = i
+				}
+			}
+		}
+		plan.Allocations[split].AppliedAmount -= overshoot
+		plan.Allocations[split].RemainingAmount = overshoot
+		plan.Split = &plan.Allocations[split]
+	}
+
+	for _, a := range plan.Allocations {
+		plan.Achieved += a.AppliedAmount
+	}
+	plan.Shortfall = plan.Target - plan.Achieved
+	return plan
+}
+
+// splitCandidate picks the unselected receipt to claim part of for a
+// shortfall: the oldest that covers it, or else the smallest that does.
+// Returns -1 if no receipt covers the shortfall.
+func splitCandidate(receipts []Receipt, selected []int, shortfall Money, oldest bool) int {
+	taken := make(map[int]bool, len(selected))
+	for _, idx := range selected {
+		taken[idx] = true
+	}
+
+	best := -1
+	for i, r := range receipts {
+		if taken[i] || r.RemainingAmount <= shortfall {
+			continue
+		}
+		if best < 0 {
+			best = i
+		} else if oldest && r.Date.Before(receipts[best].Date) {
+			best = i
+		} else if !oldest && r.RemainingAmount < receipts[best].RemainingAmount {
+			best = i
+		}
+	}
+	return best
+}
+
+// oldestFirst adds receipts by ascending date while they fit under target
+func oldestFirst(receipts []Receipt, target Money, maxCount int) SubsetSumResult {
+	order := make([]int, len(receipts))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		a, b := receipts[order[i]], receipts[order[j]]
+		if !a.Date.Equal(b.Date) {
+			return a.Date.Before(b.Date)
+		}
+		return a.ID < b.ID
+	})
+
+	result := SubsetSumResult{Indices: []int{}, Exact: true, Method: SolverGreedy}
+	for _, idx := range order {
+		if maxCount > 0 && len(result.Indices) >= maxCount {
+			break
+		}
+		if amount := receipts[idx].RemainingAmount; result.Sum+amount <= target {
+			result.Sum += amount
+			result.Indices = append(result.Indices, idx)
+		}
+	}
+	return result
+}
+
+// closestAbove finds the smallest sum at or above target. That is the total
+// minus the largest sum of receipts that can be left out without dropping
+// below target, so it reuses the at-most solver on the complement. When
+// every receipt together falls short, all of them are returned.
+func closestAbove(amounts []Money, target Money, maxCount int) SubsetSumResult {
+	var total Money
+	for _, a := range amounts {
+		total += a
+	}
+
+	if total <= target {
+		all := make([]int, len(amounts))
+		for i := range all {
+			all[i] = i
+		}
+		if maxCount > 0 && len(all) > maxCount {
+			return subsetSumGreedy(amounts, all, total, true, maxCount)
+		}
+		return SubsetSumResult{Indices: all, Sum: total, Exact: true, Method: SolverTrivial}
+	}
+
+	leftOut := SolveSubsetSum(amounts, total-target)
+	excluded := make(map[int]bool, len(leftOut.Indices))
+	for _, idx := range leftOut.Indices {
+		excluded[idx] = true
+	}
+
+	result := SubsetSumResult{Indices: []int{}, Exact: leftOut.Exact, Method: leftOut.Method}
+	for i, a := range amounts {
+		if !excluded[i] {
+			result.Indices = append(result.Indices, i)
+			result.Sum += a
+		}
+	}
+	if maxCount <= 0 || len(result.Indices) <= maxCount {
+		return result
+	}
+
+	// Too many receipts: take the largest until the target is covered, which
+	// uses the fewest receipts but may overshoot by more
+	order := make([]int, len(amounts))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return amounts[order[i]] > amounts[order[j]] })
+
+	result = SubsetSumResult{Indices: []int{}, Exact: false, Method: SolverGreedy}
+	for _, idx := range order {
+		if result.Sum >= target || len(result.Indices) >= maxCount {
+			break
+		}
+		result.Indices = append(result.Indices, idx)
+		result.Sum += amounts[idx]
+	}
+	sort.Ints(result.Indices)
+	return result
+}
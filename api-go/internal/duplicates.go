@@ -0,0 +1,172 @@
+package internal
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Duplicate matching looks at receipts dated within duplicateDateWindow
+// days whose original total is within duplicateAmountTolerance (at least
+// duplicateMinTolerance), and scores each by vendor, amount and date.
+// Candidates scoring below duplicateMinScore, or past the first
+// duplicateMaxCandidates, are dropped.
+const (
+	duplicateDateWindow      = 3
+	duplicateAmountTolerance = 0.02
+	duplicateMinTolerance    = Money(100)
+	duplicateMinScore        = 0.75
+	duplicateMaxCandidates   = 5
+
+	duplicateVendorWeight = 0.5
+	duplicateAmountWeight = 0.3
+	duplicateDateWeight   = 0.2
+)
+
+// DuplicateCandidate is a receipt that may be the same purchase as another.
+// Score, from 0 to 1, weighs the vendor, amount and date scores.
+type DuplicateCandidate struct {
+	ReceiptID     int       `json:"receipt_id"`
+	Vendor        string    `json:"vendor"`
+	OriginalTotal Money     `json:"original_total"`
+	Date          time.Time `json:"date"`
+	Score         float64   `json:"score"`
+	VendorScore   float64   `json:"vendor_score"`
+	AmountScore   float64   `json:"amount_score"`
+	DateScore     float64   `json:"date_score"`
+}
+
+// duplicateTolerance is how far an original total may be from amount and
+// still match
+func duplicateTolerance(amount Money) Money {
+	tolerance := Money(math.Round(float64(amount) * duplicateAmountTolerance))
+	if tolerance < duplicateMinTolerance {
+		tolerance = duplicateMinTolerance
+	}
+	return tolerance
+}
+
+// scoreDuplicate scores other as a duplicate of receipt. An amount within
+// tolerance scores 0.5 to 1 and a date within the window 0.25 to 1.
+func scoreDuplicate(aliases VendorAliases, receipt, other *Receipt) DuplicateCandidate {
+	c := DuplicateCandidate{
+		ReceiptID:     other.ID,
+		Vendor:        other.Vendor,
+		OriginalTotal: other.OriginalTotal,
+		Date:          other.Date,
+	}
+
+	c.VendorScore = aliases.Similarity(receipt.Vendor, other.Vendor)
+
+	diff := receipt.OriginalTotal - other.OriginalTotal
+	if diff < 0 {
+		diff = -diff
+	}
+	if tolerance := duplicateTolerance(receipt.OriginalTotal); diff <= tolerance {
+		c.AmountScore = 1 - 0.5*float64(diff)/float64(tolerance)
+	}
+
+	days := math.Abs(math.Round(receipt.Date.Sub(other.Date).Hours() / 24))
+	if days <= duplicateDateWindow {
+		c.DateScore = 1 - days/(duplicateDateWindow+1)
+	}
+
+	c.Score = duplicateVendorWeight*c.VendorScore + duplicateAmountWeight*c.AmountScore + duplicateDateWeight*c.DateScore
+	c.Score = math.Round(c.Score*100) / 100
+	c.VendorScore = math.Round(c.VendorScore*100) / 100
+	c.AmountScore = math.Round(c.AmountScore*100) / 100
+	c.DateScore = math.Round(c.DateScore*100) / 100
+	return c
+}
+
+// FindDuplicateCandidates ranks the household's other receipts that may be
+// the same purchase as receipt, best first. Vendors are compared by
+// canonical name (see VendorAliases), so "WALGREENS #1234" matches
+// "Walgreens", and the amount and date may be slightly off, as OCR misreads
+// them. Receipts in another currency never match.
+func (db *Database) FindDuplicateCandidates(receipt *Receipt) ([]DuplicateCandidate, error) {
+	candidates := []DuplicateCandidate{}
+	if receipt.Vendor == "" || receipt.OriginalTotal <= 0 {
+		return candidates, nil
+	}
+
+	aliases, err := db.GetVendorAliases()
+	if err != nil {
+		return nil, err
+	}
+
+	tolerance := duplicateTolerance(receipt.OriginalTotal)
+	window := duplicateDateWindow * 24 * time.Hour
+	rows, err := db.conn.Query(`
+        SELECT `+receiptColumns+`
+        FROM receipts r
+        WHERE r.household_id = $1
+          AND r.id <> $2
+          AND r.currency = $3
+          AND r.date BETWEEN $4 AND $5
+          AND r.original_total BETWEEN $6 AND $7
+    `, receipt.HouseholdID, receipt.ID, receipt.Currency,
+		receipt.Date.Add(-window), receipt.Date.Add(window),
+		receipt.OriginalTotal-tolerance, receipt.OriginalTotal+tolerance)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		other, err := scanReceipt(rows)
+		if err != nil {
+			return nil, err
+		}
+		if c := scoreDuplicate(aliases, receipt, other); c.Score >= duplicateMinScore {
+			candidates = append(candidates, c)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].Score != candidates[j].Score {
+			return candidates[i].Score > candidates[j].Score
+		}
+		return candidates[i].ReceiptID < candidates[j].ReceiptID
+	})
+	if len(candidates) > duplicateMaxCandidates {
+		candidates = candidates[:duplicateMaxCandidates]
+	}
+	return candidates, nil
+}
+
+// ReceiptDuplicatesHandler ranks the receipts that may be the same purchase
+// as a receipt: GET /api/receipts/{id}/duplicates
+func (s *Server) ReceiptDuplicatesHandler(w http.ResponseWriter, r *http.Request, receiptID int) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	receipt, err := s.DB.GetReceiptByID(CurrentMembership(r).HouseholdID, receiptID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Receipt not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Failed to get receipt %d: %v", receiptID, err)
+		http.Error(w, "Failed to get receipt", http.StatusInternalServerError)
+		return
+	}
+
+	candidates, err := s.DB.FindDuplicateCandidates(receipt)
+	if err != nil {
+		log.Printf("Failed to find duplicates of receipt %d: %v", receiptID, err)
+		http.Error(w, "Failed to find duplicates", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(candidates)
+}
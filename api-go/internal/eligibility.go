@@ -0,0 +1,549 @@
+package internal
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Eligibility categories a rule assigns to a line or vendor
+const (
+	EligibilityEligible   = "eligible"
+	EligibilityIneligible = "ineligible"
+	EligibilityNeedsLMN   = "needs_lmn" // qualifies only with a letter of medical necessity
+)
+
+// EligibilityRule classifies the receipt lines whose description contains
+// one of Keywords, or every line of a receipt whose vendor matches one of
+// the Vendors glob patterns (e.g. "*dental*"). Keywords match at the start
+// of a word, so "ibuprof" matches "IBUPROFEN 200MG".
+type EligibilityRule struct {
+	Code        string   `json:"code"` // category code, e.g. "otc-medicine"
+	Category    string   `json:"category"`
+	Eligibility string   `json:"eligibility"`
+	Keywords    []string `json:"keywords,omitempty"`
+	Vendors     []string `json:"vendors,omitempty"`
+	Reference   string   `json:"reference,omitempty"` // where the IRS says so
+}
+
+// RuleSet is one version of the eligibility rules. Version 0 is the
+// built-in rule set, used until an administrator saves one.
+type RuleSet struct {
+	Version   int               `json:"version"`
+	Note      *string           `json:"note"`
+	CreatedBy *int              `json:"created_by"`
+	CreatedAt *time.Time        `json:"created_at"`
+	Rules     []EligibilityRule `json:"rules"`
+}
+
+// LineEligibility explains how one receipt item was classified. Code and
+// Eligibility are empty when no rule matched, in which case the item keeps
+// its current eligibility.
+type LineEligibility struct {
+	ItemID      int    `json:"item_id"`
+	Description string `json:"description"`
+	Amount      *Money `json:"amount"`
+	Code        string `json:"code,omitempty"`
+	Eligibility string `json:"eligibility,omitempty"`
+	HSAEligible bool   `json:"hsa_eligible"`
+	Explanation string `json:"explanation"`
+}
+
+// EligibilitySuggestion is the rules engine's verdict on a receipt. Its
+// QualifiedAmount is what applying it saves: the original total for Yes and
+// No, as on every such receipt, and for Partially the eligible items' sum.
+// A No receipt is kept out of reimbursements by its status, not its amount.
+type EligibilitySuggestion struct {
+	RuleSetVersion  int               `json:"rule_set_version"`
+	HSAStatus       string            `json:"hsa_status"`
+	QualifiedAmount Money             `json:"qualified_amount"`
+	VendorCode      string            `json:"vendor_code,omitempty"`
+	Explanation     string            `json:"explanation"`
+	Lines           []LineEligibility `json:"lines"`
+}
+
+// ErrInvalidRuleSet wraps the reason a rule set was rejected
+var ErrInvalidRuleSet = errors.New("invalid rule set")
+
+// Validate normalizes keywords and vendor patterns to lower case and checks
+// that every rule has a unique code, a known eligibility, something to
+// match and well-formed vendor patterns
+func (rs *RuleSet) Validate() error {
+	codes := map[string]bool{}
+	for i := range rs.Rules {
+		rule := &rs.Rules[i]
+		rule.Code = strings.TrimSpace(rule.Code)
+		if rule.Code == "" {
+			return fmt.Errorf("%w: rule %d has no code", ErrInvalidRuleSet, i+1)
+		}
+		if codes[rule.Code] {
+			return fmt.Errorf("%w: duplicate code %q", ErrInvalidRuleSet, rule.Code)
+		}
+		codes[rule.Code] = true
+
+		switch rule.Eligibility {
+		case EligibilityEligible, EligibilityIneligible, EligibilityNeedsLMN:
+		default:
+			return fmt.Errorf("%w: rule %q has eligibility %q, want eligible, ineligible or needs_lmn",
+				ErrInvalidRuleSet, rule.Code, rule.Eligibility)
+		}
+
+		keywords := rule.Keywords[:0]
+		for _, keyword := range rule.Keywords {
+			if keyword = eligibilityWords(keyword); keyword != "" {
+				keywords = append(keywords, keyword)
+			}
+		}
+		rule.Keywords = keywords
+
+		for j, pattern := range rule.Vendors {
+			pattern = strings.ToLower(strings.TrimSpace(pattern))
+			if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+				return fmt.Errorf("%w: rule %q has an invalid vendor pattern %q", ErrInvalidRuleSet, rule.Code, pattern)
+			}
+			rule.Vendors[j] = pattern
+		}
+
+		if len(rule.Keywords) == 0 && len(rule.Vendors) == 0 {
+			return fmt.Errorf("%w: rule %q has no keywords or vendors", ErrInvalidRuleSet, rule.Code)
+		}
+	}
+	return nil
+}
+
+// eligibilityWords lower-cases text and keeps only its letters and digits,
+// one space between words, so "Band-Aid®" reads "band aid"
+func eligibilityWords(text string) string {
+	fields := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	return strings.Join(fields, " ")
+}
+
+// matchKeyword returns the rule with the longest keyword found at the start
+// of a word of description; the earlier rule wins a tie
+func (rs *RuleSet) matchKeyword(description string) (*EligibilityRule, string) {
+	words := " " + eligibilityWords(description)
+	var best *EligibilityRule
+	bestKeyword := ""
+	for i := range rs.Rules {
+		for _, keyword := range rs.Rules[i].Keywords {
+			if len(keyword) > len(bestKeyword) && strings.Contains(words, " "+keyword) {
+				best, bestKeyword = &rs.Rules[i], keyword
+			}
+		}
+	}
+	return best, bestKeyword
+}
+
+// matchVendor returns the first rule with a vendor pattern matching vendor
+func (rs *RuleSet) matchVendor(vendor string) (*EligibilityRule, string) {
+	vendor = strings.ToLower(strings.TrimSpace(vendor))
+	if vendor == "" {
+		return nil, ""
+	}
+	vendor = strings.ReplaceAll(vendor, "/", " ")
+	for i := range rs.Rules {
+		for _, pattern := range rs.Rules[i].Vendors {
+			if ok, _ := path.Match(pattern, vendor); ok {
+				return &rs.Rules[i], pattern
+			}
+		}
+	}
+	return nil, ""
+}
+
+// ruleExplanation describes a match for a person reading the receipt
+func ruleExplanation(rule *EligibilityRule, matched string) string {
+	var verdict string
+	switch rule.Eligibility {
+	case EligibilityEligible:
+		verdict = "eligible"
+	case EligibilityIneligible:
+		verdict = "not eligible"
+	case EligibilityNeedsLMN:
+		verdict = "eligible only with a letter of medical necessity"
+	}
+	explanation := fmt.Sprintf("%s (%s), %s: matched %q", rule.Category, rule.Code, verdict, matched)
+	if rule.Reference != "" {
+		explanation += "; see " + rule.Reference
+	}
+	return explanation
+}
+
+// Classify suggests a receipt's HSA status and qualified amount from its
+// vendor and items. An item takes the rule its description matches, or
+// else the rule its vendor matches; an item no rule matches keeps its
+// current eligibility. Only eligible items count as qualified, so items
+// needing a letter of medical necessity have to be marked eligible by hand.
+// A receipt without items follows its vendor's rule, if any.
+func (rs *RuleSet) Classify(receipt *Receipt) *EligibilitySuggestion {
+	suggestion := &EligibilitySuggestion{
+		RuleSetVersion:  rs.Version,
+		HSAStatus:       receipt.HSAStatus,
+		QualifiedAmount: receipt.QualifiedAmount,
+		Lines:           []LineEligibility{},
+	}
+	if suggestion.HSAStatus != HSAStatusPartially {
+		suggestion.QualifiedAmount = receipt.OriginalTotal
+	}
+
+	vendorRule, vendorPattern := rs.matchVendor(receipt.Vendor)
+	if vendorRule != nil {
+		suggestion.VendorCode = vendorRule.Code
+	}
+
+	if len(receipt.Items) == 0 {
+		if vendorRule == nil {
+			suggestion.Explanation = "No rule matched the vendor and the receipt has no items; its status is left as is"
+			return suggestion
+		}
+		suggestion.HSAStatus = HSAStatusNo
+		if vendorRule.Eligibility == EligibilityEligible {
+			suggestion.HSAStatus = HSAStatusYes
+		}
+		suggestion.QualifiedAmount = receipt.OriginalTotal
+		suggestion.Explanation = "Vendor: " + ruleExplanation(vendorRule, vendorPattern)
+		return suggestion
+	}
+
+	items := make([]ReceiptItem, len(receipt.Items))
+	matched := 0
+	for i, item := range receipt.Items {
+		line := LineEligibility{
+			ItemID:      item.ID,
+			Description: item.Description,
+			Amount:      item.Amount,
+			HSAEligible: item.HSAEligible,
+		}
+		if rule, keyword := rs.matchKeyword(item.Description); rule != nil {
+			line.Code, line.Eligibility = rule.Code, rule.Eligibility
+			line.Explanation = ruleExplanation(rule, keyword)
+		} else if vendorRule != nil {
+			line.Code, line.Eligibility = vendorRule.Code, vendorRule.Eligibility
+			line.Explanation = "Vendor: " + ruleExplanation(vendorRule, vendorPattern)
+		} else {
+			line.Explanation = "No rule matched; eligibility left as is"
+		}
+		if line.Eligibility != "" {
+			line.HSAEligible = line.Eligibility == EligibilityEligible
+			matched++
+		}
+
+		items[i] = item
+		items[i].HSAEligible = line.HSAEligible
+		suggestion.Lines = append(suggestion.Lines, line)
+	}
+
+	status, qualified, priced := ItemsHSAStatus(items)
+	suggestion.HSAStatus = status
+	switch {
+	case status != HSAStatusPartially:
+		suggestion.QualifiedAmount = receipt.OriginalTotal
+	case priced:
+		suggestion.QualifiedAmount = qualified
+	}
+
+	suggestion.Explanation = fmt.Sprintf("%d of %d items matched a rule", matched, len(items))
+	if status == HSAStatusPartially && !priced {
+		suggestion.Explanation += "; an eligible item has no amount, so the qualified amount is left as is"
+	}
+	return suggestion
+}
+
+// applyEligibility copies a suggestion, including its qualified amount,
+// onto a receipt and its items
+func applyEligibility(receipt *Receipt, suggestion *EligibilitySuggestion) {
+	for i, line := range suggestion.Lines {
+		if i < len(receipt.Items) {
+			receipt.Items[i].HSAEligible = line.HSAEligible
+		}
+	}
+	receipt.HSAStatus = suggestion.HSAStatus
+	receipt.HSAQualified = receipt.HSAStatus != HSAStatusNo
+	receipt.QualifiedAmount = suggestion.QualifiedAmount
+}
+
+// GetRuleSet returns a saved rule set, or the active one for version 0:
+// the newest saved, or the built-in rules when none has been saved. It
+// returns sql.ErrNoRows for an unknown version.
+func (db *Database) GetRuleSet(version int) (*RuleSet, error) {
+	query := `
+        SELECT version, note, created_by, created_at, rules
+        FROM eligibility_rule_sets
+        WHERE $1 = 0 OR version = $1
+        ORDER BY version DESC
+        LIMIT 1
+    `
+
+	var rs RuleSet
+	var rules []byte
+	err := db.conn.QueryRow(query, version).Scan(&rs.Version, &rs.Note, &rs.CreatedBy, &rs.CreatedAt, &rules)
+	if err == sql.ErrNoRows && version == 0 {
+		return DefaultRuleSet(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var body struct {
+		Rules []EligibilityRule `json:"rules"`
+	}
+	if err := json.Unmarshal(rules, &body); err != nil {
+		return nil, fmt.Errorf("failed to decode rule set %d: %v", rs.Version, err)
+	}
+	rs.Rules = body.Rules
+	return &rs, nil
+}
+
+// ListRuleSets returns every saved rule set, newest first, without its rules
+func (db *Database) ListRuleSets() ([]RuleSet, error) {
+	rows, err := db.conn.Query(`
+        SELECT version, note, created_by, created_at
+        FROM eligibility_rule_sets
+        ORDER BY version DESC
+    `)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sets := []RuleSet{}
+	for rows.Next() {
+		var rs RuleSet
+		if err := rows.Scan(&rs.Version, &rs.Note, &rs.CreatedBy, &rs.CreatedAt); err != nil {
+			return nil, err
+		}
+		sets = append(sets, rs)
+	}
+	return sets, rows.Err()
+}
+
+// SaveRuleSet stores rs as the new active version
+func (db *Database) SaveRuleSet(rs *RuleSet, createdBy int) error {
+	rules, err := json.Marshal(struct {
+		Rules []EligibilityRule `json:"rules"`
+	}{rs.Rules})
+	if err != nil {
+		return err
+	}
+
+	rs.CreatedBy = &createdBy
+	return db.conn.QueryRow(`
+        INSERT INTO eligibility_rule_sets (rules, note, created_by)
+        VALUES ($1, $2, $3)
+        RETURNING version, created_at
+    `, string(rules), rs.Note, createdBy).Scan(&rs.Version, &rs.CreatedAt)
+}
+
+// ApplyEligibility classifies a receipt with rs and saves the suggestion
+// onto it and its items. The qualified amount is changed by
+// setQualifiedAmount. It returns the updated receipt with its items,
+// ErrQualifiedBelowClaimed, or sql.ErrNoRows.
+func (db *Database) ApplyEligibility(householdID int, receiptID int, rs *RuleSet) (*Receipt, *EligibilitySuggestion, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	query := `
+        SELECT ` + receiptColumns + `
+        FROM receipts r
+        WHERE r.id = $1 AND r.household_id = $2
+        FOR UPDATE
+    `
+	receipt, err := scanReceipt(tx.QueryRow(query, receiptID, householdID))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rows, err := tx.Query(`
+        SELECT `+receiptItemColumns+`
+        FROM receipt_items i
+        WHERE i.receipt_id = $1
+        ORDER BY i.position, i.id
+    `, receiptID)
+	if err != nil {
+		return nil, nil, err
+	}
+	receipt.Items = []ReceiptItem{}
+	for rows.Next() {
+		item, err := scanReceiptItem(rows)
+		if err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		receipt.Items = append(receipt.Items, *item)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	suggestion := rs.Classify(receipt)
+	applyEligibility(receipt, suggestion)
+
+	for _, item := range receipt.Items {
+		if _, err := tx.Exec("UPDATE receipt_items SET hsa_eligible = $1 WHERE id = $2",
+			item.HSAEligible, item.ID); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	_, err = tx.Exec("UPDATE receipts SET hsa_status = $1, hsa_qualified = $2 WHERE id = $3",
+		receipt.HSAStatus, receipt.HSAQualified, receipt.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	updated, err := setQualifiedAmount(tx, householdID, receiptID, receipt.QualifiedAmount)
+	if err != nil {
+		return nil, nil, err
+	}
+	updated.Items = receipt.Items
+	receipt = updated
+
+	return receipt, suggestion, tx.Commit()
+}
+
+// EligibilityRulesHandler returns the active rule set, or the one named by
+// ?version=N (GET), or saves a new version (PUT, server administrators
+// only) from {"note": "...", "rules": [...]}
+func (s *Server) EligibilityRulesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		version := 0
+		if v := r.URL.Query().Get("version"); v != "" {
+			parsed, err := strconv.Atoi(v)
+			if err != nil || parsed < 0 {
+				http.Error(w, "Invalid version", http.StatusBadRequest)
+				return
+			}
+			version = parsed
+		}
+
+		rs, err := s.DB.GetRuleSet(version)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Rule set not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Printf("Failed to get eligibility rules: %v", err)
+			http.Error(w, "Failed to get eligibility rules", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rs)
+	case http.MethodPut:
+		user := CurrentUser(r)
+		if !s.IsAdmin(user) {
+			http.Error(w, "Only server administrators can change eligibility rules", http.StatusForbidden)
+			return
+		}
+
+		var rs RuleSet
+		if err := json.NewDecoder(r.Body).Decode(&rs); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err := rs.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := s.DB.SaveRuleSet(&rs, user.ID); err != nil {
+			log.Printf("Failed to save eligibility rules: %v", err)
+			http.Error(w, "Failed to save eligibility rules", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("User %s saved eligibility rule set version %d", user.Username, rs.Version)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(rs)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// EligibilityRuleVersionsHandler lists the saved rule sets:
+// GET /api/eligibility/rules/versions
+func (s *Server) EligibilityRuleVersionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sets, err := s.DB.ListRuleSets()
+	if err != nil {
+		log.Printf("Failed to list eligibility rules: %v", err)
+		http.Error(w, "Failed to list eligibility rules", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sets)
+}
+
+// ReceiptEligibilityHandler explains how the active rules classify a
+// receipt (GET /api/receipts/{id}/eligibility) or applies that
+// classification to it and its items (POST), responding with
+// {"receipt": ..., "suggestion": ...}. Users can still override the result
+// by editing the receipt or toggling items.
+func (s *Server) ReceiptEligibilityHandler(w http.ResponseWriter, r *http.Request, receiptID int) {
+	membership := CurrentMembership(r)
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if !membership.CanWrite() {
+			http.Error(w, "Viewers cannot change receipts", http.StatusForbidden)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rs, err := s.DB.GetRuleSet(0)
+	if err != nil {
+		log.Printf("Failed to get eligibility rules: %v", err)
+		http.Error(w, "Failed to get eligibility rules", http.StatusInternalServerError)
+		return
+	}
+
+	var receipt *Receipt
+	var suggestion *EligibilitySuggestion
+	if r.Method == http.MethodPost {
+		receipt, suggestion, err = s.DB.ApplyEligibility(membership.HouseholdID, receiptID, rs)
+	} else if receipt, err = s.DB.GetReceiptByID(membership.HouseholdID, receiptID); err == nil {
+		if receipt.Items, err = s.DB.GetReceiptItems(receiptID); err == nil {
+			suggestion = rs.Classify(receipt)
+		}
+	}
+	if err == sql.ErrNoRows {
+		http.Error(w, "Receipt not found", http.StatusNotFound)
+		return
+	} else if err == ErrQualifiedBelowClaimed {
+		http.Error(w, "More has been claimed from the receipt than the rules qualify; release the claims first", http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Printf("Failed to classify receipt %d: %v", receiptID, err)
+		http.Error(w, "Failed to classify receipt", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"receipt":    receipt,
+		"suggestion": suggestion,
+	})
+}
@@ -0,0 +1,121 @@
+package internal
+
+// DefaultRuleSet returns the built-in rules, drawn from IRS Publication 502
+// (Medical and Dental Expenses) and, for over-the-counter medicines and
+// menstrual care products, the CARES Act changes described in Publication
+// 969. They cover common pharmacy and provider receipts, not every case;
+// administrators can save their own version.
+func DefaultRuleSet() *RuleSet {
+	return &RuleSet{
+		Version: 0,
+		Rules: []EligibilityRule{
+			{
+				Code:        "prescription",
+				Category:    "Prescription medicines",
+				Eligibility: EligibilityEligible,
+				Keywords:    []string{"rx", "prescription", "copay", "co pay", "insulin"},
+				Reference:   "Pub. 502, Medicines",
+			},
+			{
+				Code:        "otc-medicine",
+				Category:    "Over-the-counter medicines",
+				Eligibility: EligibilityEligible,
+				Keywords: []string{
+					"ibuprof", "acetaminophen", "aspirin", "naproxen", "advil", "tylenol", "aleve", "motrin",
+					"antacid", "allergy", "antihistamine", "loratadine", "cetirizine", "fexofenadine", "claritin",
+					"zyrtec", "cold flu", "cough", "decongestant", "nasal spray", "hydrocortisone",
+					"antibiotic ointment", "neosporin", "laxative", "antidiarrheal", "eye drops",
+					"nicotine gum", "nicotine patch", "nicotine lozenge",
+				},
+				Reference: "Pub. 969, Qualified medical expenses (CARES Act)",
+			},
+			{
+				Code:        "menstrual-care",
+				Category:    "Menstrual care products",
+				Eligibility: EligibilityEligible,
+				Keywords:    []string{"tampon", "menstrual", "pantiliner", "panty liner", "maxi pad"},
+				Reference:   "Pub. 969, Qualified medical expenses (CARES Act)",
+			},
+			{
+				Code:        "medical-supplies",
+				Category:    "Medical supplies and equipment",
+				Eligibility: EligibilityEligible,
+				Keywords: []string{
+					"bandage", "band aid", "gauze", "first aid", "thermometer", "blood pressure", "glucose",
+					"test strip", "lancet", "pregnancy test", "ovulation test", "covid test", "crutch",
+					"breast pump", "hearing aid", "heating pad", "knee brace", "wrist brace",
+				},
+				Reference: "Pub. 502, Medical supplies; Breast pumps and supplies; Hearing aids",
+			},
+			{
+				Code:        "vision",
+				Category:    "Eyeglasses and contact lenses",
+				Eligibility: EligibilityEligible,
+				Keywords: []string{
+					"eyeglasses", "prescription glasses", "reading glasses", "contact lens", "contact solution",
+					"lens solution", "eye exam",
+				},
+				Reference: "Pub. 502, Contact lenses; Eyeglasses",
+			},
+			{
+				Code:        "medical-care",
+				Category:    "Medical, dental and vision care",
+				Eligibility: EligibilityEligible,
+				Keywords:    []string{"office visit", "exam", "deductible", "coinsurance", "x ray", "lab work"},
+				Vendors: []string{
+					"*dental*", "*dentist*", "*orthodont*", "*hospital*", "*clinic*", "*medical*", "*physician*",
+					"*urgent care*", "*optometr*", "*ophthalm*", "*chiropract*", "*physical therapy*",
+					"*laborator*", "*pediatric*", "*dermatolog*", "*md", "*m.d.", "*dds", "*d.d.s.",
+				},
+				Reference: "Pub. 502, What Are Medical Expenses?",
+			},
+			{
+				Code:        "supplements",
+				Category:    "Vitamins and supplements",
+				Eligibility: EligibilityNeedsLMN,
+				Keywords: []string{
+					"vitamin", "multivitamin", "supplement", "fish oil", "omega 3", "probiotic", "melatonin",
+					"protein powder",
+				},
+				Reference: "Pub. 502, Nutritional supplements",
+			},
+			{
+				Code:        "weight-loss",
+				Category:    "Weight loss and fitness",
+				Eligibility: EligibilityNeedsLMN,
+				Keywords:    []string{"weight loss", "meal replacement", "gym", "fitness", "massage"},
+				Reference:   "Pub. 502, Weight-loss program; Health club dues",
+			},
+			{
+				Code:        "cosmetic",
+				Category:    "Cosmetics",
+				Eligibility: EligibilityIneligible,
+				Keywords: []string{
+					"cosmetic", "makeup", "lipstick", "mascara", "eyeliner", "foundation", "perfume", "cologne",
+					"nail polish", "teeth whitening", "whitening strips",
+				},
+				Reference: "Pub. 502, Cosmetic surgery",
+			},
+			{
+				Code:        "toiletries",
+				Category:    "Toiletries and general health items",
+				Eligibility: EligibilityIneligible,
+				Keywords: []string{
+					"toothpaste", "toothbrush", "floss", "mouthwash", "shampoo", "conditioner", "deodorant",
+					"soap", "body wash", "lotion", "razor", "shaving", "tissues",
+				},
+				Reference: "Pub. 502, What Expenses Aren't Includible?",
+			},
+			{
+				Code:        "general-merchandise",
+				Category:    "General merchandise",
+				Eligibility: EligibilityIneligible,
+				Keywords: []string{
+					"candy", "soda", "snack", "chips", "paper towel", "toilet paper", "grocery", "gift card",
+					"magazine", "greeting card", "batteries", "detergent",
+				},
+				Reference: "Pub. 502, What Expenses Aren't Includible?",
+			},
+		},
+	}
+}
@@ -0,0 +1,107 @@
+package internal
+
+import (
+	"testing"
+)
+
+func TestApplyEligibilityKeepsClaims(t *testing.T) {
+	db, householdID := testDatabase(t)
+	receipt := createTestReceipt(t, db, householdID, 5000)
+	addTestItems(t, db, receipt, testItem("Bandages", 3000), testItem("Candy bar", 2000))
+	rs := &RuleSet{Rules: []EligibilityRule{{Code: "candy", Eligibility: EligibilityIneligible, Keywords: []string{"candy"}}}}
+
+	if err := db.UpdateReceipt(receipt, BalanceChange{ApplyAll: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := db.ApplyEligibility(householdID, receipt.ID, rs); err != ErrQualifiedBelowClaimed {
+		t.Fatalf("applying rules that qualify less than was claimed: %v", err)
+	}
+	checkBalance(t, db, receipt, 5000, 0)
+
+	if err := db.UpdateReceipt(receipt, BalanceChange{Release: true, Apply: 3000}); err != nil {
+		t.Fatal(err)
+	}
+	updated, suggestion, err := db.ApplyEligibility(householdID, receipt.ID, rs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.HSAStatus != HSAStatusPartially || suggestion.QualifiedAmount != 3000 || len(updated.Items) != 2 {
+		t.Errorf("applied %s with %d items, suggested %s", updated.HSAStatus, len(updated.Items), suggestion.QualifiedAmount)
+	}
+	// Exactly the claimed amount still qualifies, so the receipt is used up
+	checkBalance(t, db, receipt, 3000, 0)
+}
+
+func TestClassifyQualifiedAmountIsApplied(t *testing.T) {
+	rs := &RuleSet{Rules: []EligibilityRule{
+		{Code: "candy", Eligibility: EligibilityIneligible, Keywords: []string{"candy"}},
+		{Code: "bandages", Eligibility: EligibilityEligible, Keywords: []string{"bandage"}},
+		{Code: "grocery", Eligibility: EligibilityIneligible, Vendors: []string{"*grocery*"}},
+	}}
+	if err := rs.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	amount := func(m Money) *Money { return &m }
+
+	tests := []struct {
+		name      string
+		receipt   Receipt
+		status    string
+		qualified Money
+	}{
+		{
+			name:    "ineligible vendor without items",
+			receipt: Receipt{Vendor: "Corner Grocery", OriginalTotal: 5000, QualifiedAmount: 5000, HSAStatus: HSAStatusYes},
+			status:  HSAStatusNo, qualified: 5000,
+		},
+		{
+			name: "no item eligible",
+			receipt: Receipt{Vendor: "Pharmacy", OriginalTotal: 2000, QualifiedAmount: 2000, HSAStatus: HSAStatusYes,
+				Items: []ReceiptItem{{Description: "Candy bar", Amount: amount(2000), HSAEligible: true}}},
+			status: HSAStatusNo, qualified: 2000,
+		},
+		{
+			name: "every item eligible",
+			receipt: Receipt{Vendor: "Pharmacy", OriginalTotal: 3200, QualifiedAmount: 3200, HSAStatus: HSAStatusNo,
+				Items: []ReceiptItem{{Description: "Bandages", Amount: amount(3000)}}},
+			status: HSAStatusYes, qualified: 3200,
+		},
+		{
+			name: "priced mixed items",
+			receipt: Receipt{Vendor: "Pharmacy", OriginalTotal: 5000, QualifiedAmount: 5000, HSAStatus: HSAStatusYes,
+				Items: []ReceiptItem{
+					{Description: "Bandages", Amount: amount(3000), HSAEligible: true},
+					{Description: "Candy bar", Amount: amount(2000), HSAEligible: true},
+				}},
+			status: HSAStatusPartially, qualified: 3000,
+		},
+		{
+			// Without amounts a No receipt's qualified amount stays the total
+			name: "unpriced mixed items",
+			receipt: Receipt{Vendor: "Pharmacy", OriginalTotal: 5000, QualifiedAmount: 5000, HSAStatus: HSAStatusNo,
+				Items: []ReceiptItem{{Description: "Bandages"}, {Description: "Candy bar", HSAEligible: true}}},
+			status: HSAStatusPartially, qualified: 5000,
+		},
+		{
+			name:    "no rule matched",
+			receipt: Receipt{Vendor: "Pharmacy", OriginalTotal: 1500, QualifiedAmount: 1500, HSAStatus: HSAStatusNo},
+			status:  HSAStatusNo, qualified: 1500,
+		},
+	}
+	for _, tt := range tests {
+		suggestion := rs.Classify(&tt.receipt)
+		if suggestion.HSAStatus != tt.status || suggestion.QualifiedAmount != tt.qualified {
+			t.Errorf("%s: suggested %s qualifying %s, want %s qualifying %s",
+				tt.name, suggestion.HSAStatus, suggestion.QualifiedAmount, tt.status, tt.qualified)
+		}
+
+		applyEligibility(&tt.receipt, suggestion)
+		if tt.receipt.HSAStatus != suggestion.HSAStatus || tt.receipt.QualifiedAmount != suggestion.QualifiedAmount {
+			t.Errorf("%s: applied %s qualifying %s, but suggested %s qualifying %s", tt.name,
+				tt.receipt.HSAStatus, tt.receipt.QualifiedAmount, suggestion.HSAStatus, suggestion.QualifiedAmount)
+		}
+		if tt.receipt.HSAQualified != (tt.status != HSAStatusNo) {
+			t.Errorf("%s: hsa_qualified %v for %s", tt.name, tt.receipt.HSAQualified, tt.status)
+		}
+	}
+}
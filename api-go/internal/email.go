@@ -0,0 +1,264 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"path"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// ErrNoReceiptInEmail is returned for a message with no image or PDF
+// attachment and no body to render
+var ErrNoReceiptInEmail = errors.New("the message has no image or PDF attachment and no text")
+
+// emailMaxDepth bounds how deeply multipart parts and forwarded messages
+// are opened
+const emailMaxDepth = 10
+
+// emailAttachmentTypes are the attachment types kept as receipts, with the
+// extension given to one that arrives without a filename
+var emailAttachmentTypes = map[string]string{
+	"application/pdf": ".pdf",
+	"image/jpeg":      ".jpg",
+	"image/png":       ".png",
+	"image/gif":       ".gif",
+	"image/heic":      ".heic",
+	"image/heif":      ".heic",
+	"image/webp":      ".webp",
+	"image/tiff":      ".tiff",
+}
+
+var (
+	emailDroppedElements = regexp.MustCompile(`(?is)<(script|style|head|title)\b.*?</(script|style|head|title)\s*>`)
+	emailComments        = regexp.MustCompile(`(?s)<!--.*?-->`)
+	emailLineBreaks      = regexp.MustCompile(`(?i)<br\s*/?>|</(p|div|tr|table|h[1-6]|li|ul|ol|blockquote|pre)\s*>|<(p|div|h[1-6]|ul|ol|hr)\b[^>]*>`)
+	emailCellBreaks      = regexp.MustCompile(`(?i)</t[dh]\s*>`)
+	emailListItems       = regexp.MustCompile(`(?i)<li\b[^>]*>`)
+	emailTags            = regexp.MustCompile(`(?s)<[^>]*>`)
+	emailSpaces          = regexp.MustCompile(`[ \t\r\n\f\x{00a0}]+`)
+	emailBlankLines      = regexp.MustCompile(`\n{3,}`)
+)
+
+// emailParts collects what a message holds while its parts are walked
+type emailParts struct {
+	files []DocumentFile
+	html  string
+	text  string
+}
+
+// ParseEmailReceipts reads a MIME message and returns its image and PDF
+// attachments, including those of forwarded messages. Images embedded in
+// an HTML body (logos, with a Content-ID) are left out. A message without
+// attachments has its HTML body, or else its plain-text body, rendered to a
+// PDF with the sender, date and subject on top.
+func ParseEmailReceipts(raw []byte) ([]DocumentFile, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse message: %v", err)
+	}
+
+	parts := &emailParts{}
+	if err := parts.walk(textproto.MIMEHeader(msg.Header), msg.Body, 0); err != nil {
+		return nil, err
+	}
+	if len(parts.files) > 0 {
+		return parts.files, nil
+	}
+
+	body := parts.text
+	if parts.html != "" {
+		body = htmlToText(parts.html)
+	}
+	if strings.TrimSpace(body) == "" {
+		return nil, ErrNoReceiptInEmail
+	}
+
+	subject := decodeEmailHeader(msg.Header.Get("Subject"))
+	var b strings.Builder
+	for _, field := range []string{"From", "Date", "Subject"} {
+		if value := decodeEmailHeader(msg.Header.Get(field)); value != "" {
+			fmt.Fprintf(&b, "%s: %s\n", field, value)
+		}
+	}
+	b.WriteString("\n")
+	b.WriteString(strings.TrimSpace(body))
+
+	return []DocumentFile{{Filename: emailFilename(subject) + ".pdf", Data: RenderTextPDF(subject, b.String())}}, nil
+}
+
+func (p *emailParts) walk(header textproto.MIMEHeader, body io.Reader, depth int) error {
+	if depth > emailMaxDepth {
+		return nil
+	}
+
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType, params = "text/plain", map[string]string{}
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("failed to read message part: %v", err)
+			}
+			if err := p.walk(part.Header, part, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+
+	data, err := io.ReadAll(decodeTransferEncoding(header.Get("Content-Transfer-Encoding"), body))
+	if err != nil {
+		return fmt.Errorf("failed to decode message part: %v", err)
+	}
+
+	disposition, dispositionParams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	filename := dispositionParams["filename"]
+	if filename == "" {
+		filename = params["name"]
+	}
+	filename = path.Base(strings.ReplaceAll(decodeEmailHeader(filename), "\\", "/"))
+	if filename == "." || filename == "/" {
+		filename = ""
+	}
+
+	ext, receiptType := emailAttachmentTypes[mediaType]
+	if mediaType == "application/octet-stream" && filename != "" {
+		ext = strings.ToLower(path.Ext(filename))
+		receiptType = ContentTypeForKey(filename) != "application/octet-stream"
+	}
+
+	switch {
+	case mediaType == "message/rfc822":
+		// A message forwarded as an attachment
+		inner, err := mail.ReadMessage(bytes.NewReader(data))
+		if err != nil {
+			log.Printf("Warning: Skipping unreadable forwarded message: %v", err)
+			return nil
+		}
+		return p.walk(textproto.MIMEHeader(inner.Header), inner.Body, depth+1)
+	case receiptType:
+		// Pictures shown inside an HTML body are logos, not receipts
+		if header.Get("Content-ID") != "" && disposition != "attachment" {
+			return nil
+		}
+		if filename == "" {
+			filename = fmt.Sprintf("attachment-%d%s", len(p.files)+1, ext)
+		}
+		p.files = append(p.files, DocumentFile{Filename: filename, Data: data})
+	case disposition == "attachment":
+	case mediaType == "text/html" && p.html == "":
+		p.html = decodeCharset(data, params["charset"])
+	case mediaType == "text/plain" && p.text == "":
+		p.text = decodeCharset(data, params["charset"])
+	}
+	return nil
+}
+
+func decodeTransferEncoding(encoding string, body io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		return quotedprintable.NewReader(body)
+	default:
+		return body
+	}
+}
+
+// decodeCharset converts Latin-1 and Windows-1252 text to UTF-8; anything
+// else is taken to be UTF-8 (or ASCII) already
+func decodeCharset(data []byte, charset string) string {
+	switch strings.ToLower(charset) {
+	case "iso-8859-1", "latin1", "windows-1252", "cp1252":
+		var b strings.Builder
+		reverse := map[byte]rune{}
+		for r, c := range winAnsi {
+			reverse[c] = r
+		}
+		for _, c := range data {
+			if r, ok := reverse[c]; ok {
+				b.WriteRune(r)
+			} else {
+				b.WriteRune(rune(c))
+			}
+		}
+		return b.String()
+	default:
+		return strings.ToValidUTF8(string(data), "?")
+	}
+}
+
+// decodeEmailHeader decodes RFC 2047 encoded words such as =?UTF-8?Q?...?=
+func decodeEmailHeader(value string) string {
+	dec := &mime.WordDecoder{CharsetReader: func(charset string, input io.Reader) (io.Reader, error) {
+		data, err := io.ReadAll(input)
+		if err != nil {
+			return nil, err
+		}
+		return strings.NewReader(decodeCharset(data, charset)), nil
+	}}
+	if decoded, err := dec.DecodeHeader(value); err == nil {
+		return decoded
+	}
+	return value
+}
+
+// htmlToText keeps the text of an HTML body, one line per paragraph, row or
+// line break, with table cells separated by spaces
+func htmlToText(body string) string {
+	body = emailComments.ReplaceAllString(body, "")
+	body = emailDroppedElements.ReplaceAllString(body, "")
+	// Whitespace in HTML source is not layout
+	body = emailSpaces.ReplaceAllString(body, " ")
+	body = emailLineBreaks.ReplaceAllString(body, "\n")
+	body = emailCellBreaks.ReplaceAllString(body, "    ")
+	body = emailListItems.ReplaceAllString(body, "\n- ")
+	body = emailTags.ReplaceAllString(body, "")
+	body = strings.ReplaceAll(html.UnescapeString(body), "\u00a0", " ")
+
+	lines := strings.Split(body, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSpace(line)
+	}
+	return strings.TrimSpace(emailBlankLines.ReplaceAllString(strings.Join(lines, "\n"), "\n\n"))
+}
+
+// emailFilename makes a file name from a subject line
+func emailFilename(subject string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' || r == '_':
+			return r
+		case unicode.IsSpace(r):
+			return '-'
+		default:
+			return -1
+		}
+	}, subject)
+	name = strings.Trim(name, "-")
+	if runes := []rune(name); len(runes) > 60 {
+		name = string(runes[:60])
+	}
+	if name == "" {
+		name = "email"
+	}
+	return name
+}
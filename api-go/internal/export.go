@@ -0,0 +1,201 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// exportMarker is written at the root of every export so a later export
+// only ever replaces a directory it generated itself
+const exportMarker = ".hsa-export"
+
+// ExportReceiptTree materializes the browsable layout
+//
+//	dir/[household_<id>/]used|unused/<year>/<receipt id>_<original name>
+//
+// from the receipts in the database. Used receipts are filed under the year
+// they were used, unused ones under the receipt's year. A receipt's other
+// attachments go next to it as <receipt id>_<document type>_<original name>.
+// With hardlink set and local storage, files are hard links to the stored
+// blobs; otherwise they are copies. The tree is built next to dir and swapped
+// in, so readers never see it half written. householdID 0 exports every
+// household, each in its own folder. It returns the number of files written.
+func (s *Server) ExportReceiptTree(dir string, householdID int, hardlink bool) (int, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return 0, err
+	}
+	if err := s.checkExportDir(dir); err != nil {
+		return 0, err
+	}
+
+	receipts, err := s.DB.GetReceiptsWithFiles(householdID)
+	if err != nil {
+		return 0, err
+	}
+	attachments, err := s.DB.GetSecondaryAttachments(householdID)
+	if err != nil {
+		return 0, err
+	}
+	receiptAttachments := map[int][]Attachment{}
+	for _, a := range attachments {
+		receiptAttachments[a.ReceiptID] = append(receiptAttachments[a.ReceiptID], a)
+	}
+
+	tmp := fmt.Sprintf("%s.tmp-%d", dir, time.Now().UnixNano())
+	if err := os.MkdirAll(tmp, 0755); err != nil {
+		return 0, fmt.Errorf("failed to create export directory: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	if err := os.WriteFile(filepath.Join(tmp, exportMarker), []byte("Generated by hsa-api export-tree; do not edit\n"), 0644); err != nil {
+		return 0, err
+	}
+
+	local, _ := s.Store.(*LocalStore)
+	written := 0
+	for _, r := range receipts {
+		dst := filepath.Join(tmp, exportRelPath(r, householdID == 0))
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return written, err
+		}
+
+		err := s.exportFile(s.ReceiptKey(r.ImagePath), dst, hardlink, local)
+		if err == ErrBlobNotFound || os.IsNotExist(err) {
+			log.Printf("Warning: Receipt %d file %s is missing, not exporting it", r.ID, r.ImagePath)
+		} else if err != nil {
+			return written, fmt.Errorf("failed to export receipt %d: %v", r.ID, err)
+		} else {
+			written++
+		}
+
+		for _, a := range receiptAttachments[r.ID] {
+			name := strings.NewReplacer("/", "_", `\`, "_").Replace(a.OriginalName)
+			attachmentDst := filepath.Join(filepath.Dir(dst), fmt.Sprintf("%d_%s_%s", r.ID, a.DocumentType, name))
+			err := s.exportFile(s.ReceiptKey(a.StorageKey), attachmentDst, hardlink, local)
+			if err == ErrBlobNotFound || os.IsNotExist(err) {
+				log.Printf("Warning: Receipt %d attachment %s is missing, not exporting it", r.ID, a.StorageKey)
+				continue
+			}
+			if err != nil {
+				return written, fmt.Errorf("failed to export receipt %d attachment %d: %v", r.ID, a.ID, err)
+			}
+			written++
+		}
+	}
+
+	// Swap the new tree in, keeping the old one until the rename succeeds
+	old := ""
+	if _, err := os.Stat(dir); err == nil {
+		old = fmt.Sprintf("%s.old-%d", dir, time.Now().UnixNano())
+		if err := os.Rename(dir, old); err != nil {
+			return written, fmt.Errorf("failed to replace export directory: %v", err)
+		}
+	}
+	if err := os.Rename(tmp, dir); err != nil {
+		if old != "" {
+			os.Rename(old, dir)
+		}
+		return written, fmt.Errorf("failed to replace export directory: %v", err)
+	}
+	if old != "" {
+		if err := os.RemoveAll(old); err != nil {
+			log.Printf("Warning: Failed to remove previous export %s: %v", old, err)
+		}
+	}
+
+	return written, nil
+}
+
+// checkExportDir refuses directories the export would clobber: the receipt
+// store itself, or an existing non-empty directory it did not generate
+func (s *Server) checkExportDir(dir string) error {
+	if s.ReceiptDir != "" {
+		root, err := filepath.Abs(s.ReceiptDir)
+		blobs := filepath.Join(root, receiptBlobPrefix)
+		if err == nil && (dir == root || dir == blobs || strings.HasPrefix(dir, blobs+string(filepath.Separator))) {
+			return fmt.Errorf("refusing to export into the receipt store %s", dir)
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	if _, err := os.Stat(filepath.Join(dir, exportMarker)); err != nil {
+		return fmt.Errorf("refusing to replace %s: it is not empty and was not created by export-tree", dir)
+	}
+	return nil
+}
+
+// exportRelPath is a receipt's path within the export tree
+func exportRelPath(r Receipt, perHousehold bool) string {
+	status, year := "unused", r.Date.Year()
+	if r.Used {
+		status = "used"
+		if r.UsedDate != nil {
+			year = r.UsedDate.Year()
+		}
+	}
+
+	name := r.OriginalName
+	if name == "" {
+		name = path.Base(r.ImagePath)
+	}
+	name = strings.NewReplacer("/", "_", `\`, "_").Replace(name)
+
+	rel := filepath.Join(status, strconv.Itoa(year), fmt.Sprintf("%d_%s", r.ID, name))
+	if perHousehold {
+		rel = filepath.Join(fmt.Sprintf("household_%d", r.HouseholdID), rel)
+	}
+	return rel
+}
+
+// exportFile hard links or copies a stored file into the export tree
+func (s *Server) exportFile(key string, dst string, hardlink bool, local *LocalStore) error {
+	if !hardlink || local == nil {
+		return s.copyBlobToFile(key, dst)
+	}
+
+	src, err := local.FilePath(key)
+	if err != nil {
+		return ErrBlobNotFound
+	}
+	err = os.Link(src, dst)
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Hard link failed for %s, copying instead: %v", key, err)
+		err = s.copyBlobToFile(key, dst)
+	}
+	return err
+}
+
+func (s *Server) copyBlobToFile(key string, dst string) error {
+	src, _, err := s.Store.Get(key)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, src); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,48 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Extractor reads vendor, amount, date and HSA status out of a receipt file.
+// Implementations must be safe for concurrent use by the OCR workers.
+type Extractor interface {
+	// Extract parses one receipt; filename is the name it was uploaded as
+	Extract(filename string, data []byte) (*OCRResult, error)
+}
+
+// ExtractorConfig selects and configures an Extractor
+type ExtractorConfig struct {
+	Provider string // "http", "text" or "fixture"
+
+	// ServiceURL is the OCR service for the http provider
+	ServiceURL string
+
+	// FixtureDir holds the JSON fixtures replayed by the fixture provider.
+	// With FixtureRecord set, receipts without a fixture are sent to the
+	// OCR service at ServiceURL and its answer is saved as a new fixture.
+	FixtureDir    string
+	FixtureRecord bool
+}
+
+// NewExtractor builds the extractor named by cfg.Provider
+func NewExtractor(cfg ExtractorConfig) (Extractor, error) {
+	switch strings.ToLower(cfg.Provider) {
+	case "", "http":
+		return NewHTTPExtractor(cfg.ServiceURL), nil
+	case "text":
+		return NewTextExtractor(), nil
+	case "fixture":
+		if cfg.FixtureDir == "" {
+			return nil, fmt.Errorf("the fixture OCR provider needs a fixture directory")
+		}
+		fixtures := NewFixtureExtractor(cfg.FixtureDir)
+		if cfg.FixtureRecord {
+			fixtures.Record = NewHTTPExtractor(cfg.ServiceURL)
+		}
+		return fixtures, nil
+	default:
+		return nil, fmt.Errorf("unknown OCR provider %q, expected http, text or fixture", cfg.Provider)
+	}
+}
@@ -0,0 +1,97 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// FixtureExtractor replays recorded OCR results from JSON files, so uploads
+// and OCR jobs can be exercised without the OCR service. A fixture is an
+// OCRResult, or {"error": "..."} to make the extraction fail. It is looked
+// up as, in order:
+//
+//	Dir/<sha256 of the file>.json
+//	Dir/<uploaded filename>.json
+//	Dir/default.json
+//
+// With Record set, a file without a fixture is extracted by Record and the
+// result saved as Dir/<sha256>.json.
+type FixtureExtractor struct {
+	Dir    string
+	Record Extractor
+}
+
+// fixture is the on-disk form of a recorded extraction
+type fixture struct {
+	OCRResult
+	Error string `json:"error,omitempty"`
+}
+
+func NewFixtureExtractor(dir string) *FixtureExtractor {
+	return &FixtureExtractor{Dir: dir}
+}
+
+func (e *FixtureExtractor) Extract(filename string, data []byte) (*OCRResult, error) {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+
+	names := []string{hash + ".json"}
+	if base := filepath.Base(filename); base != "." && base != string(filepath.Separator) {
+		names = append(names, base+".json")
+	}
+	if e.Record == nil {
+		names = append(names, "default.json")
+	}
+
+	for _, name := range names {
+		raw, err := os.ReadFile(filepath.Join(e.Dir, name))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read OCR fixture: %v", err)
+		}
+
+		var f fixture
+		if err := json.Unmarshal(raw, &f); err != nil {
+			return nil, fmt.Errorf("failed to parse OCR fixture %s: %v", name, err)
+		}
+		if f.Error != "" {
+			return nil, errors.New(f.Error)
+		}
+		return &f.OCRResult, nil
+	}
+
+	if e.Record == nil {
+		return nil, fmt.Errorf("no OCR fixture for %s (sha256 %s) in %s", filename, hash, e.Dir)
+	}
+	return e.record(hash, filename, data)
+}
+
+func (e *FixtureExtractor) record(hash string, filename string, data []byte) (*OCRResult, error) {
+	result, err := e.Record.Extract(filename, data)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(e.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create fixture directory: %v", err)
+	}
+	path := filepath.Join(e.Dir, hash+".json")
+	if err := os.WriteFile(path, append(raw, '\n'), 0644); err != nil {
+		return nil, fmt.Errorf("failed to save OCR fixture: %v", err)
+	}
+
+	log.Printf("Recorded OCR fixture %s for %s", path, filename)
+	return result, nil
+}
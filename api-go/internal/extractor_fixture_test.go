@@ -0,0 +1,116 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testFixtureDir = "testdata/ocr"
+
+func TestFixtureExtractorLookup(t *testing.T) {
+	receipt, err := os.ReadFile("testdata/receipts/pharmacy.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(receipt)
+	if _, err := os.Stat(filepath.Join(testFixtureDir, hex.EncodeToString(sum[:])+".json")); err != nil {
+		t.Fatalf("testdata/receipts/pharmacy.txt changed; rename its fixture after the new sha256: %v", err)
+	}
+
+	e := NewFixtureExtractor(testFixtureDir)
+	tests := []struct {
+		name     string
+		filename string
+		data     []byte
+		vendor   string
+		amount   Money
+	}{
+		// The hash wins over the filename
+		{"hash", "scan.jpg", receipt, "Main Street Pharmacy", 2349},
+		{"filename", "uploads/scan.jpg", []byte("another scan"), "Eye Care Center", 15000},
+		{"default", "unknown.png", []byte("unknown"), "Fixture Vendor", 1000},
+	}
+	for _, tt := range tests {
+		result, err := e.Extract(tt.filename, tt.data)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if result.Vendor != tt.vendor || result.Amount != tt.amount {
+			t.Errorf("%s: got %q for %s, want %q for %s", tt.name, result.Vendor, result.Amount, tt.vendor, tt.amount)
+		}
+	}
+
+	result, err := e.Extract("scan.jpg", receipt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Items) != 3 || result.Items[2].HSAEligible == nil || *result.Items[2].HSAEligible {
+		t.Errorf("hash fixture items = %+v, want 3 with the last ineligible", result.Items)
+	}
+	result, err = e.Extract("scan.jpg", []byte("another scan"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Items) != 1 || result.Items[0].Description != "Eye exam" {
+		t.Errorf("filename fixture items = %+v, want the bare description", result.Items)
+	}
+}
+
+func TestFixtureExtractorError(t *testing.T) {
+	e := NewFixtureExtractor(testFixtureDir)
+	if _, err := e.Extract("unreadable.pdf", []byte("%PDF-1.7")); err == nil || err.Error() != "page 1 is blank" {
+		t.Errorf("error fixture: %v", err)
+	}
+
+	e.Dir = t.TempDir()
+	_, err := e.Extract("scan.jpg", []byte("scan"))
+	if err == nil || !strings.Contains(err.Error(), "no OCR fixture for scan.jpg") {
+		t.Errorf("missing fixture: %v", err)
+	}
+}
+
+// countingExtractor counts its calls and reads everything as the same result
+type countingExtractor struct {
+	calls  int
+	result *OCRResult
+	err    error
+}
+
+func (e *countingExtractor) Extract(filename string, data []byte) (*OCRResult, error) {
+	e.calls++
+	return e.result, e.err
+}
+
+func TestFixtureExtractorRecord(t *testing.T) {
+	record := &countingExtractor{result: &OCRResult{Vendor: "Clinic", Amount: 4000, HSAStatus: HSAStatusYes}}
+	e := &FixtureExtractor{Dir: filepath.Join(t.TempDir(), "fixtures"), Record: record}
+
+	for i := 0; i < 2; i++ {
+		result, err := e.Extract("visit.pdf", []byte("visit"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Vendor != "Clinic" || result.Amount != 4000 {
+			t.Fatalf("extraction %d = %+v", i+1, result)
+		}
+	}
+	if record.calls != 1 {
+		t.Errorf("Record called %d times, want once and then replayed", record.calls)
+	}
+	sum := sha256.Sum256([]byte("visit"))
+	if _, err := os.Stat(filepath.Join(e.Dir, hex.EncodeToString(sum[:])+".json")); err != nil {
+		t.Errorf("recorded fixture: %v", err)
+	}
+
+	// A failed extraction is not recorded, and default.json is not used
+	failing := &countingExtractor{err: errors.New("service unavailable")}
+	e = &FixtureExtractor{Dir: testFixtureDir, Record: failing}
+	if _, err := e.Extract("unknown.png", []byte("unknown")); err == nil || err.Error() != "service unavailable" {
+		t.Errorf("failed recording: %v", err)
+	}
+}
@@ -0,0 +1,73 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ocrTimeout bounds one call to the OCR service, which reads every page of
+// a multi-page PDF in that call
+const ocrTimeout = 2 * time.Minute
+
+// HTTPExtractor sends receipts to the OCR service (service-ocr), which
+// answers POST {URL}/parse with an OCRResult
+type HTTPExtractor struct {
+	URL    string
+	Client *http.Client
+}
+
+func NewHTTPExtractor(serviceURL string) *HTTPExtractor {
+	return &HTTPExtractor{
+		URL:    strings.TrimSuffix(serviceURL, "/"),
+		Client: &http.Client{Timeout: ocrTimeout},
+	}
+}
+
+func (e *HTTPExtractor) Extract(filename string, data []byte) (*OCRResult, error) {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+
+	part, err := writer.CreateFormFile("file", filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create form file: %v", err)
+	}
+
+	if _, err := part.Write(data); err != nil {
+		return nil, fmt.Errorf("failed to copy file: %v", err)
+	}
+
+	writer.Close()
+
+	url := fmt.Sprintf("%s/parse", e.URL)
+	req, err := http.NewRequest("POST", url, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	resp, err := e.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to call OCR service: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("OCR service returned status %d: %s",
+			resp.StatusCode, string(bodyBytes))
+	}
+
+	var result OCRResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to parse OCR response: %v", err)
+	}
+
+	return &result, nil
+}
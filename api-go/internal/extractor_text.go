@@ -0,0 +1,274 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ErrNotText is returned by TextExtractor for images, PDFs and other binary
+// files, which need an OCR service to read
+var ErrNotText = errors.New("the text OCR provider only reads plain-text receipts")
+
+// TextExtractor parses receipts that are already text (e-mailed or
+// exported receipts, OCR output from elsewhere) with simple heuristics and
+// no external service. It reads the vendor from the first line, the amount
+// from the last total line, tax and discounts from their own lines, the
+// priced lines above the totals as items and the first recognizable date.
+// It marks the receipt HSA-qualified when it mentions a pharmacy,
+// prescription or care provider.
+type TextExtractor struct{}
+
+func NewTextExtractor() *TextExtractor {
+	return &TextExtractor{}
+}
+
+var (
+	textAmountPattern = regexp.MustCompile(`([$€£]|\b(?:USD|EUR|GBP|CAD|AUD)\b)?\s*(\d{1,3}(?:,\d{3})+|\d+)\.(\d{2})\b`)
+
+	// textDatePatterns pair a date pattern with the layout that parses it
+	textDatePatterns = []struct {
+		pattern *regexp.Regexp
+		layouts []string
+	}{
+		{regexp.MustCompile(`\b\d{4}-\d{2}-\d{2}\b`), []string{"2006-01-02"}},
+		{regexp.MustCompile(`\b\d{1,2}/\d{1,2}/\d{4}\b`), []string{"1/2/2006"}},
+		{regexp.MustCompile(`\b\d{1,2}/\d{1,2}/\d{2}\b`), []string{"1/2/06"}},
+		{regexp.MustCompile(`(?i)\b[a-z]{3,9}\.? \d{1,2},? \d{4}\b`), []string{"Jan 2 2006", "January 2 2006"}},
+		{regexp.MustCompile(`(?i)\b\d{1,2} [a-z]{3,9}\.?,? \d{4}\b`), []string{"2 Jan 2006", "2 January 2006"}},
+	}
+
+	// textTotalLabels mark the line holding the amount paid, best first
+	textTotalLabels = []string{"amount due", "balance due", "grand total", "total due", "amount paid", "total"}
+
+	// textSkippedLabels look like totals but are not the amount paid
+	textSkippedLabels = []string{"subtotal", "sub total", "sub-total", "tax", "savings", "items"}
+
+	// textTaxLabels and textDiscountLabels mark the tax and discount lines
+	textTaxLabels      = []string{"tax", "vat", "gst", "hst"}
+	textDiscountLabels = []string{"discount", "coupon", "savings", "promo"}
+
+	textCurrencySymbols = map[string]string{"$": "USD", "€": "EUR", "£": "GBP"}
+
+	// textMedicalKeywords suggest an HSA-qualified expense
+	textMedicalKeywords = []string{
+		"pharmacy", "prescription", "rx", "clinic", "medical", "hospital", "dental", "dentist",
+		"orthodont", "optometr", "vision", "eye care", "physician", "doctor", "copay", "co pay",
+		"urgent care", "laboratory", "chiropract", "physical therapy",
+	}
+)
+
+func (e *TextExtractor) Extract(filename string, data []byte) (*OCRResult, error) {
+	if !utf8.Valid(data) || bytes.IndexByte(data, 0) >= 0 {
+		return nil, ErrNotText
+	}
+
+	text := strings.ReplaceAll(string(data), "\r\n", "\n")
+	lines := strings.Split(text, "\n")
+
+	result := &OCRResult{RawText: text}
+	result.Vendor = textVendor(lines)
+	result.Amount, result.Currency = textTotal(lines)
+	result.Tax = textLabeledAmount(lines, textTaxLabels)
+	result.Discount = textLabeledAmount(lines, textDiscountLabels)
+	result.Items = textItems(lines)
+	if date, ok := textDate(text); ok {
+		result.Date = date.Format("01/02/2006")
+	}
+
+	result.HSAStatus = HSAStatusNo
+	if textMentionsCare(text) {
+		result.HSAStatus = HSAStatusYes
+	}
+	result.HSAQualified = result.HSAStatus == HSAStatusYes
+
+	return result, nil
+}
+
+// textVendor is the first line that reads like a name rather than a date,
+// an amount or a generic heading
+func textVendor(lines []string) string {
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		letters := 0
+		for _, r := range line {
+			if unicode.IsLetter(r) {
+				letters++
+			}
+		}
+		if letters < 2 {
+			continue
+		}
+		switch strings.ToLower(strings.Trim(line, " *-=#:")) {
+		case "receipt", "sales receipt", "invoice", "welcome", "thank you", "customer copy":
+			continue
+		}
+		return line
+	}
+	return ""
+}
+
+// textTotal returns the amount on the best total line, falling back to the
+// largest amount on the receipt
+func textTotal(lines []string) (Money, string) {
+	bestRank := len(textTotalLabels)
+	var best Money
+	bestCurrency := ""
+	var largest Money
+	largestCurrency := ""
+
+	for _, line := range lines {
+		matches := textAmountPattern.FindAllStringSubmatch(line, -1)
+		if len(matches) == 0 {
+			continue
+		}
+		// The last amount on a line is the one in the right-hand column
+		m := matches[len(matches)-1]
+		amount, err := ParseMoney(m[2] + "." + m[3])
+		if err != nil {
+			continue
+		}
+		currency := m[1]
+		if code, ok := textCurrencySymbols[currency]; ok {
+			currency = code
+		}
+
+		if amount > largest {
+			largest, largestCurrency = amount, currency
+		}
+
+		lower := strings.ToLower(line)
+		if containsAny(lower, textSkippedLabels) {
+			continue
+		}
+		for rank, label := range textTotalLabels {
+			// The last line with the best label wins, e.g. a total after a
+			// discount
+			if rank <= bestRank && strings.Contains(lower, label) {
+				bestRank, best, bestCurrency = rank, amount, currency
+				break
+			}
+		}
+	}
+
+	if bestRank < len(textTotalLabels) {
+		return best, bestCurrency
+	}
+	return largest, largestCurrency
+}
+
+// textLabeledAmount sums the amounts on lines carrying one of labels, e.g. a
+// state and a county tax, leaving out totals and subtotals that mention them
+func textLabeledAmount(lines []string, labels []string) Money {
+	var sum Money
+	for _, line := range lines {
+		lower := strings.ToLower(line)
+		if !textHasWord(lower, labels) || containsAny(lower, textTotalLabels) {
+			continue
+		}
+		matches := textAmountPattern.FindAllStringSubmatch(line, -1)
+		if len(matches) == 0 {
+			continue
+		}
+		m := matches[len(matches)-1]
+		if amount, err := ParseMoney(m[2] + "." + m[3]); err == nil {
+			sum += amount
+		}
+	}
+	return sum
+}
+
+// textItems reads the priced lines above the first priced total, subtotal
+// or tax line, leaving out discounts. Lines without an amount, such as an
+// "ITEMS" heading or "Total items: 3", never end the list.
+func textItems(lines []string) []OCRItem {
+	var items []OCRItem
+	for _, line := range lines {
+		loc := textAmountPattern.FindAllStringSubmatchIndex(line, -1)
+		if len(loc) == 0 {
+			continue
+		}
+		lower := strings.ToLower(line)
+		if textHasWord(lower, textSkippedLabels) || textHasWord(lower, textTotalLabels) {
+			break
+		}
+		if textHasWord(lower, textDiscountLabels) {
+			continue
+		}
+
+		last := loc[len(loc)-1]
+		description := strings.TrimSpace(line[:last[0]])
+		if !strings.ContainsFunc(description, unicode.IsLetter) {
+			continue
+		}
+		amount, err := ParseMoney(line[last[4]:last[5]] + "." + line[last[6]:last[7]])
+		if err != nil {
+			continue
+		}
+		items = append(items, OCRItem{Description: description, Quantity: 1, Amount: &amount})
+	}
+	return items
+}
+
+// textDate finds the first date in the text, reading 01/02/2025 US-style
+func textDate(text string) (time.Time, bool) {
+	bestIndex := -1
+	var best time.Time
+	for _, p := range textDatePatterns {
+		for _, loc := range p.pattern.FindAllStringIndex(text, -1) {
+			if bestIndex >= 0 && loc[0] >= bestIndex {
+				break
+			}
+			candidate := strings.NewReplacer(",", "", ".", "").Replace(text[loc[0]:loc[1]])
+			for _, layout := range p.layouts {
+				if date, err := time.Parse(layout, candidate); err == nil {
+					bestIndex, best = loc[0], date
+					break
+				}
+			}
+		}
+	}
+	return best, bestIndex >= 0
+}
+
+// textMentionsCare matches the medical keywords at the start of a word, so
+// "optometr" matches "optometrist" and "rx" matches "rx#"
+func textMentionsCare(text string) bool {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool { return !unicode.IsLetter(r) })
+	joined := " " + strings.Join(words, " ") + " "
+	for _, keyword := range textMedicalKeywords {
+		if strings.Contains(joined, " "+keyword) {
+			return true
+		}
+	}
+	return false
+}
+
+// textHasWord matches words and phrases rather than substrings, so "tax"
+// does not match "taxi" and "sub-total" matches "Sub Total"
+func textHasWord(lower string, words []string) bool {
+	joined := " " + strings.Join(textWords(lower), " ") + " "
+	for _, word := range words {
+		if strings.Contains(joined, " "+strings.Join(textWords(word), " ")+" ") {
+			return true
+		}
+	}
+	return false
+}
+
+func textWords(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool { return !unicode.IsLetter(r) })
+}
+
+func containsAny(s string, substrs []string) bool {
+	for _, sub := range substrs {
+		if strings.Contains(s, sub) {
+			return true
+		}
+	}
+	return false
+}
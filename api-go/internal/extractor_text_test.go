@@ -0,0 +1,85 @@
+package internal
+
+import (
+	"os"
+	"testing"
+)
+
+func TestTextExtractor(t *testing.T) {
+	type item struct {
+		description string
+		amount      Money
+	}
+	tests := []struct {
+		file      string
+		vendor    string
+		amount    Money
+		currency  string
+		tax       Money
+		discount  Money
+		date      string
+		hsaStatus string
+		items     []item
+	}{
+		{
+			// A leading ITEMS heading, "Taxi" and "Total items: 3" do not
+			// end the items; the subtotal does
+			file: "pharmacy.txt", vendor: "Main Street Pharmacy", amount: 2349, currency: "USD",
+			tax: 100, discount: 100, date: "03/14/2025", hsaStatus: HSAStatusYes,
+			items: []item{{"Rx #448812 Amoxicillin", 1250}, {"Bandages 30 ct", 499}, {"Taxi voucher", 600}},
+		},
+		{
+			file: "grocery.txt", vendor: "Corner Grocery", amount: 550, currency: "",
+			tax: 0, discount: 50, date: "01/07/2025", hsaStatus: HSAStatusNo,
+			items: []item{{"Apples", 320}, {"Bread", 280}},
+		},
+	}
+
+	e := NewTextExtractor()
+	for _, tt := range tests {
+		data, err := os.ReadFile("testdata/receipts/" + tt.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := e.Extract(tt.file, data)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.file, err)
+		}
+
+		if result.Vendor != tt.vendor {
+			t.Errorf("%s: vendor %q, want %q", tt.file, result.Vendor, tt.vendor)
+		}
+		if result.Amount != tt.amount || result.Currency != tt.currency {
+			t.Errorf("%s: total %s %s, want %s %s", tt.file, result.Amount, result.Currency, tt.amount, tt.currency)
+		}
+		if result.Tax != tt.tax || result.Discount != tt.discount {
+			t.Errorf("%s: tax %s, discount %s; want %s, %s", tt.file, result.Tax, result.Discount, tt.tax, tt.discount)
+		}
+		if result.Date != tt.date {
+			t.Errorf("%s: date %q, want %q", tt.file, result.Date, tt.date)
+		}
+		if result.HSAStatus != tt.hsaStatus || result.HSAQualified != (tt.hsaStatus == HSAStatusYes) {
+			t.Errorf("%s: status %s, qualified %v; want %s", tt.file, result.HSAStatus, result.HSAQualified, tt.hsaStatus)
+		}
+
+		if len(result.Items) != len(tt.items) {
+			t.Errorf("%s: items %+v, want %v", tt.file, result.Items, tt.items)
+			continue
+		}
+		for i, want := range tt.items {
+			got := result.Items[i]
+			if got.Description != want.description || got.Amount == nil || *got.Amount != want.amount || got.Quantity != 1 {
+				t.Errorf("%s: item %d is %q %v, want %q %s", tt.file, i, got.Description, got.Amount, want.description, want.amount)
+			}
+		}
+	}
+}
+
+func TestTextExtractorRejectsBinary(t *testing.T) {
+	e := NewTextExtractor()
+	for _, data := range [][]byte{testPNG(t, 8, 8), {0xff, 0xfe, 'a'}, []byte("TOTAL\x00 1.00")} {
+		if _, err := e.Extract("receipt", data); err != ErrNotText {
+			t.Errorf("Extract(%q) = %v, want ErrNotText", data[:min(len(data), 8)], err)
+		}
+	}
+}
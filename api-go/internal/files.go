@@ -0,0 +1,246 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// receiptBlobPrefix holds every receipt file, named by content hash
+const receiptBlobPrefix = "blobs/"
+
+// receiptURLExpiry is how long a presigned receipt download URL stays valid
+const receiptURLExpiry = 15 * time.Minute
+
+// ReceiptBlobKey is the storage key for a receipt file with the given
+// SHA-256: blobs/ab/ab12...ef.jpg. The extension of the uploaded filename is
+// kept so the content type can be served without a lookup.
+func ReceiptBlobKey(imageHash string, filename string) string {
+	ext := strings.ToLower(path.Ext(filename))
+	if len(ext) > 8 || strings.ContainsAny(ext, `/\`) {
+		ext = ""
+	}
+	return receiptBlobPrefix + imageHash[:2] + "/" + imageHash + ext
+}
+
+// IsReceiptBlobKey reports whether imagePath is already content addressed
+func IsReceiptBlobKey(imagePath string) bool {
+	return strings.HasPrefix(imagePath, receiptBlobPrefix)
+}
+
+// ReceiptKey maps a receipt's image_path to its storage key. Receipts saved
+// before storage was pluggable hold absolute paths under ReceiptDir.
+func (s *Server) ReceiptKey(imagePath string) string {
+	if s.ReceiptDir != "" && filepath.IsAbs(imagePath) {
+		rel, err := filepath.Rel(s.ReceiptDir, imagePath)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return filepath.ToSlash(rel)
+		}
+	}
+	return imagePath
+}
+
+// StoreReceiptFile saves an uploaded file under its content key and returns
+// the key. Identical files share one blob, so an existing blob is kept. The
+// blob stays locked against DeleteReceiptFile until the caller, having
+// saved the row that references it, calls unlock.
+func (s *Server) StoreReceiptFile(imageHash string, filename string, data []byte) (key string, unlock func(), err error) {
+	key = ReceiptBlobKey(imageHash, filename)
+	unlock, err = s.DB.LockStoredFile(key)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if _, err := s.Store.Stat(key); err == nil {
+		return key, unlock, nil
+	} else if err != ErrBlobNotFound {
+		unlock()
+		return "", nil, err
+	}
+
+	if err := s.Store.Put(key, bytes.NewReader(data), int64(len(data)), ContentTypeForKey(key)); err != nil {
+		unlock()
+		return "", nil, err
+	}
+	return key, unlock, nil
+}
+
+// ReadReceiptFile reads a receipt's stored file
+func (s *Server) ReadReceiptFile(imagePath string) ([]byte, error) {
+	file, _, err := s.Store.Get(s.ReceiptKey(imagePath))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
+
+// ServeStoredFile sends a stored receipt or attachment file, named filename
+// when it is not empty. With PresignDownloads the client is redirected to
+// fetch it from object storage directly.
+func (s *Server) ServeStoredFile(w http.ResponseWriter, r *http.Request, key, contentType, filename string) {
+	// Let the client fetch straight from object storage when it can
+	if s.PresignDownloads {
+		url, err := s.Store.PresignGet(key, receiptURLExpiry)
+		if err == nil {
+			http.Redirect(w, r, url, http.StatusFound)
+			return
+		}
+		if err != ErrPresignUnsupported {
+			log.Printf("Failed to presign receipt file %s: %v", key, err)
+		}
+	}
+
+	file, info, err := s.Store.Get(key)
+	if err == ErrBlobNotFound {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to read receipt file %s: %v", key, err)
+		http.Error(w, "Failed to read file", http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	w.Header().Set("Content-Type", contentType)
+	if filename != "" {
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": filename}))
+	}
+
+	// Local files support range requests and conditional GETs
+	if seeker, ok := file.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, path.Base(key), info.ModTime, seeker)
+		return
+	}
+
+	if info.Size >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	}
+	if _, err := io.Copy(w, file); err != nil {
+		log.Printf("Failed to send receipt file %s: %v", key, err)
+	}
+}
+
+// DeleteReceiptFile removes a deleted receipt's file unless another receipt
+// (e.g. the same upload in another household) still references it
+func (s *Server) DeleteReceiptFile(imagePath string) error {
+	if imagePath == "" {
+		return nil
+	}
+
+	// An upload reusing the file holds the lock until its row is saved
+	unlock, err := s.DB.LockStoredFile(imagePath)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	inUse, err := s.DB.ImagePathInUse(imagePath)
+	if err != nil {
+		return err
+	}
+	if inUse {
+		return nil
+	}
+	return s.Store.Delete(s.ReceiptKey(imagePath))
+}
+
+// MigrateReceiptFiles moves files stored under the old used/<year> and
+// unused/<year> layout to their content keys and updates image_path. It is
+// safe to run repeatedly; missing files are logged and left for fsck.
+func (s *Server) MigrateReceiptFiles() (int, error) {
+	receipts, err := s.DB.GetReceiptsWithFiles(0)
+	if err != nil {
+		return 0, err
+	}
+
+	migrated := 0
+	for _, r := range receipts {
+		if IsReceiptBlobKey(r.ImagePath) {
+			continue
+		}
+
+		oldKey := s.ReceiptKey(r.ImagePath)
+		hash := r.ImageHash
+		if len(hash) != sha256.Size*2 {
+			if hash, err = s.hashStoredFile(oldKey); err != nil {
+				log.Printf("Warning: Cannot re-key receipt %d file %s: %v", r.ID, r.ImagePath, err)
+				continue
+			}
+		}
+		newKey := ReceiptBlobKey(hash, r.ImagePath)
+
+		err = s.rekeyReceiptFile(r, oldKey, newKey, true)
+		if err == ErrBlobNotFound {
+			log.Printf("Warning: Receipt %d file %s is missing, not re-keying it", r.ID, r.ImagePath)
+			continue
+		}
+		if err != nil {
+			return migrated, fmt.Errorf("failed to re-key receipt %d file: %v", r.ID, err)
+		}
+		migrated++
+	}
+
+	return migrated, nil
+}
+
+// rekeyReceiptFile copies a receipt's file from oldKey to newKey, unless a
+// blob is already there (identical content was stored first), and points the
+// receipt at it. The old file is deleted only after the row is updated, only
+// when deleteOld is set and, like any deleted file, only when nothing else
+// references it.
+func (s *Server) rekeyReceiptFile(r Receipt, oldKey, newKey string, deleteOld bool) error {
+	if err := s.moveReceiptFile(r, oldKey, newKey); err != nil {
+		return err
+	}
+	if deleteOld && oldKey != newKey {
+		if err := s.DeleteReceiptFile(oldKey); err != nil {
+			log.Printf("Warning: Failed to delete old receipt file %s: %v", oldKey, err)
+		}
+	}
+	return nil
+}
+
+// moveReceiptFile copies the file to newKey and updates the receipt under
+// newKey's lock, as StoreReceiptFile does for uploads
+func (s *Server) moveReceiptFile(r Receipt, oldKey, newKey string) error {
+	unlock, err := s.DB.LockStoredFile(newKey)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if _, err := s.Store.Stat(newKey); err == ErrBlobNotFound {
+		if err := s.Store.Copy(oldKey, newKey); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	return s.DB.SetReceiptImagePath(r.ID, newKey)
+}
+
+func (s *Server) hashStoredFile(key string) (string, error) {
+	file, _, err := s.Store.Get(key)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,58 @@
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeleteReceiptFileWaitsForUpload(t *testing.T) {
+	db, householdID := testDatabase(t)
+	s := testOCRServer(t, db)
+	data := []byte("shared scan")
+	old, _ := createTestPendingReceipt(t, s, householdID, "scan.jpg", data, 1)
+	if err := db.DeleteReceipt(householdID, old.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// An upload of the same file reuses the blob and holds its lock
+	key, unlock, err := s.StoreReceiptFile(old.ImageHash, "scan.jpg", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != old.ImagePath {
+		t.Fatalf("stored as %s, want the existing blob %s", key, old.ImagePath)
+	}
+
+	// so deleting the old receipt's file waits for its row
+	deleted := make(chan error)
+	go func() { deleted <- s.DeleteReceiptFile(old.ImagePath) }()
+	select {
+	case err := <-deleted:
+		t.Fatalf("deleted the file while an upload was reusing it: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	receipt := *old
+	receipt.ID = 0
+	if _, err := db.CreatePendingReceipt(&receipt, 1); err != nil {
+		t.Fatal(err)
+	}
+	unlock()
+	if err := <-deleted; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Store.Stat(key); err != nil {
+		t.Fatalf("the new receipt's file: %v", err)
+	}
+
+	// Once nothing references it, the file is deleted
+	if err := db.DeleteReceipt(householdID, receipt.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteReceiptFile(key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Store.Stat(key); err != ErrBlobNotFound {
+		t.Fatalf("the unreferenced file: %v", err)
+	}
+}
@@ -0,0 +1,357 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Kinds of inconsistency between the receipts table and the store
+const (
+	FsckMissingFile   = "missing_file"   // image_path or an attachment points at nothing
+	FsckOrphanedFile  = "orphaned_file"  // a stored file nothing references
+	FsckHashMismatch  = "hash_mismatch"  // the file's SHA-256 is not the recorded hash
+	FsckMisplacedFile = "misplaced_file" // the file is not at its content key
+)
+
+// fsckPrefixes are the parts of the store that hold receipt files: blobs/
+// and the used/ and unused/ trees of the layout before content addressing.
+// Anything else (an export view, lost+found/) is left alone.
+var fsckPrefixes = []string{receiptBlobPrefix, "used/", "unused/"}
+
+// fsckLostAndFound receives orphaned files on repair instead of deleting them
+const fsckLostAndFound = "lost+found/"
+
+// fsckOrphanGrace protects fresh uploads, whose file is stored before the
+// receipt row exists, from being reported or moved as orphans
+const fsckOrphanGrace = time.Hour
+
+// FsckOptions controls CheckStorage
+type FsckOptions struct {
+	Repair bool
+	// VerifyHashes reads every file to compare it with image_hash. Without
+	// it only existence and placement are checked, and repair still hashes
+	// any file it is about to move.
+	VerifyHashes bool
+}
+
+// FsckIssue is one inconsistency. Repair describes what repair mode did
+// about it and is empty when the issue was left alone.
+type FsckIssue struct {
+	Kind         string `json:"kind"`
+	ReceiptID    int    `json:"receipt_id,omitempty"`
+	AttachmentID int    `json:"attachment_id,omitempty"`
+	HouseholdID  int    `json:"household_id,omitempty"`
+	Key          string `json:"key"`
+	Detail       string `json:"detail"`
+	Repair       string `json:"repair,omitempty"`
+}
+
+// FsckReport is the result of CheckStorage
+type FsckReport struct {
+	Repair          bool        `json:"repair"`
+	ReceiptsChecked int         `json:"receipts_checked"`
+	FilesChecked    int         `json:"files_checked"`
+	Issues          []FsckIssue `json:"issues"`
+	Repaired        int         `json:"repaired"`
+}
+
+// Unrepaired counts the issues still outstanding
+func (r *FsckReport) Unrepaired() int {
+	return len(r.Issues) - r.Repaired
+}
+
+// fsck holds the state of one CheckStorage run
+type fsck struct {
+	s      *Server
+	opts   FsckOptions
+	report *FsckReport
+
+	files  map[string]BlobInfo
+	refs   map[string]int    // receipts and attachments referencing each key
+	hashes map[string]string // SHA-256 of files read so far
+}
+
+// CheckStorage reconciles the receipts table with the files in the store.
+// It reports receipts whose file is missing, files no receipt references,
+// files whose content does not match image_hash, and files that are not at
+// their content key (e.g. still in the old used/<year> folders). With
+// Repair it re-keys misplaced files, points receipts with a missing file at
+// an identical stored file when there is one, and moves orphans older than
+// an hour to lost+found/. Hash mismatches are only reported, since there is
+// no telling whether the file or the database is wrong. The files of
+// attachments other than receipt files are checked too, but not repaired.
+func (s *Server) CheckStorage(opts FsckOptions) (*FsckReport, error) {
+	c := &fsck{
+		s:      s,
+		opts:   opts,
+		report: &FsckReport{Repair: opts.Repair, Issues: []FsckIssue{}},
+		files:  map[string]BlobInfo{},
+		refs:   map[string]int{},
+		hashes: map[string]string{},
+	}
+
+	for _, prefix := range fsckPrefixes {
+		err := s.Store.List(prefix, func(info BlobInfo) error {
+			c.files[info.Key] = info
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list stored files: %v", err)
+		}
+	}
+	c.report.FilesChecked = len(c.files)
+
+	receipts, err := s.DB.GetReceiptsWithFiles(0)
+	if err != nil {
+		return nil, err
+	}
+	c.report.ReceiptsChecked = len(receipts)
+	for _, r := range receipts {
+		c.refs[s.ReceiptKey(r.ImagePath)]++
+	}
+	attachments, err := s.DB.GetSecondaryAttachments(0)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range attachments {
+		c.refs[s.ReceiptKey(a.StorageKey)]++
+	}
+
+	for _, r := range receipts {
+		if err := c.checkReceipt(r); err != nil {
+			return nil, err
+		}
+	}
+	for _, a := range attachments {
+		if err := c.checkAttachment(a); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.checkOrphans(); err != nil {
+		return nil, err
+	}
+
+	for _, issue := range c.report.Issues {
+		if issue.Repair != "" {
+			c.report.Repaired++
+		}
+	}
+	return c.report, nil
+}
+
+func (c *fsck) add(issue FsckIssue) *FsckIssue {
+	c.report.Issues = append(c.report.Issues, issue)
+	return &c.report.Issues[len(c.report.Issues)-1]
+}
+
+// hash returns the SHA-256 of a stored file, reading it at most once
+func (c *fsck) hash(key string) (string, error) {
+	if h, ok := c.hashes[key]; ok {
+		return h, nil
+	}
+	h, err := c.s.hashStoredFile(key)
+	if err != nil {
+		return "", err
+	}
+	c.hashes[key] = h
+	return h, nil
+}
+
+func (c *fsck) checkReceipt(r Receipt) error {
+	key := c.s.ReceiptKey(r.ImagePath)
+	if _, ok := c.files[key]; !ok {
+		return c.repairMissing(r, key)
+	}
+
+	if c.opts.VerifyHashes {
+		actual, err := c.hash(key)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %v", key, err)
+		}
+		if actual != r.ImageHash {
+			c.add(FsckIssue{Kind: FsckHashMismatch, ReceiptID: r.ID, HouseholdID: r.HouseholdID, Key: key,
+				Detail: fmt.Sprintf("file hashes to %s, receipt expects %s", actual, r.ImageHash)})
+			return nil
+		}
+	}
+
+	if len(r.ImageHash) < 2 {
+		return nil
+	}
+	expected := ReceiptBlobKey(r.ImageHash, key)
+	if key == expected {
+		return nil
+	}
+
+	issue := c.add(FsckIssue{Kind: FsckMisplacedFile, ReceiptID: r.ID, HouseholdID: r.HouseholdID, Key: key,
+		Detail: "expected at " + expected})
+	if !c.opts.Repair {
+		return nil
+	}
+
+	// Never file content under a hash it does not have
+	actual, err := c.hash(key)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", key, err)
+	}
+	if actual != r.ImageHash {
+		issue.Kind = FsckHashMismatch
+		issue.Detail = fmt.Sprintf("file hashes to %s, receipt expects %s", actual, r.ImageHash)
+		return nil
+	}
+
+	c.refs[key]--
+	if err := c.s.rekeyReceiptFile(r, key, expected, c.refs[key] == 0); err != nil {
+		return fmt.Errorf("failed to move receipt %d file: %v", r.ID, err)
+	}
+	c.refs[expected]++
+	if c.refs[key] == 0 {
+		delete(c.files, key)
+	}
+	c.files[expected] = BlobInfo{Key: expected}
+	c.hashes[expected] = actual
+	issue.Repair = "moved to " + expected
+	return nil
+}
+
+// checkAttachment reports an attachment whose file is missing or, with
+// VerifyHashes, does not match its hash
+func (c *fsck) checkAttachment(a Attachment) error {
+	key := c.s.ReceiptKey(a.StorageKey)
+	if _, ok := c.files[key]; !ok {
+		c.add(FsckIssue{Kind: FsckMissingFile, ReceiptID: a.ReceiptID, AttachmentID: a.ID, Key: key,
+			Detail: "no stored file for the " + a.DocumentType + " attachment"})
+		return nil
+	}
+	if !c.opts.VerifyHashes {
+		return nil
+	}
+
+	actual, err := c.hash(key)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", key, err)
+	}
+	if actual != a.FileHash {
+		c.add(FsckIssue{Kind: FsckHashMismatch, ReceiptID: a.ReceiptID, AttachmentID: a.ID, Key: key,
+			Detail: fmt.Sprintf("file hashes to %s, attachment expects %s", actual, a.FileHash)})
+	}
+	return nil
+}
+
+// repairMissing reports a receipt without a file and, in repair mode, looks
+// for a stored file with the receipt's hash: its content key, or an orphan
+func (c *fsck) repairMissing(r Receipt, key string) error {
+	issue := c.add(FsckIssue{Kind: FsckMissingFile, ReceiptID: r.ID, HouseholdID: r.HouseholdID, Key: key,
+		Detail: "no stored file"})
+	if !c.opts.Repair || len(r.ImageHash) < 2 {
+		return nil
+	}
+
+	expected := ReceiptBlobKey(r.ImageHash, key)
+	source := ""
+	if _, ok := c.files[expected]; ok {
+		source = expected
+	} else {
+		for _, orphan := range c.sortedOrphans() {
+			h, err := c.hash(orphan)
+			if err != nil {
+				return fmt.Errorf("failed to read %s: %v", orphan, err)
+			}
+			if h == r.ImageHash {
+				source = orphan
+				break
+			}
+		}
+	}
+	if source == "" {
+		return nil
+	}
+
+	c.refs[key]--
+	if err := c.s.rekeyReceiptFile(r, source, expected, c.refs[source] == 0); err != nil {
+		return fmt.Errorf("failed to relink receipt %d file: %v", r.ID, err)
+	}
+	if c.refs[source] == 0 && source != expected {
+		delete(c.files, source)
+	}
+	c.refs[expected]++
+	c.files[expected] = BlobInfo{Key: expected}
+	c.hashes[expected] = r.ImageHash
+
+	issue.Repair = "relinked to " + expected
+	if source != expected {
+		issue.Repair = fmt.Sprintf("relinked to %s (found at %s)", expected, source)
+	}
+	return nil
+}
+
+// sortedOrphans lists the stored files no receipt references
+func (c *fsck) sortedOrphans() []string {
+	var orphans []string
+	for key := range c.files {
+		if c.refs[key] == 0 {
+			orphans = append(orphans, key)
+		}
+	}
+	sort.Strings(orphans)
+	return orphans
+}
+
+func (c *fsck) checkOrphans() error {
+	cutoff := time.Now().Add(-fsckOrphanGrace)
+	for _, key := range c.sortedOrphans() {
+		info := c.files[key]
+		issue := c.add(FsckIssue{Kind: FsckOrphanedFile, Key: key,
+			Detail: fmt.Sprintf("%d bytes, not referenced by any receipt or attachment", info.Size)})
+
+		if info.ModTime.After(cutoff) {
+			issue.Detail += "; modified within the last hour, may be an upload in progress"
+			continue
+		}
+		if !c.opts.Repair {
+			continue
+		}
+
+		target := fsckLostAndFound + key
+		if err := c.s.Store.Move(key, target); err != nil {
+			return fmt.Errorf("failed to move orphan %s: %v", key, err)
+		}
+		issue.Repair = "moved to " + target
+	}
+	return nil
+}
+
+// FsckHandler checks receipt storage (GET) or checks and repairs it (POST).
+// It spans every household, so it is limited to the server's admin users.
+// ?hashes=false skips reading every file.
+func (s *Server) FsckHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.IsAdmin(CurrentUser(r)) {
+		http.Error(w, "Only server administrators can check storage", http.StatusForbidden)
+		return
+	}
+
+	opts := FsckOptions{VerifyHashes: !strings.EqualFold(r.URL.Query().Get("hashes"), "false")}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		opts.Repair = true
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	report, err := s.CheckStorage(opts)
+	if err != nil {
+		log.Printf("Storage check failed: %v", err)
+		http.Error(w, "Storage check failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -7,15 +7,39 @@ import (
 )
 
 type Server struct {
-    DB            *Database
-    OCRServiceURL string
-    ReceiptDir    string
-}
+    DB         *Database
+    Extractor  Extractor // reads receipts for the OCR jobs
+    ReceiptDir string
+    Store      BlobStore // receipt files, keyed by image_path
+
+    // Jobs runs background work such as OCR; nil in one-off commands
+    Jobs           *JobRunner
+    OCRMaxAttempts int
+
+    // DuplicateImageDistance is the largest perceptual hash distance at
+    // which an upload is flagged as a possible duplicate; -1 disables it
+    DuplicateImageDistance int
+
+    // MaxUploadSize bounds an upload request's body and MaxUploadFileSize
+    // each file in it, in bytes; 0 means no limit
+    MaxUploadSize     int64
+    MaxUploadFileSize int64
 
-const HOUSEHOLD_USER = "household"
+    // ReceiptEmailDomain is the domain of the members' receipt addresses
+    // when the SMTP receiver is enabled, "" otherwise
+    ReceiptEmailDomain string
+
+    // PresignDownloads redirects receipt file downloads to presigned URLs
+    // when Store supports them
+    PresignDownloads bool
+
+    AllowRegistration bool
+    AdminUsers        []string      // usernames allowed to use /api/admin
+    OIDC              *OIDCProvider // nil when single sign-on is not configured
+}
 
 func (s *Server) ListReceiptsHandler(w http.ResponseWriter, r *http.Request) {
-    receipts, err := s.DB.GetAllReceipts(HOUSEHOLD_USER)
+    receipts, err := s.DB.GetAllReceipts(CurrentMembership(r).HouseholdID, 0)
     if err != nil {
         log.Printf("Failed to get receipts: %v", err)
         http.Error(w, "Failed to get receipts", http.StatusInternalServerError)
@@ -26,40 +50,31 @@ func (s *Server) ListReceiptsHandler(w http.ResponseWriter, r *http.Request) {
     json.NewEncoder(w).Encode(receipts)
 }
 
+// DeductHandler suggests receipts covering a reimbursement amount using the
+// requested strategy and constraints
 func (s *Server) DeductHandler(w http.ResponseWriter, r *http.Request) {
-    var req struct {
-        UserID string  `json:"user_id"`
-        Amount float64 `json:"amount"`
-    }
+    var req DeductionRequest
     
     if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
         http.Error(w, "Invalid request", http.StatusBadRequest)
         return
     }
     
-    if req.UserID == "" {
-        req.UserID = HOUSEHOLD_USER
+    from, until, err := req.normalize()
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
     }
     
-    receipts, err := s.DB.GetEligibleReceipts(req.UserID)
+    receipts, err := s.DB.GetEligibleReceipts(CurrentMembership(r).HouseholdID, req.MemberID, req.Currency, from, until)
     if err != nil {
         log.Printf("Failed to get eligible receipts: %v", err)
         http.Error(w, "Failed to get receipts", http.StatusInternalServerError)
         return
     }
     
-    amounts := make([]float64, len(receipts))
-    for i, r := range receipts {
-        amounts[i] = r.TotalAmount
-    }
-    
-    indices := SubsetSum(amounts, req.Amount)
-    
-    selected := make([]Receipt, len(indices))
-    for i, idx := range indices {
-        selected[i] = receipts[idx]
-    }
+    plan := PlanDeduction(receipts, req)
     
     w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(selected)
-}
\ No newline at end of file
+    json.NewEncoder(w).Encode(plan)
+}
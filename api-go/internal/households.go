@@ -0,0 +1,894 @@
+package internal
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const memberColumns = `
+        m.id, m.household_id, m.user_id, u.username, m.email, m.name, m.role,
+        m.eligible_from, m.eligible_until, m.created_at, m.email_token,
+        m.invited_user_id, iu.username`
+
+// memberTables joins the member's account and any account invited to it
+const memberTables = `
+        FROM household_members m
+        LEFT JOIN users u ON u.id = m.user_id
+        LEFT JOIN users iu ON iu.id = m.invited_user_id`
+
+func scanMember(row rowScanner) (*HouseholdMember, error) {
+	var m HouseholdMember
+	err := row.Scan(&m.ID, &m.HouseholdID, &m.UserID, &m.Username, &m.Email, &m.Name, &m.Role,
+		&m.EligibleFrom, &m.EligibleUntil, &m.CreatedAt, &m.EmailToken,
+		&m.InvitedUserID, &m.InvitedUsername)
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func validRole(role string) bool {
+	return role == RoleOwner || role == RoleAdult || role == RoleViewer
+}
+
+// CreatePersonalHousehold creates a household owned by user, named after
+// them, and returns the owner's member record
+func (db *Database) CreatePersonalHousehold(user *User) (*HouseholdMember, error) {
+	return db.CreateHousehold(user, user.Username+"'s household")
+}
+
+// CreateHousehold creates a household owned by user and returns the owner's
+// member record. It becomes the user's default household if they belong to
+// no other.
+func (db *Database) CreateHousehold(user *User, name string) (*HouseholdMember, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var householdID int
+	err = tx.QueryRow("INSERT INTO households (name) VALUES ($1) RETURNING id", name).Scan(&householdID)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &HouseholdMember{HouseholdID: householdID, UserID: &user.ID, Username: &user.Username,
+		Name: user.Username, Role: RoleOwner}
+	err = tx.QueryRow(`
+        INSERT INTO household_members (household_id, user_id, name, role)
+        VALUES ($1, $2, $3, $4)
+        RETURNING id, created_at, email_token
+    `, householdID, user.ID, m.Name, m.Role).Scan(&m.ID, &m.CreatedAt, &m.EmailToken)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := pinDefaultHousehold(tx, user.ID); err != nil {
+		return nil, err
+	}
+
+	return m, tx.Commit()
+}
+
+// pinDefaultHousehold stores the household user's requests currently act on
+// as their default if they have none or no longer belong to it, so joining
+// another household never changes which one that is
+func pinDefaultHousehold(tx *sql.Tx, userID int) error {
+	_, err := tx.Exec(`
+        UPDATE users SET default_household_id = (
+            SELECT MIN(household_id) FROM household_members WHERE user_id = $1
+        )
+        WHERE id = $1 AND (default_household_id IS NULL OR default_household_id NOT IN (
+            SELECT household_id FROM household_members WHERE user_id = $1
+        ))
+    `, userID)
+	return err
+}
+
+// GetMembership returns user's member record in a household. householdID 0
+// selects the user's default household, or their oldest if they no longer
+// belong to it. Returns nil if the user is not a member.
+func (db *Database) GetMembership(userID int, householdID int) (*HouseholdMember, error) {
+	query := `
+        SELECT ` + memberColumns + memberTables + `
+        WHERE m.user_id = $1 AND ($2 = 0 OR m.household_id = $2)
+        ORDER BY COALESCE(m.household_id = u.default_household_id, false) DESC, m.household_id
+        LIMIT 1
+    `
+
+	m, err := scanMember(db.conn.QueryRow(query, userID, householdID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// ListHouseholds returns every household user belongs to, with the user's role
+// and which one is their default
+func (db *Database) ListHouseholds(userID int) ([]Household, error) {
+	query := `
+        SELECT h.id, h.name, h.created_at, m.role, COALESCE(h.id = u.default_household_id, false)
+        FROM households h
+        JOIN household_members m ON m.household_id = h.id
+        JOIN users u ON u.id = m.user_id
+        WHERE m.user_id = $1
+        ORDER BY h.id
+    `
+
+	rows, err := db.conn.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var households []Household
+	for rows.Next() {
+		var h Household
+		if err := rows.Scan(&h.ID, &h.Name, &h.CreatedAt, &h.Role, &h.Default); err != nil {
+			return nil, err
+		}
+		households = append(households, h)
+	}
+
+	return households, rows.Err()
+}
+
+// GetHousehold returns a household with its members
+func (db *Database) GetHousehold(householdID int) (*Household, error) {
+	var h Household
+	err := db.conn.QueryRow("SELECT id, name, created_at FROM households WHERE id = $1", householdID).
+		Scan(&h.ID, &h.Name, &h.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	members, err := db.GetMembers(householdID)
+	if err != nil {
+		return nil, err
+	}
+	h.Members = members
+
+	return &h, nil
+}
+
+// SetDefaultHousehold makes householdID the household user's requests act on
+// when none is selected. Returns sql.ErrNoRows if the user is not a member.
+func (db *Database) SetDefaultHousehold(userID int, householdID int) error {
+	result, err := db.conn.Exec(`
+        UPDATE users SET default_household_id = $1
+        WHERE id = $2 AND EXISTS (
+            SELECT 1 FROM household_members WHERE household_id = $1 AND user_id = $2
+        )
+    `, householdID, userID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (db *Database) RenameHousehold(householdID int, name string) error {
+	_, err := db.conn.Exec("UPDATE households SET name = $1 WHERE id = $2", name, householdID)
+	return err
+}
+
+func (db *Database) GetMembers(householdID int) ([]HouseholdMember, error) {
+	query := `
+        SELECT ` + memberColumns + memberTables + `
+        WHERE m.household_id = $1
+        ORDER BY m.id
+    `
+
+	rows, err := db.conn.Query(query, householdID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var members []HouseholdMember
+	for rows.Next() {
+		m, err := scanMember(rows)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, *m)
+	}
+
+	return members, rows.Err()
+}
+
+func (db *Database) GetMember(householdID int, memberID int) (*HouseholdMember, error) {
+	query := `
+        SELECT ` + memberColumns + memberTables + `
+        WHERE m.id = $1 AND m.household_id = $2
+    `
+
+	return scanMember(db.conn.QueryRow(query, memberID, householdID))
+}
+
+// GetMemberByEmailToken finds the member an emailed receipt is addressed to.
+// Returns nil if no member has the token.
+func (db *Database) GetMemberByEmailToken(token string) (*HouseholdMember, error) {
+	query := `
+        SELECT ` + memberColumns + memberTables + `
+        WHERE m.email_token = $1
+    `
+
+	m, err := scanMember(db.conn.QueryRow(query, strings.ToLower(token)))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func (db *Database) CreateMember(m *HouseholdMember) error {
+	query := `
+        INSERT INTO household_members (household_id, user_id, invited_user_id, email, name, role,
+                                       eligible_from, eligible_until)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+        RETURNING id, created_at, email_token
+    `
+
+	return db.conn.QueryRow(query, m.HouseholdID, m.UserID, m.InvitedUserID, m.Email, m.Name, m.Role,
+		m.EligibleFrom, m.EligibleUntil).Scan(&m.ID, &m.CreatedAt, &m.EmailToken)
+}
+
+// IsInvited reports whether user has a pending invitation to a household
+func (db *Database) IsInvited(userID int, householdID int) (bool, error) {
+	var invited bool
+	err := db.conn.QueryRow(`
+        SELECT EXISTS (
+            SELECT 1 FROM household_members WHERE household_id = $1 AND invited_user_id = $2
+        )
+    `, householdID, userID).Scan(&invited)
+	return invited, err
+}
+
+// ListInvitations returns user's pending household invitations, oldest first
+func (db *Database) ListInvitations(userID int) ([]Invitation, error) {
+	query := `
+        SELECT m.id, m.household_id, h.name, m.name, m.role, m.created_at
+        FROM household_members m
+        JOIN households h ON h.id = m.household_id
+        WHERE m.invited_user_id = $1
+        ORDER BY m.id
+    `
+
+	rows, err := db.conn.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invitations := []Invitation{}
+	for rows.Next() {
+		var inv Invitation
+		if err := rows.Scan(&inv.ID, &inv.HouseholdID, &inv.HouseholdName, &inv.Name, &inv.Role, &inv.CreatedAt); err != nil {
+			return nil, err
+		}
+		invitations = append(invitations, inv)
+	}
+
+	return invitations, rows.Err()
+}
+
+// AcceptInvitation links user to the member record they were invited to.
+// Their default household does not change unless they had none. Returns
+// sql.ErrNoRows if there is no such invitation or the user already belongs to
+// that household.
+func (db *Database) AcceptInvitation(userID int, memberID int) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := pinDefaultHousehold(tx, userID); err != nil {
+		return err
+	}
+
+	result, err := tx.Exec(`
+        UPDATE household_members m
+        SET user_id = $1, invited_user_id = NULL
+        WHERE m.id = $2 AND m.invited_user_id = $1
+          AND NOT EXISTS (
+              SELECT 1 FROM household_members o
+              WHERE o.household_id = m.household_id AND o.user_id = $1
+          )
+    `, userID, memberID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+
+	// Only does anything if this is the user's first household
+	if err := pinDefaultHousehold(tx, userID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// DeclineInvitation withdraws user from an invitation. The member record
+// stays as a dependent; its email is cleared so single sign-on does not offer
+// it again. Returns sql.ErrNoRows if there is no such invitation.
+func (db *Database) DeclineInvitation(userID int, memberID int) error {
+	result, err := db.conn.Exec(`
+        UPDATE household_members
+        SET invited_user_id = NULL, email = NULL
+        WHERE id = $1 AND invited_user_id = $2
+    `, memberID, userID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (db *Database) UpdateMember(m *HouseholdMember) error {
+	query := `
+        UPDATE household_members
+        SET name = $1, role = $2, eligible_from = $3, eligible_until = $4, email = $5
+        WHERE id = $6 AND household_id = $7
+    `
+
+	_, err := db.conn.Exec(query, m.Name, m.Role, m.EligibleFrom, m.EligibleUntil, m.Email, m.ID, m.HouseholdID)
+	return err
+}
+
+// DeleteMember removes a member; their receipts become unattributed
+func (db *Database) DeleteMember(householdID int, memberID int) error {
+	_, err := db.conn.Exec("DELETE FROM household_members WHERE id = $1 AND household_id = $2", memberID, householdID)
+	return err
+}
+
+func (db *Database) CountOwners(householdID int) (int, error) {
+	var count int
+	err := db.conn.QueryRow("SELECT COUNT(*) FROM household_members WHERE household_id = $1 AND role = $2 AND user_id IS NOT NULL",
+		householdID, RoleOwner).Scan(&count)
+	return count, err
+}
+
+// MemberSummary totals one member's receipts in one currency. MemberID is
+// nil for receipts not attributed to anyone.
+type MemberSummary struct {
+	MemberID       *int   `json:"member_id"`
+	Name           string `json:"name"`
+	Currency       string `json:"currency"`
+	ReceiptCount   int    `json:"receipt_count"`
+	QualifiedTotal Money  `json:"qualified_total"`
+	UsedTotal      Money  `json:"used_total"`
+	AvailableTotal Money  `json:"available_total"`
+}
+
+// GetMemberReport sums a household's qualified receipts per member. year 0
+// means all years.
+func (db *Database) GetMemberReport(householdID int, year int) ([]MemberSummary, error) {
+	query := `
+        SELECT r.member_id, COALESCE(m.name, 'Unassigned'), r.currency, COUNT(*),
+               COALESCE(SUM(r.qualified_amount), 0),
+               COALESCE(SUM(r.qualified_amount - r.remaining_amount), 0),
+               COALESCE(SUM(r.remaining_amount), 0)
+        FROM receipts r
+        LEFT JOIN household_members m ON m.id = r.member_id
+        WHERE r.household_id = $1
+          AND (r.hsa_status = 'Yes' OR r.hsa_status = 'Partially')
+          AND ($2 = 0 OR EXTRACT(YEAR FROM r.date) = $2)
+        GROUP BY r.member_id, m.name, r.currency
+        ORDER BY m.name NULLS LAST, r.currency
+    `
+
+	rows, err := db.conn.Query(query, householdID, year)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var summaries []MemberSummary
+	for rows.Next() {
+		var s MemberSummary
+		if err := rows.Scan(&s.MemberID, &s.Name, &s.Currency, &s.ReceiptCount, &s.QualifiedTotal,
+			&s.UsedTotal, &s.AvailableTotal); err != nil {
+			return nil, err
+		}
+		summaries = append(summaries, s)
+	}
+
+	return summaries, rows.Err()
+}
+
+// CurrentMembership returns the caller's member record in the household
+// selected for this request (see Authenticate)
+func CurrentMembership(r *http.Request) *HouseholdMember {
+	m, _ := r.Context().Value(membershipContextKey).(*HouseholdMember)
+	return m
+}
+
+// requestHouseholdID reads the household selected by the X-Household-ID
+// header or household_id query parameter; 0 means the default household
+func requestHouseholdID(r *http.Request) (int, error) {
+	value := r.Header.Get("X-Household-ID")
+	if value == "" {
+		value = r.URL.Query().Get("household_id")
+	}
+	if value == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(value)
+}
+
+// parseDate parses an optional YYYY-MM-DD date; empty means nil
+func parseDate(value *string) (*time.Time, error) {
+	if value == nil || *value == "" {
+		return nil, nil
+	}
+	t, err := time.Parse("2006-01-02", *value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid date %q, expected YYYY-MM-DD", *value)
+	}
+	return &t, nil
+}
+
+// HouseholdsHandler lists every household the caller belongs to (GET) or
+// creates one owned by the caller (POST)
+func (s *Server) HouseholdsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		s.createHousehold(w, r)
+		return
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	households, err := s.DB.ListHouseholds(CurrentUser(r).ID)
+	if err != nil {
+		log.Printf("Failed to list households: %v", err)
+		http.Error(w, "Failed to list households", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(households)
+}
+
+func (s *Server) createHousehold(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Name) == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	user := CurrentUser(r)
+	owner, err := s.DB.CreateHousehold(user, strings.TrimSpace(req.Name))
+	if err != nil {
+		log.Printf("Failed to create household: %v", err)
+		http.Error(w, "Failed to create household", http.StatusInternalServerError)
+		return
+	}
+	household, err := s.DB.GetHousehold(owner.HouseholdID)
+	if err != nil {
+		log.Printf("Failed to get household: %v", err)
+		http.Error(w, "Failed to get household", http.StatusInternalServerError)
+		return
+	}
+	household.Role = owner.Role
+
+	log.Printf("User %s created household %d", user.Username, household.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(household)
+}
+
+// DefaultHouseholdHandler sets (PUT) the household the caller's requests act
+// on when none is selected
+func (s *Server) DefaultHouseholdHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		HouseholdID int `json:"household_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.HouseholdID <= 0 {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	user := CurrentUser(r)
+	err := s.DB.SetDefaultHousehold(user.ID, req.HouseholdID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Not a member of this household", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to set default household: %v", err)
+		http.Error(w, "Failed to set default household", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":      "Default household updated",
+		"household_id": req.HouseholdID,
+	})
+}
+
+// InvitationsHandler lists the caller's pending household invitations
+func (s *Server) InvitationsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	invitations, err := s.DB.ListInvitations(CurrentUser(r).ID)
+	if err != nil {
+		log.Printf("Failed to list invitations: %v", err)
+		http.Error(w, "Failed to list invitations", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(invitations)
+}
+
+// InvitationByIDHandler accepts (POST /api/invitations/{id}/accept) or
+// declines (DELETE /api/invitations/{id}) a household invitation. Accepting
+// joins the household without changing the caller's default household.
+func (s *Server) InvitationByIDHandler(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/api/invitations/")
+	accept := strings.HasSuffix(path, "/accept")
+	id, err := strconv.Atoi(strings.TrimSuffix(path, "/accept"))
+	if err != nil {
+		http.Error(w, "Invalid invitation ID", http.StatusBadRequest)
+		return
+	}
+
+	user := CurrentUser(r)
+	switch {
+	case accept && r.Method == http.MethodPost:
+		err = s.DB.AcceptInvitation(user.ID, id)
+	case !accept && r.Method == http.MethodDelete:
+		err = s.DB.DeclineInvitation(user.ID, id)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err == sql.ErrNoRows {
+		http.Error(w, "Invitation not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to answer invitation: %v", err)
+		http.Error(w, "Failed to answer invitation", http.StatusInternalServerError)
+		return
+	}
+
+	message := "Invitation declined"
+	if accept {
+		message = "Invitation accepted"
+		log.Printf("User %s accepted invitation %d", user.Username, id)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": message})
+}
+
+// HouseholdHandler shows (GET) or renames (PUT) the current household
+func (s *Server) HouseholdHandler(w http.ResponseWriter, r *http.Request) {
+	membership := CurrentMembership(r)
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		if !membership.CanManage() {
+			http.Error(w, "Only household owners can rename the household", http.StatusForbidden)
+			return
+		}
+
+		var req struct {
+			Name string `json:"name"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Name) == "" {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err := s.DB.RenameHousehold(membership.HouseholdID, strings.TrimSpace(req.Name)); err != nil {
+			log.Printf("Failed to rename household: %v", err)
+			http.Error(w, "Failed to update household", http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	household, err := s.DB.GetHousehold(membership.HouseholdID)
+	if err != nil {
+		log.Printf("Failed to get household: %v", err)
+		http.Error(w, "Failed to get household", http.StatusInternalServerError)
+		return
+	}
+	household.Role = membership.Role
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(household)
+}
+
+type memberRequest struct {
+	Name          *string `json:"name"`
+	Username      *string `json:"username"`
+	Email         *string `json:"email"`
+	Role          *string `json:"role"`
+	EligibleFrom  *string `json:"eligible_from"`
+	EligibleUntil *string `json:"eligible_until"`
+}
+
+// apply copies the request fields that were set onto m
+func (req *memberRequest) apply(m *HouseholdMember) error {
+	if req.Name != nil {
+		m.Name = strings.TrimSpace(*req.Name)
+	}
+	if req.Email != nil {
+		if email := strings.ToLower(strings.TrimSpace(*req.Email)); email == "" {
+			m.Email = nil
+		} else if !strings.Contains(email, "@") {
+			return fmt.Errorf("invalid email address")
+		} else {
+			m.Email = &email
+		}
+	}
+	if req.Role != nil {
+		if !validRole(*req.Role) {
+			return fmt.Errorf("role must be one of %s, %s, %s", RoleOwner, RoleAdult, RoleViewer)
+		}
+		m.Role = *req.Role
+	}
+
+	var err error
+	if req.EligibleFrom != nil {
+		if m.EligibleFrom, err = parseDate(req.EligibleFrom); err != nil {
+			return err
+		}
+	}
+	if req.EligibleUntil != nil {
+		if m.EligibleUntil, err = parseDate(req.EligibleUntil); err != nil {
+			return err
+		}
+	}
+
+	if m.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if m.EligibleFrom != nil && m.EligibleUntil != nil && m.EligibleUntil.Before(*m.EligibleFrom) {
+		return fmt.Errorf("eligible_until is before eligible_from")
+	}
+	return nil
+}
+
+// MembersHandler lists (GET) or adds (POST) members of the current household.
+// A member with a username invites that account, which joins the household
+// once it accepts (see InvitationByIDHandler); one with only an email is an
+// invitation offered when that person signs in via single sign-on; one with
+// neither is a dependent.
+func (s *Server) MembersHandler(w http.ResponseWriter, r *http.Request) {
+	membership := CurrentMembership(r)
+
+	switch r.Method {
+	case http.MethodGet:
+		members, err := s.DB.GetMembers(membership.HouseholdID)
+		if err != nil {
+			log.Printf("Failed to get members: %v", err)
+			http.Error(w, "Failed to get members", http.StatusInternalServerError)
+			return
+		}
+		// Anyone who knows a receipt address can add receipts with it
+		if s.ReceiptEmailDomain != "" && membership.CanWrite() {
+			for i := range members {
+				members[i].ReceiptAddress = members[i].EmailToken + "@" + s.ReceiptEmailDomain
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(members)
+		return
+	case http.MethodPost:
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !membership.CanManage() {
+		http.Error(w, "Only household owners can add members", http.StatusForbidden)
+		return
+	}
+
+	var req memberRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	member := &HouseholdMember{HouseholdID: membership.HouseholdID, Role: RoleViewer}
+	if req.Username != nil && *req.Username != "" {
+		user, err := s.DB.GetUserByUsername(strings.ToLower(strings.TrimSpace(*req.Username)))
+		if err != nil {
+			log.Printf("Failed to look up user: %v", err)
+			http.Error(w, "Failed to add member", http.StatusInternalServerError)
+			return
+		}
+		if user == nil {
+			http.Error(w, "No account with that username", http.StatusNotFound)
+			return
+		}
+		if existing, err := s.DB.GetMembership(user.ID, membership.HouseholdID); err == nil && existing != nil {
+			http.Error(w, "That account is already a member", http.StatusConflict)
+			return
+		}
+		if invited, err := s.DB.IsInvited(user.ID, membership.HouseholdID); err == nil && invited {
+			http.Error(w, "That account has already been invited", http.StatusConflict)
+			return
+		}
+		member.InvitedUserID = &user.ID
+		member.InvitedUsername = &user.Username
+		member.Name = user.Username
+	}
+
+	if err := req.apply(member); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.DB.CreateMember(member); err != nil {
+		log.Printf("Failed to create member: %v", err)
+		http.Error(w, "Failed to add member", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Added member %q (id=%d, role=%s) to household %d", member.Name, member.ID, member.Role, member.HouseholdID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(member)
+}
+
+// MemberByIDHandler updates (PUT) or removes (DELETE) a household member
+func (s *Server) MemberByIDHandler(w http.ResponseWriter, r *http.Request) {
+	membership := CurrentMembership(r)
+
+	id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/api/household/members/"))
+	if err != nil {
+		http.Error(w, "Invalid member ID", http.StatusBadRequest)
+		return
+	}
+
+	if r.Method != http.MethodPut && r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !membership.CanManage() {
+		http.Error(w, "Only household owners can change members", http.StatusForbidden)
+		return
+	}
+
+	member, err := s.DB.GetMember(membership.HouseholdID, id)
+	if err != nil {
+		http.Error(w, "Member not found", http.StatusNotFound)
+		return
+	}
+
+	// Never leave a household without an owner who can log in
+	losingOwner := member.Role == RoleOwner && member.UserID != nil
+	if r.Method == http.MethodDelete {
+		if losingOwner && !s.hasOtherOwner(w, membership.HouseholdID) {
+			return
+		}
+		if err := s.DB.DeleteMember(membership.HouseholdID, id); err != nil {
+			log.Printf("Failed to delete member: %v", err)
+			http.Error(w, "Failed to remove member", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"message": "Member removed successfully"})
+		return
+	}
+
+	var req memberRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := req.apply(member); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if losingOwner && member.Role != RoleOwner && !s.hasOtherOwner(w, membership.HouseholdID) {
+		return
+	}
+
+	if err := s.DB.UpdateMember(member); err != nil {
+		log.Printf("Failed to update member: %v", err)
+		http.Error(w, "Failed to update member", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(member)
+}
+
+// hasOtherOwner writes an error and returns false if the household has only
+// one owner account
+func (s *Server) hasOtherOwner(w http.ResponseWriter, householdID int) bool {
+	owners, err := s.DB.CountOwners(householdID)
+	if err != nil {
+		log.Printf("Failed to count owners: %v", err)
+		http.Error(w, "Failed to update member", http.StatusInternalServerError)
+		return false
+	}
+	if owners < 2 {
+		http.Error(w, "A household needs at least one owner", http.StatusConflict)
+		return false
+	}
+	return true
+}
+
+// HouseholdReportHandler totals qualified, used and available amounts per
+// member, optionally for a single ?year=
+func (s *Server) HouseholdReportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	year := 0
+	if value := r.URL.Query().Get("year"); value != "" {
+		var err error
+		if year, err = strconv.Atoi(value); err != nil {
+			http.Error(w, "Invalid year", http.StatusBadRequest)
+			return
+		}
+	}
+
+	summaries, err := s.DB.GetMemberReport(CurrentMembership(r).HouseholdID, year)
+	if err != nil {
+		log.Printf("Failed to build member report: %v", err)
+		http.Error(w, "Failed to build report", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"year":    year,
+		"members": summaries,
+	})
+}
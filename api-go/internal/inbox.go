@@ -0,0 +1,244 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// inboxLockKey is the pg_advisory_lock key held while scanning the inbox,
+// so only one replica imports a file
+const inboxLockKey int64 = 0x6873615f696e62 // "hsa_inb"
+
+const (
+	// inboxSettle is how long a file must go unmodified before it is
+	// imported, so a scanner still writing it is not read half-way
+	inboxSettle = 10 * time.Second
+	// maxInboxFileSize is the largest file imported from the inbox
+	maxInboxFileSize = 256 << 20
+
+	inboxProcessedDir = "processed"
+	inboxFailedDir    = "failed"
+)
+
+// InboxConfig configures the watched inbox folder
+type InboxConfig struct {
+	Dir string
+	// Username owns the imported receipts, in HouseholdID or, when it is 0,
+	// the user's default household
+	Username     string
+	HouseholdID  int
+	PollInterval time.Duration
+}
+
+// InboxWatcher imports the files dropped into a folder, e.g. by a network
+// scanner, as receipts. Each file goes through the upload pipeline, then
+// moves to processed/, or to failed/ next to a .error.txt file saying why.
+// Files are only moved after their receipt is saved, so a restart imports
+// anything left behind again; the file hash check reports it as a duplicate
+// and it moves to processed/.
+type InboxWatcher struct {
+	s   *Server
+	cfg InboxConfig
+}
+
+func NewInboxWatcher(s *Server, cfg InboxConfig) *InboxWatcher {
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = 30 * time.Second
+	}
+	return &InboxWatcher{s: s, cfg: cfg}
+}
+
+// Start creates the inbox folders and scans the inbox in the background
+func (iw *InboxWatcher) Start() error {
+	for _, dir := range []string{iw.cfg.Dir, iw.dir(inboxProcessedDir), iw.dir(inboxFailedDir)} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+
+	go func() {
+		for {
+			if n, err := iw.Scan(); err != nil {
+				log.Printf("Failed to scan inbox %s: %v", iw.cfg.Dir, err)
+			} else if n > 0 {
+				log.Printf("Imported %d files from inbox %s", n, iw.cfg.Dir)
+			}
+			time.Sleep(iw.cfg.PollInterval)
+		}
+	}()
+	return nil
+}
+
+func (iw *InboxWatcher) dir(name string) string {
+	return filepath.Join(iw.cfg.Dir, name)
+}
+
+// Scan imports the settled files in the inbox and returns how many it
+// moved. It does nothing while another replica is scanning.
+func (iw *InboxWatcher) Scan() (int, error) {
+	ctx := context.Background()
+	conn, err := iw.s.DB.conn.Conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	var locked bool
+	if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", inboxLockKey).Scan(&locked); err != nil {
+		return 0, fmt.Errorf("failed to acquire inbox lock: %v", err)
+	}
+	if !locked {
+		return 0, nil
+	}
+	defer func() {
+		if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", inboxLockKey); err != nil {
+			log.Printf("Warning: Failed to release inbox lock: %v", err)
+		}
+	}()
+
+	entries, err := os.ReadDir(iw.cfg.Dir)
+	if err != nil {
+		return 0, err
+	}
+
+	var upload *ReceiptUpload
+	moved := 0
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Type().IsRegular() || inboxIgnored(name) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < inboxSettle {
+			continue
+		}
+
+		// Look the owner up once per scan, and only when there is work
+		if upload == nil {
+			if upload, err = iw.owner(); err != nil {
+				return moved, err
+			}
+		}
+
+		if err := iw.importFile(*upload, name, info.Size()); err != nil {
+			return moved, err
+		}
+		moved++
+	}
+	return moved, nil
+}
+
+// inboxIgnored skips hidden files and the temporary names scanners and
+// file copies write to before renaming
+func inboxIgnored(name string) bool {
+	lower := strings.ToLower(name)
+	return strings.HasPrefix(name, ".") || strings.HasPrefix(name, "~") ||
+		strings.HasSuffix(lower, ".tmp") || strings.HasSuffix(lower, ".part") ||
+		strings.HasSuffix(lower, ".crdownload") || strings.HasSuffix(lower, ".error.txt")
+}
+
+// owner is the upload template for the inbox's user and household
+func (iw *InboxWatcher) owner() (*ReceiptUpload, error) {
+	user, err := iw.s.DB.GetUserByUsername(iw.cfg.Username)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, fmt.Errorf("inbox user %q does not exist", iw.cfg.Username)
+	}
+	membership, err := iw.s.DB.GetMembership(user.ID, iw.cfg.HouseholdID)
+	if err != nil {
+		return nil, err
+	}
+	if membership == nil || !membership.CanWrite() {
+		return nil, fmt.Errorf("inbox user %q cannot add receipts to household %d", iw.cfg.Username, iw.cfg.HouseholdID)
+	}
+	return &ReceiptUpload{Username: user.Username, HouseholdID: membership.HouseholdID, MemberID: membership.ID}, nil
+}
+
+// importFile uploads one inbox file and moves it out of the inbox. Only a
+// failure to move the file is returned, since the file would otherwise be
+// imported again on every scan.
+func (iw *InboxWatcher) importFile(upload ReceiptUpload, name string, size int64) error {
+	source := filepath.Join(iw.cfg.Dir, name)
+	upload.Filename = name
+
+	var results []UploadResult
+	if size > maxInboxFileSize {
+		results = []UploadResult{{Filename: name, Status: UploadFailed,
+			Message: fmt.Sprintf("File is larger than %d MB", maxInboxFileSize>>20)}}
+	} else if data, err := os.ReadFile(source); err != nil {
+		log.Printf("Failed to read inbox file %s: %v", source, err)
+		results = []UploadResult{{Filename: name, Status: UploadFailed, Message: "Failed to read file"}}
+	} else {
+		upload.Data = data
+		results = iw.s.IngestUpload(upload)
+	}
+
+	failed := false
+	for _, result := range results {
+		if result.Status != UploadCreated && result.Status != UploadDuplicate {
+			failed = true
+		}
+	}
+
+	if !failed {
+		target := uniquePath(iw.dir(inboxProcessedDir), name)
+		if err := os.Rename(source, target); err != nil {
+			return fmt.Errorf("failed to move %s to %s: %v", source, target, err)
+		}
+		log.Printf("Imported inbox file %s", name)
+		return nil
+	}
+
+	target := uniquePath(iw.dir(inboxFailedDir), name)
+	if err := os.WriteFile(target+".error.txt", []byte(inboxErrorReport(results)), 0644); err != nil {
+		log.Printf("Warning: Failed to write error file for %s: %v", target, err)
+	}
+	if err := os.Rename(source, target); err != nil {
+		return fmt.Errorf("failed to move %s to %s: %v", source, target, err)
+	}
+	log.Printf("Inbox file %s failed to import, moved to %s", name, target)
+	return nil
+}
+
+// inboxErrorReport describes every file of a failed import, one per line
+func inboxErrorReport(results []UploadResult) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Import failed at %s\n\n", time.Now().Format(time.RFC3339))
+	for _, result := range results {
+		fmt.Fprintf(&b, "%s: %s: %s", result.Filename, result.Status, result.Message)
+		switch {
+		case result.ReceiptID != 0:
+			fmt.Fprintf(&b, " (receipt %d)", result.ReceiptID)
+		case result.Receipt != nil:
+			fmt.Fprintf(&b, " (receipt %d)", result.Receipt.ID)
+		case len(result.Matches) > 0:
+			ids := make([]string, len(result.Matches))
+			for i, match := range result.Matches {
+				ids[i] = fmt.Sprint(match.Receipt.ID)
+			}
+			fmt.Fprintf(&b, " (looks like receipt %s; upload it from the app to keep it anyway)", strings.Join(ids, ", "))
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// uniquePath is dir/name, or dir/name-2.ext, dir/name-3.ext and so on when
+// that file exists
+func uniquePath(dir, name string) string {
+	target := filepath.Join(dir, name)
+	ext := filepath.Ext(name)
+	for i := 2; ; i++ {
+		if _, err := os.Lstat(target); os.IsNotExist(err) {
+			return target
+		}
+		target = filepath.Join(dir, fmt.Sprintf("%s-%d%s", strings.TrimSuffix(name, ext), i, ext))
+	}
+}
@@ -0,0 +1,250 @@
+package internal
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+const receiptItemColumns = `
+        i.id, i.receipt_id, i.position, i.description, i.quantity, i.unit_price, i.amount, i.hsa_eligible, i.page`
+
+func scanReceiptItem(row rowScanner) (*ReceiptItem, error) {
+	var item ReceiptItem
+	err := row.Scan(&item.ID, &item.ReceiptID, &item.Position, &item.Description, &item.Quantity,
+		&item.UnitPrice, &item.Amount, &item.HSAEligible, &item.Page)
+	if err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+// ItemsHSAStatus derives a receipt's HSA status from its items: Yes when
+// every item is eligible, No when none is, Partially otherwise. qualified is
+// the eligible items' total and priced is false when an eligible item has no
+// amount, in which case the qualified amount cannot be derived.
+func ItemsHSAStatus(items []ReceiptItem) (status string, qualified Money, priced bool) {
+	eligible := 0
+	priced = true
+	for _, item := range items {
+		if !item.HSAEligible {
+			continue
+		}
+		eligible++
+		if item.Amount == nil {
+			priced = false
+		} else {
+			qualified += *item.Amount
+		}
+	}
+
+	switch eligible {
+	case len(items):
+		status = HSAStatusYes
+	case 0:
+		status = HSAStatusNo
+	default:
+		status = HSAStatusPartially
+	}
+	return status, qualified, priced
+}
+
+// GetReceiptItems returns a receipt's items in receipt order
+func (db *Database) GetReceiptItems(receiptID int) ([]ReceiptItem, error) {
+	query := `
+        SELECT ` + receiptItemColumns + `
+        FROM receipt_items i
+        WHERE i.receipt_id = $1
+        ORDER BY i.position, i.id
+    `
+
+	rows, err := db.conn.Query(query, receiptID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []ReceiptItem{}
+	for rows.Next() {
+		item, err := scanReceiptItem(rows)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, *item)
+	}
+
+	return items, rows.Err()
+}
+
+// replaceReceiptItems swaps a receipt's items for a new extraction's
+func replaceReceiptItems(tx *sql.Tx, receiptID int, items []ReceiptItem) error {
+	if _, err := tx.Exec("DELETE FROM receipt_items WHERE receipt_id = $1", receiptID); err != nil {
+		return err
+	}
+
+	for i := range items {
+		item := &items[i]
+		item.ReceiptID = receiptID
+		err := tx.QueryRow(`
+            INSERT INTO receipt_items (receipt_id, position, description, quantity, unit_price, amount, hsa_eligible, page)
+            VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+            RETURNING id
+        `, receiptID, item.Position, item.Description, item.Quantity, item.UnitPrice, item.Amount,
+			item.HSAEligible, item.Page).Scan(&item.ID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetReceiptItemsEligible marks every item of a receipt eligible or not, to
+// follow a receipt edited to Yes or No
+func (db *Database) SetReceiptItemsEligible(receiptID int, eligible bool) error {
+	_, err := db.conn.Exec("UPDATE receipt_items SET hsa_eligible = $1 WHERE receipt_id = $2", eligible, receiptID)
+	return err
+}
+
+// SetItemEligibility toggles one item and re-derives the receipt's HSA
+// status and qualified amount: the eligible items' sum for Partially when
+// every eligible item is priced, the original total for Yes and No. The
+// amount is changed by setQualifiedAmount. It returns the updated receipt
+// with its items, ErrQualifiedBelowClaimed, or sql.ErrNoRows.
+func (db *Database) SetItemEligibility(householdID int, receiptID int, itemID int, eligible bool) (*Receipt, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := `
+        SELECT ` + receiptColumns + `
+        FROM receipts r
+        WHERE r.id = $1 AND r.household_id = $2
+        FOR UPDATE
+    `
+	receipt, err := scanReceipt(tx.QueryRow(query, receiptID, householdID))
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := tx.Exec("UPDATE receipt_items SET hsa_eligible = $1 WHERE id = $2 AND receipt_id = $3",
+		eligible, itemID, receiptID)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return nil, sql.ErrNoRows
+	}
+
+	rows, err := tx.Query(`
+        SELECT `+receiptItemColumns+`
+        FROM receipt_items i
+        WHERE i.receipt_id = $1
+        ORDER BY i.position, i.id
+    `, receiptID)
+	if err != nil {
+		return nil, err
+	}
+	receipt.Items = []ReceiptItem{}
+	for rows.Next() {
+		item, err := scanReceiptItem(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		receipt.Items = append(receipt.Items, *item)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	status, qualified, priced := ItemsHSAStatus(receipt.Items)
+	if status != HSAStatusPartially {
+		qualified, priced = receipt.OriginalTotal, true
+	}
+
+	receipt.HSAStatus = status
+	receipt.HSAQualified = status != HSAStatusNo
+	_, err = tx.Exec("UPDATE receipts SET hsa_status = $1, hsa_qualified = $2 WHERE id = $3",
+		receipt.HSAStatus, receipt.HSAQualified, receipt.ID)
+	if err != nil {
+		return nil, err
+	}
+	if priced {
+		updated, err := setQualifiedAmount(tx, householdID, receiptID, qualified)
+		if err != nil {
+			return nil, err
+		}
+		updated.Items = receipt.Items
+		receipt = updated
+	}
+
+	return receipt, tx.Commit()
+}
+
+// ReceiptItemsHandler lists a receipt's items: GET /api/receipts/{id}/items
+func (s *Server) ReceiptItemsHandler(w http.ResponseWriter, r *http.Request, receiptID int) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if _, err := s.DB.GetReceiptByID(CurrentMembership(r).HouseholdID, receiptID); err != nil {
+		http.Error(w, "Receipt not found", http.StatusNotFound)
+		return
+	}
+
+	items, err := s.DB.GetReceiptItems(receiptID)
+	if err != nil {
+		log.Printf("Failed to get receipt items: %v", err)
+		http.Error(w, "Failed to get receipt items", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(items)
+}
+
+// ReceiptItemHandler toggles an item's HSA eligibility:
+// PUT /api/receipts/{id}/items/{item_id} with {"hsa_eligible": false}.
+// It responds with the receipt, whose status and qualified amount follow its
+// items.
+func (s *Server) ReceiptItemHandler(w http.ResponseWriter, r *http.Request, receiptID int, itemID int) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	membership := CurrentMembership(r)
+	if !membership.CanWrite() {
+		http.Error(w, "Viewers cannot change receipts", http.StatusForbidden)
+		return
+	}
+
+	var req struct {
+		HSAEligible *bool `json:"hsa_eligible"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.HSAEligible == nil {
+		http.Error(w, "hsa_eligible is required", http.StatusBadRequest)
+		return
+	}
+
+	receipt, err := s.DB.SetItemEligibility(membership.HouseholdID, receiptID, itemID, *req.HSAEligible)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Item not found", http.StatusNotFound)
+		return
+	} else if err == ErrQualifiedBelowClaimed {
+		http.Error(w, "More has been claimed from the receipt than its eligible items add up to; release the claims first", http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Printf("Failed to update receipt item: %v", err)
+		http.Error(w, "Failed to update receipt item", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(receipt)
+}
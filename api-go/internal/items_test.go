@@ -0,0 +1,76 @@
+package internal
+
+import (
+	"testing"
+)
+
+// testItem is an eligible item of one unit
+func testItem(description string, amount Money) ReceiptItem {
+	return ReceiptItem{Description: description, Quantity: 1, Amount: &amount, HSAEligible: true}
+}
+
+// addTestItems saves items on a receipt and returns them with their IDs
+func addTestItems(t *testing.T, db *Database, receipt *Receipt, items ...ReceiptItem) []ReceiptItem {
+	t.Helper()
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if err := replaceReceiptItems(tx, receipt.ID, items); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	saved, err := db.GetReceiptItems(receipt.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return saved
+}
+
+func TestSetItemEligibilityKeepsClaims(t *testing.T) {
+	db, householdID := testDatabase(t)
+	receipt := createTestReceipt(t, db, householdID, 5000)
+	items := addTestItems(t, db, receipt, testItem("Bandages", 3000), testItem("Gauze", 2000))
+
+	if err := db.UpdateReceipt(receipt, BalanceChange{ApplyAll: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Leaving less qualified than was claimed is refused, not clamped
+	_, err := db.SetItemEligibility(householdID, receipt.ID, items[1].ID, false)
+	if err != ErrQualifiedBelowClaimed {
+		t.Fatalf("toggling below the claimed amount: %v", err)
+	}
+	checkBalance(t, db, receipt, 5000, 0)
+	if saved, _ := db.GetReceiptItems(receipt.ID); !saved[1].HSAEligible {
+		t.Error("a refused toggle was saved")
+	}
+
+	if err := db.UpdateReceipt(receipt, BalanceChange{Release: true, Apply: 2000}); err != nil {
+		t.Fatal(err)
+	}
+	updated, err := db.SetItemEligibility(householdID, receipt.ID, items[1].ID, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.HSAStatus != HSAStatusPartially || updated.QualifiedAmount != 3000 || updated.RemainingAmount != 1000 {
+		t.Errorf("returned %s, qualified %s, remaining %s", updated.HSAStatus, updated.QualifiedAmount, updated.RemainingAmount)
+	}
+	checkBalance(t, db, receipt, 3000, 1000)
+
+	// Claiming the rest uses the receipt up; making the item eligible again
+	// gives it a balance to claim
+	if err := db.UpdateReceipt(updated, BalanceChange{ApplyAll: true}); err != nil {
+		t.Fatal(err)
+	}
+	checkBalance(t, db, receipt, 3000, 0)
+	if _, err := db.SetItemEligibility(householdID, receipt.ID, items[1].ID, true); err != nil {
+		t.Fatal(err)
+	}
+	checkBalance(t, db, receipt, 5000, 2000)
+}
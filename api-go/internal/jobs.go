@@ -0,0 +1,563 @@
+package internal
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Job kinds
+const (
+	JobKindOCR = "ocr"
+)
+
+// Job statuses. A failed attempt puts the job back in queued with a backoff
+// until max_attempts is reached; then it is dead-lettered.
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobDead      = "dead"
+)
+
+const (
+	// jobPollInterval is how often idle workers look for due jobs (retries
+	// become due without anyone calling Notify)
+	jobPollInterval = 5 * time.Second
+	// jobStaleAfter requeues running jobs whose worker has gone away
+	jobStaleAfter = 5 * time.Minute
+	// jobBackoffBase and jobBackoffMax bound the delay between attempts
+	jobBackoffBase = 15 * time.Second
+	jobBackoffMax  = time.Hour
+)
+
+// ErrJobActive is returned by RequeueOCR while the receipt's previous OCR
+// job has not finished
+var ErrJobActive = errors.New("an OCR job for this receipt is already queued or running")
+
+// ErrReceiptClaimed is returned by RequeueOCR for receipts that have been
+// used or partly reimbursed, whose amounts must not change under them
+var ErrReceiptClaimed = errors.New("receipt has already been used for a reimbursement")
+
+// Job is a unit of background work, persisted in the jobs table
+type Job struct {
+	ID          int             `json:"id"`
+	Kind        string          `json:"kind"`
+	HouseholdID int             `json:"household_id"`
+	ReceiptID   *int            `json:"receipt_id"`
+	Status      string          `json:"status"`
+	Attempts    int             `json:"attempts"`
+	MaxAttempts int             `json:"max_attempts"`
+	RunAt       time.Time       `json:"run_at"`
+	LastError   *string         `json:"last_error"`
+	Result      json.RawMessage `json:"result"`
+	CreatedAt   time.Time       `json:"created_at"`
+	UpdatedAt   time.Time       `json:"updated_at"`
+	FinishedAt  *time.Time      `json:"finished_at"`
+}
+
+const jobColumns = `
+        j.id, j.kind, j.household_id, j.receipt_id, j.status, j.attempts, j.max_attempts,
+        j.run_at, j.last_error, j.result, j.created_at, j.updated_at, j.finished_at`
+
+func scanJob(row rowScanner) (*Job, error) {
+	var j Job
+	var result []byte
+	err := row.Scan(&j.ID, &j.Kind, &j.HouseholdID, &j.ReceiptID, &j.Status, &j.Attempts, &j.MaxAttempts,
+		&j.RunAt, &j.LastError, &result, &j.CreatedAt, &j.UpdatedAt, &j.FinishedAt)
+	if err != nil {
+		return nil, err
+	}
+	if len(result) > 0 {
+		j.Result = json.RawMessage(result)
+	}
+	return &j, nil
+}
+
+func enqueueJob(q queryRower, kind string, householdID int, receiptID *int, maxAttempts int) (*Job, error) {
+	query := `
+        INSERT INTO jobs AS j (kind, household_id, receipt_id, status, max_attempts, run_at, created_at, updated_at)
+        VALUES ($1, $2, $3, 'queued', $4, NOW(), NOW(), NOW())
+        RETURNING ` + jobColumns
+
+	return scanJob(q.QueryRow(query, kind, householdID, receiptID, maxAttempts))
+}
+
+// CreatePendingReceipt saves a receipt awaiting OCR together with its OCR
+// job, so an upload never leaves a receipt without a job or a job without a
+// receipt
+func (db *Database) CreatePendingReceipt(receipt *Receipt, maxAttempts int) (*Job, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	receipt.OCRStatus = OCRStatusPending
+	if err := insertReceipt(tx, receipt); err != nil {
+		return nil, err
+	}
+
+	job, err := enqueueJob(tx, JobKindOCR, receipt.HouseholdID, &receipt.ID, maxAttempts)
+	if err != nil {
+		return nil, err
+	}
+
+	return job, tx.Commit()
+}
+
+// RequeueOCR queues another OCR run for a receipt and marks it pending. It
+// returns sql.ErrNoRows, ErrJobActive or ErrReceiptClaimed.
+func (db *Database) RequeueOCR(householdID int, receiptID int, maxAttempts int) (*Job, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var used bool
+	var total, remaining Money
+	err = tx.QueryRow(`
+        SELECT used, qualified_amount, remaining_amount FROM receipts
+        WHERE id = $1 AND household_id = $2
+        FOR UPDATE
+    `, receiptID, householdID).Scan(&used, &total, &remaining)
+	if err != nil {
+		return nil, err
+	}
+	if used || remaining != total {
+		return nil, ErrReceiptClaimed
+	}
+
+	var active bool
+	err = tx.QueryRow("SELECT EXISTS (SELECT 1 FROM jobs WHERE receipt_id = $1 AND status IN ('queued', 'running'))",
+		receiptID).Scan(&active)
+	if err != nil {
+		return nil, err
+	}
+	if active {
+		return nil, ErrJobActive
+	}
+
+	if _, err := tx.Exec("UPDATE receipts SET ocr_status = $1 WHERE id = $2", OCRStatusPending, receiptID); err != nil {
+		return nil, err
+	}
+
+	job, err := enqueueJob(tx, JobKindOCR, householdID, &receiptID, maxAttempts)
+	if err != nil {
+		return nil, err
+	}
+
+	return job, tx.Commit()
+}
+
+// GetJob returns one of a household's jobs, or sql.ErrNoRows
+func (db *Database) GetJob(householdID int, id int) (*Job, error) {
+	query := `
+        SELECT ` + jobColumns + `
+        FROM jobs j
+        WHERE j.id = $1 AND j.household_id = $2
+    `
+
+	return scanJob(db.conn.QueryRow(query, id, householdID))
+}
+
+// ClaimJob marks the oldest due job running and returns it, or nil when
+// nothing is due. SKIP LOCKED lets any number of workers, in any number of
+// replicas, claim jobs without handing one out twice.
+func (db *Database) ClaimJob() (*Job, error) {
+	query := `
+        UPDATE jobs j
+        SET status = 'running', attempts = j.attempts + 1, locked_at = NOW(), updated_at = NOW()
+        WHERE j.id = (
+            SELECT id FROM jobs
+            WHERE status = 'queued' AND run_at <= NOW()
+            ORDER BY run_at, id
+            FOR UPDATE SKIP LOCKED
+            LIMIT 1
+        )
+        RETURNING ` + jobColumns
+
+	job, err := scanJob(db.conn.QueryRow(query))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return job, err
+}
+
+// CompleteOCRJob saves an OCR job's extraction, including any items, onto
+// its receipt, marks the receipt ready and the job succeeded, in one
+// transaction. The qualified amount is changed by setQualifiedAmount, so a
+// result qualifying for less than was claimed while OCR ran fails the job.
+func (db *Database) CompleteOCRJob(job *Job, receipt *Receipt, result interface{}) error {
+	resultJSON, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+        UPDATE receipts
+        SET vendor = $1, original_total = $2, tax_amount = $3, discount_amount = $4, currency = $5, date = $6,
+            hsa_qualified = $7, hsa_status = $8, raw_text = $9, ocr_status = $10, page_count = $11
+        WHERE id = $12
+    `, receipt.Vendor, receipt.OriginalTotal, receipt.TaxAmount, receipt.DiscountAmount, receipt.Currency,
+		receipt.Date, receipt.HSAQualified, receipt.HSAStatus, receipt.RawText, OCRStatusReady, receipt.PageCount,
+		receipt.ID)
+	if err != nil {
+		return err
+	}
+	if _, err := setQualifiedAmount(tx, receipt.HouseholdID, receipt.ID, receipt.QualifiedAmount); err != nil {
+		return err
+	}
+
+	if receipt.Items != nil {
+		if err := replaceReceiptItems(tx, receipt.ID, receipt.Items); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(`
+        UPDATE jobs
+        SET status = 'succeeded', result = $1, last_error = NULL, locked_at = NULL,
+            finished_at = NOW(), updated_at = NOW()
+        WHERE id = $2
+    `, string(resultJSON), job.ID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// FailJob records a failed attempt. The job is retried after a backoff
+// until it runs out of attempts; then it is dead-lettered and its receipt
+// marked ocr_failed. It reports whether the job is dead.
+func (db *Database) FailJob(job *Job, jobErr error) (bool, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	dead := job.Attempts >= job.MaxAttempts
+	if dead {
+		_, err = tx.Exec(`
+            UPDATE jobs
+            SET status = 'dead', last_error = $1, locked_at = NULL, finished_at = NOW(), updated_at = NOW()
+            WHERE id = $2
+        `, jobErr.Error(), job.ID)
+		if err == nil && job.ReceiptID != nil {
+			_, err = tx.Exec("UPDATE receipts SET ocr_status = $1 WHERE id = $2", OCRStatusFailed, *job.ReceiptID)
+		}
+	} else {
+		_, err = tx.Exec(`
+            UPDATE jobs
+            SET status = 'queued', last_error = $1, locked_at = NULL, run_at = $2, updated_at = NOW()
+            WHERE id = $3
+        `, jobErr.Error(), time.Now().Add(jobBackoff(job.Attempts)), job.ID)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return dead, tx.Commit()
+}
+
+// ReapStaleJobs requeues jobs left running by a worker that died (a crash or
+// a replica going away), or dead-letters them if that was their last attempt
+func (db *Database) ReapStaleJobs(staleAfter time.Duration) (int, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	cutoff := time.Now().Add(-staleAfter)
+	reason := "worker stopped before finishing the job"
+
+	requeued, err := tx.Exec(`
+        UPDATE jobs
+        SET status = 'queued', last_error = $1, locked_at = NULL, run_at = NOW(), updated_at = NOW()
+        WHERE status = 'running' AND locked_at < $2 AND attempts < max_attempts
+    `, reason, cutoff)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.Exec(`
+        UPDATE receipts r
+        SET ocr_status = $1
+        FROM jobs j
+        WHERE j.receipt_id = r.id AND j.status = 'running' AND j.locked_at < $2
+    `, OCRStatusFailed, cutoff)
+	if err != nil {
+		return 0, err
+	}
+
+	dead, err := tx.Exec(`
+        UPDATE jobs
+        SET status = 'dead', last_error = $1, locked_at = NULL, finished_at = NOW(), updated_at = NOW()
+        WHERE status = 'running' AND locked_at < $2
+    `, reason, cutoff)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	n1, _ := requeued.RowsAffected()
+	n2, _ := dead.RowsAffected()
+	return int(n1 + n2), nil
+}
+
+// jobBackoff is the delay before retrying after the given attempt:
+// 15s, 30s, 1m, 2m, ... up to an hour
+func jobBackoff(attempts int) time.Duration {
+	delay := jobBackoffBase
+	for i := 1; i < attempts && delay < jobBackoffMax; i++ {
+		delay *= 2
+	}
+	if delay > jobBackoffMax {
+		delay = jobBackoffMax
+	}
+	return delay
+}
+
+// JobRunner is a pool of workers processing the jobs table
+type JobRunner struct {
+	s       *Server
+	workers int
+	wake    chan struct{}
+}
+
+// NewJobRunner creates a runner with the given number of workers; Start
+// launches them
+func NewJobRunner(s *Server, workers int) *JobRunner {
+	if workers < 1 {
+		workers = 1
+	}
+	return &JobRunner{s: s, workers: workers, wake: make(chan struct{}, workers)}
+}
+
+// Start launches the workers and the stale-job reaper in the background
+func (jr *JobRunner) Start() {
+	for i := 0; i < jr.workers; i++ {
+		go jr.work()
+	}
+	go jr.reap()
+}
+
+// Notify wakes an idle worker after a job is enqueued, instead of waiting
+// for the next poll
+func (jr *JobRunner) Notify() {
+	if jr == nil {
+		return
+	}
+	select {
+	case jr.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (jr *JobRunner) work() {
+	for {
+		job, err := jr.s.DB.ClaimJob()
+		if err != nil {
+			log.Printf("Failed to claim job: %v", err)
+		}
+		if job == nil {
+			select {
+			case <-jr.wake:
+			case <-time.After(jobPollInterval):
+			}
+			continue
+		}
+		jr.run(job)
+	}
+}
+
+func (jr *JobRunner) run(job *Job) {
+	var err error
+	switch job.Kind {
+	case JobKindOCR:
+		err = jr.s.runOCRJob(job)
+	default:
+		err = fmt.Errorf("unknown job kind %q", job.Kind)
+	}
+
+	if err == nil {
+		log.Printf("Job %d (%s) succeeded on attempt %d", job.ID, job.Kind, job.Attempts)
+		return
+	}
+
+	dead, failErr := jr.s.DB.FailJob(job, err)
+	if failErr != nil {
+		log.Printf("Failed to record failure of job %d: %v", job.ID, failErr)
+		return
+	}
+	if dead {
+		log.Printf("Job %d (%s) failed for good after %d attempts: %v", job.ID, job.Kind, job.Attempts, err)
+	} else {
+		log.Printf("Job %d (%s) attempt %d failed, retrying in %s: %v",
+			job.ID, job.Kind, job.Attempts, jobBackoff(job.Attempts), err)
+	}
+}
+
+func (jr *JobRunner) reap() {
+	for {
+		if n, err := jr.s.DB.ReapStaleJobs(jobStaleAfter); err != nil {
+			log.Printf("Failed to reap stale jobs: %v", err)
+		} else if n > 0 {
+			log.Printf("Recovered %d stale jobs", n)
+		}
+		time.Sleep(jobStaleAfter / 2)
+	}
+}
+
+// runOCRJob reads a receipt's file, runs it through the Extractor,
+// classifies it with the active eligibility rules, gives the vendor its
+// canonical name and saves the result. A receipt that may duplicate others
+// is still saved; the job result ranks the candidates.
+func (s *Server) runOCRJob(job *Job) error {
+	if job.ReceiptID == nil {
+		return fmt.Errorf("OCR job has no receipt")
+	}
+	receipt, err := s.DB.GetReceiptByID(job.HouseholdID, *job.ReceiptID)
+	if err != nil {
+		return fmt.Errorf("failed to load receipt %d: %v", *job.ReceiptID, err)
+	}
+	// Items an extraction does not replace are classified again
+	if receipt.Items, err = s.DB.GetReceiptItems(receipt.ID); err != nil {
+		return fmt.Errorf("failed to load receipt items: %v", err)
+	}
+
+	data, err := s.ReadReceiptFile(receipt.ImagePath)
+	if err != nil {
+		return fmt.Errorf("failed to read receipt file: %v", err)
+	}
+
+	filename := receipt.OriginalName
+	if filename == "" {
+		filename = receipt.ImagePath
+	}
+	if pageCount, err := DocumentPageCount(receipt.ImagePath, data); err == nil {
+		receipt.PageCount = pageCount
+	}
+	ocrResult, err := s.Extractor.Extract(filename, data)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("OCR Result for receipt %d: Vendor=%s, Amount=%s %s, Date=%s, HSAStatus=%s",
+		receipt.ID, ocrResult.Vendor, ocrResult.Amount, ocrResult.Currency, ocrResult.Date, ocrResult.HSAStatus)
+
+	result := OCRJobResult{OCRResult: *ocrResult}
+	result.Warnings = applyOCRResult(receipt, ocrResult)
+
+	if rules, err := s.DB.GetRuleSet(0); err != nil {
+		log.Printf("Warning: Failed to load eligibility rules, receipt %d is not classified: %v", receipt.ID, err)
+	} else {
+		result.Eligibility = rules.Classify(receipt)
+		applyEligibility(receipt, result.Eligibility)
+	}
+
+	if aliases, err := s.DB.GetVendorAliases(); err != nil {
+		log.Printf("Warning: Failed to load vendor aliases, vendor of receipt %d is not normalized: %v", receipt.ID, err)
+	} else if canonical := aliases.Canonical(receipt.Vendor); canonical != "" {
+		receipt.Vendor = canonical
+	}
+
+	candidates, err := s.DB.FindDuplicateCandidates(receipt)
+	if err != nil {
+		return fmt.Errorf("failed to check for duplicates: %v", err)
+	}
+	if len(candidates) > 0 {
+		log.Printf("Receipt %d may be a duplicate of receipt %d (score %.2f)",
+			receipt.ID, candidates[0].ReceiptID, candidates[0].Score)
+		result.DuplicateOf = &candidates[0].ReceiptID
+		result.Duplicates = candidates
+	}
+
+	return s.DB.CompleteOCRJob(job, receipt, result)
+}
+
+// JobByIDHandler returns one of the household's jobs: GET /api/jobs/{id}
+func (s *Server) JobByIDHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/api/jobs/"))
+	if err != nil {
+		http.Error(w, "Invalid job ID", http.StatusBadRequest)
+		return
+	}
+
+	job, err := s.DB.GetJob(CurrentMembership(r).HouseholdID, id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Failed to get job: %v", err)
+		http.Error(w, "Failed to get job", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
+
+// RerunOCRHandler queues a fresh OCR run for a receipt whose extraction
+// failed or came out wrong: POST /api/receipts/{id}/ocr
+func (s *Server) RerunOCRHandler(w http.ResponseWriter, r *http.Request, receiptID int) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	membership := CurrentMembership(r)
+	if !membership.CanWrite() {
+		http.Error(w, "Viewers cannot re-run OCR", http.StatusForbidden)
+		return
+	}
+
+	job, err := s.DB.RequeueOCR(membership.HouseholdID, receiptID, s.OCRMaxAttempts)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Receipt not found", http.StatusNotFound)
+		return
+	} else if err == ErrJobActive || err == ErrReceiptClaimed {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Printf("Failed to queue OCR: %v", err)
+		http.Error(w, "Failed to queue OCR", http.StatusInternalServerError)
+		return
+	}
+	s.Jobs.Notify()
+
+	log.Printf("User %s queued OCR job %d for receipt %d", CurrentUser(r).Username, job.ID, receiptID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":         receiptID,
+		"job_id":     job.ID,
+		"ocr_status": OCRStatusPending,
+		"message":    "OCR queued",
+	})
+}
@@ -0,0 +1,201 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+func TestJobBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{0, 15 * time.Second},
+		{1, 15 * time.Second},
+		{2, 30 * time.Second},
+		{3, time.Minute},
+		{4, 2 * time.Minute},
+		{8, 32 * time.Minute},
+		{9, time.Hour},
+		{100, time.Hour},
+	}
+	for _, tt := range tests {
+		if got := jobBackoff(tt.attempts); got != tt.want {
+			t.Errorf("jobBackoff(%d) = %s, want %s", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+// testOCRServer is a server reading receipts with the fixtures in
+// testdata/ocr and storing files in a temporary directory
+func testOCRServer(t *testing.T, db *Database) *Server {
+	return &Server{DB: db, Extractor: NewFixtureExtractor(testFixtureDir), Store: NewLocalStore(t.TempDir())}
+}
+
+// createTestPendingReceipt stores data as filename and saves a receipt
+// awaiting OCR with its job
+func createTestPendingReceipt(t *testing.T, s *Server, householdID int, filename string, data []byte, maxAttempts int) (*Receipt, *Job) {
+	t.Helper()
+
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	key, unlock, err := s.StoreReceiptFile(hash, filename, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+	receipt := &Receipt{
+		UserID:       "test",
+		HouseholdID:  householdID,
+		ImagePath:    key,
+		ImageHash:    hash,
+		OriginalName: filename,
+		Currency:     DefaultCurrency,
+		Date:         time.Now(),
+	}
+	job, err := s.DB.CreatePendingReceipt(receipt, maxAttempts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return receipt, job
+}
+
+// claimTestJob claims the next due job, which must be want
+func claimTestJob(t *testing.T, db *Database, want *Job) *Job {
+	t.Helper()
+
+	job, err := db.ClaimJob()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job == nil || job.ID != want.ID {
+		t.Fatalf("claimed %+v, want job %d; is the test database in use?", job, want.ID)
+	}
+	return job
+}
+
+// checkJob fails the test unless the job and its receipt have the given
+// statuses
+func checkJob(t *testing.T, db *Database, job *Job, status string, attempts int, ocrStatus string) *Job {
+	t.Helper()
+
+	saved, err := db.GetJob(job.HouseholdID, job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Status != status || saved.Attempts != attempts {
+		t.Fatalf("job %s after %d attempts, want %s after %d", saved.Status, saved.Attempts, status, attempts)
+	}
+	if (saved.FinishedAt != nil) != (status == JobDead || status == JobSucceeded) {
+		t.Fatalf("job %s with finished_at %v", saved.Status, saved.FinishedAt)
+	}
+	receipt, err := db.GetReceiptByID(job.HouseholdID, *job.ReceiptID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if receipt.OCRStatus != ocrStatus {
+		t.Fatalf("receipt ocr_status %s, want %s", receipt.OCRStatus, ocrStatus)
+	}
+	return saved
+}
+
+func TestOCRJobRetriesThenDies(t *testing.T) {
+	db, householdID := testDatabase(t)
+	s := testOCRServer(t, db)
+	jr := NewJobRunner(s, 1)
+
+	// The fixture for unreadable.pdf fails every extraction
+	_, job := createTestPendingReceipt(t, s, householdID, "unreadable.pdf", []byte("%PDF-1.7 blank"), 2)
+
+	jr.run(claimTestJob(t, db, job))
+	saved := checkJob(t, db, job, JobQueued, 1, OCRStatusPending)
+	if saved.LastError == nil || *saved.LastError != "page 1 is blank" {
+		t.Fatalf("last_error %v", saved.LastError)
+	}
+
+	// The retry waits out the backoff
+	if next, err := db.ClaimJob(); err != nil || next != nil {
+		t.Fatalf("claimed %+v, %v before the retry was due", next, err)
+	}
+
+	if _, err := db.conn.Exec("UPDATE jobs SET run_at = NOW() WHERE id = $1", job.ID); err != nil {
+		t.Fatal(err)
+	}
+	jr.run(claimTestJob(t, db, job))
+	checkJob(t, db, job, JobDead, 2, OCRStatusFailed)
+
+	if next, err := db.ClaimJob(); err != nil || next != nil {
+		t.Fatalf("claimed %+v, %v after the job died", next, err)
+	}
+}
+
+func TestOCRJobSucceeds(t *testing.T) {
+	db, householdID := testDatabase(t)
+	s := testOCRServer(t, db)
+
+	// scan.jpg has a fixture of its own; anything else gets default.json
+	receipt, job := createTestPendingReceipt(t, s, householdID, "scan.jpg", []byte("eye exam scan"), 3)
+
+	NewJobRunner(s, 1).run(claimTestJob(t, db, job))
+	checkJob(t, db, job, JobSucceeded, 1, OCRStatusReady)
+
+	saved, err := db.GetReceiptByID(householdID, receipt.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Vendor != "Eye Care Center" || saved.OriginalTotal != 15000 || saved.QualifiedAmount != 15000 {
+		t.Errorf("receipt %q for %s qualifying %s, want the scan.jpg fixture", saved.Vendor, saved.OriginalTotal, saved.QualifiedAmount)
+	}
+}
+
+func TestClaimJobSkipsLockedJobs(t *testing.T) {
+	db, householdID := testDatabase(t)
+	s := testOCRServer(t, db)
+	_, job := createTestPendingReceipt(t, s, householdID, "scan.jpg", []byte("scan"), 3)
+
+	// Another worker holding the row lock keeps the job from this one
+	tx, err := db.conn.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("SELECT id FROM jobs WHERE id = $1 FOR UPDATE", job.ID); err != nil {
+		t.Fatal(err)
+	}
+	if claimed, err := db.ClaimJob(); err != nil || claimed != nil {
+		t.Fatalf("claimed %+v, %v while the job was locked", claimed, err)
+	}
+
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	claimTestJob(t, db, job)
+	checkJob(t, db, job, JobRunning, 1, OCRStatusPending)
+}
+
+func TestReapStaleJobs(t *testing.T) {
+	db, householdID := testDatabase(t)
+	s := testOCRServer(t, db)
+	_, retried := createTestPendingReceipt(t, s, householdID, "scan.jpg", []byte("first scan"), 2)
+	_, last := createTestPendingReceipt(t, s, householdID, "scan.jpg", []byte("second scan"), 1)
+	claimTestJob(t, db, retried)
+	claimTestJob(t, db, last)
+
+	// Jobs running for less than staleAfter are left alone
+	if _, err := db.ReapStaleJobs(time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	checkJob(t, db, retried, JobRunning, 1, OCRStatusPending)
+
+	_, err := db.conn.Exec("UPDATE jobs SET locked_at = NOW() - INTERVAL '2 hours' WHERE household_id = $1", householdID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := db.ReapStaleJobs(time.Hour); err != nil || n < 2 {
+		t.Fatalf("reaped %d jobs, %v", n, err)
+	}
+	checkJob(t, db, retried, JobQueued, 1, OCRStatusPending)
+	checkJob(t, db, last, JobDead, 1, OCRStatusFailed)
+}
@@ -0,0 +1,289 @@
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// migrationLockKey is the pg_advisory_lock key held while migrating, so API
+// replicas booting together apply each migration exactly once
+const migrationLockKey int64 = 0x6873615f6d6967 // "hsa_mig"
+
+// migrationFilePattern matches NNN_name.sql (or NNN_name.up.sql) and the
+// optional NNN_name.down.sql that reverts it
+var migrationFilePattern = regexp.MustCompile(`^(\d+)_(.+?)(\.up|\.down)?\.sql$`)
+
+// Migration is one numbered schema change. Down is empty when the migration
+// cannot be rolled back.
+type Migration struct {
+	Version  int
+	Name     string
+	Up       string
+	Down     string
+	Checksum string // SHA-256 of Up
+}
+
+// MigrationState pairs a migration found on disk with its row in
+// schema_migrations; AppliedAt is nil while it is pending
+type MigrationState struct {
+	Migration
+	AppliedAt       *time.Time
+	AppliedChecksum string
+}
+
+// LoadMigrations reads every migration in dir, ordered by version
+func LoadMigrations(dir string) ([]Migration, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read migrations directory: %v", err)
+	}
+
+	byVersion := map[int]*Migration{}
+	for _, entry := range entries {
+		match := migrationFilePattern.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || match == nil {
+			continue
+		}
+
+		version, err := strconv.Atoi(match[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration version in %s", entry.Name())
+		}
+		content, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read migration %s: %v", entry.Name(), err)
+		}
+
+		m := byVersion[version]
+		if m == nil {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		} else if m.Name != match[2] {
+			return nil, fmt.Errorf("migration version %d is used by both %s and %s", version, m.Name, match[2])
+		}
+
+		if match[3] == ".down" {
+			m.Down = string(content)
+		} else {
+			if m.Up != "" {
+				return nil, fmt.Errorf("migration %d_%s has more than one up file", version, m.Name)
+			}
+			m.Up = string(content)
+			sum := sha256.Sum256(content)
+			m.Checksum = hex.EncodeToString(sum[:])
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %d_%s has a down file but no up file", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+
+	return migrations, nil
+}
+
+// withMigrationLock runs fn on a single connection holding the migration
+// advisory lock, after making sure schema_migrations exists
+func (db *Database) withMigrationLock(fn func(conn *sql.Conn) error) error {
+	ctx := context.Background()
+	conn, err := db.conn.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLockKey); err != nil {
+		return fmt.Errorf("failed to acquire migration lock: %v", err)
+	}
+	defer func() {
+		if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", migrationLockKey); err != nil {
+			log.Printf("Warning: Failed to release migration lock: %v", err)
+		}
+	}()
+
+	_, err = conn.ExecContext(ctx, `
+        CREATE TABLE IF NOT EXISTS schema_migrations (
+            version INTEGER PRIMARY KEY,
+            name VARCHAR(255) NOT NULL,
+            checksum VARCHAR(64) NOT NULL,
+            applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+        )
+    `)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %v", err)
+	}
+
+	return fn(conn)
+}
+
+// migrationStates matches the migrations on disk with schema_migrations.
+// Applied versions whose file is gone are returned with an empty Up.
+func migrationStates(conn *sql.Conn, migrations []Migration) ([]MigrationState, error) {
+	rows, err := conn.QueryContext(context.Background(),
+		"SELECT version, name, checksum, applied_at FROM schema_migrations ORDER BY version")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := map[int]MigrationState{}
+	for rows.Next() {
+		var s MigrationState
+		var appliedAt time.Time
+		if err := rows.Scan(&s.Version, &s.Name, &s.AppliedChecksum, &appliedAt); err != nil {
+			return nil, err
+		}
+		s.AppliedAt = &appliedAt
+		applied[s.Version] = s
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	states := make([]MigrationState, 0, len(migrations))
+	for _, m := range migrations {
+		s, ok := applied[m.Version]
+		delete(applied, m.Version)
+		if !ok {
+			s = MigrationState{}
+		}
+		s.Migration = m
+		states = append(states, s)
+	}
+	for _, s := range applied {
+		states = append(states, s)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Version < states[j].Version })
+
+	return states, nil
+}
+
+// RunMigrations applies every pending migration in dir, in version order,
+// each in its own transaction. It refuses to run if an applied migration's
+// file has changed since it was applied.
+func (db *Database) RunMigrations(migrationsDir string) error {
+	log.Println("Running database migrations...")
+
+	migrations, err := LoadMigrations(migrationsDir)
+	if err != nil {
+		return err
+	}
+
+	return db.withMigrationLock(func(conn *sql.Conn) error {
+		states, err := migrationStates(conn, migrations)
+		if err != nil {
+			return err
+		}
+
+		applied := 0
+		for _, s := range states {
+			switch {
+			case s.AppliedAt != nil && s.Up == "":
+				log.Printf("Warning: Applied migration %d_%s is missing from %s", s.Version, s.Name, migrationsDir)
+				continue
+			case s.AppliedAt != nil && s.AppliedChecksum != s.Checksum:
+				return fmt.Errorf("migration %d_%s was modified after it was applied (checksum %s, applied %s)",
+					s.Version, s.Name, s.Checksum[:12], s.AppliedChecksum[:12])
+			case s.AppliedAt != nil:
+				continue
+			}
+
+			log.Printf("Applying migration: %d_%s", s.Version, s.Name)
+			err := runMigrationTx(conn, s.Up, `
+                INSERT INTO schema_migrations (version, name, checksum, applied_at)
+                VALUES ($1, $2, $3, NOW())
+            `, s.Version, s.Name, s.Checksum)
+			if err != nil {
+				return fmt.Errorf("failed to apply migration %d_%s: %v", s.Version, s.Name, err)
+			}
+			applied++
+		}
+
+		log.Printf("Migrations complete: %d applied, %d total", applied, len(migrations))
+		return nil
+	})
+}
+
+// RollbackMigrations reverts the last steps applied migrations, newest
+// first, each with its down file in its own transaction
+func (db *Database) RollbackMigrations(migrationsDir string, steps int) error {
+	migrations, err := LoadMigrations(migrationsDir)
+	if err != nil {
+		return err
+	}
+
+	return db.withMigrationLock(func(conn *sql.Conn) error {
+		states, err := migrationStates(conn, migrations)
+		if err != nil {
+			return err
+		}
+
+		for i := len(states) - 1; i >= 0 && steps > 0; i-- {
+			s := states[i]
+			if s.AppliedAt == nil {
+				continue
+			}
+			if s.Down == "" {
+				return fmt.Errorf("migration %d_%s has no down file and cannot be rolled back", s.Version, s.Name)
+			}
+
+			log.Printf("Rolling back migration: %d_%s", s.Version, s.Name)
+			err := runMigrationTx(conn, s.Down, "DELETE FROM schema_migrations WHERE version = $1", s.Version)
+			if err != nil {
+				return fmt.Errorf("failed to roll back migration %d_%s: %v", s.Version, s.Name, err)
+			}
+			steps--
+		}
+
+		return nil
+	})
+}
+
+// MigrationStatus lists every migration on disk or in schema_migrations
+func (db *Database) MigrationStatus(migrationsDir string) ([]MigrationState, error) {
+	migrations, err := LoadMigrations(migrationsDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var states []MigrationState
+	err = db.withMigrationLock(func(conn *sql.Conn) error {
+		states, err = migrationStates(conn, migrations)
+		return err
+	})
+	return states, err
+}
+
+// runMigrationTx executes script and the bookkeeping statement in one
+// transaction on conn
+func runMigrationTx(conn *sql.Conn, script string, bookkeeping string, args ...interface{}) error {
+	ctx := context.Background()
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, script); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, bookkeeping, args...); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
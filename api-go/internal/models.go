@@ -11,21 +11,148 @@ const (
 	HSAStatusPartially = "Partially"
 )
 
+// Receipt OCR states. Uploads start pending and become ready when their OCR
+// job succeeds, or failed once it is dead-lettered.
+const (
+	OCRStatusPending = "pending_ocr"
+	OCRStatusReady   = "ready"
+	OCRStatusFailed  = "ocr_failed"
+)
+
 // Receipt represents a stored receipt with all metadata
 type Receipt struct {
-	ID           int        `json:"id"`
-	UserID       string     `json:"user_id"`
-	Vendor       string     `json:"vendor"`
-	TotalAmount  float64    `json:"total_amount"` 
-	Date         time.Time  `json:"date"`
-	HSAQualified bool       `json:"hsa_qualified"`
-	HSAStatus    string     `json:"hsa_status"`
-	ImagePath    string     `json:"image_path"`
-	ImageHash    string     `json:"image_hash"`
-	RawText      string     `json:"raw_text"`
-	Used         bool       `json:"used"`
-	UsedDate     *time.Time `json:"used_date"`
-	UseReason    *string    `json:"use_reason"`
-	CreatedAt    time.Time  `json:"created_at"`
+	ID              int        `json:"id"`
+	UserID          string     `json:"user_id"`
+	HouseholdID     int        `json:"household_id"`
+	MemberID        *int       `json:"member_id"`
+	Vendor          string     `json:"vendor"`
+	OriginalTotal   Money      `json:"original_total"`   // as printed, after tax and discounts
+	QualifiedAmount Money      `json:"qualified_amount"` // HSA-qualified part of OriginalTotal
+	RemainingAmount Money      `json:"remaining_amount"` // unclaimed part of QualifiedAmount
+	TaxAmount       Money      `json:"tax_amount"`
+	DiscountAmount  Money      `json:"discount_amount"`
+	Currency        string     `json:"currency"`
+	Date            time.Time  `json:"date"`
+	HSAQualified    bool       `json:"hsa_qualified"`
+	HSAStatus       string     `json:"hsa_status"`
+	ImagePath       string     `json:"image_path"` // storage key, blobs/ab/<image_hash>.<ext>
+	OriginalName    string     `json:"original_filename"`
+	PageCount       int        `json:"page_count"` // pages in the file, 1 for an image
+	ImageHash       string     `json:"image_hash"`
+	PerceptualHash  *int64     `json:"-"` // dHash of the image, nil unless it is a decodable image
+	RawText         string     `json:"raw_text"`
+	OCRStatus       string     `json:"ocr_status"`
+	Used            bool       `json:"used"`
+	UsedDate        *time.Time `json:"used_date"`
+	UseReason       *string    `json:"use_reason"`
+	CreatedAt       time.Time  `json:"created_at"`
+
+	Items       []ReceiptItem `json:"items,omitempty"`       // only filled in for single receipts
+	Attachments []Attachment  `json:"attachments,omitempty"` // only filled in for single receipts
+}
+
+// Attachment is a document kept with a receipt for an audit. Every receipt
+// with a file has one primary attachment, the receipt file itself, whose
+// StorageKey is the receipt's ImagePath; others hold e.g. the insurer's
+// Explanation of Benefits or a Letter of Medical Necessity.
+type Attachment struct {
+	ID           int       `json:"id"`
+	ReceiptID    int       `json:"receipt_id"`
+	DocumentType string    `json:"document_type"` // receipt, eob, lmn or other
+	Primary      bool      `json:"primary"`
+	FileHash     string    `json:"file_hash"` // SHA-256 of the file
+	StorageKey   string    `json:"storage_key"`
+	MimeType     string    `json:"mime_type"`
+	OriginalName string    `json:"original_filename"`
+	UploadedBy   string    `json:"uploaded_by"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// ReceiptItem is one line of a receipt. Amount is nil when the receipt shows
+// no price for the line, Page when the extractor did not say which page of
+// a multi-page receipt it is on.
+type ReceiptItem struct {
+	ID          int     `json:"id"`
+	ReceiptID   int     `json:"receipt_id"`
+	Position    int     `json:"position"`
+	Description string  `json:"description"`
+	Quantity    float64 `json:"quantity"`
+	UnitPrice   *Money  `json:"unit_price"`
+	Amount      *Money  `json:"amount"`
+	HSAEligible bool    `json:"hsa_eligible"`
+	Page        *int    `json:"page"`
+}
+
+// Household member roles, from most to least privileged
+const (
+	RoleOwner  = "owner"
+	RoleAdult  = "adult"
+	RoleViewer = "viewer"
+)
+
+// User is a login account. Receipts record the uploader's Username.
+type User struct {
+	ID           int       `json:"id"`
+	Username     string    `json:"username"`
+	PasswordHash string    `json:"-"`
+	Email        *string   `json:"email,omitempty"` // verified by single sign-on
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// Household is a shared HSA workspace. Receipts belong to a household.
+type Household struct {
+	ID        int               `json:"id"`
+	Name      string            `json:"name"`
+	CreatedAt time.Time         `json:"created_at"`
+	Role      string            `json:"role,omitempty"` // the requesting user's role
+	Default   bool              `json:"default,omitempty"`
+	Members   []HouseholdMember `json:"members,omitempty"`
+}
+
+// HouseholdMember is a person expenses can be attributed to. Members with a
+// UserID can log in; dependents without an account just carry eligibility
+// dates. A member with only an Email is offered to the account that first
+// signs in with that verified email. Receipts dated outside [EligibleFrom, EligibleUntil] are not
+// offered for deductions.
+type HouseholdMember struct {
+	ID            int        `json:"id"`
+	HouseholdID   int        `json:"household_id"`
+	UserID        *int       `json:"user_id"`
+	Username      *string    `json:"username,omitempty"`
+	Email         *string    `json:"email"` // invitation, claimed at single sign-on
+	Name          string     `json:"name"`
+	Role          string     `json:"role"`
+	EligibleFrom  *time.Time `json:"eligible_from"`
+	EligibleUntil *time.Time `json:"eligible_until"`
+	CreatedAt     time.Time  `json:"created_at"`
+	// InvitedUserID is an account invited to become this member; UserID is
+	// only set once that account accepts
+	InvitedUserID   *int    `json:"invited_user_id,omitempty"`
+	InvitedUsername *string `json:"invited_username,omitempty"`
+	// EmailToken is the local part of the member's address for emailing
+	// receipts in; ReceiptAddress is the full address, shown to members who
+	// can upload when the SMTP receiver is enabled
+	EmailToken     string `json:"-"`
+	ReceiptAddress string `json:"receipt_address,omitempty"`
 }
 
+// CanWrite reports whether the member may change receipts
+func (m *HouseholdMember) CanWrite() bool {
+	return m.Role == RoleOwner || m.Role == RoleAdult
+}
+
+// CanManage reports whether the member may change the household itself
+func (m *HouseholdMember) CanManage() bool {
+	return m.Role == RoleOwner
+}
+
+// Invitation is a household membership offered to an account, waiting for
+// it to accept or decline. ID is the member record's ID.
+type Invitation struct {
+	ID            int       `json:"id"`
+	HouseholdID   int       `json:"household_id"`
+	HouseholdName string    `json:"household_name"`
+	Name          string    `json:"name"`
+	Role          string    `json:"role"`
+	CreatedAt     time.Time `json:"created_at"`
+}
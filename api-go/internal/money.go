@@ -0,0 +1,160 @@
+package internal
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// DefaultCurrency is used for receipts whose currency is unknown
+const DefaultCurrency = "USD"
+
+// Money is an exact amount in cents (minor units of the owning record's
+// Currency). It never passes through float64: JSON numbers and DECIMAL
+// columns are parsed and formatted as decimal text, so 0.1 + 0.2 is always
+// 0.30 and reimbursement totals never drift.
+type Money int64
+
+// ParseMoney parses a decimal amount such as "12.34", "-5", "$1,024.5" or
+// "3.456". Digits beyond the cent are rounded half away from zero.
+func ParseMoney(s string) (Money, error) {
+	s = strings.TrimSpace(s)
+	s = strings.ReplaceAll(s, ",", "")
+	s = strings.TrimPrefix(s, "$")
+
+	negative := false
+	if strings.HasPrefix(s, "-") {
+		negative = true
+		s = s[1:]
+	} else if strings.HasPrefix(s, "+") {
+		s = s[1:]
+	}
+	s = strings.TrimPrefix(s, "$")
+
+	whole, frac, _ := strings.Cut(s, ".")
+	if whole == "" && frac == "" {
+		return 0, fmt.Errorf("invalid amount %q", s)
+	}
+	if whole == "" {
+		whole = "0"
+	}
+	for _, part := range []string{whole, frac} {
+		for _, c := range part {
+			if c < '0' || c > '9' {
+				return 0, fmt.Errorf("invalid amount %q", s)
+			}
+		}
+	}
+
+	units, err := strconv.ParseInt(whole, 10, 64)
+	if err != nil || units > (1<<62)/100 {
+		return 0, fmt.Errorf("amount %q out of range", s)
+	}
+
+	frac += "000"
+	cents, _ := strconv.ParseInt(frac[:2], 10, 64)
+	total := units*100 + cents
+	if frac[2] >= '5' {
+		total++
+	}
+
+	if negative {
+		total = -total
+	}
+	return Money(total), nil
+}
+
+// Cents returns the amount in minor units
+func (m Money) Cents() int64 {
+	return int64(m)
+}
+
+// String formats the amount as a decimal with two places, e.g. "-12.05"
+func (m Money) String() string {
+	sign := ""
+	cents := int64(m)
+	if cents < 0 {
+		sign = "-"
+		cents = -cents
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, cents/100, cents%100)
+}
+
+// MarshalJSON encodes the amount as a JSON number with two decimals
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// UnmarshalJSON accepts a JSON number or a numeric string
+func (m *Money) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if string(data) == "null" {
+		return nil
+	}
+	if s, err := strconv.Unquote(string(data)); err == nil {
+		data = []byte(s)
+	}
+	if bytes.ContainsAny(data, "eE") {
+		return fmt.Errorf("amount %s must not use exponent notation", data)
+	}
+
+	parsed, err := ParseMoney(string(data))
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
+
+// Scan reads a DECIMAL or integer column
+func (m *Money) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*m = 0
+		return nil
+	case int64:
+		*m = Money(v * 100)
+		return nil
+	case []byte:
+		parsed, err := ParseMoney(string(v))
+		if err != nil {
+			return err
+		}
+		*m = parsed
+		return nil
+	case string:
+		parsed, err := ParseMoney(v)
+		if err != nil {
+			return err
+		}
+		*m = parsed
+		return nil
+	default:
+		return fmt.Errorf("cannot scan %T into Money", src)
+	}
+}
+
+// Value writes the amount as decimal text, which Postgres casts to NUMERIC
+// without rounding
+func (m Money) Value() (driver.Value, error) {
+	return m.String(), nil
+}
+
+// NormalizeCurrency upper-cases an ISO 4217 code, defaulting to DefaultCurrency
+func NormalizeCurrency(code string) (string, error) {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if code == "" {
+		return DefaultCurrency, nil
+	}
+	if len(code) != 3 {
+		return "", fmt.Errorf("invalid currency code %q", code)
+	}
+	for _, c := range code {
+		if c < 'A' || c > 'Z' {
+			return "", fmt.Errorf("invalid currency code %q", code)
+		}
+	}
+	return code, nil
+}
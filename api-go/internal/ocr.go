@@ -0,0 +1,163 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// OCRResult is what an Extractor reads from a receipt file. Amount is the
+// total paid, after tax and discounts. Date is MM/DD/YYYY, as the OCR
+// service returns it. For a multi-page PDF, PageCount is how many pages were
+// read, TotalPage the page showing the total and each item's Page where it
+// was found, all 1-based and 0 when not known.
+type OCRResult struct {
+	Vendor       string `json:"vendor"`
+	Amount       Money  `json:"amount"`
+	Tax          Money  `json:"tax,omitempty"`
+	Discount     Money  `json:"discount,omitempty"`
+	Currency     string `json:"currency"` // ISO 4217, optional
+	Date         string `json:"date"`
+	HSAQualified bool   `json:"hsa_qualified"`
+	HSAStatus    string `json:"hsa_status"` // "Yes", "No", or "Partially"
+	RawText      string `json:"raw_text"`
+	PageCount    int    `json:"page_count,omitempty"`
+	TotalPage    int    `json:"total_page,omitempty"`
+
+	Items []OCRItem `json:"items,omitempty"`
+}
+
+// OCRItem is one line item of an extraction
+type OCRItem struct {
+	Description string  `json:"description"`
+	Quantity    float64 `json:"quantity,omitempty"`
+	UnitPrice   *Money  `json:"unit_price,omitempty"`
+	Amount      *Money  `json:"amount,omitempty"`
+	HSAEligible *bool   `json:"hsa_eligible,omitempty"` // eligible unless the extractor says otherwise
+	Page        int     `json:"page,omitempty"`
+}
+
+// UnmarshalJSON also accepts a bare description, which older versions of
+// the OCR service return
+func (item *OCRItem) UnmarshalJSON(data []byte) error {
+	var description string
+	if err := json.Unmarshal(data, &description); err == nil {
+		*item = OCRItem{Description: description}
+		return nil
+	}
+
+	type plain OCRItem
+	return json.Unmarshal(data, (*plain)(item))
+}
+
+// OCRJobResult is stored as an OCR job's result. Warnings flag a
+// low-quality extraction worth re-running or checking by hand. Eligibility
+// is how the rules engine classified the receipt.
+type OCRJobResult struct {
+	OCRResult
+	Warnings    []string               `json:"warnings,omitempty"`
+	DuplicateOf *int                   `json:"duplicate_of,omitempty"` // best of Duplicates
+	Duplicates  []DuplicateCandidate   `json:"duplicates,omitempty"`
+	Eligibility *EligibilitySuggestion `json:"eligibility,omitempty"`
+}
+
+// applyOCRResult copies an extraction onto a receipt, normalizing currency,
+// date and HSA status, and returns warnings for anything it could not read.
+// Fields the extraction is missing keep the receipt's current value, so a
+// worse re-run never blanks out what an earlier one (or a user) filled in.
+func applyOCRResult(receipt *Receipt, result *OCRResult) []string {
+	var warnings []string
+
+	if vendor := strings.TrimSpace(result.Vendor); vendor != "" {
+		receipt.Vendor = vendor
+	} else {
+		warnings = append(warnings, "no vendor found")
+	}
+
+	if result.Amount > 0 {
+		receipt.OriginalTotal = result.Amount
+		receipt.QualifiedAmount = result.Amount
+	} else {
+		warnings = append(warnings, "no amount found")
+	}
+	if result.Tax > 0 {
+		receipt.TaxAmount = result.Tax
+	}
+	if result.Discount > 0 {
+		receipt.DiscountAmount = result.Discount
+	}
+
+	if result.Currency != "" {
+		if currency, err := NormalizeCurrency(result.Currency); err == nil {
+			receipt.Currency = currency
+		} else {
+			warnings = append(warnings, fmt.Sprintf("unrecognized currency %q", result.Currency))
+		}
+	}
+	if receipt.Currency == "" {
+		receipt.Currency = DefaultCurrency
+	}
+
+	if result.Date == "" {
+		warnings = append(warnings, "no date found")
+	} else if date, err := time.Parse("01/02/2006", result.Date); err != nil {
+		warnings = append(warnings, fmt.Sprintf("unrecognized date %q", result.Date))
+	} else {
+		receipt.Date = date
+	}
+
+	// Normalize HSA status
+	receipt.HSAStatus = result.HSAStatus
+	if receipt.HSAStatus == "" {
+		if result.HSAQualified {
+			receipt.HSAStatus = HSAStatusYes
+		} else {
+			receipt.HSAStatus = HSAStatusNo
+		}
+	}
+	receipt.HSAQualified = receipt.HSAStatus == HSAStatusYes || receipt.HSAStatus == HSAStatusPartially
+
+	receipt.RawText = result.RawText
+
+	if result.PageCount > 0 && result.PageCount < receipt.PageCount {
+		warnings = append(warnings, fmt.Sprintf("only %d of %d pages were read", result.PageCount, receipt.PageCount))
+	}
+
+	// A re-run that finds no items keeps the ones already on the receipt
+	if len(result.Items) > 0 {
+		receipt.Items = receipt.Items[:0]
+		for i, item := range result.Items {
+			description := strings.TrimSpace(item.Description)
+			if description == "" {
+				continue
+			}
+			quantity := item.Quantity
+			if quantity <= 0 {
+				quantity = 1
+			}
+			var page *int
+			if n := item.Page; n > 0 && n <= receipt.PageCount {
+				page = &n
+			}
+			receipt.Items = append(receipt.Items, ReceiptItem{
+				Position:    i,
+				Description: description,
+				Quantity:    quantity,
+				UnitPrice:   item.UnitPrice,
+				Amount:      item.Amount,
+				HSAEligible: item.HSAEligible == nil || *item.HSAEligible,
+				Page:        page,
+			})
+		}
+
+		// An extractor that judges items makes the receipt Partially
+		if status, qualified, priced := ItemsHSAStatus(receipt.Items); status == HSAStatusPartially && priced &&
+			qualified <= receipt.OriginalTotal {
+			receipt.HSAStatus = HSAStatusPartially
+			receipt.HSAQualified = true
+			receipt.QualifiedAmount = qualified
+		}
+	}
+	return warnings
+}
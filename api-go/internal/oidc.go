@@ -0,0 +1,745 @@
+package internal
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	oidcStateTTL    = 10 * time.Minute
+	oidcClockSkew   = time.Minute
+	oidcHTTPTimeout = 10 * time.Second
+)
+
+// OIDCConfig configures single sign-on against an OpenID Connect provider
+type OIDCConfig struct {
+	IssuerURL    string
+	ClientID     string
+	ClientSecret string // optional for public clients; PKCE is always used
+	RedirectURL  string // this API's /api/auth/oidc/callback URL
+	Scopes       []string
+	// PostLoginURL is the frontend page that receives the session token in
+	// its URL fragment (#token=...)
+	PostLoginURL string
+	// AutoCreateUsers provisions a local account on first login. Without it
+	// only identities linked to an existing account can sign in.
+	AutoCreateUsers bool
+}
+
+// OIDCProvider runs the authorization code + PKCE flow. The issuer's
+// discovery document and signing keys are fetched lazily through HTTPClient,
+// so any issuer reachable over HTTP (including a local mock) works.
+type OIDCProvider struct {
+	Config     OIDCConfig
+	HTTPClient *http.Client
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]crypto.PublicKey
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// OIDCClaims are the ID token claims used to map a login onto a local user
+type OIDCClaims struct {
+	Issuer            string       `json:"iss"`
+	Subject           string       `json:"sub"`
+	Audience          oidcAudience `json:"aud"`
+	ExpiresAt         int64        `json:"exp"`
+	IssuedAt          int64        `json:"iat"`
+	Nonce             string       `json:"nonce"`
+	Email             string       `json:"email"`
+	EmailVerified     bool         `json:"email_verified"`
+	PreferredUsername string       `json:"preferred_username"`
+	Name              string       `json:"name"`
+}
+
+// oidcAudience accepts both the string and array forms of "aud"
+type oidcAudience []string
+
+func (a *oidcAudience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = oidcAudience{single}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return err
+	}
+	*a = many
+	return nil
+}
+
+func NewOIDCProvider(cfg OIDCConfig) *OIDCProvider {
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"openid", "email", "profile"}
+	}
+	return &OIDCProvider{
+		Config:     cfg,
+		HTTPClient: &http.Client{Timeout: oidcHTTPTimeout},
+	}
+}
+
+func (p *OIDCProvider) getJSON(endpoint string, v interface{}) error {
+	resp, err := p.HTTPClient.Get(endpoint)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("GET %s returned status %d: %s", endpoint, resp.StatusCode, string(body))
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// Discover fetches and caches the issuer's discovery document
+func (p *OIDCProvider) Discover() (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	var d oidcDiscovery
+	endpoint := strings.TrimSuffix(p.Config.IssuerURL, "/") + "/.well-known/openid-configuration"
+	if err := p.getJSON(endpoint, &d); err != nil {
+		return nil, fmt.Errorf("failed to fetch OIDC discovery document: %v", err)
+	}
+	if strings.TrimSuffix(d.Issuer, "/") != strings.TrimSuffix(p.Config.IssuerURL, "/") {
+		return nil, fmt.Errorf("discovery issuer %q does not match configured issuer %q", d.Issuer, p.Config.IssuerURL)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, fmt.Errorf("discovery document is missing required endpoints")
+	}
+
+	p.discovery = &d
+	return p.discovery, nil
+}
+
+// AuthCodeURL builds the authorization request for the S256 PKCE challenge
+// of codeVerifier
+func (p *OIDCProvider) AuthCodeURL(state, nonce, codeVerifier string) (string, error) {
+	d, err := p.Discover()
+	if err != nil {
+		return "", err
+	}
+
+	challenge := sha256.Sum256([]byte(codeVerifier))
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.Config.ClientID},
+		"redirect_uri":          {p.Config.RedirectURL},
+		"scope":                 {strings.Join(p.Config.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return d.AuthorizationEndpoint + sep + params.Encode(), nil
+}
+
+// Exchange redeems an authorization code and returns the verified ID token claims
+func (p *OIDCProvider) Exchange(code, codeVerifier, nonce string) (*OIDCClaims, error) {
+	d, err := p.Discover()
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.Config.RedirectURL},
+		"client_id":     {p.Config.ClientID},
+		"code_verifier": {codeVerifier},
+	}
+	req, err := http.NewRequest(http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create token request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.Config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.Config.ClientID), url.QueryEscape(p.Config.ClientSecret))
+	}
+
+	resp, err := p.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to call token endpoint: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("token endpoint returned status %d: %s", resp.StatusCode, string(body))
+	}
+
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return nil, fmt.Errorf("failed to parse token response: %v", err)
+	}
+	if tokens.IDToken == "" {
+		return nil, fmt.Errorf("token response has no id_token")
+	}
+
+	return p.VerifyIDToken(tokens.IDToken, nonce)
+}
+
+// VerifyIDToken checks an ID token's signature against the issuer's JWKS and
+// validates its issuer, audience, expiry and nonce
+func (p *OIDCProvider) VerifyIDToken(rawToken, nonce string) (*OIDCClaims, error) {
+	parts := strings.Split(rawToken, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed ID token")
+	}
+
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("malformed ID token header: %v", err)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return nil, fmt.Errorf("malformed ID token header: %v", err)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed ID token signature: %v", err)
+	}
+
+	key, err := p.signingKey(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyJWS(header.Alg, key, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return nil, err
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed ID token payload: %v", err)
+	}
+	var claims OIDCClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("malformed ID token payload: %v", err)
+	}
+
+	now := time.Now()
+	d, _ := p.Discover()
+	switch {
+	case claims.Issuer != d.Issuer:
+		return nil, fmt.Errorf("ID token issuer %q does not match %q", claims.Issuer, d.Issuer)
+	case !claims.Audience.contains(p.Config.ClientID):
+		return nil, fmt.Errorf("ID token audience does not include client %q", p.Config.ClientID)
+	case time.Unix(claims.ExpiresAt, 0).Add(oidcClockSkew).Before(now):
+		return nil, fmt.Errorf("ID token has expired")
+	case claims.IssuedAt != 0 && time.Unix(claims.IssuedAt, 0).Add(-oidcClockSkew).After(now):
+		return nil, fmt.Errorf("ID token was issued in the future")
+	case claims.Nonce != nonce:
+		return nil, fmt.Errorf("ID token nonce does not match")
+	case claims.Subject == "":
+		return nil, fmt.Errorf("ID token has no subject")
+	}
+
+	return &claims, nil
+}
+
+func (a oidcAudience) contains(clientID string) bool {
+	for _, aud := range a {
+		if aud == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+// signingKey returns the JWKS key with kid, refetching the key set once if
+// the key is unknown so issuer key rotation is picked up
+func (p *OIDCProvider) signingKey(kid string) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	key, ok := p.keys[kid]
+	p.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	d, err := p.Discover()
+	if err != nil {
+		return nil, err
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := p.getJSON(d.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("failed to fetch OIDC signing keys: %v", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		pub, err := jwk.publicKey()
+		if err != nil {
+			log.Printf("Warning: Skipping OIDC signing key %q: %v", jwk.Kid, err)
+			continue
+		}
+		keys[jwk.Kid] = pub
+	}
+
+	p.mu.Lock()
+	p.keys = keys
+	p.mu.Unlock()
+
+	// A token without kid is accepted if the issuer publishes a single key
+	if kid == "" && len(keys) == 1 {
+		for _, k := range keys {
+			return k, nil
+		}
+	}
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("no OIDC signing key with kid %q", kid)
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid modulus: %v", err)
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil || !e.IsInt64() {
+			return nil, fmt.Errorf("invalid exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("invalid x coordinate: %v", err)
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("invalid y coordinate: %v", err)
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("point is not on curve %s", k.Crv)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+// verifyJWS checks a JWS signature over signingInput. Only asymmetric
+// algorithms are accepted, so a token can't be forged with alg "none" or an
+// HMAC keyed with the public key.
+func verifyJWS(alg string, key crypto.PublicKey, signingInput, signature []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported ID token algorithm %q", alg)
+	}
+
+	h := hash.New()
+	h.Write(signingInput)
+	digest := h.Sum(nil)
+
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") {
+			return fmt.Errorf("algorithm %s does not match RSA key", alg)
+		}
+		if err := rsa.VerifyPKCS1v15(pub, hash, digest, signature); err != nil {
+			return fmt.Errorf("invalid ID token signature")
+		}
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if !strings.HasPrefix(alg, "ES") || len(signature) != 2*size {
+			return fmt.Errorf("algorithm %s does not match EC key", alg)
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return fmt.Errorf("invalid ID token signature")
+		}
+	default:
+		return fmt.Errorf("unsupported signing key")
+	}
+
+	return nil
+}
+
+func (db *Database) CreateOIDCLoginState(state, codeVerifier, nonce string, expiresAt time.Time) error {
+	query := `
+        INSERT INTO oidc_login_states (state, code_verifier, nonce, expires_at)
+        VALUES ($1, $2, $3, $4)
+    `
+
+	_, err := db.conn.Exec(query, HashToken(state), codeVerifier, nonce, expiresAt)
+	return err
+}
+
+// ConsumeOIDCLoginState deletes and returns an unexpired login state, so each
+// state can complete at most one login
+func (db *Database) ConsumeOIDCLoginState(state string) (codeVerifier string, nonce string, err error) {
+	query := `
+        DELETE FROM oidc_login_states
+        WHERE state = $1 AND expires_at > NOW()
+        RETURNING code_verifier, nonce
+    `
+
+	err = db.conn.QueryRow(query, HashToken(state)).Scan(&codeVerifier, &nonce)
+	if _, cleanupErr := db.conn.Exec("DELETE FROM oidc_login_states WHERE expires_at <= NOW()"); cleanupErr != nil {
+		log.Printf("Warning: Failed to prune OIDC login states: %v", cleanupErr)
+	}
+	return codeVerifier, nonce, err
+}
+
+// GetUserByOIDCIdentity returns the user linked to an issuer/subject pair, or nil
+func (db *Database) GetUserByOIDCIdentity(issuer, subject string) (*User, error) {
+	query := `
+        SELECT ` + userColumns + `
+        FROM oidc_identities i
+        JOIN users u ON u.id = i.user_id
+        WHERE i.issuer = $1 AND i.subject = $2
+    `
+
+	u, err := scanUser(db.conn.QueryRow(query, issuer, subject))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return u, err
+}
+
+func (db *Database) LinkOIDCIdentity(userID int, issuer, subject string) error {
+	query := `
+        INSERT INTO oidc_identities (user_id, issuer, subject)
+        VALUES ($1, $2, $3)
+        ON CONFLICT (issuer, subject) DO NOTHING
+    `
+
+	_, err := db.conn.Exec(query, userID, issuer, subject)
+	return err
+}
+
+// ClaimInvitedMemberships matches member records invited by email to user
+// and returns how many were claimed. With join the user becomes those
+// members; otherwise each becomes an invitation the user has to accept.
+func (db *Database) ClaimInvitedMemberships(userID int, email string, join bool) (int64, error) {
+	column := "invited_user_id"
+	if join {
+		column = "user_id"
+	}
+	query := `
+        UPDATE household_members m
+        SET ` + column + ` = $1
+        WHERE LOWER(m.email) = LOWER($2) AND m.user_id IS NULL AND m.invited_user_id IS NULL
+          AND NOT EXISTS (
+              SELECT 1 FROM household_members o
+              WHERE o.household_id = m.household_id
+                AND (o.user_id = $1 OR o.invited_user_id = $1)
+          )
+    `
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(query, userID, email)
+	if err != nil {
+		return 0, err
+	}
+	claimed, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if join {
+		if err := pinDefaultHousehold(tx, userID); err != nil {
+			return 0, err
+		}
+	}
+
+	return claimed, tx.Commit()
+}
+
+// OIDCInfoHandler tells the frontend whether to offer single sign-on
+func (s *Server) OIDCInfoHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"enabled": s.OIDC != nil})
+}
+
+// OIDCLoginHandler starts single sign-on by redirecting to the issuer
+func (s *Server) OIDCLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if s.OIDC == nil {
+		http.Error(w, "Single sign-on is not configured", http.StatusNotFound)
+		return
+	}
+
+	state, _, err := NewToken()
+	if err != nil {
+		http.Error(w, "Failed to start login", http.StatusInternalServerError)
+		return
+	}
+	nonce, _, err := NewToken()
+	if err != nil {
+		http.Error(w, "Failed to start login", http.StatusInternalServerError)
+		return
+	}
+	codeVerifier, _, err := NewToken()
+	if err != nil {
+		http.Error(w, "Failed to start login", http.StatusInternalServerError)
+		return
+	}
+
+	authURL, err := s.OIDC.AuthCodeURL(state, nonce, codeVerifier)
+	if err != nil {
+		log.Printf("OIDC discovery failed: %v", err)
+		http.Error(w, "Identity provider unavailable", http.StatusBadGateway)
+		return
+	}
+
+	if err := s.DB.CreateOIDCLoginState(state, codeVerifier, nonce, time.Now().Add(oidcStateTTL)); err != nil {
+		log.Printf("Failed to store OIDC login state: %v", err)
+		http.Error(w, "Failed to start login", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// OIDCCallbackHandler completes single sign-on: it redeems the code, maps the
+// identity onto a local user and hands a session token to the frontend
+func (s *Server) OIDCCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	if s.OIDC == nil {
+		http.Error(w, "Single sign-on is not configured", http.StatusNotFound)
+		return
+	}
+
+	query := r.URL.Query()
+	if errCode := query.Get("error"); errCode != "" {
+		log.Printf("OIDC login failed at the provider: %s: %s", errCode, query.Get("error_description"))
+		s.oidcRedirect(w, r, url.Values{"error": {errCode}})
+		return
+	}
+
+	codeVerifier, nonce, err := s.DB.ConsumeOIDCLoginState(query.Get("state"))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Login expired or already used, please try again", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		log.Printf("Failed to load OIDC login state: %v", err)
+		http.Error(w, "Failed to complete login", http.StatusInternalServerError)
+		return
+	}
+
+	claims, err := s.OIDC.Exchange(query.Get("code"), codeVerifier, nonce)
+	if err != nil {
+		log.Printf("OIDC code exchange failed: %v", err)
+		http.Error(w, "Failed to verify login with the identity provider", http.StatusUnauthorized)
+		return
+	}
+
+	user, err := s.userForOIDCClaims(claims)
+	if err != nil {
+		log.Printf("Failed to map OIDC identity %s/%s: %v", claims.Issuer, claims.Subject, err)
+		http.Error(w, "Failed to complete login", http.StatusInternalServerError)
+		return
+	}
+	if user == nil {
+		log.Printf("OIDC login rejected: no local account for %s (%s)", claims.Subject, claims.Email)
+		s.oidcRedirect(w, r, url.Values{"error": {"no_account"}})
+		return
+	}
+
+	token, tokenHash, err := NewToken()
+	if err != nil {
+		http.Error(w, "Failed to create session", http.StatusInternalServerError)
+		return
+	}
+	if err := s.DB.CreateSession(user.ID, tokenHash, time.Now().Add(sessionTTL)); err != nil {
+		log.Printf("Failed to create session: %v", err)
+		http.Error(w, "Failed to create session", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("User %s signed in via OIDC", user.Username)
+	s.oidcRedirect(w, r, url.Values{"token": {token}})
+}
+
+// oidcRedirect sends the browser to the frontend with values in the URL
+// fragment, which browsers never send to servers or put in Referer headers
+func (s *Server) oidcRedirect(w http.ResponseWriter, r *http.Request, values url.Values) {
+	http.Redirect(w, r, s.OIDC.Config.PostLoginURL+"#"+values.Encode(), http.StatusFound)
+}
+
+// userForOIDCClaims maps an identity onto a local user: first by a linked
+// issuer/subject, then by verified email, then (if enabled) by creating a new
+// account. A new account joins the households that invited the verified
+// email; an existing one gets them as invitations to accept, so its
+// households never change behind its back. Users without any household get a
+// personal one. Returns nil if the identity may not sign in.
+func (s *Server) userForOIDCClaims(claims *OIDCClaims) (*User, error) {
+	user, err := s.DB.GetUserByOIDCIdentity(claims.Issuer, claims.Subject)
+	if err != nil {
+		return nil, err
+	}
+
+	email := ""
+	if claims.EmailVerified {
+		email = strings.ToLower(strings.TrimSpace(claims.Email))
+	}
+
+	if user == nil && email != "" {
+		if user, err = s.DB.GetUserByEmail(email); err != nil {
+			return nil, err
+		}
+	}
+
+	created := false
+	if user == nil {
+		if !s.OIDC.Config.AutoCreateUsers {
+			return nil, nil
+		}
+		if user, err = s.createOIDCUser(claims, email); err != nil {
+			return nil, err
+		}
+		created = true
+	}
+
+	if err := s.DB.LinkOIDCIdentity(user.ID, claims.Issuer, claims.Subject); err != nil {
+		return nil, err
+	}
+
+	if email != "" {
+		if claimed, err := s.DB.ClaimInvitedMemberships(user.ID, email, created); err != nil {
+			return nil, err
+		} else if claimed > 0 && created {
+			log.Printf("User %s joined %d household(s) invited as %s", user.Username, claimed, email)
+		} else if claimed > 0 {
+			log.Printf("User %s was invited to %d household(s) as %s", user.Username, claimed, email)
+		}
+	}
+
+	if membership, err := s.DB.GetMembership(user.ID, 0); err != nil {
+		return nil, err
+	} else if membership == nil {
+		if _, err := s.DB.CreatePersonalHousehold(user); err != nil {
+			return nil, err
+		}
+	}
+
+	return user, nil
+}
+
+// createOIDCUser provisions a password-less account named after the
+// identity's preferred username or email, adding a suffix if it is taken
+func (s *Server) createOIDCUser(claims *OIDCClaims, email string) (*User, error) {
+	base := strings.ToLower(strings.TrimSpace(claims.PreferredUsername))
+	if base == "" && email != "" {
+		base = strings.SplitN(email, "@", 2)[0]
+	}
+	if len(base) < 3 || reservedUsername(base) {
+		base = "user-" + claims.Subject
+	}
+	if len(base) > 90 {
+		base = base[:90]
+	}
+
+	username := base
+	for i := 2; ; i++ {
+		existing, err := s.DB.GetUserByUsername(username)
+		if err != nil {
+			return nil, err
+		}
+		if existing == nil {
+			break
+		}
+		username = fmt.Sprintf("%s-%d", base, i)
+	}
+
+	// An empty password hash never verifies, so the account can only sign in via OIDC
+	user := &User{Username: username}
+	if email != "" {
+		user.Email = &email
+	}
+	if err := s.DB.CreateUser(user); err != nil {
+		return nil, err
+	}
+
+	log.Printf("Created user %s (id=%d) from OIDC identity %s", user.Username, user.ID, claims.Subject)
+	return user, nil
+}
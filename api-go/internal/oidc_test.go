@@ -0,0 +1,443 @@
+package internal
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testClientID     = "hsa-api"
+	testClientSecret = "s3cret"
+	testRedirectURL  = "http://app.test/api/auth/oidc/callback"
+)
+
+// mockIssuer is a minimal OpenID provider: discovery, JWKS, an authorization
+// endpoint that approves every request, and a token endpoint that checks the
+// PKCE verifier before issuing an ID token
+type mockIssuer struct {
+	*httptest.Server
+	t      *testing.T
+	rsaKey *rsa.PrivateKey
+	ecKey  *ecdsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]url.Values // authorization request of each issued code
+	// alg signs the ID tokens; claims, when set, edits them first
+	alg    string
+	claims func(map[string]interface{})
+	// rotated publishes only a new RSA key, under another kid
+	rotated *rsa.PrivateKey
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	t.Helper()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := &mockIssuer{t: t, rsaKey: rsaKey, ecKey: ecKey, codes: map[string]url.Values{}, alg: "RS256"}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", m.discovery)
+	mux.HandleFunc("/jwks", m.jwks)
+	mux.HandleFunc("/authorize", m.authorize)
+	mux.HandleFunc("/token", m.token)
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+	return m
+}
+
+func (m *mockIssuer) provider() *OIDCProvider {
+	return NewOIDCProvider(OIDCConfig{
+		IssuerURL:    m.URL,
+		ClientID:     testClientID,
+		ClientSecret: testClientSecret,
+		RedirectURL:  testRedirectURL,
+	})
+}
+
+func (m *mockIssuer) discovery(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]string{
+		"issuer":                 m.URL,
+		"authorization_endpoint": m.URL + "/authorize",
+		"token_endpoint":         m.URL + "/token",
+		"jwks_uri":               m.URL + "/jwks",
+	})
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func (m *mockIssuer) jwks(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rsaJWK := func(kid string, key *rsa.PublicKey) map[string]string {
+		return map[string]string{"kty": "RSA", "kid": kid, "use": "sig",
+			"n": b64(key.N.Bytes()), "e": b64(big.NewInt(int64(key.E)).Bytes())}
+	}
+	keys := []map[string]string{
+		rsaJWK("rsa-1", &m.rsaKey.PublicKey),
+		{"kty": "EC", "kid": "ec-1", "crv": "P-256",
+			"x": b64(m.ecKey.X.FillBytes(make([]byte, 32))), "y": b64(m.ecKey.Y.FillBytes(make([]byte, 32)))},
+		// Encryption keys are not for verifying signatures
+		{"kty": "RSA", "kid": "enc-1", "use": "enc", "n": b64(m.rsaKey.N.Bytes()), "e": "AQAB"},
+	}
+	if m.rotated != nil {
+		keys = []map[string]string{rsaJWK("rsa-2", &m.rotated.PublicKey)}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+}
+
+// authorize approves the request and redirects back with a code
+func (m *mockIssuer) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("response_type") != "code" || q.Get("client_id") != testClientID || q.Get("code_challenge_method") != "S256" {
+		http.Error(w, "invalid_request", http.StatusBadRequest)
+		return
+	}
+
+	code := fmt.Sprintf("code-%d", time.Now().UnixNano())
+	m.mu.Lock()
+	m.codes[code] = q
+	m.mu.Unlock()
+
+	http.Redirect(w, r, q.Get("redirect_uri")+"?"+url.Values{"code": {code}, "state": {q.Get("state")}}.Encode(), http.StatusFound)
+}
+
+// token redeems a code once, for the client that asked for it and the
+// verifier matching its challenge
+func (m *mockIssuer) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil || r.Method != http.MethodPost {
+		http.Error(w, "invalid_request", http.StatusBadRequest)
+		return
+	}
+	if id, secret, ok := r.BasicAuth(); !ok || id != testClientID || secret != testClientSecret {
+		http.Error(w, "invalid_client", http.StatusUnauthorized)
+		return
+	}
+
+	m.mu.Lock()
+	auth, ok := m.codes[r.PostForm.Get("code")]
+	delete(m.codes, r.PostForm.Get("code"))
+	m.mu.Unlock()
+
+	challenge := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	switch {
+	case !ok, r.PostForm.Get("grant_type") != "authorization_code",
+		r.PostForm.Get("redirect_uri") != auth.Get("redirect_uri"):
+		http.Error(w, "invalid_grant", http.StatusBadRequest)
+		return
+	case b64(challenge[:]) != auth.Get("code_challenge"):
+		http.Error(w, "invalid_grant: PKCE verification failed", http.StatusBadRequest)
+		return
+	}
+
+	claims := map[string]interface{}{
+		"iss":                m.URL,
+		"sub":                "user-42",
+		"aud":                testClientID,
+		"exp":                time.Now().Add(time.Hour).Unix(),
+		"iat":                time.Now().Unix(),
+		"nonce":              auth.Get("nonce"),
+		"email":              "sam@example.com",
+		"email_verified":     true,
+		"preferred_username": "sam",
+	}
+	if m.claims != nil {
+		m.claims(claims)
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"access_token": "unused",
+		"token_type":   "Bearer",
+		"id_token":     m.sign(m.alg, "", claims),
+	})
+}
+
+// sign builds a compact JWS. kid defaults to the key the algorithm uses.
+// Besides RS256 and ES256 it makes the tokens an attacker would try: alg
+// "none", and HS256 keyed with the issuer's public key.
+func (m *mockIssuer) sign(alg, kid string, claims map[string]interface{}) string {
+	m.t.Helper()
+
+	if kid == "" {
+		kid = "rsa-1"
+		if strings.HasPrefix(alg, "ES") {
+			kid = "ec-1"
+		}
+	}
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	input := b64(header) + "." + b64(payload)
+	digest := sha256.Sum256([]byte(input))
+
+	var signature []byte
+	var err error
+	switch alg {
+	case "RS256":
+		key := m.rsaKey
+		if kid == "rsa-2" {
+			key = m.rotated
+		}
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	case "ES256":
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, m.ecKey, digest[:])
+		if err == nil {
+			signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		}
+	case "HS256":
+		der, _ := x509.MarshalPKIXPublicKey(&m.rsaKey.PublicKey)
+		mac := hmac.New(sha256.New, der)
+		mac.Write([]byte(input))
+		signature = mac.Sum(nil)
+	case "none":
+	default:
+		m.t.Fatalf("cannot sign with %s", alg)
+	}
+	if err != nil {
+		m.t.Fatal(err)
+	}
+	return input + "." + b64(signature)
+}
+
+// login runs the authorization code flow up to the callback and returns the
+// code, after checking the authorization request the provider built
+func login(t *testing.T, p *OIDCProvider, state, nonce, verifier string) string {
+	t.Helper()
+
+	authURL, err := p.AuthCodeURL(state, nonce, verifier)
+	if err != nil {
+		t.Fatalf("AuthCodeURL: %v", err)
+	}
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	challenge := sha256.Sum256([]byte(verifier))
+	if q.Get("code_challenge") != b64(challenge[:]) || q.Get("code_challenge_method") != "S256" {
+		t.Errorf("authorization request has challenge %q (%s)", q.Get("code_challenge"), q.Get("code_challenge_method"))
+	}
+	if q.Get("scope") != "openid email profile" || q.Get("state") != state || q.Get("nonce") != nonce {
+		t.Errorf("authorization request has scope %q, state %q, nonce %q", q.Get("scope"), q.Get("state"), q.Get("nonce"))
+	}
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorize returned %d", resp.StatusCode)
+	}
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if callback.Query().Get("state") != state {
+		t.Fatalf("callback state %q, want %q", callback.Query().Get("state"), state)
+	}
+	return callback.Query().Get("code")
+}
+
+func TestOIDCDiscovery(t *testing.T) {
+	m := newMockIssuer(t)
+
+	d, err := m.provider().Discover()
+	if err != nil {
+		t.Fatalf("Discover: %v", err)
+	}
+	if d.Issuer != m.URL || d.TokenEndpoint != m.URL+"/token" || d.JWKSURI != m.URL+"/jwks" {
+		t.Errorf("discovery = %+v", d)
+	}
+
+	// The discovery document must name the configured issuer
+	impostor := httptest.NewServer(http.HandlerFunc(m.discovery))
+	defer impostor.Close()
+	p := NewOIDCProvider(OIDCConfig{IssuerURL: impostor.URL, ClientID: testClientID})
+	if _, err := p.Discover(); err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Errorf("Discover with a mismatched issuer: %v", err)
+	}
+}
+
+func TestOIDCCodeExchange(t *testing.T) {
+	for _, alg := range []string{"RS256", "ES256"} {
+		t.Run(alg, func(t *testing.T) {
+			m := newMockIssuer(t)
+			m.alg = alg
+			p := m.provider()
+
+			code := login(t, p, "state-1", "nonce-1", "verifier-0123456789-0123456789-0123456789")
+			claims, err := p.Exchange(code, "verifier-0123456789-0123456789-0123456789", "nonce-1")
+			if err != nil {
+				t.Fatalf("Exchange: %v", err)
+			}
+			if claims.Issuer != m.URL || claims.Subject != "user-42" || claims.Email != "sam@example.com" ||
+				!claims.EmailVerified || claims.PreferredUsername != "sam" {
+				t.Errorf("claims = %+v", claims)
+			}
+
+			// A code is redeemed once
+			if _, err := p.Exchange(code, "verifier-0123456789-0123456789-0123456789", "nonce-1"); err == nil {
+				t.Error("a code was redeemed twice")
+			}
+		})
+	}
+}
+
+func TestOIDCExchangeRejectsWrongVerifier(t *testing.T) {
+	m := newMockIssuer(t)
+	p := m.provider()
+
+	code := login(t, p, "state-1", "nonce-1", "the-right-verifier-0123456789-0123456789")
+	_, err := p.Exchange(code, "a-wrong-verifier-0123456789-0123456789", "nonce-1")
+	if err == nil || !strings.Contains(err.Error(), "PKCE") {
+		t.Errorf("Exchange with the wrong verifier: %v", err)
+	}
+}
+
+func TestOIDCExchangeRejectsBadNonce(t *testing.T) {
+	m := newMockIssuer(t)
+	p := m.provider()
+
+	code := login(t, p, "state-1", "nonce-1", "verifier-0123456789-0123456789-0123456789")
+	_, err := p.Exchange(code, "verifier-0123456789-0123456789-0123456789", "nonce-of-another-login")
+	if err == nil || !strings.Contains(err.Error(), "nonce") {
+		t.Errorf("Exchange with another login's nonce: %v", err)
+	}
+}
+
+func TestOIDCExchangeRejectsBadAudience(t *testing.T) {
+	m := newMockIssuer(t)
+	m.claims = func(c map[string]interface{}) { c["aud"] = []string{"another-client"} }
+	p := m.provider()
+
+	code := login(t, p, "state-1", "nonce-1", "verifier-0123456789-0123456789-0123456789")
+	_, err := p.Exchange(code, "verifier-0123456789-0123456789-0123456789", "nonce-1")
+	if err == nil || !strings.Contains(err.Error(), "audience") {
+		t.Errorf("Exchange of a token for another client: %v", err)
+	}
+}
+
+func TestOIDCVerifyIDToken(t *testing.T) {
+	m := newMockIssuer(t)
+	p := m.provider()
+
+	valid := func() map[string]interface{} {
+		return map[string]interface{}{
+			"iss":   m.URL,
+			"sub":   "user-42",
+			"aud":   []string{"someone-else", testClientID},
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"iat":   time.Now().Unix(),
+			"nonce": "nonce-1",
+		}
+	}
+	with := func(key string, value interface{}) map[string]interface{} {
+		c := valid()
+		if value == nil {
+			delete(c, key)
+		} else {
+			c[key] = value
+		}
+		return c
+	}
+
+	if _, err := p.VerifyIDToken(m.sign("RS256", "", valid()), "nonce-1"); err != nil {
+		t.Fatalf("valid RS256 token: %v", err)
+	}
+	if _, err := p.VerifyIDToken(m.sign("ES256", "", valid()), "nonce-1"); err != nil {
+		t.Fatalf("valid ES256 token: %v", err)
+	}
+
+	tampered := m.sign("RS256", "", valid())
+	parts := strings.Split(tampered, ".")
+	payload, _ := json.Marshal(with("sub", "admin"))
+	tampered = parts[0] + "." + b64(payload) + "." + parts[2]
+
+	tests := []struct {
+		name  string
+		token string
+		want  string
+	}{
+		{"wrong nonce", m.sign("RS256", "", with("nonce", "nonce-2")), "nonce"},
+		{"missing nonce", m.sign("RS256", "", with("nonce", nil)), "nonce"},
+		{"wrong audience", m.sign("RS256", "", with("aud", "another-client")), "audience"},
+		{"wrong issuer", m.sign("RS256", "", with("iss", "https://evil.example")), "issuer"},
+		{"expired", m.sign("RS256", "", with("exp", time.Now().Add(-time.Hour).Unix())), "expired"},
+		{"issued in the future", m.sign("RS256", "", with("iat", time.Now().Add(time.Hour).Unix())), "future"},
+		{"no subject", m.sign("RS256", "", with("sub", "")), "subject"},
+		{"alg none", m.sign("none", "rsa-1", valid()), "algorithm"},
+		{"HS256 keyed with the public key", m.sign("HS256", "rsa-1", valid()), "algorithm"},
+		{"RS256 header on an EC key", m.sign("RS256", "ec-1", valid()), "does not match"},
+		{"ES256 header on an RSA key", strings.Replace(m.sign("ES256", "ec-1", valid()),
+			b64([]byte(`{"alg":"ES256","kid":"ec-1","typ":"JWT"}`)),
+			b64([]byte(`{"alg":"ES256","kid":"rsa-1","typ":"JWT"}`)), 1), "does not match"},
+		{"encryption key", m.sign("RS256", "enc-1", valid()), "no OIDC signing key"},
+		{"tampered payload", tampered, "signature"},
+		{"malformed", "not-a-jwt", "malformed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := p.VerifyIDToken(tt.token, "nonce-1")
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got %v, want an error about %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestOIDCSigningKeyRotation(t *testing.T) {
+	m := newMockIssuer(t)
+	p := m.provider()
+
+	claims := map[string]interface{}{
+		"iss": m.URL, "sub": "user-42", "aud": testClientID,
+		"exp": time.Now().Add(time.Hour).Unix(), "nonce": "n",
+	}
+	if _, err := p.VerifyIDToken(m.sign("RS256", "", claims), "n"); err != nil {
+		t.Fatalf("before rotation: %v", err)
+	}
+
+	rotated, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.mu.Lock()
+	m.rotated = rotated
+	m.mu.Unlock()
+
+	// An unknown kid refetches the key set
+	if _, err := p.VerifyIDToken(m.sign("RS256", "rsa-2", claims), "n"); err != nil {
+		t.Fatalf("token signed with the new key: %v", err)
+	}
+	if _, err := p.VerifyIDToken(m.sign("RS256", "rsa-1", claims), "n"); err == nil {
+		t.Error("token signed with the retired key was accepted")
+	}
+}
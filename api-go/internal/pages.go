@@ -0,0 +1,432 @@
+package internal
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// GetReceiptsWithoutPageCount returns receipts whose files have not been
+// counted yet, oldest first
+func (db *Database) GetReceiptsWithoutPageCount() ([]Receipt, error) {
+	query := `
+        SELECT ` + receiptColumns + `
+        FROM receipts r
+        WHERE r.page_count IS NULL AND COALESCE(r.image_path, '') <> ''
+        ORDER BY r.id
+    `
+
+	rows, err := db.conn.Query(query)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanReceipts(rows)
+}
+
+// SetReceiptPageCount records the number of pages in a receipt's file
+func (db *Database) SetReceiptPageCount(receiptID int, pageCount int) error {
+	_, err := db.conn.Exec("UPDATE receipts SET page_count = $1 WHERE id = $2", pageCount, receiptID)
+	return err
+}
+
+// BackfillPageCounts counts the pages of PDFs uploaded before page counts
+// were kept. A PDF that cannot be read counts as one page, so it is not
+// read again at every start.
+func (s *Server) BackfillPageCounts() (int, error) {
+	receipts, err := s.DB.GetReceiptsWithoutPageCount()
+	if err != nil {
+		return 0, err
+	}
+
+	counted := 0
+	for _, r := range receipts {
+		data, err := s.ReadReceiptFile(r.ImagePath)
+		if err != nil {
+			log.Printf("Warning: Cannot read receipt %d file to count its pages: %v", r.ID, err)
+			continue
+		}
+		pageCount, err := DocumentPageCount(r.ImagePath, data)
+		if err != nil {
+			log.Printf("Warning: Cannot count the pages of receipt %d: %v", r.ID, err)
+		}
+		if err := s.DB.SetReceiptPageCount(r.ID, pageCount); err != nil {
+			return counted, fmt.Errorf("failed to save page count of receipt %d: %v", r.ID, err)
+		}
+		counted++
+	}
+	return counted, nil
+}
+
+// receiptBaseName is a receipt's upload name without its extension, for
+// naming the files split from or merged out of it
+func receiptBaseName(receipt *Receipt) string {
+	name := receipt.OriginalName
+	if name == "" {
+		name = path.Base(receipt.ImagePath)
+	}
+	return strings.TrimSuffix(name, path.Ext(name))
+}
+
+// receiptClaimed reports whether any of a receipt has been used, so it can
+// no longer be replaced by split or merged receipts
+func receiptClaimed(receipt *Receipt) bool {
+	return receipt.Used || receipt.RemainingAmount != receipt.QualifiedAmount
+}
+
+// ReplaceUnclaimedReceipts gives each receipt in replacements the other
+// attachments of the receipts in ids, then deletes those receipts, in one
+// transaction. A receipt that has been claimed is not deleted, checked in
+// the same statement so a claim cannot slip in between; then nothing is
+// changed and the error is ErrReceiptClaimed, or sql.ErrNoRows if one was
+// deleted instead.
+func (db *Database) ReplaceUnclaimedReceipts(householdID int, ids []int, replacements []int) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, id := range ids {
+		for _, replacement := range replacements {
+			if err := copyAttachments(tx, id, replacement); err != nil {
+				return fmt.Errorf("failed to keep attachments: %v", err)
+			}
+		}
+	}
+
+	result, err := tx.Exec(`
+        DELETE FROM receipts
+        WHERE id = ANY($1) AND household_id = $2 AND used = false AND remaining_amount = qualified_amount
+    `, pq.Array(ids), householdID)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == int64(len(ids)) {
+		return tx.Commit()
+	}
+
+	// Whatever is left of ids was claimed
+	var claimed bool
+	err = tx.QueryRow("SELECT EXISTS (SELECT 1 FROM receipts WHERE id = ANY($1) AND household_id = $2)",
+		pq.Array(ids), householdID).Scan(&claimed)
+	if err != nil {
+		return err
+	}
+	if claimed {
+		return ErrReceiptClaimed
+	}
+	return sql.ErrNoRows
+}
+
+// replaceReceipts replaces receipts split or merged into replacements with
+// ReplaceUnclaimedReceipts, then deletes their files unless another receipt
+// still references them. The receipts are left in place on error.
+func (s *Server) replaceReceipts(receipts []*Receipt, replacements []int) error {
+	ids := make([]int, len(receipts))
+	attachments := make([][]Attachment, len(receipts))
+	for i, receipt := range receipts {
+		ids[i] = receipt.ID
+		var err error
+		if attachments[i], err = s.DB.GetReceiptAttachments(receipt.ID); err != nil {
+			return fmt.Errorf("failed to get attachments: %v", err)
+		}
+	}
+
+	if err := s.DB.ReplaceUnclaimedReceipts(receipts[0].HouseholdID, ids, replacements); err != nil {
+		return err
+	}
+	for i, receipt := range receipts {
+		s.DeleteReceiptFiles(receipt, attachments[i])
+	}
+	return nil
+}
+
+// discardReceipts deletes the receipts created by a split or merge that did
+// not go through, with their files
+func (s *Server) discardReceipts(householdID int, ids []int) {
+	for _, id := range ids {
+		receipt, err := s.DB.GetReceiptByID(householdID, id)
+		if err != nil {
+			log.Printf("Warning: Failed to get receipt %d to discard it: %v", id, err)
+			continue
+		}
+		attachments, err := s.DB.GetReceiptAttachments(id)
+		if err != nil {
+			log.Printf("Warning: Failed to get receipt %d attachments to discard it: %v", id, err)
+			continue
+		}
+		if err := s.DB.DeleteReceipt(householdID, id); err != nil {
+			log.Printf("Warning: Failed to discard receipt %d: %v", id, err)
+			continue
+		}
+		s.DeleteReceiptFiles(receipt, attachments)
+	}
+}
+
+// ReceiptSplitHandler splits a multi-page PDF receipt into several:
+// POST /api/receipts/{id}/split with {"pages": ["1-2", "3", "4-"]}. Each
+// entry becomes a new receipt holding those pages, uploaded by the same
+// user for the same member, with its own OCR job and the original's other
+// attachments. The original receipt is deleted once every part is saved.
+// If any part fails, or the original cannot be replaced, e.g. because it
+// was claimed meanwhile, the parts saved so far are deleted and the
+// original is kept.
+func (s *Server) ReceiptSplitHandler(w http.ResponseWriter, r *http.Request, receiptID int) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	membership := CurrentMembership(r)
+	if !membership.CanWrite() {
+		http.Error(w, "Viewers cannot change receipts", http.StatusForbidden)
+		return
+	}
+
+	var req struct {
+		Pages []string `json:"pages"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Pages) == 0 {
+		http.Error(w, "pages is required, e.g. [\"1-2\", \"3\"]", http.StatusBadRequest)
+		return
+	}
+
+	receipt, err := s.DB.GetReceiptByID(membership.HouseholdID, receiptID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Receipt not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Failed to get receipt: %v", err)
+		http.Error(w, "Failed to get receipt", http.StatusInternalServerError)
+		return
+	}
+	if receiptClaimed(receipt) {
+		http.Error(w, ErrReceiptClaimed.Error(), http.StatusConflict)
+		return
+	}
+	if !IsPDF(receipt.ImagePath, nil) {
+		http.Error(w, "Only PDF receipts can be split", http.StatusBadRequest)
+		return
+	}
+
+	data, err := s.ReadReceiptFile(receipt.ImagePath)
+	if err != nil {
+		log.Printf("Failed to read receipt %d file: %v", receipt.ID, err)
+		http.Error(w, "Failed to read receipt file", http.StatusInternalServerError)
+		return
+	}
+	pageCount, err := PDFPageCount(data)
+	if err != nil {
+		http.Error(w, "Cannot read the PDF: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Every part is cut before anything is saved, so a bad range changes
+	// nothing
+	var parts []DocumentFile
+	for _, spec := range req.Pages {
+		pages, err := ParsePageRanges(spec, pageCount)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		part, err := ExtractPDFPages(data, pages)
+		if err != nil {
+			http.Error(w, "Cannot split the PDF: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		name := strings.NewReplacer(" ", "", ",", "_").Replace(spec)
+		parts = append(parts, DocumentFile{Filename: fmt.Sprintf("%s-p%s.pdf", receiptBaseName(receipt), name), Data: part})
+	}
+
+	memberID := 0
+	if receipt.MemberID != nil {
+		memberID = *receipt.MemberID
+	}
+	saved := true
+	var partIDs, created []int
+	results := make([]UploadResult, 0, len(parts))
+	for _, part := range parts {
+		result := s.IngestReceipt(ReceiptUpload{
+			Username:       receipt.UserID,
+			HouseholdID:    receipt.HouseholdID,
+			MemberID:       memberID,
+			Filename:       part.Filename,
+			Data:           part.Data,
+			AllowDuplicate: true,
+		})
+		switch {
+		case result.Status == UploadCreated:
+			partIDs = append(partIDs, result.ReceiptID)
+			created = append(created, result.ReceiptID)
+		case result.Status == UploadDuplicate && result.Receipt != nil && result.Receipt.ID != receipt.ID:
+			// The part was already uploaded as a receipt of its own
+			partIDs = append(partIDs, result.Receipt.ID)
+		default:
+			// A part identical to the receipt being split leaves it in place
+			saved = false
+		}
+		results = append(results, result)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !saved {
+		s.discardReceipts(receipt.HouseholdID, created)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message": "Some parts could not be saved; the original receipt was kept",
+			"results": results,
+		})
+		return
+	}
+
+	if err := s.replaceReceipts([]*Receipt{receipt}, partIDs); err != nil {
+		s.discardReceipts(receipt.HouseholdID, created)
+		switch err {
+		case ErrReceiptClaimed:
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]string{"message": err.Error()})
+		case sql.ErrNoRows:
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"message": "The receipt was deleted meanwhile"})
+		default:
+			log.Printf("Failed to replace split receipt %d: %v", receipt.ID, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"message": "Failed to replace the receipt; the original receipt was kept"})
+		}
+		return
+	}
+	log.Printf("User %s split receipt %d into %d receipts", CurrentUser(r).Username, receipt.ID, len(parts))
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": fmt.Sprintf("Receipt split into %d receipts", len(parts)),
+		"results": results,
+	})
+}
+
+// MergeReceiptsHandler combines receipts into one:
+// POST /api/receipts/merge with {"receipt_ids": [3, 4, 5]}. Their files
+// become one PDF, in the order given, saved as a new receipt for the first
+// receipt's member with its own OCR job and the merged receipts' other
+// attachments; the merged receipts are deleted, all in one transaction. If
+// any of them cannot be, e.g. because it was claimed meanwhile, none is and
+// the new receipt is deleted instead. Images become pages of
+// their own; HEIC photos cannot be combined.
+func (s *Server) MergeReceiptsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	membership := CurrentMembership(r)
+	if !membership.CanWrite() {
+		http.Error(w, "Viewers cannot change receipts", http.StatusForbidden)
+		return
+	}
+
+	var req struct {
+		ReceiptIDs []int `json:"receipt_ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	var receipts []*Receipt
+	var files []DocumentFile
+	seen := map[int]bool{}
+	for _, id := range req.ReceiptIDs {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+
+		receipt, err := s.DB.GetReceiptByID(membership.HouseholdID, id)
+		if err == sql.ErrNoRows {
+			http.Error(w, fmt.Sprintf("Receipt %d not found", id), http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Printf("Failed to get receipt: %v", err)
+			http.Error(w, "Failed to get receipt", http.StatusInternalServerError)
+			return
+		}
+		if receiptClaimed(receipt) {
+			http.Error(w, fmt.Sprintf("Receipt %d: %v", id, ErrReceiptClaimed), http.StatusConflict)
+			return
+		}
+
+		data, err := s.ReadReceiptFile(receipt.ImagePath)
+		if err != nil {
+			log.Printf("Failed to read receipt %d file: %v", receipt.ID, err)
+			http.Error(w, "Failed to read receipt file", http.StatusInternalServerError)
+			return
+		}
+		receipts = append(receipts, receipt)
+		// The stored key's extension tells what the file is
+		files = append(files, DocumentFile{Filename: receipt.ImagePath, Data: data})
+	}
+	if len(receipts) < 2 {
+		http.Error(w, "receipt_ids must name at least two receipts", http.StatusBadRequest)
+		return
+	}
+
+	merged, err := MergeDocuments(files)
+	if err != nil {
+		http.Error(w, "Cannot combine the receipts: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	first := receipts[0]
+	memberID := 0
+	if first.MemberID != nil {
+		memberID = *first.MemberID
+	}
+	result := s.IngestReceipt(ReceiptUpload{
+		Username:       CurrentUser(r).Username,
+		HouseholdID:    membership.HouseholdID,
+		MemberID:       memberID,
+		Filename:       receiptBaseName(first) + "-merged.pdf",
+		Data:           merged,
+		AllowDuplicate: true,
+	})
+
+	if result.Status == UploadCreated {
+		if err := s.replaceReceipts(receipts, []int{result.ReceiptID}); err != nil {
+			s.discardReceipts(membership.HouseholdID, []int{result.ReceiptID})
+			switch err {
+			case ErrReceiptClaimed:
+				http.Error(w, err.Error(), http.StatusConflict)
+			case sql.ErrNoRows:
+				http.Error(w, "A receipt being merged was deleted meanwhile", http.StatusNotFound)
+			default:
+				log.Printf("Failed to replace merged receipts %v: %v", req.ReceiptIDs, err)
+				http.Error(w, "Failed to replace the merged receipts", http.StatusInternalServerError)
+			}
+			return
+		}
+		log.Printf("User %s merged receipts %v into receipt %d", CurrentUser(r).Username, req.ReceiptIDs, result.ReceiptID)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	switch result.Status {
+	case UploadCreated:
+		w.WriteHeader(http.StatusAccepted)
+	case UploadDuplicate:
+		w.WriteHeader(http.StatusConflict)
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	json.NewEncoder(w).Encode(result)
+}
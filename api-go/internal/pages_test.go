@@ -0,0 +1,53 @@
+package internal
+
+import (
+	"database/sql"
+	"testing"
+)
+
+func TestReplaceUnclaimedReceipts(t *testing.T) {
+	db, householdID := testDatabase(t)
+	a := createTestReceipt(t, db, householdID, 1000)
+	b := createTestReceipt(t, db, householdID, 2000)
+	c := createTestReceipt(t, db, householdID, 3000)
+	merged := createTestReceipt(t, db, householdID, 6000)
+	ids := []int{a.ID, b.ID, c.ID}
+
+	exists := func(r *Receipt) bool {
+		t.Helper()
+		_, err := db.GetReceiptByID(householdID, r.ID)
+		if err != nil && err != sql.ErrNoRows {
+			t.Fatal(err)
+		}
+		return err == nil
+	}
+
+	// One claimed receipt keeps all of them
+	if err := db.UpdateReceipt(b, BalanceChange{Apply: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.ReplaceUnclaimedReceipts(householdID, ids, []int{merged.ID}); err != ErrReceiptClaimed {
+		t.Fatalf("replacing with one receipt claimed: %v", err)
+	}
+	for _, r := range []*Receipt{a, b, c} {
+		if !exists(r) {
+			t.Errorf("receipt %d was deleted although receipt %d is claimed", r.ID, b.ID)
+		}
+	}
+
+	if err := db.UpdateReceipt(b, BalanceChange{Release: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.ReplaceUnclaimedReceipts(householdID, ids, []int{merged.ID}); err != nil {
+		t.Fatalf("replacing unclaimed receipts: %v", err)
+	}
+	for _, r := range []*Receipt{a, b, c} {
+		if exists(r) {
+			t.Errorf("receipt %d was not deleted", r.ID)
+		}
+	}
+
+	if err := db.ReplaceUnclaimedReceipts(householdID, []int{a.ID}, []int{merged.ID}); err != sql.ErrNoRows {
+		t.Errorf("replacing a deleted receipt: %v", err)
+	}
+}
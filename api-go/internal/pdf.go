@@ -0,0 +1,1504 @@
+package internal
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The PDF support here is what receipts need: count pages, copy some pages
+// into a new file, and join PDFs and images into one. Pages are copied with
+// everything they reference (fonts, images, form field appearances), but
+// links to pages left behind, bookmarks and the document outline are not.
+
+var (
+	// ErrNotPDF is returned for a file that is not a readable PDF
+	ErrNotPDF = errors.New("not a readable PDF")
+	// ErrPDFEncrypted is returned when splitting or combining an encrypted
+	// PDF, whose pages cannot be copied without its key
+	ErrPDFEncrypted = errors.New("encrypted PDFs cannot be split or combined")
+	// ErrUnsupportedDocument is returned when combining a file that is
+	// neither a PDF nor a JPEG, PNG or GIF image
+	ErrUnsupportedDocument = errors.New("only PDF, JPEG, PNG and GIF files can be combined into a PDF")
+)
+
+// pdfMaxDepth bounds the nesting of PDF objects and of the page tree, so a
+// malformed or hostile file cannot exhaust the stack
+const pdfMaxDepth = 100
+
+// pdfMaxDecoded bounds a decompressed cross-reference or object stream
+const pdfMaxDecoded = 64 << 20
+
+// DocumentFile is a receipt file by name, e.g. one of several to combine
+type DocumentFile struct {
+	Filename string
+	Data     []byte
+}
+
+// IsPDF reports whether a file is a PDF, by its extension or its signature
+func IsPDF(filename string, data []byte) bool {
+	return strings.EqualFold(path.Ext(filename), ".pdf") || bytes.HasPrefix(data, []byte("%PDF-"))
+}
+
+// DocumentPageCount is the number of pages in a receipt file: a PDF's page
+// count, or 1 for an image or a PDF that cannot be read
+func DocumentPageCount(filename string, data []byte) (int, error) {
+	if !IsPDF(filename, data) {
+		return 1, nil
+	}
+	n, err := PDFPageCount(data)
+	if err != nil {
+		return 1, err
+	}
+	return n, nil
+}
+
+// PDFPageCount counts a PDF's pages. Encrypted PDFs can be counted, since
+// the page tree itself is not encrypted.
+func PDFPageCount(data []byte) (int, error) {
+	doc, err := parsePDF(data)
+	if err != nil {
+		return 0, err
+	}
+	pages, err := doc.pages()
+	if err != nil {
+		return 0, err
+	}
+	return len(pages), nil
+}
+
+// ExtractPDFPages returns a new PDF holding the given 1-based pages of a
+// PDF, in the order given
+func ExtractPDFPages(data []byte, pages []int) ([]byte, error) {
+	doc, err := parsePDF(data)
+	if err != nil {
+		return nil, err
+	}
+	if doc.encrypted() {
+		return nil, ErrPDFEncrypted
+	}
+	all, err := doc.pages()
+	if err != nil {
+		return nil, err
+	}
+
+	selected := make([]pdfPage, len(pages))
+	for i, n := range pages {
+		if n < 1 || n > len(all) {
+			return nil, fmt.Errorf("page %d is out of range, the PDF has %d pages", n, len(all))
+		}
+		selected[i] = all[n-1]
+	}
+
+	w := newPDFWriter()
+	if err := w.importPages(doc, selected); err != nil {
+		return nil, err
+	}
+	return w.bytes(), nil
+}
+
+// MergeDocuments combines files into one PDF: every page of each PDF and
+// each image as a page of its own, in the order given
+func MergeDocuments(files []DocumentFile) ([]byte, error) {
+	w := newPDFWriter()
+	for _, file := range files {
+		if !IsPDF(file.Filename, file.Data) {
+			if err := w.addImagePage(file.Data); err != nil {
+				return nil, fmt.Errorf("%s: %w", file.Filename, err)
+			}
+			continue
+		}
+
+		doc, err := parsePDF(file.Data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file.Filename, err)
+		}
+		if doc.encrypted() {
+			return nil, fmt.Errorf("%s: %w", file.Filename, ErrPDFEncrypted)
+		}
+		pages, err := doc.pages()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file.Filename, err)
+		}
+		if err := w.importPages(doc, pages); err != nil {
+			return nil, fmt.Errorf("%s: %w", file.Filename, err)
+		}
+	}
+	return w.bytes(), nil
+}
+
+// ParsePageRanges reads a page selection like "1-3,5,7-" (7 to the last
+// page) into page numbers, checking each against pageCount
+func ParsePageRanges(spec string, pageCount int) ([]int, error) {
+	var pages []int
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		first, last, isRange := strings.Cut(part, "-")
+		from, err := strconv.Atoi(strings.TrimSpace(first))
+		if err != nil {
+			return nil, fmt.Errorf("invalid page range %q", part)
+		}
+		to := from
+		if isRange {
+			to = pageCount
+			if last = strings.TrimSpace(last); last != "" {
+				if to, err = strconv.Atoi(last); err != nil {
+					return nil, fmt.Errorf("invalid page range %q", part)
+				}
+			}
+		}
+		if from < 1 || to > pageCount || from > to {
+			return nil, fmt.Errorf("page range %q is outside pages 1-%d", part, pageCount)
+		}
+		for n := from; n <= to; n++ {
+			pages = append(pages, n)
+		}
+	}
+	if len(pages) == 0 {
+		return nil, fmt.Errorf("no pages selected")
+	}
+	return pages, nil
+}
+
+// PDF object model. Numbers are int64 or float64, booleans bool and null
+// nil; strings keep their bytes as read.
+type (
+	pdfObject  interface{}
+	pdfName    string
+	pdfStr     string
+	pdfKeyword string // obj, stream, R and other bare words; never a value
+	pdfArray   []pdfObject
+	pdfDict    map[pdfName]pdfObject
+	pdfRef     struct{ num, gen int }
+	pdfStream  struct {
+		dict pdfDict
+		data []byte // as stored, still encoded
+	}
+)
+
+// pdfLexer reads PDF objects from data starting at pos
+type pdfLexer struct {
+	data []byte
+	pos  int
+}
+
+func isPDFSpace(c byte) bool {
+	return c == ' ' || c == '\n' || c == '\r' || c == '\t' || c == '\f' || c == 0
+}
+
+func isPDFDelimiter(c byte) bool {
+	return strings.IndexByte("()<>[]{}/%", c) >= 0
+}
+
+func (l *pdfLexer) skipSpace() {
+	for l.pos < len(l.data) {
+		switch c := l.data[l.pos]; {
+		case isPDFSpace(c):
+			l.pos++
+		case c == '%':
+			for l.pos < len(l.data) && l.data[l.pos] != '\n' && l.data[l.pos] != '\r' {
+				l.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (l *pdfLexer) hasPrefix(s string) bool {
+	return bytes.HasPrefix(l.data[l.pos:], []byte(s))
+}
+
+// word reads the regular characters up to the next space or delimiter
+func (l *pdfLexer) word() string {
+	start := l.pos
+	for l.pos < len(l.data) && !isPDFSpace(l.data[l.pos]) && !isPDFDelimiter(l.data[l.pos]) {
+		l.pos++
+	}
+	return string(l.data[start:l.pos])
+}
+
+// integer reads an unsigned integer, as in cross-reference tables
+func (l *pdfLexer) integer() (int64, error) {
+	l.skipSpace()
+	word := l.word()
+	n, err := strconv.ParseInt(word, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: expected an integer at offset %d", ErrNotPDF, l.pos)
+	}
+	return n, nil
+}
+
+func (l *pdfLexer) object(depth int) (pdfObject, error) {
+	if depth > pdfMaxDepth {
+		return nil, fmt.Errorf("%w: objects nested too deeply", ErrNotPDF)
+	}
+	l.skipSpace()
+	if l.pos >= len(l.data) {
+		return nil, fmt.Errorf("%w: unexpected end of file", ErrNotPDF)
+	}
+
+	switch c := l.data[l.pos]; {
+	case c == '/':
+		l.pos++
+		return l.name(), nil
+	case c == '(':
+		l.pos++
+		return l.literalString(), nil
+	case c == '<' && l.hasPrefix("<<"):
+		l.pos += 2
+		return l.dict(depth)
+	case c == '<':
+		l.pos++
+		return l.hexString(), nil
+	case c == '[':
+		l.pos++
+		var array pdfArray
+		for {
+			l.skipSpace()
+			if l.pos >= len(l.data) {
+				return nil, fmt.Errorf("%w: unterminated array", ErrNotPDF)
+			}
+			if l.data[l.pos] == ']' {
+				l.pos++
+				return array, nil
+			}
+			obj, err := l.object(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			array = append(array, obj)
+		}
+	case c == '+' || c == '-' || c == '.' || (c >= '0' && c <= '9'):
+		return l.number(), nil
+	case isPDFDelimiter(c):
+		l.pos++
+		if c == '{' || c == '}' {
+			return pdfKeyword(c), nil
+		}
+		return nil, fmt.Errorf("%w: unexpected %q at offset %d", ErrNotPDF, c, l.pos-1)
+	default:
+		switch word := l.word(); word {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "null":
+			return nil, nil
+		default:
+			return pdfKeyword(word), nil
+		}
+	}
+}
+
+// number reads a number, or a reference when the integer is followed by a
+// generation number and R
+func (l *pdfLexer) number() pdfObject {
+	word := l.word()
+	if strings.ContainsRune(word, '.') {
+		f, _ := strconv.ParseFloat(word, 64)
+		return f
+	}
+	n, err := strconv.ParseInt(word, 10, 64)
+	if err != nil {
+		f, _ := strconv.ParseFloat(word, 64)
+		return f
+	}
+
+	if n >= 0 && !strings.HasPrefix(word, "+") {
+		save := l.pos
+		l.skipSpace()
+		if gen, err := strconv.Atoi(l.word()); err == nil && gen >= 0 {
+			l.skipSpace()
+			if l.pos < len(l.data) && l.data[l.pos] == 'R' &&
+				(l.pos+1 == len(l.data) || isPDFSpace(l.data[l.pos+1]) || isPDFDelimiter(l.data[l.pos+1])) {
+				l.pos++
+				return pdfRef{num: int(n), gen: gen}
+			}
+		}
+		l.pos = save
+	}
+	return n
+}
+
+func (l *pdfLexer) name() pdfName {
+	raw := l.word()
+	if !strings.Contains(raw, "#") {
+		return pdfName(raw)
+	}
+	var b strings.Builder
+	for i := 0; i < len(raw); i++ {
+		if raw[i] == '#' && i+2 < len(raw) {
+			if c, err := strconv.ParseUint(raw[i+1:i+3], 16, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 2
+				continue
+			}
+		}
+		b.WriteByte(raw[i])
+	}
+	return pdfName(b.String())
+}
+
+func (l *pdfLexer) literalString() pdfStr {
+	var b []byte
+	nesting := 0
+	for l.pos < len(l.data) {
+		c := l.data[l.pos]
+		l.pos++
+		switch {
+		case c == '(':
+			nesting++
+		case c == ')':
+			if nesting == 0 {
+				return pdfStr(b)
+			}
+			nesting--
+		case c == '\\' && l.pos < len(l.data):
+			c = l.data[l.pos]
+			l.pos++
+			switch c {
+			case 'n':
+				c = '\n'
+			case 'r':
+				c = '\r'
+			case 't':
+				c = '\t'
+			case 'b':
+				c = '\b'
+			case 'f':
+				c = '\f'
+			case '\r':
+				// A backslash at the end of a line continues the string
+				if l.pos < len(l.data) && l.data[l.pos] == '\n' {
+					l.pos++
+				}
+				continue
+			case '\n':
+				continue
+			default:
+				if c >= '0' && c <= '7' {
+					value := int(c - '0')
+					for i := 0; i < 2 && l.pos < len(l.data) && l.data[l.pos] >= '0' && l.data[l.pos] <= '7'; i++ {
+						value = value*8 + int(l.data[l.pos]-'0')
+						l.pos++
+					}
+					c = byte(value)
+				}
+			}
+		}
+		b = append(b, c)
+	}
+	return pdfStr(b)
+}
+
+func (l *pdfLexer) hexString() pdfStr {
+	var digits []byte
+	for l.pos < len(l.data) && l.data[l.pos] != '>' {
+		if c := l.data[l.pos]; !isPDFSpace(c) {
+			digits = append(digits, c)
+		}
+		l.pos++
+	}
+	l.pos++
+	if len(digits)%2 == 1 {
+		digits = append(digits, '0')
+	}
+	b := make([]byte, 0, len(digits)/2)
+	for i := 0; i < len(digits); i += 2 {
+		c, _ := strconv.ParseUint(string(digits[i:i+2]), 16, 8)
+		b = append(b, byte(c))
+	}
+	return pdfStr(b)
+}
+
+func (l *pdfLexer) dict(depth int) (pdfDict, error) {
+	dict := pdfDict{}
+	for {
+		l.skipSpace()
+		if l.pos >= len(l.data) {
+			return nil, fmt.Errorf("%w: unterminated dictionary", ErrNotPDF)
+		}
+		if l.hasPrefix(">>") {
+			l.pos += 2
+			return dict, nil
+		}
+		key, err := l.object(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		name, ok := key.(pdfName)
+		if !ok {
+			return nil, fmt.Errorf("%w: dictionary key is not a name at offset %d", ErrNotPDF, l.pos)
+		}
+		value, err := l.object(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		dict[name] = value
+	}
+}
+
+// pdfXrefEntry locates an object: at an offset in the file, or at an index
+// in a compressed object stream
+type pdfXrefEntry struct {
+	offset   int64
+	inStream bool
+	stream   int
+}
+
+// pdfDocument is a parsed PDF. Objects are read when first needed.
+type pdfDocument struct {
+	data    []byte
+	xref    map[int]pdfXrefEntry
+	trailer pdfDict
+	objects map[int]pdfObject
+	streams map[int]map[int]pdfObject // parsed object streams
+	loading map[int]bool
+}
+
+// pdfPage is a leaf of the page tree with its inherited attributes
+// (resources, page boxes and rotation) filled in
+type pdfPage struct {
+	ref  pdfRef
+	dict pdfDict
+}
+
+// pdfInherited are the page attributes a page takes from its ancestors
+var pdfInherited = []pdfName{"Resources", "MediaBox", "CropBox", "Rotate"}
+
+// pdfObjectHeader finds "12 0 obj" when the cross-reference data is broken
+var pdfObjectHeader = regexp.MustCompile(`\b(\d+)[ \t\r\n\f\x00]+(\d+)[ \t\r\n\f\x00]+obj\b`)
+
+func parsePDF(data []byte) (*pdfDocument, error) {
+	header := bytes.Index(data[:min(len(data), 1024)], []byte("%PDF-"))
+	if header < 0 {
+		return nil, ErrNotPDF
+	}
+
+	doc := newPDFDocument(data)
+	if err := doc.readXref(); err == nil {
+		if _, err := doc.pages(); err == nil {
+			return doc, nil
+		}
+	}
+
+	// Damaged files, and files edited without updating their offsets, are
+	// read by finding every object in the file instead
+	doc = newPDFDocument(data)
+	if err := doc.reconstruct(); err != nil {
+		return nil, err
+	}
+	if _, err := doc.pages(); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+func newPDFDocument(data []byte) *pdfDocument {
+	return &pdfDocument{
+		data:    data,
+		xref:    map[int]pdfXrefEntry{},
+		objects: map[int]pdfObject{},
+		streams: map[int]map[int]pdfObject{},
+		loading: map[int]bool{},
+	}
+}
+
+func (d *pdfDocument) encrypted() bool {
+	return d.trailer["Encrypt"] != nil
+}
+
+// readXref reads the cross-reference sections from the last one back,
+// following Prev. Entries already read belong to newer revisions and win.
+func (d *pdfDocument) readXref() error {
+	i := bytes.LastIndex(d.data, []byte("startxref"))
+	if i < 0 {
+		return fmt.Errorf("%w: no startxref", ErrNotPDF)
+	}
+	l := &pdfLexer{data: d.data, pos: i + len("startxref")}
+	offset, err := l.integer()
+	if err != nil {
+		return err
+	}
+
+	seen := map[int64]bool{}
+	for !seen[offset] {
+		seen[offset] = true
+		trailer, err := d.readXrefSection(offset)
+		if err != nil {
+			return err
+		}
+		if d.trailer == nil {
+			d.trailer = trailer
+		}
+		// Hybrid files list their compressed objects in a separate stream
+		if stm, ok := trailer["XRefStm"].(int64); ok && !seen[stm] {
+			seen[stm] = true
+			if _, err := d.readXrefSection(stm); err != nil {
+				return err
+			}
+		}
+		prev, ok := trailer["Prev"].(int64)
+		if !ok {
+			break
+		}
+		offset = prev
+	}
+	if d.trailer["Root"] == nil {
+		return fmt.Errorf("%w: no document catalog", ErrNotPDF)
+	}
+	return nil
+}
+
+// readXrefSection reads a cross-reference table and its trailer, or a
+// cross-reference stream, at offset and returns the trailer
+func (d *pdfDocument) readXrefSection(offset int64) (pdfDict, error) {
+	if offset < 0 || offset >= int64(len(d.data)) {
+		return nil, fmt.Errorf("%w: cross-reference offset %d is outside the file", ErrNotPDF, offset)
+	}
+	l := &pdfLexer{data: d.data, pos: int(offset)}
+	l.skipSpace()
+
+	if !l.hasPrefix("xref") {
+		obj, err := d.readObjectAt(offset, -1)
+		if err != nil {
+			return nil, err
+		}
+		stream, ok := obj.(*pdfStream)
+		if !ok || stream.dict["Type"] != pdfName("XRef") {
+			return nil, fmt.Errorf("%w: no cross-reference at offset %d", ErrNotPDF, offset)
+		}
+		return stream.dict, d.readXrefStream(stream)
+	}
+
+	l.pos += len("xref")
+	for {
+		l.skipSpace()
+		if l.hasPrefix("trailer") {
+			l.pos += len("trailer")
+			obj, err := l.object(0)
+			if err != nil {
+				return nil, err
+			}
+			trailer, ok := obj.(pdfDict)
+			if !ok {
+				return nil, fmt.Errorf("%w: trailer is not a dictionary", ErrNotPDF)
+			}
+			return trailer, nil
+		}
+
+		start, err := l.integer()
+		if err != nil {
+			return nil, err
+		}
+		count, err := l.integer()
+		if err != nil {
+			return nil, err
+		}
+		for k := int64(0); k < count; k++ {
+			entryOffset, err := l.integer()
+			if err != nil {
+				return nil, err
+			}
+			if _, err := l.integer(); err != nil {
+				return nil, err
+			}
+			l.skipSpace()
+			kind := l.word()
+			num := int(start + k)
+			if _, known := d.xref[num]; kind == "n" && entryOffset > 0 && !known {
+				d.xref[num] = pdfXrefEntry{offset: entryOffset}
+			}
+		}
+	}
+}
+
+func (d *pdfDocument) readXrefStream(stream *pdfStream) error {
+	data, err := d.decodeStream(stream)
+	if err != nil {
+		return err
+	}
+
+	var widths [3]int
+	w, _ := stream.dict["W"].(pdfArray)
+	if len(w) != 3 {
+		return fmt.Errorf("%w: bad cross-reference stream widths", ErrNotPDF)
+	}
+	for i := range widths {
+		n, ok := w[i].(int64)
+		if !ok || n < 0 || n > 8 {
+			return fmt.Errorf("%w: bad cross-reference stream widths", ErrNotPDF)
+		}
+		widths[i] = int(n)
+	}
+	entrySize := widths[0] + widths[1] + widths[2]
+	if entrySize == 0 {
+		return fmt.Errorf("%w: bad cross-reference stream widths", ErrNotPDF)
+	}
+
+	index, _ := stream.dict["Index"].(pdfArray)
+	if index == nil {
+		size, _ := stream.dict["Size"].(int64)
+		index = pdfArray{int64(0), size}
+	}
+
+	field := func(b []byte) int64 {
+		var n int64
+		for _, c := range b {
+			n = n<<8 | int64(c)
+		}
+		return n
+	}
+
+	pos := 0
+	for i := 0; i+1 < len(index); i += 2 {
+		start, _ := index[i].(int64)
+		count, _ := index[i+1].(int64)
+		for k := int64(0); k < count && pos+entrySize <= len(data); k++ {
+			entry := data[pos : pos+entrySize]
+			pos += entrySize
+
+			kind := int64(1) // the type field may be left out
+			if widths[0] > 0 {
+				kind = field(entry[:widths[0]])
+			}
+			second := field(entry[widths[0] : widths[0]+widths[1]])
+			num := int(start + k)
+			if _, known := d.xref[num]; known {
+				continue
+			}
+			switch kind {
+			case 1:
+				d.xref[num] = pdfXrefEntry{offset: second}
+			case 2:
+				d.xref[num] = pdfXrefEntry{inStream: true, stream: int(second)}
+			}
+		}
+	}
+	return nil
+}
+
+// reconstruct rebuilds the cross-reference data by finding each object in
+// the file, including those in object streams, and the catalog
+func (d *pdfDocument) reconstruct() error {
+	for _, m := range pdfObjectHeader.FindAllSubmatchIndex(d.data, -1) {
+		num, err := strconv.Atoi(string(d.data[m[2]:m[3]]))
+		if err != nil {
+			continue
+		}
+		// Later definitions are newer revisions
+		d.xref[num] = pdfXrefEntry{offset: int64(m[0])}
+	}
+	if len(d.xref) == 0 {
+		return ErrNotPDF
+	}
+
+	nums := make([]int, 0, len(d.xref))
+	for num := range d.xref {
+		nums = append(nums, num)
+	}
+	sort.Ints(nums)
+
+	var catalog *pdfRef
+	for _, num := range nums {
+		obj, err := d.load(num)
+		if err != nil {
+			continue
+		}
+		if stream, ok := obj.(*pdfStream); ok && stream.dict["Type"] == pdfName("ObjStm") {
+			if objects, err := d.objectStream(num); err == nil {
+				for inner := range objects {
+					if _, known := d.xref[inner]; !known {
+						d.xref[inner] = pdfXrefEntry{inStream: true, stream: num}
+					}
+				}
+			}
+		}
+	}
+	// The catalog may be one of the objects found in object streams
+	nums = nums[:0]
+	for num := range d.xref {
+		nums = append(nums, num)
+	}
+	sort.Ints(nums)
+	for _, num := range nums {
+		if dict, ok := d.loadDict(num); ok && dict["Type"] == pdfName("Catalog") {
+			ref := pdfRef{num: num}
+			catalog = &ref
+		}
+	}
+
+	if i := bytes.LastIndex(d.data, []byte("trailer")); i >= 0 {
+		l := &pdfLexer{data: d.data, pos: i + len("trailer")}
+		if obj, err := l.object(0); err == nil {
+			d.trailer, _ = obj.(pdfDict)
+		}
+	}
+	if d.trailer == nil {
+		d.trailer = pdfDict{}
+	}
+	if root, ok := d.trailer["Root"].(pdfRef); !ok || !d.isCatalog(root.num) {
+		if catalog == nil {
+			return fmt.Errorf("%w: no document catalog", ErrNotPDF)
+		}
+		d.trailer["Root"] = *catalog
+	}
+	return nil
+}
+
+func (d *pdfDocument) loadDict(num int) (pdfDict, bool) {
+	obj, err := d.load(num)
+	if err != nil {
+		return nil, false
+	}
+	dict, ok := obj.(pdfDict)
+	return dict, ok
+}
+
+func (d *pdfDocument) isCatalog(num int) bool {
+	dict, ok := d.loadDict(num)
+	return ok && dict["Type"] == pdfName("Catalog")
+}
+
+// readObjectAt reads "num gen obj ... endobj" at offset; num -1 accepts any
+// object number
+func (d *pdfDocument) readObjectAt(offset int64, num int) (pdfObject, error) {
+	if offset < 0 || offset >= int64(len(d.data)) {
+		return nil, fmt.Errorf("%w: object offset %d is outside the file", ErrNotPDF, offset)
+	}
+	l := &pdfLexer{data: d.data, pos: int(offset)}
+	n, err := l.integer()
+	if err != nil {
+		return nil, err
+	}
+	if num >= 0 && int(n) != num {
+		return nil, fmt.Errorf("%w: expected object %d at offset %d, found %d", ErrNotPDF, num, offset, n)
+	}
+	if _, err := l.integer(); err != nil {
+		return nil, err
+	}
+	if keyword, err := l.object(0); err != nil || keyword != pdfKeyword("obj") {
+		return nil, fmt.Errorf("%w: expected obj at offset %d", ErrNotPDF, offset)
+	}
+
+	obj, err := l.object(0)
+	if err != nil {
+		return nil, err
+	}
+	dict, isDict := obj.(pdfDict)
+	l.skipSpace()
+	if !isDict || !l.hasPrefix("stream") {
+		return obj, nil
+	}
+
+	l.pos += len("stream")
+	if l.hasPrefix("\r\n") {
+		l.pos += 2
+	} else if l.hasPrefix("\n") || l.hasPrefix("\r") {
+		l.pos++
+	}
+	start := l.pos
+
+	// Trust Length when endstream follows it, otherwise look for endstream
+	end := -1
+	if length, err := d.resolve(dict["Length"]); err == nil {
+		if n, ok := length.(int64); ok && n >= 0 && int64(start)+n <= int64(len(d.data)) {
+			after := &pdfLexer{data: d.data, pos: start + int(n)}
+			after.skipSpace()
+			if after.hasPrefix("endstream") {
+				end = start + int(n)
+			}
+		}
+	}
+	if end < 0 {
+		i := bytes.Index(d.data[start:], []byte("endstream"))
+		if i < 0 {
+			return nil, fmt.Errorf("%w: unterminated stream at offset %d", ErrNotPDF, offset)
+		}
+		end = start + i
+		if end > start && d.data[end-1] == '\n' {
+			end--
+		}
+		if end > start && d.data[end-1] == '\r' {
+			end--
+		}
+	}
+	return &pdfStream{dict: dict, data: d.data[start:end]}, nil
+}
+
+// load returns object num, reading it on first use. Missing objects are
+// null, as the PDF format has it.
+func (d *pdfDocument) load(num int) (pdfObject, error) {
+	if obj, ok := d.objects[num]; ok {
+		return obj, nil
+	}
+	entry, ok := d.xref[num]
+	if !ok {
+		return nil, nil
+	}
+	if d.loading[num] {
+		return nil, fmt.Errorf("%w: object %d refers to itself", ErrNotPDF, num)
+	}
+	d.loading[num] = true
+	defer delete(d.loading, num)
+
+	var obj pdfObject
+	if entry.inStream {
+		objects, err := d.objectStream(entry.stream)
+		if err != nil {
+			return nil, err
+		}
+		obj = objects[num]
+	} else {
+		var err error
+		if obj, err = d.readObjectAt(entry.offset, num); err != nil {
+			return nil, err
+		}
+	}
+	d.objects[num] = obj
+	return obj, nil
+}
+
+// resolve follows references to the object they point to
+func (d *pdfDocument) resolve(obj pdfObject) (pdfObject, error) {
+	for i := 0; i < pdfMaxDepth; i++ {
+		ref, ok := obj.(pdfRef)
+		if !ok {
+			return obj, nil
+		}
+		var err error
+		if obj, err = d.load(ref.num); err != nil {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("%w: references nested too deeply", ErrNotPDF)
+}
+
+// objectStream parses the objects compressed into object stream num
+func (d *pdfDocument) objectStream(num int) (map[int]pdfObject, error) {
+	if objects, ok := d.streams[num]; ok {
+		return objects, nil
+	}
+	obj, err := d.load(num)
+	if err != nil {
+		return nil, err
+	}
+	stream, ok := obj.(*pdfStream)
+	if !ok {
+		return nil, fmt.Errorf("%w: object stream %d is missing", ErrNotPDF, num)
+	}
+	data, err := d.decodeStream(stream)
+	if err != nil {
+		return nil, err
+	}
+
+	count, _ := stream.dict["N"].(int64)
+	first, _ := stream.dict["First"].(int64)
+	if first < 0 || first > int64(len(data)) {
+		return nil, fmt.Errorf("%w: bad object stream %d", ErrNotPDF, num)
+	}
+	header := &pdfLexer{data: data[:first]}
+	objects := map[int]pdfObject{}
+	for i := int64(0); i < count; i++ {
+		objNum, err := header.integer()
+		if err != nil {
+			break
+		}
+		offset, err := header.integer()
+		if err != nil || first+offset >= int64(len(data)) {
+			break
+		}
+		l := &pdfLexer{data: data, pos: int(first + offset)}
+		if objects[int(objNum)], err = l.object(0); err != nil {
+			return nil, err
+		}
+	}
+	d.streams[num] = objects
+	return objects, nil
+}
+
+// decodeStream undoes a stream's filters. Only Flate, with or without a PNG
+// predictor, is needed for the streams that are read rather than copied.
+func (d *pdfDocument) decodeStream(stream *pdfStream) ([]byte, error) {
+	filterObj, err := d.resolve(stream.dict["Filter"])
+	if err != nil {
+		return nil, err
+	}
+	parmsObj, err := d.resolve(stream.dict["DecodeParms"])
+	if err != nil {
+		return nil, err
+	}
+
+	var filters, parms pdfArray
+	switch f := filterObj.(type) {
+	case pdfName:
+		filters, parms = pdfArray{f}, pdfArray{parmsObj}
+	case pdfArray:
+		filters = f
+		parms, _ = parmsObj.(pdfArray)
+	}
+
+	data := stream.data
+	for i, filter := range filters {
+		switch filter {
+		case pdfName("FlateDecode"), pdfName("Fl"):
+			if data, err = inflate(data); err != nil {
+				return nil, err
+			}
+			var p pdfDict
+			if i < len(parms) {
+				resolved, err := d.resolve(parms[i])
+				if err != nil {
+					return nil, err
+				}
+				p, _ = resolved.(pdfDict)
+			}
+			if data, err = unpredict(data, p); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("%w: unsupported stream filter %v", ErrNotPDF, filter)
+		}
+	}
+	return data, nil
+}
+
+// inflate decompresses zlib data, or raw deflate data as some writers
+// produce. A truncated stream yields what could be read.
+func inflate(data []byte) ([]byte, error) {
+	var r io.Reader
+	if zr, err := zlib.NewReader(bytes.NewReader(data)); err == nil {
+		r = zr
+	} else {
+		r = flate.NewReader(bytes.NewReader(data))
+	}
+	out, err := io.ReadAll(io.LimitReader(r, pdfMaxDecoded+1))
+	if len(out) > pdfMaxDecoded {
+		return nil, fmt.Errorf("%w: stream is too large", ErrNotPDF)
+	}
+	if err != nil && len(out) == 0 {
+		return nil, fmt.Errorf("%w: cannot decompress stream: %v", ErrNotPDF, err)
+	}
+	return out, nil
+}
+
+// unpredict reverses a PNG predictor (Predictor 10-15), the one used by
+// cross-reference streams
+func unpredict(data []byte, parms pdfDict) ([]byte, error) {
+	predictor, _ := parms["Predictor"].(int64)
+	if predictor < 10 {
+		if predictor > 1 {
+			return nil, fmt.Errorf("%w: unsupported predictor %d", ErrNotPDF, predictor)
+		}
+		return data, nil
+	}
+
+	columns, colors, bits := int64(1), int64(1), int64(8)
+	if n, ok := parms["Columns"].(int64); ok && n > 0 {
+		columns = n
+	}
+	if n, ok := parms["Colors"].(int64); ok && n > 0 {
+		colors = n
+	}
+	if n, ok := parms["BitsPerComponent"].(int64); ok && n > 0 {
+		bits = n
+	}
+	bpp := int(max(1, colors*bits/8))
+	rowLen := int((colors*bits*columns + 7) / 8)
+
+	var out []byte
+	prev := make([]byte, rowLen)
+	for pos := 0; pos+1+rowLen <= len(data); pos += 1 + rowLen {
+		kind, row := data[pos], append([]byte(nil), data[pos+1:pos+1+rowLen]...)
+		for i := range row {
+			var left, up, upLeft byte
+			if i >= bpp {
+				left, upLeft = row[i-bpp], prev[i-bpp]
+			}
+			up = prev[i]
+			switch kind {
+			case 1:
+				row[i] += left
+			case 2:
+				row[i] += up
+			case 3:
+				row[i] += byte((int(left) + int(up)) / 2)
+			case 4:
+				row[i] += paeth(left, up, upLeft)
+			}
+		}
+		out = append(out, row...)
+		prev = row
+	}
+	return out, nil
+}
+
+func paeth(a, b, c byte) byte {
+	p := int(a) + int(b) - int(c)
+	pa, pb, pc := abs(p-int(a)), abs(p-int(b)), abs(p-int(c))
+	switch {
+	case pa <= pb && pa <= pc:
+		return a
+	case pb <= pc:
+		return b
+	default:
+		return c
+	}
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// pages lists the document's pages in order
+func (d *pdfDocument) pages() ([]pdfPage, error) {
+	root, err := d.resolve(d.trailer["Root"])
+	if err != nil {
+		return nil, err
+	}
+	catalog, ok := root.(pdfDict)
+	if !ok {
+		return nil, fmt.Errorf("%w: no document catalog", ErrNotPDF)
+	}
+
+	var pages []pdfPage
+	visited := map[int]bool{}
+	var walk func(node pdfObject, inherited pdfDict, depth int) error
+	walk = func(node pdfObject, inherited pdfDict, depth int) error {
+		if depth > pdfMaxDepth {
+			return fmt.Errorf("%w: page tree nested too deeply", ErrNotPDF)
+		}
+		ref, _ := node.(pdfRef)
+		if ref.num != 0 {
+			if visited[ref.num] {
+				return nil
+			}
+			visited[ref.num] = true
+		}
+		obj, err := d.resolve(node)
+		if err != nil {
+			return err
+		}
+		dict, ok := obj.(pdfDict)
+		if !ok {
+			return nil
+		}
+
+		attrs := pdfDict{}
+		for _, key := range pdfInherited {
+			if value, ok := dict[key]; ok {
+				attrs[key] = value
+			} else if value, ok := inherited[key]; ok {
+				attrs[key] = value
+			}
+		}
+
+		kidsObj, err := d.resolve(dict["Kids"])
+		if err != nil {
+			return err
+		}
+		if kids, ok := kidsObj.(pdfArray); ok && dict["Type"] != pdfName("Page") {
+			for _, kid := range kids {
+				if err := walk(kid, attrs, depth+1); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		page := pdfDict{}
+		for key, value := range dict {
+			page[key] = value
+		}
+		for key, value := range attrs {
+			page[key] = value
+		}
+		pages = append(pages, pdfPage{ref: ref, dict: page})
+		return nil
+	}
+
+	if err := walk(catalog["Pages"], pdfDict{}, 0); err != nil {
+		return nil, err
+	}
+	if len(pages) == 0 {
+		return nil, fmt.Errorf("%w: the PDF has no pages", ErrNotPDF)
+	}
+	return pages, nil
+}
+
+// pdfWriter builds a new PDF from pages copied out of other documents and
+// from images. Object n is objects[n-1]; object 1 is the page tree.
+type pdfWriter struct {
+	objects  []pdfObject
+	pagesRef pdfRef
+	kids     pdfArray
+	imported map[*pdfDocument]map[int]pdfRef
+}
+
+func newPDFWriter() *pdfWriter {
+	w := &pdfWriter{imported: map[*pdfDocument]map[int]pdfRef{}}
+	w.pagesRef = w.add(nil)
+	return w
+}
+
+func (w *pdfWriter) add(obj pdfObject) pdfRef {
+	w.objects = append(w.objects, obj)
+	return pdfRef{num: len(w.objects)}
+}
+
+// importPages copies pages and everything they reference. Their numbers
+// are reserved first, so links between the copied pages keep working.
+func (w *pdfWriter) importPages(d *pdfDocument, pages []pdfPage) error {
+	refs := w.imported[d]
+	if refs == nil {
+		refs = map[int]pdfRef{}
+		w.imported[d] = refs
+	}
+
+	newRefs := make([]pdfRef, len(pages))
+	for i, page := range pages {
+		newRefs[i] = w.add(nil)
+		// A page selected twice is copied twice; links go to the first copy
+		if _, ok := refs[page.ref.num]; !ok && page.ref.num != 0 {
+			refs[page.ref.num] = newRefs[i]
+		}
+	}
+
+	for i, page := range pages {
+		dict := pdfDict{}
+		for _, key := range sortedKeys(page.dict) {
+			if key == "Parent" {
+				continue
+			}
+			value, err := w.copy(d, page.dict[key], 0)
+			if err != nil {
+				return err
+			}
+			dict[key] = value
+		}
+		dict["Type"] = pdfName("Page")
+		dict["Parent"] = w.pagesRef
+		if dict["MediaBox"] == nil {
+			dict["MediaBox"] = pdfArray{int64(0), int64(0), int64(612), int64(792)}
+		}
+		w.objects[newRefs[i].num-1] = dict
+		w.kids = append(w.kids, newRefs[i])
+	}
+	return nil
+}
+
+// copy copies obj from d, giving referenced objects new numbers. Pages not
+// being copied, and the page tree, are left behind as null.
+func (w *pdfWriter) copy(d *pdfDocument, obj pdfObject, depth int) (pdfObject, error) {
+	if depth > pdfMaxDepth {
+		return nil, fmt.Errorf("%w: objects nested too deeply", ErrNotPDF)
+	}
+
+	switch v := obj.(type) {
+	case pdfRef:
+		refs := w.imported[d]
+		if ref, ok := refs[v.num]; ok {
+			return ref, nil
+		}
+		target, err := d.resolve(v)
+		if err != nil {
+			return nil, err
+		}
+		var dict pdfDict
+		switch t := target.(type) {
+		case pdfDict:
+			dict = t
+		case *pdfStream:
+			dict = t.dict
+		}
+		if dict["Type"] == pdfName("Page") || dict["Type"] == pdfName("Pages") {
+			return nil, nil
+		}
+
+		// Referenced objects are copied one level down, so long chains of
+		// references do not nest
+		ref := w.add(nil)
+		refs[v.num] = ref
+		copied, err := w.copy(d, target, 0)
+		if err != nil {
+			return nil, err
+		}
+		w.objects[ref.num-1] = copied
+		return ref, nil
+	case pdfDict:
+		dict := pdfDict{}
+		for _, key := range sortedKeys(v) {
+			value, err := w.copy(d, v[key], depth+1)
+			if err != nil {
+				return nil, err
+			}
+			dict[key] = value
+		}
+		return dict, nil
+	case pdfArray:
+		array := make(pdfArray, len(v))
+		for i, item := range v {
+			value, err := w.copy(d, item, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			array[i] = value
+		}
+		return array, nil
+	case *pdfStream:
+		dict, err := w.copy(d, v.dict, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		return &pdfStream{dict: dict.(pdfDict), data: v.data}, nil
+	default:
+		return v, nil
+	}
+}
+
+// bytes writes the document with a catalog, the page tree and a classic
+// cross-reference table. The same input always gives the same bytes, so a
+// repeated split is found by its file hash.
+func (w *pdfWriter) bytes() []byte {
+	w.objects[w.pagesRef.num-1] = pdfDict{
+		"Type":  pdfName("Pages"),
+		"Kids":  w.kids,
+		"Count": int64(len(w.kids)),
+	}
+	catalog := w.add(pdfDict{"Type": pdfName("Catalog"), "Pages": w.pagesRef})
+
+	var out bytes.Buffer
+	out.WriteString("%PDF-1.7\n%\xe2\xe3\xcf\xd3\n")
+	offsets := make([]int, len(w.objects))
+	for i, obj := range w.objects {
+		offsets[i] = out.Len()
+		fmt.Fprintf(&out, "%d 0 obj\n", i+1)
+		writePDFObject(&out, obj)
+		out.WriteString("\nendobj\n")
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(w.objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root %d 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(w.objects)+1, catalog.num, xref)
+	return out.Bytes()
+}
+
+func sortedKeys(dict pdfDict) []pdfName {
+	keys := make([]pdfName, 0, len(dict))
+	for key := range dict {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
+
+func writePDFObject(out *bytes.Buffer, obj pdfObject) {
+	switch v := obj.(type) {
+	case nil:
+		out.WriteString("null")
+	case bool:
+		out.WriteString(strconv.FormatBool(v))
+	case int64:
+		out.WriteString(strconv.FormatInt(v, 10))
+	case float64:
+		out.WriteString(strconv.FormatFloat(v, 'f', -1, 64))
+	case pdfName:
+		out.WriteByte('/')
+		for i := 0; i < len(v); i++ {
+			c := v[i]
+			if c < 0x21 || c > 0x7e || c == '#' || isPDFDelimiter(c) {
+				fmt.Fprintf(out, "#%02X", c)
+			} else {
+				out.WriteByte(c)
+			}
+		}
+	case pdfStr:
+		fmt.Fprintf(out, "<%X>", string(v))
+	case pdfKeyword:
+		out.WriteString(string(v))
+	case pdfRef:
+		fmt.Fprintf(out, "%d 0 R", v.num)
+	case pdfArray:
+		out.WriteByte('[')
+		for i, item := range v {
+			if i > 0 {
+				out.WriteByte(' ')
+			}
+			writePDFObject(out, item)
+		}
+		out.WriteByte(']')
+	case pdfDict:
+		out.WriteString("<<")
+		for _, key := range sortedKeys(v) {
+			writePDFObject(out, key)
+			out.WriteByte(' ')
+			writePDFObject(out, v[key])
+		}
+		out.WriteString(">>")
+	case *pdfStream:
+		dict := pdfDict{}
+		for key, value := range v.dict {
+			dict[key] = value
+		}
+		dict["Length"] = int64(len(v.data))
+		writePDFObject(out, dict)
+		out.WriteString("\nstream\n")
+		out.Write(v.data)
+		out.WriteString("\nendstream")
+	}
+}
+
+// pdfImageLongSide and pdfImageShortSide bound an image page in points, so
+// a photo fills at most a US Letter page
+const (
+	pdfImageLongSide  = 792
+	pdfImageShortSide = 612
+)
+
+// addImagePage adds an image as a page of its own, scaled to fit a Letter
+// page. JPEGs are embedded as they are and turned upright by their EXIF
+// orientation; PNGs and GIFs are decoded and flattened onto white.
+func (w *pdfWriter) addImagePage(data []byte) error {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || cfg.Width <= 0 || cfg.Height <= 0 {
+		return ErrUnsupportedDocument
+	}
+
+	xobject := &pdfStream{dict: pdfDict{
+		"Type":             pdfName("XObject"),
+		"Subtype":          pdfName("Image"),
+		"Width":            int64(cfg.Width),
+		"Height":           int64(cfg.Height),
+		"BitsPerComponent": int64(8),
+	}}
+	rotate := int64(0)
+	if format == "jpeg" {
+		xobject.dict["Filter"] = pdfName("DCTDecode")
+		switch cfg.ColorModel {
+		case color.GrayModel:
+			xobject.dict["ColorSpace"] = pdfName("DeviceGray")
+		case color.CMYKModel:
+			// CMYK JPEGs are written inverted by Adobe software
+			xobject.dict["ColorSpace"] = pdfName("DeviceCMYK")
+			xobject.dict["Decode"] = pdfArray{int64(1), int64(0), int64(1), int64(0), int64(1), int64(0), int64(1), int64(0)}
+		default:
+			xobject.dict["ColorSpace"] = pdfName("DeviceRGB")
+		}
+		xobject.data = data
+		rotate = jpegRotation(data)
+	} else {
+		img, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			return ErrUnsupportedDocument
+		}
+		bounds := img.Bounds()
+		canvas := image.NewRGBA(bounds)
+		draw.Draw(canvas, bounds, image.White, image.Point{}, draw.Src)
+		draw.Draw(canvas, bounds, img, bounds.Min, draw.Over)
+
+		var pixels bytes.Buffer
+		zw := zlib.NewWriter(&pixels)
+		for i := 0; i < len(canvas.Pix); i += 4 {
+			zw.Write(canvas.Pix[i : i+3])
+		}
+		zw.Close()
+		xobject.dict["Filter"] = pdfName("FlateDecode")
+		xobject.dict["ColorSpace"] = pdfName("DeviceRGB")
+		xobject.data = pixels.Bytes()
+	}
+
+	long, short := float64(max(cfg.Width, cfg.Height)), float64(min(cfg.Width, cfg.Height))
+	scale := min(pdfImageLongSide/long, pdfImageShortSide/short)
+	width := float64(int64(float64(cfg.Width)*scale*100)) / 100
+	height := float64(int64(float64(cfg.Height)*scale*100)) / 100
+
+	content := &pdfStream{dict: pdfDict{}, data: []byte(fmt.Sprintf("q %s 0 0 %s 0 0 cm /Im1 Do Q",
+		strconv.FormatFloat(width, 'f', -1, 64), strconv.FormatFloat(height, 'f', -1, 64)))}
+	page := pdfDict{
+		"Type":      pdfName("Page"),
+		"Parent":    w.pagesRef,
+		"MediaBox":  pdfArray{int64(0), int64(0), width, height},
+		"Resources": pdfDict{"XObject": pdfDict{"Im1": w.add(xobject)}},
+		"Contents":  w.add(content),
+	}
+	if rotate != 0 {
+		page["Rotate"] = rotate
+	}
+	w.kids = append(w.kids, w.add(page))
+	return nil
+}
+
+// jpegRotation reads a JPEG's EXIF orientation and returns the clockwise
+// page rotation that shows it upright. Mirrored orientations are rare from
+// cameras and are shown unmirrored.
+func jpegRotation(data []byte) int64 {
+	// Walk the markers up to the image data, looking for APP1 "Exif"
+	for pos := 2; pos+4 <= len(data) && data[pos] == 0xFF; {
+		marker := data[pos+1]
+		size := int(data[pos+2])<<8 | int(data[pos+3])
+		if marker == 0xDA || size < 2 || pos+2+size > len(data) {
+			return 0
+		}
+		segment := data[pos+4 : pos+2+size]
+		pos += 2 + size
+		if marker != 0xE1 || !bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			continue
+		}
+
+		tiff := segment[6:]
+		if len(tiff) < 8 {
+			return 0
+		}
+		var order binary.ByteOrder = binary.BigEndian
+		if tiff[0] == 'I' {
+			order = binary.LittleEndian
+		}
+		ifd := int(order.Uint32(tiff[4:8]))
+		if ifd+2 > len(tiff) {
+			return 0
+		}
+		entries := int(order.Uint16(tiff[ifd:]))
+		for i := 0; i < entries; i++ {
+			entry := ifd + 2 + 12*i
+			if entry+12 > len(tiff) {
+				return 0
+			}
+			if order.Uint16(tiff[entry:]) != 0x0112 {
+				continue
+			}
+			switch order.Uint16(tiff[entry+8:]) {
+			case 3, 4:
+				return 180
+			case 5, 6:
+				return 90
+			case 7, 8:
+				return 270
+			}
+			return 0
+		}
+		return 0
+	}
+	return 0
+}
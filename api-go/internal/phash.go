@@ -0,0 +1,242 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	_ "image/gif" // register decoders for image.Decode
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"log"
+	"math/bits"
+	"path"
+	"sort"
+	"strings"
+)
+
+// phashGridSize is the side of the grayscale thumbnail an image is reduced
+// to before hashing; phashSamples is how many pixels per thumbnail cell are
+// averaged along each axis, which keeps large photos fast to hash
+const (
+	phashGridSize = 32
+	phashSamples  = 8
+)
+
+// phashMaxPixels is the largest image decoded for hashing, 50 megapixels.
+// A few kilobytes of PNG or GIF can declare far more pixels than memory
+// holds, so larger images go unhashed.
+const phashMaxPixels = 50_000_000
+
+// phashExtensions are the stored files that can be perceptually hashed
+var phashExtensions = map[string]bool{".jpg": true, ".jpeg": true, ".png": true, ".gif": true}
+
+// SimilarReceipt is a receipt whose image looks like an upload's. Distance
+// is the number of perceptual hash bits that differ, 0 to 64.
+type SimilarReceipt struct {
+	Receipt  *Receipt `json:"receipt"`
+	Distance int      `json:"distance"`
+}
+
+// PerceptualHashes decodes a JPEG, PNG or GIF and returns the dHash of the
+// image as stored followed by its rotations by 90, 180 and 270 degrees, so
+// photos taken sideways still match. Unlike a SHA-256, a dHash changes by
+// only a few bits when the same receipt is photographed again. Images over
+// phashMaxPixels are refused before they are decoded.
+func PerceptualHashes(data []byte) ([4]uint64, error) {
+	var hashes [4]uint64
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return hashes, err
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > phashMaxPixels {
+		return hashes, fmt.Errorf("image of %dx%d pixels is too large to hash", cfg.Width, cfg.Height)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return hashes, err
+	}
+
+	grid := phashThumbnail(img)
+	for i := range hashes {
+		hashes[i] = dHash(grid)
+		grid = rotateGrid(grid)
+	}
+	return hashes, nil
+}
+
+// HammingDistance counts the bits in which two hashes differ
+func HammingDistance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// phashThumbnail averages the image's luminance over a square grid of
+// cells, stretching it to fit
+func phashThumbnail(img image.Image) [][]float64 {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	grid := make([][]float64, phashGridSize)
+	for y := range grid {
+		grid[y] = make([]float64, phashGridSize)
+		for x := range grid[y] {
+			var sum float64
+			for sy := 0; sy < phashSamples; sy++ {
+				py := bounds.Min.Y + ((y*phashSamples+sy)*2+1)*height/(phashGridSize*phashSamples*2)
+				for sx := 0; sx < phashSamples; sx++ {
+					px := bounds.Min.X + ((x*phashSamples+sx)*2+1)*width/(phashGridSize*phashSamples*2)
+					r, g, b, _ := img.At(px, py).RGBA()
+					// ITU-R 601 luma, as color.GrayModel computes it
+					sum += float64(19595*r+38470*g+7471*b) / (1 << 16)
+				}
+			}
+			grid[y][x] = sum / (phashSamples * phashSamples)
+		}
+	}
+	return grid
+}
+
+// rotateGrid turns a square grid a quarter turn clockwise
+func rotateGrid(grid [][]float64) [][]float64 {
+	n := len(grid)
+	rotated := make([][]float64, n)
+	for y := range rotated {
+		rotated[y] = make([]float64, n)
+		for x := range rotated[y] {
+			rotated[y][x] = grid[n-1-x][y]
+		}
+	}
+	return rotated
+}
+
+// dHash shrinks the grid to 9x8 cells and sets one bit per pair of
+// horizontal neighbours, when the left cell is brighter
+func dHash(grid [][]float64) uint64 {
+	const cols, rows = 9, 8
+	n := len(grid)
+
+	var cells [rows][cols]float64
+	for y := 0; y < rows; y++ {
+		y0, y1 := y*n/rows, (y+1)*n/rows
+		for x := 0; x < cols; x++ {
+			x0, x1 := x*n/cols, (x+1)*n/cols
+			var sum float64
+			for gy := y0; gy < y1; gy++ {
+				for gx := x0; gx < x1; gx++ {
+					sum += grid[gy][gx]
+				}
+			}
+			cells[y][x] = sum / float64((y1-y0)*(x1-x0))
+		}
+	}
+
+	var hash uint64
+	for y := 0; y < rows; y++ {
+		for x := 0; x < cols-1; x++ {
+			hash <<= 1
+			if cells[y][x] > cells[y][x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// FindSimilarReceipts returns the household's receipts whose image is within
+// maxDistance bits of any of hashes (see PerceptualHashes), closest first
+func (db *Database) FindSimilarReceipts(householdID int, hashes [4]uint64, maxDistance int) ([]SimilarReceipt, error) {
+	rows, err := db.conn.Query(`
+        SELECT id, perceptual_hash FROM receipts
+        WHERE household_id = $1 AND perceptual_hash IS NOT NULL
+    `, householdID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	distances := map[int]int{}
+	for rows.Next() {
+		var id int
+		var stored int64
+		if err := rows.Scan(&id, &stored); err != nil {
+			return nil, err
+		}
+		best := 65
+		for _, hash := range hashes {
+			if d := HammingDistance(uint64(stored), hash); d < best {
+				best = d
+			}
+		}
+		if best <= maxDistance {
+			distances[id] = best
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	similar := []SimilarReceipt{}
+	for id, distance := range distances {
+		receipt, err := db.GetReceiptByID(householdID, id)
+		if err != nil {
+			return nil, err
+		}
+		similar = append(similar, SimilarReceipt{Receipt: receipt, Distance: distance})
+	}
+	sort.Slice(similar, func(i, j int) bool {
+		if similar[i].Distance != similar[j].Distance {
+			return similar[i].Distance < similar[j].Distance
+		}
+		return similar[i].Receipt.ID < similar[j].Receipt.ID
+	})
+	return similar, nil
+}
+
+// SetPerceptualHash records a receipt image's perceptual hash
+func (db *Database) SetPerceptualHash(receiptID int, hash uint64) error {
+	_, err := db.conn.Exec("UPDATE receipts SET perceptual_hash = $1 WHERE id = $2", int64(hash), receiptID)
+	return err
+}
+
+// BackfillPerceptualHashes hashes the images of receipts saved before
+// perceptual hashes were kept. Files that cannot be read or decoded are
+// logged and skipped.
+func (s *Server) BackfillPerceptualHashes() (int, error) {
+	receipts, err := s.DB.GetReceiptsWithFiles(0)
+	if err != nil {
+		return 0, err
+	}
+
+	hashed := 0
+	for _, r := range receipts {
+		if r.PerceptualHash != nil || !phashExtensions[strings.ToLower(path.Ext(r.ImagePath))] {
+			continue
+		}
+
+		hashes, err := s.hashStoredImage(s.ReceiptKey(r.ImagePath))
+		if err != nil {
+			log.Printf("Warning: Cannot compute perceptual hash of receipt %d: %v", r.ID, err)
+			continue
+		}
+		if err := s.DB.SetPerceptualHash(r.ID, hashes[0]); err != nil {
+			return hashed, fmt.Errorf("failed to save perceptual hash of receipt %d: %v", r.ID, err)
+		}
+		hashed++
+	}
+	return hashed, nil
+}
+
+func (s *Server) hashStoredImage(key string) ([4]uint64, error) {
+	file, _, err := s.Store.Get(key)
+	if err != nil {
+		return [4]uint64{}, err
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return [4]uint64{}, err
+	}
+	return PerceptualHashes(data)
+}
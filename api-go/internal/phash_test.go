@@ -0,0 +1,60 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+// testPNG encodes a width by height gradient
+func testPNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+
+	img := image.NewGray(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetGray(x, y, color.Gray{Y: uint8((x + y) * 255 / (width + height))})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestPerceptualHashesRotations(t *testing.T) {
+	hashes, err := PerceptualHashes(testPNG(t, 120, 80))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hashes[0] == hashes[2] {
+		t.Errorf("a gradient hashes the same upside down: %x", hashes)
+	}
+
+	// Re-encoding at another size barely changes the hash
+	larger, err := PerceptualHashes(testPNG(t, 240, 160))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := HammingDistance(hashes[0], larger[0]); d > 4 {
+		t.Errorf("scaled copy differs in %d bits", d)
+	}
+}
+
+func TestPerceptualHashesRefusesHugeImages(t *testing.T) {
+	// A valid PNG whose header claims 60000x60000 pixels, 3.6 billion
+	data := testPNG(t, 1, 1)
+	binary.BigEndian.PutUint32(data[16:], 60000)
+	binary.BigEndian.PutUint32(data[20:], 60000)
+	binary.BigEndian.PutUint32(data[29:], crc32.ChecksumIEEE(data[12:29]))
+
+	if _, err := PerceptualHashes(data); err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Fatalf("hashing an image over the pixel cap: %v", err)
+	}
+}
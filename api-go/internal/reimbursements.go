@@ -0,0 +1,399 @@
+package internal
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Reimbursement is one HSA withdrawal and the receipt amounts it claimed.
+// Allocations and Receipts are only filled in by GetReimbursement and
+// CreateReimbursement.
+type Reimbursement struct {
+	ID             int                 `json:"id"`
+	HouseholdID    int                 `json:"household_id"`
+	CreatedBy      *int                `json:"created_by"`
+	Amount         Money               `json:"amount"`
+	Currency       string              `json:"currency"`
+	ReimbursedOn   time.Time           `json:"reimbursed_on"`
+	TransactionRef *string             `json:"transaction_ref"`
+	Notes          *string             `json:"notes"`
+	CreatedAt      time.Time           `json:"created_at"`
+	ReceiptCount   int                 `json:"receipt_count"`
+	Allocations    []ReceiptAllocation `json:"allocations,omitempty"`
+	Receipts       []Receipt           `json:"receipts,omitempty"`
+}
+
+// ErrCurrencyMismatch is returned by CreateReimbursement when a receipt is
+// in a different currency than the reimbursement
+var ErrCurrencyMismatch = errors.New("every receipt must be in the reimbursement's currency")
+
+const reimbursementColumns = `
+        rb.id, rb.household_id, rb.created_by, rb.amount, rb.currency, rb.reimbursed_on,
+        rb.transaction_ref, rb.notes, rb.created_at,
+        (SELECT COUNT(*) FROM receipt_applications a WHERE a.reimbursement_id = rb.id)`
+
+func scanReimbursement(row rowScanner) (*Reimbursement, error) {
+	var rb Reimbursement
+	err := row.Scan(&rb.ID, &rb.HouseholdID, &rb.CreatedBy, &rb.Amount, &rb.Currency, &rb.ReimbursedOn,
+		&rb.TransactionRef, &rb.Notes, &rb.CreatedAt, &rb.ReceiptCount)
+	if err != nil {
+		return nil, err
+	}
+	return &rb, nil
+}
+
+// CreateReimbursement records rb and claims its allocations in a single
+// transaction built on markUsed
+func (db *Database) CreateReimbursement(rb *Reimbursement, allocations []ReceiptAllocation) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+        INSERT INTO reimbursements (household_id, created_by, amount, currency, reimbursed_on,
+                                    transaction_ref, notes, created_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, NOW())
+        RETURNING id, created_at
+    `
+	err = tx.QueryRow(query, rb.HouseholdID, rb.CreatedBy, rb.Amount, rb.Currency, rb.ReimbursedOn,
+		rb.TransactionRef, rb.Notes).Scan(&rb.ID, &rb.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	reason := fmt.Sprintf("Reimbursement #%d", rb.ID)
+	if rb.TransactionRef != nil && *rb.TransactionRef != "" {
+		reason += " (" + *rb.TransactionRef + ")"
+	}
+
+	receipts, err := markUsed(tx, rb.HouseholdID, &rb.ID, allocations, &reason)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range receipts {
+		if r.Currency != rb.Currency {
+			return ErrCurrencyMismatch
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	for i := range receipts {
+		allocations[i].RemainingAmount = receipts[i].RemainingAmount
+	}
+
+	rb.ReceiptCount = len(receipts)
+	rb.Allocations = allocations
+	rb.Receipts = receipts
+	return nil
+}
+
+func (db *Database) ListReimbursements(householdID int) ([]Reimbursement, error) {
+	query := `
+        SELECT ` + reimbursementColumns + `
+        FROM reimbursements rb
+        WHERE rb.household_id = $1
+        ORDER BY rb.reimbursed_on DESC, rb.id DESC
+    `
+
+	rows, err := db.conn.Query(query, householdID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var reimbursements []Reimbursement
+	for rows.Next() {
+		rb, err := scanReimbursement(rows)
+		if err != nil {
+			return nil, err
+		}
+		reimbursements = append(reimbursements, *rb)
+	}
+
+	return reimbursements, rows.Err()
+}
+
+// GetReimbursement returns a reimbursement with its allocations and
+// receipts, or sql.ErrNoRows
+func (db *Database) GetReimbursement(householdID int, id int) (*Reimbursement, error) {
+	query := `
+        SELECT ` + reimbursementColumns + `
+        FROM reimbursements rb
+        WHERE rb.id = $1 AND rb.household_id = $2
+    `
+
+	rb, err := scanReimbursement(db.conn.QueryRow(query, id, householdID))
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.conn.Query(`
+        SELECT a.receipt_id, a.applied_amount, r.remaining_amount
+        FROM receipt_applications a
+        JOIN receipts r ON r.id = a.receipt_id
+        WHERE a.reimbursement_id = $1
+        ORDER BY a.id
+    `, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var a ReceiptAllocation
+		if err := rows.Scan(&a.ReceiptID, &a.AppliedAmount, &a.RemainingAmount); err != nil {
+			return nil, err
+		}
+		rb.Allocations = append(rb.Allocations, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	receiptRows, err := db.conn.Query(`
+        SELECT `+receiptColumns+`
+        FROM receipts r
+        WHERE r.id IN (SELECT receipt_id FROM receipt_applications WHERE reimbursement_id = $1)
+        ORDER BY r.date, r.id
+    `, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if rb.Receipts, err = scanReceipts(receiptRows); err != nil {
+		return nil, err
+	}
+	return rb, nil
+}
+
+// UndoReimbursement gives every claimed amount back to its receipt and
+// deletes the reimbursement, in one transaction
+func (db *Database) UndoReimbursement(householdID int, id int) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var exists int
+	err = tx.QueryRow("SELECT id FROM reimbursements WHERE id = $1 AND household_id = $2 FOR UPDATE",
+		id, householdID).Scan(&exists)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+        UPDATE receipts r
+        SET remaining_amount = LEAST(r.qualified_amount, r.remaining_amount + a.applied_amount),
+            used = false,
+            used_date = NULL,
+            use_reason = CASE WHEN r.remaining_amount + a.applied_amount >= r.qualified_amount
+                              THEN NULL ELSE r.use_reason END
+        FROM receipt_applications a
+        WHERE a.receipt_id = r.id AND a.reimbursement_id = $1
+    `, id)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM reimbursements WHERE id = $1", id); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ReimbursementsHandler lists (GET) or creates (POST) the household's
+// reimbursements
+func (s *Server) ReimbursementsHandler(w http.ResponseWriter, r *http.Request) {
+	membership := CurrentMembership(r)
+
+	switch r.Method {
+	case http.MethodGet:
+		reimbursements, err := s.DB.ListReimbursements(membership.HouseholdID)
+		if err != nil {
+			log.Printf("Failed to list reimbursements: %v", err)
+			http.Error(w, "Failed to list reimbursements", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(reimbursements)
+		return
+	case http.MethodPost:
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !membership.CanWrite() {
+		http.Error(w, "Viewers cannot record reimbursements", http.StatusForbidden)
+		return
+	}
+
+	var req struct {
+		Amount         *Money              `json:"amount"`
+		Currency       string              `json:"currency"`
+		ReimbursedOn   *string             `json:"reimbursed_on"`
+		TransactionRef *string             `json:"transaction_ref"`
+		Notes          *string             `json:"notes"`
+		Allocations    []ReceiptAllocation `json:"allocations"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if len(req.Allocations) == 0 {
+		http.Error(w, "At least one allocation is required", http.StatusBadRequest)
+		return
+	}
+
+	// An allocation without applied_amount claims the receipt's whole balance
+	seen := make(map[int]bool, len(req.Allocations))
+	var total Money
+	for i := range req.Allocations {
+		a := &req.Allocations[i]
+		if seen[a.ReceiptID] {
+			http.Error(w, fmt.Sprintf("Receipt %d is listed twice", a.ReceiptID), http.StatusBadRequest)
+			return
+		}
+		seen[a.ReceiptID] = true
+
+		receipt, err := s.DB.GetReceiptByID(membership.HouseholdID, a.ReceiptID)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Receipt %d not found", a.ReceiptID), http.StatusBadRequest)
+			return
+		}
+		if a.AppliedAmount == 0 {
+			a.AppliedAmount = receipt.RemainingAmount
+		}
+		if a.AppliedAmount <= 0 {
+			http.Error(w, fmt.Sprintf("Receipt %d has no remaining balance", a.ReceiptID), http.StatusConflict)
+			return
+		}
+		if req.Currency == "" {
+			req.Currency = receipt.Currency
+		}
+		total += a.AppliedAmount
+	}
+
+	currency, err := NormalizeCurrency(req.Currency)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Amount != nil && *req.Amount != total {
+		http.Error(w, fmt.Sprintf("amount %s does not match the allocations' total %s", *req.Amount, total),
+			http.StatusBadRequest)
+		return
+	}
+
+	reimbursedOn := time.Now().UTC().Truncate(24 * time.Hour)
+	if parsed, err := parseDate(req.ReimbursedOn); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if parsed != nil {
+		reimbursedOn = *parsed
+	}
+
+	user := CurrentUser(r)
+	rb := &Reimbursement{
+		HouseholdID:    membership.HouseholdID,
+		CreatedBy:      &user.ID,
+		Amount:         total,
+		Currency:       currency,
+		ReimbursedOn:   reimbursedOn,
+		TransactionRef: trimmedOrNil(req.TransactionRef),
+		Notes:          trimmedOrNil(req.Notes),
+	}
+
+	err = s.DB.CreateReimbursement(rb, req.Allocations)
+	if err == ErrInsufficientBalance || err == ErrCurrencyMismatch {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Printf("Failed to create reimbursement: %v", err)
+		http.Error(w, "Failed to create reimbursement", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("User %s recorded reimbursement %d of %s %s from %d receipts",
+		user.Username, rb.ID, rb.Amount, rb.Currency, len(rb.Receipts))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(rb)
+}
+
+// ReimbursementByIDHandler returns (GET) or undoes (DELETE) a reimbursement
+func (s *Server) ReimbursementByIDHandler(w http.ResponseWriter, r *http.Request) {
+	membership := CurrentMembership(r)
+
+	id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/api/reimbursements/"))
+	if err != nil {
+		http.Error(w, "Invalid reimbursement ID", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		rb, err := s.DB.GetReimbursement(membership.HouseholdID, id)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Reimbursement not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Printf("Failed to get reimbursement: %v", err)
+			http.Error(w, "Failed to get reimbursement", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rb)
+	case http.MethodDelete:
+		if !membership.CanWrite() {
+			http.Error(w, "Viewers cannot undo reimbursements", http.StatusForbidden)
+			return
+		}
+
+		err := s.DB.UndoReimbursement(membership.HouseholdID, id)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Reimbursement not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Printf("Failed to undo reimbursement: %v", err)
+			http.Error(w, "Failed to undo reimbursement", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("User %s undid reimbursement %d", CurrentUser(r).Username, id)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"message": "Reimbursement undone successfully"})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// trimmedOrNil trims value and returns nil if nothing is left
+func trimmedOrNil(value *string) *string {
+	if value == nil {
+		return nil
+	}
+	trimmed := strings.TrimSpace(*value)
+	if trimmed == "" {
+		return nil
+	}
+	return &trimmed
+}
@@ -0,0 +1,303 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+const (
+	// smtpCommandTimeout closes a connection that stays silent this long
+	smtpCommandTimeout = 5 * time.Minute
+	// smtpMaxRecipients is the most RCPT TO commands accepted per message
+	smtpMaxRecipients = 20
+)
+
+// SMTPConfig configures the receiver for emailed receipts
+type SMTPConfig struct {
+	Addr string // listen address, e.g. ":2525"
+	// Domain is the domain of the members' receipt addresses,
+	// <email_token>@Domain, and the name the receiver greets with
+	Domain         string
+	MaxMessageSize int64
+}
+
+// SMTPServer receives emailed receipts. It implements the part of SMTP a
+// mail server or a local client needs to hand it messages (HELO/EHLO, MAIL,
+// RCPT, DATA, RSET, NOOP, QUIT), without authentication or TLS, so it
+// belongs behind the organization's mail server or on a private network.
+// Only the members' receipt addresses are accepted as recipients; each
+// message's receipts are uploaded for every member it is addressed to.
+type SMTPServer struct {
+	s   *Server
+	cfg SMTPConfig
+}
+
+func NewSMTPServer(s *Server, cfg SMTPConfig) *SMTPServer {
+	if cfg.MaxMessageSize <= 0 {
+		cfg.MaxMessageSize = 25 << 20
+	}
+	return &SMTPServer{s: s, cfg: cfg}
+}
+
+// ListenAndServe accepts connections on the configured address until the
+// listener fails
+func (ss *SMTPServer) ListenAndServe() error {
+	l, err := net.Listen("tcp", ss.cfg.Addr)
+	if err != nil {
+		return err
+	}
+	return ss.Serve(l)
+}
+
+func (ss *SMTPServer) Serve(l net.Listener) error {
+	defer l.Close()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go ss.handle(conn)
+	}
+}
+
+// smtpSession is one connection's state
+type smtpSession struct {
+	ss         *SMTPServer
+	conn       net.Conn
+	text       *textproto.Conn
+	greeted    bool
+	mail       bool   // a MAIL command started the current message
+	from       string // empty for bounces, MAIL FROM:<>
+	recipients []*HouseholdMember
+}
+
+func (ss *SMTPServer) handle(conn net.Conn) {
+	defer conn.Close()
+	session := &smtpSession{ss: ss, conn: conn, text: textproto.NewConn(conn)}
+	session.reply(220, "%s ESMTP hsa-api receipt receiver", ss.cfg.Domain)
+
+	for {
+		conn.SetDeadline(time.Now().Add(smtpCommandTimeout))
+		line, err := session.text.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		if !session.command(strings.ToUpper(verb), strings.TrimSpace(arg)) {
+			return
+		}
+	}
+}
+
+func (sess *smtpSession) reply(code int, format string, args ...interface{}) {
+	sess.text.PrintfLine("%d %s", code, fmt.Sprintf(format, args...))
+}
+
+func (sess *smtpSession) reset() {
+	sess.mail = false
+	sess.from = ""
+	sess.recipients = nil
+}
+
+// command runs one SMTP command and reports whether to keep reading
+func (sess *smtpSession) command(verb, arg string) bool {
+	switch verb {
+	case "HELO":
+		sess.greeted = true
+		sess.reset()
+		sess.reply(250, "%s", sess.ss.cfg.Domain)
+	case "EHLO":
+		sess.greeted = true
+		sess.reset()
+		sess.text.PrintfLine("250-%s", sess.ss.cfg.Domain)
+		sess.text.PrintfLine("250-SIZE %d", sess.ss.cfg.MaxMessageSize)
+		sess.text.PrintfLine("250 8BITMIME")
+	case "MAIL":
+		if !sess.greeted {
+			sess.reply(503, "5.5.1 Say HELO or EHLO first")
+			return true
+		}
+		from, ok := smtpPath(arg, "FROM:")
+		if !ok {
+			sess.reply(501, "5.5.4 Syntax: MAIL FROM:<address>")
+			return true
+		}
+		sess.reset()
+		sess.mail, sess.from = true, from
+		sess.reply(250, "2.1.0 OK")
+	case "RCPT":
+		sess.recipient(arg)
+	case "DATA":
+		sess.data()
+	case "RSET":
+		sess.reset()
+		sess.reply(250, "2.0.0 OK")
+	case "NOOP":
+		sess.reply(250, "2.0.0 OK")
+	case "VRFY":
+		sess.reply(252, "2.5.2 Cannot verify, send the message")
+	case "QUIT":
+		sess.reply(221, "2.0.0 Bye")
+		return false
+	default:
+		sess.reply(502, "5.5.2 Command not implemented")
+	}
+	return true
+}
+
+// smtpPath reads the address from "FROM:<a@b> SIZE=123" and the like
+func smtpPath(arg, prefix string) (string, bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", false
+	}
+	rest := strings.TrimSpace(arg[len(prefix):])
+	if !strings.HasPrefix(rest, "<") {
+		return "", false
+	}
+	end := strings.Index(rest, ">")
+	if end < 0 {
+		return "", false
+	}
+	return rest[1:end], true
+}
+
+// recipient accepts a member's receipt address: <token>@Domain, or
+// <anything>+<token>@Domain for mail systems that only forward to
+// sub-addresses
+func (sess *smtpSession) recipient(arg string) {
+	if !sess.mail {
+		sess.reply(503, "5.5.1 Need MAIL before RCPT")
+		return
+	}
+	to, ok := smtpPath(arg, "TO:")
+	if !ok {
+		sess.reply(501, "5.5.4 Syntax: RCPT TO:<address>")
+		return
+	}
+	if len(sess.recipients) >= smtpMaxRecipients {
+		sess.reply(452, "4.5.3 Too many recipients")
+		return
+	}
+
+	local, domain, found := strings.Cut(to, "@")
+	if !found || !strings.EqualFold(domain, sess.ss.cfg.Domain) {
+		sess.reply(550, "5.1.1 <%s>: Recipient address rejected", to)
+		return
+	}
+	if _, token, ok := strings.Cut(local, "+"); ok {
+		local = token
+	}
+
+	member, err := sess.ss.s.DB.GetMemberByEmailToken(local)
+	if err != nil {
+		log.Printf("Failed to look up receipt address %s: %v", to, err)
+		sess.reply(451, "4.3.0 Temporary failure, try again later")
+		return
+	}
+	if member == nil {
+		sess.reply(550, "5.1.1 <%s>: Recipient address rejected", to)
+		return
+	}
+	for _, r := range sess.recipients {
+		if r.ID == member.ID {
+			sess.reply(250, "2.1.5 OK")
+			return
+		}
+	}
+	sess.recipients = append(sess.recipients, member)
+	sess.reply(250, "2.1.5 OK")
+}
+
+func (sess *smtpSession) data() {
+	if len(sess.recipients) == 0 {
+		sess.reply(503, "5.5.1 Need RCPT before DATA")
+		return
+	}
+	sess.reply(354, "End data with <CR><LF>.<CR><LF>")
+
+	limit := sess.ss.cfg.MaxMessageSize
+	sess.conn.SetDeadline(time.Now().Add(smtpCommandTimeout))
+	dot := sess.text.DotReader()
+	message, err := io.ReadAll(io.LimitReader(dot, limit+1))
+	if err != nil {
+		sess.reset()
+		return
+	}
+	if int64(len(message)) > limit {
+		// Skip the rest of the message before answering
+		io.Copy(io.Discard, dot)
+		sess.reset()
+		sess.reply(552, "5.3.4 Message larger than %d bytes", limit)
+		return
+	}
+
+	code, text := sess.ss.deliver(sess.from, sess.recipients, message)
+	sess.reset()
+	sess.reply(code, "%s", text)
+}
+
+// deliver uploads a message's receipts for each recipient and returns the
+// SMTP reply. A message with nothing to upload is rejected, so the sender
+// hears of it; one whose files all failed to save for some recipient is
+// refused for now, so the sending server tries again later. Duplicates
+// count as delivered.
+func (ss *SMTPServer) deliver(from string, recipients []*HouseholdMember, message []byte) (int, string) {
+	files, err := ParseEmailReceipts(message)
+	if err != nil {
+		log.Printf("Rejected email from %s: %v", from, err)
+		return 554, "5.6.0 " + err.Error()
+	}
+
+	// From is only logged: it is whatever the sender claims
+	if msg, err := mail.ReadMessage(bytes.NewReader(message)); err == nil {
+		if addr, err := mail.ParseAddress(msg.Header.Get("From")); err == nil {
+			from = addr.Address
+		}
+	}
+
+	saved := 0
+	for _, member := range recipients {
+		username := EmailUploader
+		if member.Username != nil {
+			username = *member.Username
+		}
+		delivered := false
+		for _, file := range files {
+			results := ss.s.IngestUpload(ReceiptUpload{
+				Username:    username,
+				HouseholdID: member.HouseholdID,
+				MemberID:    member.ID,
+				Filename:    file.Filename,
+				Data:        file.Data,
+			})
+			for _, result := range results {
+				log.Printf("Emailed receipt %s from %s for member %d: %s (%s)",
+					result.Filename, from, member.ID, result.Status, result.Message)
+				if result.Status != UploadFailed {
+					delivered = true
+				}
+			}
+		}
+		if delivered {
+			saved++
+		}
+	}
+
+	if saved < len(recipients) {
+		return 451, "4.3.0 Some receipts could not be saved, try again later"
+	}
+	return 250, fmt.Sprintf("2.0.0 OK, %d receipt files received", len(files))
+}
@@ -0,0 +1,148 @@
+package internal
+
+import (
+	"database/sql"
+	"errors"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"testing"
+)
+
+// startSMTPServer serves SMTP for receipts.test on a random local port. Its
+// database is unreachable, so every receipt address lookup fails.
+func startSMTPServer(t *testing.T) string {
+	t.Helper()
+
+	conn, err := sql.Open("postgres", "host=127.0.0.1 port=1 sslmode=disable connect_timeout=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	ss := NewSMTPServer(&Server{DB: &Database{conn: conn}}, SMTPConfig{Domain: "receipts.test", MaxMessageSize: 1 << 20})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ss.Serve(l)
+	t.Cleanup(func() { l.Close() })
+
+	return l.Addr().String()
+}
+
+// smtpCode returns the reply code of an error from net/smtp, or 0
+func smtpCode(err error) int {
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		return protoErr.Code
+	}
+	return 0
+}
+
+func TestSMTPSession(t *testing.T) {
+	c, err := smtp.Dial(startSMTPServer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.Hello("client.test"); err != nil {
+		t.Fatalf("EHLO: %v", err)
+	}
+	if ok, size := c.Extension("SIZE"); !ok || size != "1048576" {
+		t.Errorf("SIZE extension = %v %q, want 1048576", ok, size)
+	}
+	if ok, _ := c.Extension("8BITMIME"); !ok {
+		t.Error("8BITMIME not advertised")
+	}
+
+	if err := c.Mail("sender@example.com"); err != nil {
+		t.Fatalf("MAIL: %v", err)
+	}
+	if _, err := c.Data(); smtpCode(err) != 503 {
+		t.Errorf("DATA without recipients: %v, want 503", err)
+	}
+	if err := c.Rcpt("someone@example.com"); smtpCode(err) != 550 {
+		t.Errorf("RCPT to another domain: %v, want 550", err)
+	}
+	if err := c.Rcpt("nobody@other.test"); smtpCode(err) != 550 {
+		t.Errorf("RCPT to another domain: %v, want 550", err)
+	}
+	// The address lookup fails, which the sender should retry
+	if err := c.Rcpt("abc123@receipts.test"); smtpCode(err) != 451 {
+		t.Errorf("RCPT with the database down: %v, want 451", err)
+	}
+
+	if err := c.Reset(); err != nil {
+		t.Errorf("RSET: %v", err)
+	}
+	if err := c.Noop(); err != nil {
+		t.Errorf("NOOP: %v", err)
+	}
+	if err := c.Quit(); err != nil {
+		t.Errorf("QUIT: %v", err)
+	}
+}
+
+func TestSMTPCommandOrder(t *testing.T) {
+	conn, err := textproto.Dial("tcp", startSMTPServer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, _, err := conn.ReadResponse(220); err != nil {
+		t.Fatalf("greeting: %v", err)
+	}
+
+	steps := []struct {
+		command string
+		code    int
+	}{
+		{"MAIL FROM:<sender@example.com>", 503},
+		{"HELO client.test", 250},
+		{"RCPT TO:<abc123@receipts.test>", 503},
+		{"MAIL FROM:sender@example.com", 501},
+		{"MAIL FROM:<>", 250},
+		{"RCPT TO:abc123@receipts.test", 501},
+		{"VRFY someone", 252},
+		{"TURN", 502},
+		{"QUIT", 221},
+	}
+	for _, step := range steps {
+		id, err := conn.Cmd("%s", step.command)
+		if err != nil {
+			t.Fatalf("%s: %v", step.command, err)
+		}
+		conn.StartResponse(id)
+		code, msg, err := conn.ReadResponse(step.code)
+		conn.EndResponse(id)
+		if err != nil {
+			t.Errorf("%s: got %d %s, want %d", step.command, code, msg, step.code)
+		}
+	}
+}
+
+func TestSMTPPath(t *testing.T) {
+	tests := []struct {
+		arg, prefix string
+		want        string
+		ok          bool
+	}{
+		{"FROM:<a@example.com>", "FROM:", "a@example.com", true},
+		{"from: <a@example.com> SIZE=123 BODY=8BITMIME", "FROM:", "a@example.com", true},
+		{"FROM:<>", "FROM:", "", true},
+		{"TO:<t@receipts.test>", "TO:", "t@receipts.test", true},
+		{"FROM:a@example.com", "FROM:", "", false},
+		{"FROM:<a@example.com", "FROM:", "", false},
+		{"TO:<t@receipts.test>", "FROM:", "", false},
+		{"", "TO:", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := smtpPath(tt.arg, tt.prefix)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("smtpPath(%q, %q) = %q, %v; want %q, %v", tt.arg, tt.prefix, got, ok, tt.want, tt.ok)
+		}
+	}
+}
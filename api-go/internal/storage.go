@@ -0,0 +1,110 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+)
+
+// ErrBlobNotFound is returned when a key does not exist in the store
+var ErrBlobNotFound = errors.New("blob not found")
+
+// ErrPresignUnsupported is returned by PresignGet on stores that cannot hand
+// out URLs; callers fall back to Get
+var ErrPresignUnsupported = errors.New("presigned URLs are not supported by this store")
+
+// BlobStore holds receipt files under slash-separated keys such as
+// "unused/2024/1700000000_receipt.jpg". Implementations must be safe for
+// concurrent use.
+type BlobStore interface {
+	// Put stores size bytes from data under key, replacing any existing blob
+	Put(key string, data io.Reader, size int64, contentType string) error
+	// Get opens key for reading; the caller closes the reader
+	Get(key string) (io.ReadCloser, *BlobInfo, error)
+	Stat(key string) (*BlobInfo, error)
+	// Delete removes key; deleting a missing key is not an error
+	Delete(key string) error
+	Copy(srcKey, dstKey string) error
+	Move(srcKey, dstKey string) error
+	// List calls fn for every blob whose key starts with prefix, stopping at
+	// the first error fn returns
+	List(prefix string, fn func(BlobInfo) error) error
+	// PresignGet returns a URL that reads key without credentials until
+	// expires has passed
+	PresignGet(key string, expires time.Duration) (string, error)
+}
+
+// BlobInfo describes a stored blob
+type BlobInfo struct {
+	Key         string
+	Size        int64
+	ContentType string
+	ModTime     time.Time
+}
+
+// StorageConfig selects and configures a BlobStore
+type StorageConfig struct {
+	Backend  string // "local" or "s3"
+	LocalDir string
+
+	S3Endpoint        string
+	S3Region          string
+	S3Bucket          string
+	S3AccessKeyID     string
+	S3SecretAccessKey string
+	S3ForcePathStyle  bool
+}
+
+// NewBlobStore builds the store named by cfg.Backend
+func NewBlobStore(cfg StorageConfig) (BlobStore, error) {
+	switch strings.ToLower(cfg.Backend) {
+	case "", "local":
+		return NewLocalStore(cfg.LocalDir), nil
+	case "s3":
+		return NewS3Store(S3Config{
+			Endpoint:        cfg.S3Endpoint,
+			Region:          cfg.S3Region,
+			Bucket:          cfg.S3Bucket,
+			AccessKeyID:     cfg.S3AccessKeyID,
+			SecretAccessKey: cfg.S3SecretAccessKey,
+			ForcePathStyle:  cfg.S3ForcePathStyle,
+		})
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q, expected local or s3", cfg.Backend)
+	}
+}
+
+// cleanKey normalizes a key and rejects ones that would escape the store
+func cleanKey(key string) (string, error) {
+	slashed := strings.TrimPrefix(strings.ReplaceAll(key, "\\", "/"), "/")
+	for _, part := range strings.Split(slashed, "/") {
+		if part == ".." {
+			return "", fmt.Errorf("invalid storage key %q", key)
+		}
+	}
+
+	cleaned := path.Clean(slashed)
+	if cleaned == "." {
+		return "", fmt.Errorf("invalid storage key %q", key)
+	}
+	return cleaned, nil
+}
+
+// ContentTypeForKey guesses a receipt file's content type from its extension
+func ContentTypeForKey(key string) string {
+	switch strings.ToLower(path.Ext(key)) {
+	case ".jpg", ".jpeg":
+		return "image/jpeg"
+	case ".png":
+		return "image/png"
+	case ".pdf":
+		return "application/pdf"
+	case ".heic":
+		return "image/heic"
+	default:
+		return "application/octet-stream"
+	}
+}
@@ -0,0 +1,209 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// LocalStore keeps blobs as files under Root, one file per key
+type LocalStore struct {
+	Root string
+}
+
+func NewLocalStore(root string) *LocalStore {
+	return &LocalStore{Root: root}
+}
+
+func (s *LocalStore) path(key string) (string, error) {
+	key, err := cleanKey(key)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(s.Root, filepath.FromSlash(key)), nil
+}
+
+// FilePath is the file backing key, for callers that need a real path
+// (e.g. to hard link it)
+func (s *LocalStore) FilePath(key string) (string, error) {
+	return s.path(key)
+}
+
+func (s *LocalStore) info(key string, fi os.FileInfo) *BlobInfo {
+	return &BlobInfo{Key: key, Size: fi.Size(), ContentType: ContentTypeForKey(key), ModTime: fi.ModTime()}
+}
+
+// Put writes to a temporary file next to the destination and renames it into
+// place, so readers never see a partly written blob
+func (s *LocalStore) Put(key string, data io.Reader, size int64, contentType string) error {
+	dst, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %v", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".upload-*")
+	if err != nil {
+		return fmt.Errorf("failed to create file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write file: %v", err)
+	}
+
+	return os.Rename(tmp.Name(), dst)
+}
+
+// Get returns an *os.File, so callers can seek it (e.g. http.ServeContent)
+func (s *LocalStore) Get(key string) (io.ReadCloser, *BlobInfo, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil, nil, ErrBlobNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return f, s.info(key, fi), nil
+}
+
+func (s *LocalStore) Stat(key string) (*BlobInfo, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := os.Stat(p)
+	if os.IsNotExist(err) {
+		return nil, ErrBlobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s.info(key, fi), nil
+}
+
+func (s *LocalStore) Delete(key string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *LocalStore) Copy(srcKey, dstKey string) error {
+	src, info, err := s.Get(srcKey)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	return s.Put(dstKey, src, info.Size, info.ContentType)
+}
+
+// Move renames the file, falling back to copy and delete across devices
+func (s *LocalStore) Move(srcKey, dstKey string) error {
+	src, err := s.path(srcKey)
+	if err != nil {
+		return err
+	}
+	dst, err := s.path(dstKey)
+	if err != nil {
+		return err
+	}
+	if src == dst {
+		return nil
+	}
+
+	if _, err := os.Stat(src); os.IsNotExist(err) {
+		return ErrBlobNotFound
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return fmt.Errorf("failed to create destination directory: %v", err)
+	}
+
+	if err := os.Rename(src, dst); err != nil {
+		log.Printf("os.Rename failed, using copy+delete: %v", err)
+		if err := s.Copy(srcKey, dstKey); err != nil {
+			return err
+		}
+		if err := os.Remove(src); err != nil {
+			log.Printf("Warning: Failed to delete original file after copy: %v", err)
+		}
+	}
+	return nil
+}
+
+func (s *LocalStore) List(prefix string, fn func(BlobInfo) error) error {
+	root := filepath.Clean(s.Root)
+	// Walk the deepest directory the prefix names, then filter by prefix
+	dir := root
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		sub, err := s.path(prefix[:i])
+		if err != nil {
+			return err
+		}
+		dir = sub
+	}
+
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		fi, err := d.Info()
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return fn(*s.info(key, fi))
+	})
+	return err
+}
+
+// PresignGet is not supported; receipt files are served by the API itself
+func (s *LocalStore) PresignGet(key string, expires time.Duration) (string, error) {
+	return "", ErrPresignUnsupported
+}
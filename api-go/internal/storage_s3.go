@@ -0,0 +1,476 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	s3Algorithm       = "AWS4-HMAC-SHA256"
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+	s3MaxPresign      = 7 * 24 * time.Hour
+)
+
+// S3Config points an S3Store at a bucket on AWS S3 or a compatible server
+// such as MinIO. Endpoint defaults to the AWS endpoint for Region.
+type S3Config struct {
+	Endpoint        string
+	Region          string
+	Bucket          string
+	AccessKeyID     string
+	SecretAccessKey string
+	// ForcePathStyle addresses objects as endpoint/bucket/key instead of
+	// bucket.endpoint/key, which MinIO and most self-hosted servers need
+	ForcePathStyle bool
+}
+
+// S3Store is a BlobStore backed by an S3-compatible bucket. Requests are
+// signed with AWS Signature Version 4.
+type S3Store struct {
+	cfg      S3Config
+	endpoint *url.URL
+	client   *http.Client
+	now      func() time.Time
+}
+
+// s3ListResult is one page of a ListObjectsV2 response
+type s3ListResult struct {
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+	Contents              []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+}
+
+// s3Error is the XML body S3 returns with a failed request
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func NewS3Store(cfg S3Config) (*S3Store, error) {
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("S3 bucket is required")
+	}
+	if cfg.AccessKeyID == "" || cfg.SecretAccessKey == "" {
+		return nil, fmt.Errorf("S3 access key ID and secret access key are required")
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", cfg.Region)
+	}
+
+	endpoint, err := url.Parse(strings.TrimRight(cfg.Endpoint, "/"))
+	if err != nil || endpoint.Host == "" || (endpoint.Scheme != "http" && endpoint.Scheme != "https") {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", cfg.Endpoint)
+	}
+
+	return &S3Store{
+		cfg:      cfg,
+		endpoint: endpoint,
+		client:   &http.Client{Timeout: 60 * time.Second},
+		now:      time.Now,
+	}, nil
+}
+
+// objectURL addresses key in the bucket, path- or virtual-host-style. An
+// empty key addresses the bucket itself.
+func (s *S3Store) objectURL(key string) *url.URL {
+	u := *s.endpoint
+	objectPath := "/" + s3EscapePath(key)
+	if s.cfg.ForcePathStyle {
+		objectPath = "/" + s.cfg.Bucket
+		if key != "" {
+			objectPath += "/" + s3EscapePath(key)
+		}
+	} else {
+		u.Host = s.cfg.Bucket + "." + u.Host
+	}
+	base := strings.TrimRight(s.endpoint.EscapedPath(), "/")
+	u.RawPath = base + objectPath
+	u.Path, _ = url.PathUnescape(u.RawPath)
+	return &u
+}
+
+// newRequest builds a signed request for key. body may be nil.
+func (s *S3Store) newRequest(method, key string, body []byte, headers map[string]string) (*http.Request, error) {
+	key, err := cleanKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return s.signedRequest(method, s.objectURL(key), body, headers)
+}
+
+func (s *S3Store) signedRequest(method string, u *url.URL, body []byte, headers map[string]string) (*http.Request, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, u.String(), reader)
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	sum := sha256.Sum256(body)
+	s.sign(req, hex.EncodeToString(sum[:]), s.now())
+	return req, nil
+}
+
+// do sends req and turns S3 error responses into Go errors. NoSuchKey and a
+// bare 404 become ErrBlobNotFound.
+func (s *S3Store) do(req *http.Request) (*http.Response, error) {
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("S3 %s failed: %v", req.Method, err)
+	}
+	if resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	var apiErr s3Error
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	xml.Unmarshal(body, &apiErr)
+
+	if resp.StatusCode == http.StatusNotFound && (apiErr.Code == "" || apiErr.Code == "NoSuchKey") {
+		return nil, ErrBlobNotFound
+	}
+	if apiErr.Code != "" {
+		return nil, fmt.Errorf("S3 %s returned status %d: %s: %s", req.Method, resp.StatusCode, apiErr.Code, apiErr.Message)
+	}
+	return nil, fmt.Errorf("S3 %s returned status %d", req.Method, resp.StatusCode)
+}
+
+func (s *S3Store) Put(key string, data io.Reader, size int64, contentType string) error {
+	// Receipt files are small; buffering lets the payload hash be signed
+	body, err := io.ReadAll(data)
+	if err != nil {
+		return fmt.Errorf("failed to read upload: %v", err)
+	}
+	if size >= 0 && int64(len(body)) != size {
+		return fmt.Errorf("upload size mismatch: expected %d bytes, read %d", size, len(body))
+	}
+	if contentType == "" {
+		contentType = ContentTypeForKey(key)
+	}
+
+	req, err := s.newRequest(http.MethodPut, key, body, map[string]string{"Content-Type": contentType})
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3Store) Get(key string) (io.ReadCloser, *BlobInfo, error) {
+	req, err := s.newRequest(http.MethodGet, key, nil, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp.Body, s.info(key, resp), nil
+}
+
+func (s *S3Store) Stat(key string) (*BlobInfo, error) {
+	req, err := s.newRequest(http.MethodHead, key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return s.info(key, resp), nil
+}
+
+func (s *S3Store) info(key string, resp *http.Response) *BlobInfo {
+	info := &BlobInfo{Key: key, Size: resp.ContentLength, ContentType: resp.Header.Get("Content-Type")}
+	if size, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64); err == nil {
+		info.Size = size
+	}
+	if modTime, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		info.ModTime = modTime
+	}
+	if info.ContentType == "" {
+		info.ContentType = ContentTypeForKey(key)
+	}
+	return info
+}
+
+func (s *S3Store) Delete(key string) error {
+	req, err := s.newRequest(http.MethodDelete, key, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(req)
+	if err == ErrBlobNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Copy uses a server-side CopyObject, so the bytes never pass through the API
+func (s *S3Store) Copy(srcKey, dstKey string) error {
+	src, err := cleanKey(srcKey)
+	if err != nil {
+		return err
+	}
+
+	req, err := s.newRequest(http.MethodPut, dstKey, nil, map[string]string{
+		"X-Amz-Copy-Source": "/" + s.cfg.Bucket + "/" + s3EscapePath(src),
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// CopyObject can fail after sending 200, with an <Error> body
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return fmt.Errorf("S3 copy failed: %v", err)
+	}
+	if bytes.Contains(body, []byte("<Error>")) {
+		var apiErr s3Error
+		xml.Unmarshal(body, &apiErr)
+		return fmt.Errorf("S3 copy failed: %s: %s", apiErr.Code, apiErr.Message)
+	}
+	return nil
+}
+
+// Move copies then deletes; S3 has no rename
+func (s *S3Store) Move(srcKey, dstKey string) error {
+	src, err := cleanKey(srcKey)
+	if err != nil {
+		return err
+	}
+	dst, err := cleanKey(dstKey)
+	if err != nil {
+		return err
+	}
+	if src == dst {
+		return nil
+	}
+
+	if err := s.Copy(src, dst); err != nil {
+		return err
+	}
+	return s.Delete(src)
+}
+
+// List pages through ListObjectsV2
+func (s *S3Store) List(prefix string, fn func(BlobInfo) error) error {
+	token := ""
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", prefix)
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		u := s.objectURL("")
+		u.RawQuery = s3CanonicalQuery(query)
+
+		req, err := s.signedRequest(http.MethodGet, u, nil, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := s.do(req)
+		if err == ErrBlobNotFound {
+			return fmt.Errorf("S3 bucket %s does not exist", s.cfg.Bucket)
+		}
+		if err != nil {
+			return err
+		}
+
+		var page s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("failed to parse S3 listing: %v", err)
+		}
+
+		for _, obj := range page.Contents {
+			info := BlobInfo{Key: obj.Key, Size: obj.Size, ContentType: ContentTypeForKey(obj.Key), ModTime: obj.LastModified}
+			if err := fn(info); err != nil {
+				return err
+			}
+		}
+
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+// PresignGet returns a query-string-signed GET URL for key
+func (s *S3Store) PresignGet(key string, expires time.Duration) (string, error) {
+	key, err := cleanKey(key)
+	if err != nil {
+		return "", err
+	}
+	if expires <= 0 || expires > s3MaxPresign {
+		return "", fmt.Errorf("presigned URL expiry must be between 1s and %v", s3MaxPresign)
+	}
+
+	now := s.now().UTC()
+	u := s.objectURL(key)
+	query := url.Values{}
+	query.Set("X-Amz-Algorithm", s3Algorithm)
+	query.Set("X-Amz-Credential", s.cfg.AccessKeyID+"/"+s.scope(now))
+	query.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	query.Set("X-Amz-Expires", strconv.Itoa(int(expires/time.Second)))
+	query.Set("X-Amz-SignedHeaders", "host")
+
+	canonical := strings.Join([]string{
+		http.MethodGet,
+		u.EscapedPath(),
+		s3CanonicalQuery(query),
+		"host:" + u.Host + "\n",
+		"host",
+		s3UnsignedPayload,
+	}, "\n")
+
+	u.RawQuery = s3CanonicalQuery(query) + "&X-Amz-Signature=" + s.signature(now, canonical)
+	return u.String(), nil
+}
+
+// sign adds the SigV4 Authorization header to req, covering Host and every
+// header already set on it
+func (s *S3Store) sign(req *http.Request, payloadHash string, now time.Time) {
+	now = now.UTC()
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, s.cfg.AccessKeyID, s.scope(now), signedHeaders, s.signature(now, canonical)))
+}
+
+func (s *S3Store) scope(now time.Time) string {
+	return now.Format("20060102") + "/" + s.cfg.Region + "/s3/aws4_request"
+}
+
+// signature signs the canonical request with the key derived for now's date
+func (s *S3Store) signature(now time.Time, canonical string) string {
+	hash := sha256.Sum256([]byte(canonical))
+	stringToSign := strings.Join([]string{
+		s3Algorithm,
+		now.Format("20060102T150405Z"),
+		s.scope(now),
+		hex.EncodeToString(hash[:]),
+	}, "\n")
+
+	key := s3HMAC([]byte("AWS4"+s.cfg.SecretAccessKey), now.Format("20060102"))
+	key = s3HMAC(key, s.cfg.Region)
+	key = s3HMAC(key, "s3")
+	key = s3HMAC(key, "aws4_request")
+	return hex.EncodeToString(s3HMAC(key, stringToSign))
+}
+
+func s3HMAC(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3CanonicalQuery sorts and URI-encodes query parameters as SigV4 requires
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3EscapePath URI-encodes a key, keeping its slashes
+func s3EscapePath(key string) string {
+	return s3Escape(key, false)
+}
+
+// s3Escape percent-encodes everything but RFC 3986 unreserved characters
+// (and '/' unless encodeSlash), the encoding SigV4 signs
+func s3Escape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -1,34 +1,369 @@
 package internal
 
-type state struct {
-    sum     float64
-    indices []int
-}
-
-func SubsetSum(amounts []float64, target float64) []int {
-    dp := []state{{0, []int{}}}
-    best := state{}
-    
-    for i, a := range amounts {
-        newdp := make([]state, len(dp))
-        copy(newdp, dp)
-        
-        for _, s := range dp {
-            ns := s.sum + a
-            if ns <= target && (target-ns) < (target-best.sum) {
-                newIndices := make([]int, len(s.indices))
-                copy(newIndices, s.indices)
-                newIndices = append(newIndices, i)
-                best = state{ns, newIndices}
-            }
-            
-            newIndices := make([]int, len(s.indices))
-            copy(newIndices, s.indices)
-            newIndices = append(newIndices, i)
-            newdp = append(newdp, state{ns, newIndices})
-        }
-        dp = newdp
-    }
-    
-    return best.indices
-}
\ No newline at end of file
+import (
+	"sort"
+)
+
+// Solver limits. The DP needs 4 bytes per cent of target and touches every
+// cent once per receipt; past these bounds the fallbacks take over.
+const (
+	maxDPTargetCents = 1 << 24 // ~$167,772 and 64 MiB of reconstruction table
+	maxDPWork        = 1 << 30 // receipts × cents
+	maxMITMItems     = 40      // 2^20 subset sums per half
+	maxBranchNodes   = 5000000
+	maxCountDPBits   = 1 << 28 // receipts × cents decision bits, 32 MiB
+)
+
+// Subset-sum solving methods reported in SubsetSumResult
+const (
+	SolverTrivial         = "trivial"
+	SolverDynamic         = "dynamic_programming"
+	SolverMeetInTheMiddle = "meet_in_the_middle"
+	SolverBranchAndBound  = "branch_and_bound"
+	SolverGreedy          = "greedy"
+)
+
+// SubsetSumResult is the best subset found: the one whose sum is closest to
+// the target without exceeding it. Exact is false when a size-limited fallback
+// (branch and bound at its node limit, or a greedy fill) could not prove the
+// result optimal; Sum is then the best found.
+type SubsetSumResult struct {
+	Indices []int
+	Sum     Money
+	Exact   bool
+	Method  string
+}
+
+// SubsetSum returns the indices of the amounts whose sum is closest to
+// target without exceeding it
+func SubsetSum(amounts []Money, target Money) []int {
+	return SolveSubsetSum(amounts, target).Indices
+}
+
+// positiveCandidates returns the indices of amounts that could be part of a
+// subset summing to at most target, and their total
+func positiveCandidates(amounts []Money, target Money) ([]int, Money) {
+	var candidates []int
+	var total Money
+	for i, a := range amounts {
+		if a > 0 && a <= target {
+			candidates = append(candidates, i)
+			total += a
+		}
+	}
+	return candidates, total
+}
+
+// SolveSubsetSum picks a solver by problem size: a pseudo-polynomial DP over
+// cents when target × receipts fits the work and memory bounds, otherwise
+// meet-in-the-middle for up to 40 receipts, otherwise branch and bound.
+// Non-positive amounts and amounts above target can never help and are skipped.
+func SolveSubsetSum(amounts []Money, target Money) SubsetSumResult {
+	if target <= 0 {
+		return SubsetSumResult{Indices: []int{}, Exact: true, Method: SolverTrivial}
+	}
+
+	candidates, total := positiveCandidates(amounts, target)
+	if total <= target {
+		return SubsetSumResult{Indices: append([]int{}, candidates...), Sum: total, Exact: true, Method: SolverTrivial}
+	}
+
+	var result SubsetSumResult
+	switch {
+	case int64(target) <= maxDPTargetCents && int64(target)*int64(len(candidates)) <= maxDPWork:
+		result = subsetSumDP(amounts, candidates, target)
+	case len(candidates) <= maxMITMItems:
+		result = subsetSumMeetInTheMiddle(amounts, candidates, target)
+	default:
+		result = subsetSumBranchAndBound(amounts, candidates, target)
+	}
+
+	sort.Ints(result.Indices)
+	return result
+}
+
+// subsetSumDP marks every reachable sum up to target, recording the receipt
+// that first reached it. Sums are visited downwards, so when receipt i first
+// reaches s, s - amount[i] was reachable using earlier receipts only; walking
+// back from the best sum therefore yields distinct receipts.
+func subsetSumDP(amounts []Money, candidates []int, target Money) SubsetSumResult {
+	t := int(target)
+	from := make([]int32, t+1)
+	for s := range from {
+		from[s] = -1
+	}
+
+	reachable := func(s int) bool { return s == 0 || from[s] >= 0 }
+
+	best := 0
+	for _, idx := range candidates {
+		a := int(amounts[idx])
+		for s := t; s >= a; s-- {
+			if from[s] < 0 && reachable(s-a) {
+				from[s] = int32(idx)
+				if s > best {
+					best = s
+				}
+			}
+		}
+		if best == t {
+			break
+		}
+	}
+
+	indices := []int{}
+	for s := best; s > 0; {
+		idx := int(from[s])
+		indices = append(indices, idx)
+		s -= int(amounts[idx])
+	}
+
+	return SubsetSumResult{Indices: indices, Sum: Money(best), Exact: true, Method: SolverDynamic}
+}
+
+type halfSum struct {
+	sum  Money
+	mask uint32
+}
+
+// enumerateSums lists every subset sum of items that does not exceed target
+func enumerateSums(amounts []Money, items []int, target Money) []halfSum {
+	sums := []halfSum{{0, 0}}
+	for bit, idx := range items {
+		a := amounts[idx]
+		n := len(sums)
+		for k := 0; k < n; k++ {
+			if s := sums[k].sum + a; s <= target {
+				sums = append(sums, halfSum{s, sums[k].mask | 1<<uint(bit)})
+			}
+		}
+	}
+	return sums
+}
+
+// subsetSumMeetInTheMiddle splits the receipts in two, enumerates each half's
+// subset sums, and pairs every left sum with the largest right sum that fits
+func subsetSumMeetInTheMiddle(amounts []Money, candidates []int, target Money) SubsetSumResult {
+	left := candidates[:len(candidates)/2]
+	right := candidates[len(candidates)/2:]
+
+	leftSums := enumerateSums(amounts, left, target)
+	rightSums := enumerateSums(amounts, right, target)
+	sort.Slice(rightSums, func(i, j int) bool { return rightSums[i].sum < rightSums[j].sum })
+
+	var best Money = -1
+	var bestLeft, bestRight uint32
+	for _, l := range leftSums {
+		remaining := target - l.sum
+		// first right sum greater than remaining; the one before it fits
+		k := sort.Search(len(rightSums), func(i int) bool { return rightSums[i].sum > remaining })
+		if k == 0 {
+			continue
+		}
+		r := rightSums[k-1]
+		if l.sum+r.sum > best {
+			best = l.sum + r.sum
+			bestLeft, bestRight = l.mask, r.mask
+			if best == target {
+				break
+			}
+		}
+	}
+
+	indices := []int{}
+	for bit, idx := range left {
+		if bestLeft&(1<<uint(bit)) != 0 {
+			indices = append(indices, idx)
+		}
+	}
+	for bit, idx := range right {
+		if bestRight&(1<<uint(bit)) != 0 {
+			indices = append(indices, idx)
+		}
+	}
+
+	return SubsetSumResult{Indices: indices, Sum: best, Exact: true, Method: SolverMeetInTheMiddle}
+}
+
+// subsetSumBranchAndBound searches include/exclude decisions over receipts
+// sorted largest first, pruning branches that cannot beat the best sum even
+// if every remaining receipt were added. The search stops at maxBranchNodes
+// and returns the best subset seen so far.
+func subsetSumBranchAndBound(amounts []Money, candidates []int, target Money) SubsetSumResult {
+	items := append([]int{}, candidates...)
+	sort.SliceStable(items, func(i, j int) bool { return amounts[items[i]] > amounts[items[j]] })
+
+	// suffix[k] is the sum of items[k:]
+	suffix := make([]Money, len(items)+1)
+	for k := len(items) - 1; k >= 0; k-- {
+		suffix[k] = suffix[k+1] + amounts[items[k]]
+	}
+
+	// Seed with a greedy largest-first fill so pruning starts tight
+	chosen := make([]bool, len(items))
+	bestChosen := make([]bool, len(items))
+	var best Money
+	for k, idx := range items {
+		if best+amounts[idx] <= target {
+			best += amounts[idx]
+			bestChosen[k] = true
+		}
+	}
+
+	nodes := 0
+	var search func(k int, sum Money) bool
+	search = func(k int, sum Money) bool {
+		nodes++
+		if sum > best {
+			best = sum
+			copy(bestChosen, chosen)
+		}
+		if best == target || nodes >= maxBranchNodes {
+			return true
+		}
+		if k == len(items) || sum+suffix[k] <= best {
+			return false
+		}
+
+		if a := amounts[items[k]]; sum+a <= target {
+			chosen[k] = true
+			if search(k+1, sum+a) {
+				return true
+			}
+			chosen[k] = false
+		}
+		return search(k+1, sum)
+	}
+	search(0, 0)
+
+	indices := []int{}
+	for k, idx := range items {
+		if bestChosen[k] {
+			indices = append(indices, idx)
+		}
+	}
+
+	exact := best == target || nodes < maxBranchNodes
+	return SubsetSumResult{Indices: indices, Sum: best, Exact: exact, Method: SolverBranchAndBound}
+}
+
+// SolveSubsetSumByCount is SolveSubsetSum with a preference on receipt count:
+// among the subsets reaching the best sum it returns the fewest (or, with
+// fewest false, the most) amounts. maxCount > 0 caps the subset size, and the
+// best sum is then the best reachable within the cap. Problems too large for
+// the count-tracking DP fall back to a greedy fill, largest amounts first for
+// fewest and smallest first otherwise, and report Exact false.
+func SolveSubsetSumByCount(amounts []Money, target Money, fewest bool, maxCount int) SubsetSumResult {
+	if target <= 0 {
+		return SubsetSumResult{Indices: []int{}, Exact: true, Method: SolverTrivial}
+	}
+
+	candidates, total := positiveCandidates(amounts, target)
+	if total <= target && (maxCount <= 0 || len(candidates) <= maxCount) {
+		return SubsetSumResult{Indices: append([]int{}, candidates...), Sum: total, Exact: true, Method: SolverTrivial}
+	}
+
+	if int64(target) > maxDPTargetCents || int64(target+1)*int64(len(candidates)) > maxCountDPBits {
+		result := subsetSumGreedy(amounts, candidates, target, fewest, maxCount)
+		sort.Ints(result.Indices)
+		return result
+	}
+
+	withinCap := func(count int32) bool { return maxCount <= 0 || int(count) <= maxCount }
+
+	fewestTable := newCountDP(amounts, candidates, target, true)
+	best := 0
+	for s := int(target); s > 0; s-- {
+		if c := fewestTable.count[s]; c >= 0 && withinCap(c) {
+			best = s
+			break
+		}
+	}
+
+	result := SubsetSumResult{Sum: Money(best), Exact: true, Method: SolverDynamic}
+	if fewest {
+		result.Indices = fewestTable.reconstruct(amounts, candidates, best)
+	} else if mostTable := newCountDP(amounts, candidates, target, false); withinCap(mostTable.count[best]) {
+		result.Indices = mostTable.reconstruct(amounts, candidates, best)
+	} else {
+		// The largest subset reaching best exceeds the cap; the smallest one
+		// fits but may not be the largest that does
+		result.Indices = fewestTable.reconstruct(amounts, candidates, best)
+		result.Exact = false
+	}
+
+	sort.Ints(result.Indices)
+	return result
+}
+
+// countDP holds, for every sum up to the target, the fewest (or most) amounts
+// reaching it, plus one decision bit per candidate and sum recording whether
+// that candidate's pass improved the sum. Walking the candidates backwards
+// through those bits reconstructs the subset.
+type countDP struct {
+	count []int32
+	taken []uint64
+	words int
+}
+
+func newCountDP(amounts []Money, candidates []int, target Money, fewest bool) *countDP {
+	t := int(target)
+	dp := &countDP{count: make([]int32, t+1), words: (t + 64) / 64}
+	dp.taken = make([]uint64, dp.words*len(candidates))
+	for s := 1; s <= t; s++ {
+		dp.count[s] = -1
+	}
+
+	for k, idx := range candidates {
+		a := int(amounts[idx])
+		row := dp.taken[k*dp.words : (k+1)*dp.words]
+		for s := t; s >= a; s-- {
+			prev := dp.count[s-a]
+			if prev < 0 {
+				continue
+			}
+			c := prev + 1
+			if cur := dp.count[s]; cur < 0 || (fewest && c < cur) || (!fewest && c > cur) {
+				dp.count[s] = c
+				row[s/64] |= 1 << uint(s%64)
+			}
+		}
+	}
+	return dp
+}
+
+func (dp *countDP) reconstruct(amounts []Money, candidates []int, sum int) []int {
+	indices := []int{}
+	for k := len(candidates) - 1; k >= 0 && sum > 0; k-- {
+		if dp.taken[k*dp.words+sum/64]&(1<<uint(sum%64)) != 0 {
+			indices = append(indices, candidates[k])
+			sum -= int(amounts[candidates[k]])
+		}
+	}
+	return indices
+}
+
+// subsetSumGreedy adds amounts in size order while they fit, up to maxCount
+func subsetSumGreedy(amounts []Money, candidates []int, target Money, largestFirst bool, maxCount int) SubsetSumResult {
+	items := append([]int{}, candidates...)
+	sort.SliceStable(items, func(i, j int) bool {
+		if largestFirst {
+			return amounts[items[i]] > amounts[items[j]]
+		}
+		return amounts[items[i]] < amounts[items[j]]
+	})
+
+	indices := []int{}
+	var sum Money
+	for _, idx := range items {
+		if maxCount > 0 && len(indices) >= maxCount {
+			break
+		}
+		if sum+amounts[idx] <= target {
+			sum += amounts[idx]
+			indices = append(indices, idx)
+		}
+	}
+
+	return SubsetSumResult{Indices: indices, Sum: sum, Exact: false, Method: SolverGreedy}
+}
@@ -0,0 +1,241 @@
+package internal
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// bruteForce tries every subset of amounts and returns the best sum not
+// exceeding target using at most maxCount amounts (0 means any number), with
+// the fewest and most amounts reaching that sum. Like the solvers, it never
+// uses amounts that are zero or negative.
+func bruteForce(amounts []Money, target Money, maxCount int) (best Money, fewest, most int) {
+	fewest = len(amounts) + 1
+	for mask := 0; mask < 1<<len(amounts); mask++ {
+		var sum Money
+		count := 0
+		usable := true
+		for i, a := range amounts {
+			if mask&(1<<i) != 0 {
+				sum += a
+				count++
+				usable = usable && a > 0
+			}
+		}
+		if !usable || sum > target || (maxCount > 0 && count > maxCount) {
+			continue
+		}
+		if sum > best {
+			best, fewest, most = sum, count, count
+		} else if sum == best {
+			fewest = min(fewest, count)
+			most = max(most, count)
+		}
+	}
+	return best, fewest, most
+}
+
+// checkSubset fails the test unless result names distinct amounts that add
+// up to result.Sum without exceeding target
+func checkSubset(t *testing.T, name string, amounts []Money, target Money, result SubsetSumResult) {
+	t.Helper()
+
+	seen := map[int]bool{}
+	var sum Money
+	for _, idx := range result.Indices {
+		if idx < 0 || idx >= len(amounts) || seen[idx] {
+			t.Fatalf("%s: invalid or repeated index %d in %v", name, idx, result.Indices)
+		}
+		seen[idx] = true
+		sum += amounts[idx]
+	}
+	if sum != result.Sum {
+		t.Fatalf("%s: indices %v sum to %d, result says %d", name, result.Indices, sum, result.Sum)
+	}
+	if sum > target {
+		t.Fatalf("%s: sum %d exceeds target %d", name, sum, target)
+	}
+}
+
+// randomAmounts returns n amounts up to maxCents, with the odd zero,
+// negative amount or amount above any target mixed in
+func randomAmounts(rng *rand.Rand, n int, maxCents int64) []Money {
+	amounts := make([]Money, n)
+	for i := range amounts {
+		switch rng.Intn(20) {
+		case 0:
+			amounts[i] = 0
+		case 1:
+			amounts[i] = -Money(rng.Int63n(maxCents) + 1)
+		case 2:
+			amounts[i] = Money(maxCents * int64(n+1))
+		default:
+			amounts[i] = Money(rng.Int63n(maxCents) + 1)
+		}
+	}
+	return amounts
+}
+
+func TestSubsetSumSolversMatchBruteForce(t *testing.T) {
+	solvers := map[string]func([]Money, []int, Money) SubsetSumResult{
+		SolverDynamic:         subsetSumDP,
+		SolverMeetInTheMiddle: subsetSumMeetInTheMiddle,
+		SolverBranchAndBound:  subsetSumBranchAndBound,
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	for round := 0; round < 300; round++ {
+		amounts := randomAmounts(rng, 1+rng.Intn(14), 5000)
+		var total Money
+		for _, a := range amounts {
+			if a > 0 {
+				total += a
+			}
+		}
+		target := Money(rng.Int63n(int64(total)+2) + 1)
+		want, _, _ := bruteForce(amounts, target, 0)
+
+		candidates, _ := positiveCandidates(amounts, target)
+		for name, solve := range solvers {
+			result := solve(amounts, candidates, target)
+			checkSubset(t, name, amounts, target, result)
+			if result.Sum != want || !result.Exact {
+				t.Fatalf("%s(%v, %d) = %d (exact %v), want %d", name, amounts, target, result.Sum, result.Exact, want)
+			}
+		}
+
+		result := SolveSubsetSum(amounts, target)
+		checkSubset(t, "SolveSubsetSum", amounts, target, result)
+		if result.Sum != want {
+			t.Fatalf("SolveSubsetSum(%v, %d) = %d, want %d", amounts, target, result.Sum, want)
+		}
+	}
+}
+
+func TestSolveSubsetSumByCountMatchesBruteForce(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	for round := 0; round < 300; round++ {
+		// Few distinct amounts, so many subsets tie on the best sum
+		amounts := make([]Money, 1+rng.Intn(12))
+		for i := range amounts {
+			amounts[i] = Money(100 * (1 + rng.Intn(6)))
+		}
+		target := Money(100 * (1 + rng.Intn(20)))
+		maxCount := rng.Intn(5) // 0 is no cap
+
+		best, fewest, most := bruteForce(amounts, target, maxCount)
+
+		result := SolveSubsetSumByCount(amounts, target, true, maxCount)
+		checkSubset(t, "fewest", amounts, target, result)
+		if result.Sum != best || len(result.Indices) != fewest || !result.Exact {
+			t.Fatalf("fewest(%v, %d, cap %d) = %d with %d amounts (exact %v), want %d with %d",
+				amounts, target, maxCount, result.Sum, len(result.Indices), result.Exact, best, fewest)
+		}
+
+		result = SolveSubsetSumByCount(amounts, target, false, maxCount)
+		checkSubset(t, "most", amounts, target, result)
+		if result.Sum != best {
+			t.Fatalf("most(%v, %d, cap %d) = %d, want %d", amounts, target, maxCount, result.Sum, best)
+		}
+		if maxCount > 0 && len(result.Indices) > maxCount {
+			t.Fatalf("most(%v, %d, cap %d) used %d amounts", amounts, target, maxCount, len(result.Indices))
+		}
+		// Only a cap below the largest tying subset may cost optimality
+		if result.Exact && len(result.Indices) != most {
+			t.Fatalf("most(%v, %d, cap %d) = %d amounts, want %d", amounts, target, maxCount, len(result.Indices), most)
+		}
+		if !result.Exact && len(result.Indices) != fewest {
+			t.Fatalf("most(%v, %d, cap %d) fell back to %d amounts, want the fewest, %d",
+				amounts, target, maxCount, len(result.Indices), fewest)
+		}
+	}
+}
+
+func TestSolveSubsetSumTrivialCases(t *testing.T) {
+	amounts := []Money{500, 0, -200, 1200}
+
+	if result := SolveSubsetSum(amounts, 0); result.Sum != 0 || len(result.Indices) != 0 || result.Method != SolverTrivial {
+		t.Errorf("target 0: %+v", result)
+	}
+
+	// Everything positive fits; the zero and negative amounts are left out
+	result := SolveSubsetSum(amounts, 5000)
+	if result.Sum != 1700 || len(result.Indices) != 2 || result.Method != SolverTrivial {
+		t.Errorf("target above the total: %+v", result)
+	}
+
+	if result := SolveSubsetSumByCount(amounts, 5000, true, 1); result.Sum != 1200 || len(result.Indices) != 1 {
+		t.Errorf("cap of one amount: %+v", result)
+	}
+}
+
+func TestSolveSubsetSumPicksSolverBySize(t *testing.T) {
+	rng := rand.New(rand.NewSource(3))
+
+	small := randomAmounts(rng, 20, 10000)
+	if result := SolveSubsetSum(small, 50000); result.Method != SolverDynamic {
+		t.Errorf("small target used %s", result.Method)
+	}
+
+	// Past the DP's target bound
+	large := make([]Money, 30)
+	for i := range large {
+		large[i] = Money(rng.Int63n(1<<24) + 1<<22)
+	}
+	target := Money(1<<24 + 12345)
+	result := SolveSubsetSum(large, target)
+	if result.Method != SolverMeetInTheMiddle || !result.Exact {
+		t.Errorf("30 large amounts used %s (exact %v)", result.Method, result.Exact)
+	}
+	checkSubset(t, "meet in the middle", large, target, result)
+
+	many := make([]Money, 60)
+	for i := range many {
+		many[i] = Money(rng.Int63n(1<<24) + 1<<22)
+	}
+	result = SolveSubsetSum(many, target*3)
+	if result.Method != SolverBranchAndBound {
+		t.Errorf("60 large amounts used %s", result.Method)
+	}
+	checkSubset(t, "branch and bound", many, target*3, result)
+}
+
+func benchmarkSolver(b *testing.B, solve func([]Money, []int, Money) SubsetSumResult, n int, maxCents int64, target Money) {
+	rng := rand.New(rand.NewSource(4))
+	amounts := make([]Money, n)
+	for i := range amounts {
+		amounts[i] = Money(rng.Int63n(maxCents) + 1)
+	}
+	candidates, _ := positiveCandidates(amounts, target)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		solve(amounts, candidates, target)
+	}
+}
+
+// A typical household year: 200 receipts up to $300 against a $5,000 withdrawal
+func BenchmarkSubsetSumDP(b *testing.B) {
+	benchmarkSolver(b, subsetSumDP, 200, 30000, 500000)
+}
+
+func BenchmarkSubsetSumMeetInTheMiddle(b *testing.B) {
+	benchmarkSolver(b, subsetSumMeetInTheMiddle, 40, 1<<24, 1<<26)
+}
+
+func BenchmarkSubsetSumBranchAndBound(b *testing.B) {
+	benchmarkSolver(b, subsetSumBranchAndBound, 100, 1<<24, 1<<28)
+}
+
+func BenchmarkSolveSubsetSumByCount(b *testing.B) {
+	rng := rand.New(rand.NewSource(5))
+	amounts := make([]Money, 200)
+	for i := range amounts {
+		amounts[i] = Money(rng.Int63n(30000) + 1)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		SolveSubsetSumByCount(amounts, 500000, true, 10)
+	}
+}
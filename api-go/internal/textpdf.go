@@ -0,0 +1,128 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Text PDF layout: US Letter in points, Courier so receipt columns stay
+// aligned. Courier glyphs are 0.6 em wide, so textPDFColumns characters
+// fill the width between the margins.
+const (
+	textPDFWidth    = 612
+	textPDFHeight   = 792
+	textPDFMargin   = 50
+	textPDFFontSize = 9
+	textPDFLeading  = 11
+	textPDFColumns  = (textPDFWidth - 2*textPDFMargin) * 10 / (textPDFFontSize * 6)
+	textPDFRows     = (textPDFHeight - 2*textPDFMargin) / textPDFLeading
+)
+
+// winAnsi maps the characters outside Latin-1 that WinAnsiEncoding has
+var winAnsi = map[rune]byte{
+	'€': 0x80, '‚': 0x82, '„': 0x84, '…': 0x85, '‘': 0x91, '’': 0x92, '“': 0x93, '”': 0x94,
+	'•': 0x95, '–': 0x96, '—': 0x97, '™': 0x99,
+}
+
+// RenderTextPDF lays plain text out as a PDF, wrapping long lines and
+// starting new pages as needed, so a receipt that arrives as text (such as
+// an HTML email) can be stored and read like a scanned one. title becomes
+// the document title.
+func RenderTextPDF(title, text string) []byte {
+	lines := wrapTextLines(text, textPDFColumns)
+	var pages [][]string
+	for len(lines) > textPDFRows {
+		pages = append(pages, lines[:textPDFRows])
+		lines = lines[textPDFRows:]
+	}
+	pages = append(pages, lines)
+
+	// Objects: 1 catalog, 2 page tree, 3 font, 4 info, then a page and its
+	// content stream for each page
+	var objects []string
+	kids := make([]string, len(pages))
+	for i := range pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 5+2*i)
+	}
+	objects = append(objects,
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages)),
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Courier /Encoding /WinAnsiEncoding >>",
+		fmt.Sprintf("<< /Title (%s) /Producer (hsa-api) >>", pdfString(title)),
+	)
+	for i, page := range pages {
+		var content bytes.Buffer
+		// Each ' moves down a line before showing it
+		fmt.Fprintf(&content, "BT /F1 %d Tf %d TL %d %d Td\n", textPDFFontSize, textPDFLeading,
+			textPDFMargin, textPDFHeight-textPDFMargin)
+		for _, line := range page {
+			fmt.Fprintf(&content, "(%s) '\n", pdfString(line))
+		}
+		content.WriteString("ET")
+
+		objects = append(objects,
+			fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Resources << /Font << /F1 3 0 R >> >> /Contents %d 0 R >>",
+				textPDFWidth, textPDFHeight, 6+2*i),
+			fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", content.Len(), content.String()),
+		)
+	}
+
+	var out bytes.Buffer
+	out.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	offsets := make([]int, len(objects))
+	for i, object := range objects {
+		offsets[i] = out.Len()
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R /Info 4 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return out.Bytes()
+}
+
+// wrapTextLines splits text into lines of at most width characters,
+// breaking long lines at spaces where it can and expanding tabs
+func wrapTextLines(text string, width int) []string {
+	var lines []string
+	for _, line := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n") {
+		line = strings.TrimRight(strings.ReplaceAll(line, "\t", "    "), " ")
+		for utf8.RuneCountInString(line) > width {
+			runes := []rune(line)
+			cut := width
+			if i := strings.LastIndex(string(runes[:width]), " "); i > 0 {
+				cut = utf8.RuneCountInString(string(runes[:width])[:i])
+			}
+			lines = append(lines, string(runes[:cut]))
+			line = strings.TrimLeft(string(runes[cut:]), " ")
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// pdfString encodes s for a PDF literal string in WinAnsiEncoding,
+// escaping delimiters and replacing characters it cannot show with "?"
+func pdfString(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '\\' || r == '(' || r == ')':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r >= 0x20 && r < 0x7f:
+			b.WriteRune(r)
+		case r >= 0xa0 && r <= 0xff:
+			fmt.Fprintf(&b, "\\%03o", r)
+		case winAnsi[r] != 0:
+			fmt.Fprintf(&b, "\\%03o", winAnsi[r])
+		default:
+			b.WriteByte('?')
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,276 @@
+package internal
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// API token scopes. Sessions from /api/auth/login carry every scope.
+const (
+	ScopeRead   = "read"
+	ScopeUpload = "upload"
+	ScopeDeduct = "deduct"
+	ScopeAdmin  = "admin"
+)
+
+// AllScopes lists every scope, from least to most privileged
+var AllScopes = []string{ScopeRead, ScopeUpload, ScopeDeduct, ScopeAdmin}
+
+// apiTokenPrefix marks personal access tokens so they can be told apart from
+// session tokens without a database lookup
+const apiTokenPrefix = "hsa_"
+
+// APIToken is a personal access token for scripts and automations. Only the
+// SHA-256 of the secret is stored; Prefix identifies the token in listings.
+type APIToken struct {
+	ID         int        `json:"id"`
+	UserID     int        `json:"user_id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+}
+
+func validScope(scope string) bool {
+	for _, s := range AllScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// hasScope reports whether scopes grants required. admin grants everything.
+func hasScope(scopes []string, required string) bool {
+	for _, s := range scopes {
+		if s == required || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+const apiTokenColumns = `id, user_id, name, prefix, scopes, created_at, last_used_at, expires_at, revoked_at`
+
+func scanAPIToken(row rowScanner) (*APIToken, error) {
+	var t APIToken
+	var scopes string
+	err := row.Scan(&t.ID, &t.UserID, &t.Name, &t.Prefix, &scopes, &t.CreatedAt,
+		&t.LastUsedAt, &t.ExpiresAt, &t.RevokedAt)
+	if err != nil {
+		return nil, err
+	}
+	t.Scopes = strings.Split(scopes, ",")
+	return &t, nil
+}
+
+func (db *Database) CreateAPIToken(t *APIToken, tokenHash string) error {
+	query := `
+        INSERT INTO api_tokens (user_id, name, prefix, token_hash, scopes, expires_at, created_at)
+        VALUES ($1, $2, $3, $4, $5, $6, NOW())
+        RETURNING id, created_at
+    `
+
+	return db.conn.QueryRow(query, t.UserID, t.Name, t.Prefix, tokenHash,
+		strings.Join(t.Scopes, ","), t.ExpiresAt).Scan(&t.ID, &t.CreatedAt)
+}
+
+func (db *Database) ListAPITokens(userID int) ([]APIToken, error) {
+	query := `
+        SELECT ` + apiTokenColumns + `
+        FROM api_tokens
+        WHERE user_id = $1
+        ORDER BY created_at DESC
+    `
+
+	rows, err := db.conn.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []APIToken
+	for rows.Next() {
+		t, err := scanAPIToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, *t)
+	}
+
+	return tokens, rows.Err()
+}
+
+// GetActiveAPIToken returns the unrevoked, unexpired token with tokenHash, or nil
+func (db *Database) GetActiveAPIToken(tokenHash string) (*APIToken, error) {
+	query := `
+        SELECT ` + apiTokenColumns + `
+        FROM api_tokens
+        WHERE token_hash = $1 AND revoked_at IS NULL
+          AND (expires_at IS NULL OR expires_at > NOW())
+    `
+
+	t, err := scanAPIToken(db.conn.QueryRow(query, tokenHash))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// TouchAPIToken records a use of the token, at most once a minute
+func (db *Database) TouchAPIToken(id int) error {
+	query := `
+        UPDATE api_tokens SET last_used_at = NOW()
+        WHERE id = $1 AND (last_used_at IS NULL OR last_used_at < NOW() - INTERVAL '1 minute')
+    `
+
+	_, err := db.conn.Exec(query, id)
+	return err
+}
+
+func (db *Database) RevokeAPIToken(userID int, id int) error {
+	query := `
+        UPDATE api_tokens SET revoked_at = NOW()
+        WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL
+    `
+
+	result, err := db.conn.Exec(query, id, userID)
+	if err != nil {
+		return err
+	}
+
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// TokensHandler lists (GET) or creates (POST) the caller's API tokens
+func (s *Server) TokensHandler(w http.ResponseWriter, r *http.Request) {
+	user := CurrentUser(r)
+
+	switch r.Method {
+	case http.MethodGet:
+		tokens, err := s.DB.ListAPITokens(user.ID)
+		if err != nil {
+			log.Printf("Failed to list API tokens: %v", err)
+			http.Error(w, "Failed to list tokens", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(tokens)
+		return
+	case http.MethodPost:
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Name          string   `json:"name"`
+		Scopes        []string `json:"scopes"`
+		ExpiresInDays int      `json:"expires_in_days"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > 100 {
+		http.Error(w, "Name must be 1-100 characters", http.StatusBadRequest)
+		return
+	}
+	if len(req.Scopes) == 0 {
+		http.Error(w, "At least one scope is required", http.StatusBadRequest)
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !validScope(scope) {
+			http.Error(w, fmt.Sprintf("Unknown scope %q, expected one of %s", scope, strings.Join(AllScopes, ", ")),
+				http.StatusBadRequest)
+			return
+		}
+	}
+	// A token can't grant more than the credential used to create it
+	for _, scope := range req.Scopes {
+		if !HasScope(r, scope) {
+			http.Error(w, fmt.Sprintf("Cannot grant scope %q", scope), http.StatusForbidden)
+			return
+		}
+	}
+
+	secret, _, err := NewToken()
+	if err != nil {
+		log.Printf("Failed to generate API token: %v", err)
+		http.Error(w, "Failed to create token", http.StatusInternalServerError)
+		return
+	}
+	secret = apiTokenPrefix + secret
+
+	token := &APIToken{
+		UserID: user.ID,
+		Name:   req.Name,
+		Prefix: secret[:len(apiTokenPrefix)+8],
+		Scopes: req.Scopes,
+	}
+	if req.ExpiresInDays > 0 {
+		expiresAt := time.Now().AddDate(0, 0, req.ExpiresInDays)
+		token.ExpiresAt = &expiresAt
+	}
+
+	if err := s.DB.CreateAPIToken(token, HashToken(secret)); err != nil {
+		log.Printf("Failed to create API token: %v", err)
+		http.Error(w, "Failed to create token", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("User %s created API token %d (%s) with scopes %v", user.Username, token.ID, token.Name, token.Scopes)
+
+	// The secret is only ever shown in this response
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"token":     secret,
+		"api_token": token,
+	})
+}
+
+// TokenByIDHandler revokes (DELETE) one of the caller's API tokens
+func (s *Server) TokenByIDHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/api/tokens/"))
+	if err != nil {
+		http.Error(w, "Invalid token ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.DB.RevokeAPIToken(CurrentUser(r).ID, id); err == sql.ErrNoRows {
+		http.Error(w, "Token not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Failed to revoke API token: %v", err)
+		http.Error(w, "Failed to revoke token", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Token revoked successfully"})
+}
@@ -0,0 +1,285 @@
+package internal
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// Upload statuses reported for each file
+const (
+	UploadCreated           = "created"
+	UploadDuplicate         = "duplicate"          // same file as an existing receipt
+	UploadPossibleDuplicate = "possible_duplicate" // looks like an existing receipt's image
+	UploadFailed            = "failed"
+)
+
+// Archive limits: entries past maxArchiveEntries are not read, and an entry
+// larger than maxArchiveEntrySize once decompressed fails on its own
+const (
+	maxArchiveEntries   = 1000
+	maxArchiveEntrySize = 32 << 20
+)
+
+// ErrUploadTooLarge is returned by ReadUploadFile for a file over
+// MaxUploadFileSize
+var ErrUploadTooLarge = errors.New("file is too large")
+
+// ParseUploadForm parses a multipart upload, its body capped at
+// MaxUploadSize. On failure it has answered the request, with 413 Request
+// Entity Too Large for a body over the limit, and returns false.
+func (s *Server) ParseUploadForm(w http.ResponseWriter, r *http.Request) bool {
+	if s.MaxUploadSize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, s.MaxUploadSize)
+	}
+	err := r.ParseMultipartForm(32 << 20)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, fmt.Sprintf("Upload is larger than %d MB", s.MaxUploadSize>>20), http.StatusRequestEntityTooLarge)
+		return false
+	} else if err != nil {
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// ReadUploadFile reads a file of a parsed upload, or returns
+// ErrUploadTooLarge without reading it if it is over MaxUploadFileSize
+func (s *Server) ReadUploadFile(header *multipart.FileHeader) ([]byte, error) {
+	if s.MaxUploadFileSize > 0 && header.Size > s.MaxUploadFileSize {
+		return nil, ErrUploadTooLarge
+	}
+	file, err := header.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
+
+// ReceiptUpload is a file to add to a household as a receipt. MemberID 0
+// leaves the receipt unattributed.
+type ReceiptUpload struct {
+	Username    string
+	HouseholdID int
+	MemberID    int
+	Filename    string
+	Data        []byte
+	// AllowDuplicate keeps a file that looks like an existing receipt's image
+	AllowDuplicate bool
+}
+
+// UploadResult reports what became of one uploaded file. Receipt is the
+// existing receipt a duplicate matched; Matches are the receipts a possible
+// duplicate looks like.
+type UploadResult struct {
+	Filename  string           `json:"filename"`
+	Archive   string           `json:"archive,omitempty"` // the ZIP file the entry came from
+	Status    string           `json:"status"`
+	Message   string           `json:"message"`
+	ReceiptID int              `json:"id,omitempty"`
+	MemberID  *int             `json:"member_id,omitempty"`
+	JobID     int              `json:"job_id,omitempty"`
+	OCRStatus string           `json:"ocr_status,omitempty"`
+	Receipt   *Receipt         `json:"receipt,omitempty"`
+	Matches   []SimilarReceipt `json:"matches,omitempty"`
+}
+
+// IsZipArchive reports whether an upload is a ZIP archive: by its
+// extension, or by its signature when it has none. Office documents are ZIP
+// files too, so a signature alone is not enough.
+func IsZipArchive(filename string, data []byte) bool {
+	ext := path.Ext(filename)
+	return strings.EqualFold(ext, ".zip") || (ext == "" && bytes.HasPrefix(data, []byte("PK\x03\x04")))
+}
+
+// IngestUpload adds a file as a receipt, or each file in it when it is a
+// ZIP archive, and reports on every file
+func (s *Server) IngestUpload(u ReceiptUpload) []UploadResult {
+	if IsZipArchive(u.Filename, u.Data) {
+		return s.IngestArchive(u)
+	}
+	return []UploadResult{s.IngestReceipt(u)}
+}
+
+// IngestArchive adds each file in a ZIP archive as a receipt. Folders,
+// hidden files and macOS resource forks are skipped; nested archives are
+// reported as failed. Each file is saved on its own, so one that fails does
+// not undo the others.
+func (s *Server) IngestArchive(u ReceiptUpload) []UploadResult {
+	archive, err := zip.NewReader(bytes.NewReader(u.Data), int64(len(u.Data)))
+	if err != nil {
+		return []UploadResult{{Filename: u.Filename, Status: UploadFailed, Message: "Not a readable ZIP archive"}}
+	}
+
+	var results []UploadResult
+	read := 0
+	for _, entry := range archive.File {
+		name := entry.Name
+		base := path.Base(name)
+		if entry.FileInfo().IsDir() || strings.HasPrefix(name, "__MACOSX/") || strings.HasPrefix(base, ".") ||
+			strings.EqualFold(base, "Thumbs.db") {
+			continue
+		}
+
+		result := UploadResult{Filename: name, Archive: u.Filename, Status: UploadFailed}
+		if read++; read > maxArchiveEntries {
+			result.Message = fmt.Sprintf("Archive has more than %d files; upload the rest separately", maxArchiveEntries)
+			results = append(results, result)
+			continue
+		}
+		if strings.EqualFold(path.Ext(base), ".zip") {
+			result.Message = "Archives inside archives are not supported"
+			results = append(results, result)
+			continue
+		}
+
+		data, err := readArchiveEntry(entry)
+		if err != nil {
+			result.Message = "Cannot read file from archive: " + err.Error()
+			results = append(results, result)
+			continue
+		}
+
+		entryUpload := u
+		entryUpload.Filename, entryUpload.Data = base, data
+		result = s.IngestReceipt(entryUpload)
+		result.Filename, result.Archive = name, u.Filename
+		results = append(results, result)
+	}
+
+	if len(results) == 0 {
+		return []UploadResult{{Filename: u.Filename, Status: UploadFailed, Message: "Archive has no files"}}
+	}
+	return results
+}
+
+func readArchiveEntry(entry *zip.File) ([]byte, error) {
+	if entry.UncompressedSize64 > maxArchiveEntrySize {
+		return nil, fmt.Errorf("file is larger than %d MB", maxArchiveEntrySize>>20)
+	}
+	rc, err := entry.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	// The header's size can lie, so stop reading past the limit too
+	data, err := io.ReadAll(io.LimitReader(rc, maxArchiveEntrySize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxArchiveEntrySize {
+		return nil, fmt.Errorf("file is larger than %d MB", maxArchiveEntrySize>>20)
+	}
+	return data, nil
+}
+
+// IngestReceipt adds one file as a pending receipt and queues its OCR job.
+// A file already uploaded to the household is reported as a duplicate, and
+// an image that looks like an existing receipt's as a possible duplicate
+// unless AllowDuplicate is set; neither is saved.
+func (s *Server) IngestReceipt(u ReceiptUpload) UploadResult {
+	result := UploadResult{Filename: u.Filename, Status: UploadFailed}
+	if len(u.Data) == 0 {
+		result.Message = "File is empty"
+		return result
+	}
+
+	hash := sha256.Sum256(u.Data)
+	imageHash := hex.EncodeToString(hash[:])
+
+	if existingReceipt, err := s.DB.GetReceiptByImageHash(u.HouseholdID, imageHash); err == nil && existingReceipt != nil {
+		log.Printf("Duplicate receipt detected (by hash): %s", imageHash)
+		result.Status = UploadDuplicate
+		result.Message = "This receipt has already been uploaded"
+		result.Receipt = existingReceipt
+		return result
+	}
+
+	// A second photo of the same paper receipt differs byte for byte, so
+	// compare what the image looks like too
+	var perceptualHash *int64
+	if hashes, err := PerceptualHashes(u.Data); err == nil {
+		hash := int64(hashes[0])
+		perceptualHash = &hash
+
+		if s.DuplicateImageDistance >= 0 && !u.AllowDuplicate {
+			similar, err := s.DB.FindSimilarReceipts(u.HouseholdID, hashes, s.DuplicateImageDistance)
+			if err != nil {
+				log.Printf("Warning: Failed to check for similar receipts: %v", err)
+			} else if len(similar) > 0 {
+				log.Printf("Possible duplicate receipt detected (by image): receipt %d, distance %d",
+					similar[0].Receipt.ID, similar[0].Distance)
+				result.Status = UploadPossibleDuplicate
+				result.Message = "This looks like a receipt that has already been uploaded; upload it again with allow_duplicate=true to keep it"
+				result.Matches = similar
+				return result
+			}
+		}
+	}
+
+	// Files are stored by content hash; used status lives only in the DB
+	fileKey, unlock, err := s.StoreReceiptFile(imageHash, u.Filename, u.Data)
+	if err != nil {
+		log.Printf("Failed to save file: %v", err)
+		result.Message = "Failed to save file"
+		return result
+	}
+	defer unlock()
+
+	log.Printf("File saved to: %s", fileKey)
+
+	pageCount, err := DocumentPageCount(u.Filename, u.Data)
+	if err != nil {
+		log.Printf("Warning: Cannot count the pages of %s: %v", u.Filename, err)
+	}
+
+	// OCR runs in the background; the receipt is pending until it finishes
+	receipt := &Receipt{
+		UserID:         u.Username,
+		HouseholdID:    u.HouseholdID,
+		Currency:       DefaultCurrency,
+		Date:           time.Now(),
+		HSAStatus:      HSAStatusNo,
+		ImagePath:      fileKey,
+		OriginalName:   u.Filename,
+		PageCount:      pageCount,
+		ImageHash:      imageHash,
+		PerceptualHash: perceptualHash,
+		Used:           false,
+	}
+	if u.MemberID != 0 {
+		memberID := u.MemberID
+		receipt.MemberID = &memberID
+	}
+
+	job, err := s.DB.CreatePendingReceipt(receipt, s.OCRMaxAttempts)
+	if err != nil {
+		log.Printf("Failed to save receipt to database: %v", err)
+		result.Message = "Failed to save receipt"
+		return result
+	}
+	s.Jobs.Notify()
+
+	log.Printf("Receipt saved to database with ID: %d, OCR job %d queued", receipt.ID, job.ID)
+
+	result.Status = UploadCreated
+	result.Message = "Receipt uploaded, OCR in progress"
+	result.ReceiptID = receipt.ID
+	result.MemberID = receipt.MemberID
+	result.JobID = job.ID
+	result.OCRStatus = receipt.OCRStatus
+	return result
+}
@@ -0,0 +1,69 @@
+package internal
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// uploadRequest builds a multipart upload of the given files
+func uploadRequest(t *testing.T, files map[string]string) *http.Request {
+	t.Helper()
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for name, content := range files {
+		part, err := mw.CreateFormFile("file", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write([]byte(content))
+	}
+	mw.Close()
+
+	r := httptest.NewRequest(http.MethodPost, "/api/receipts/upload", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	return r
+}
+
+func TestParseUploadFormLimitsBody(t *testing.T) {
+	s := &Server{MaxUploadSize: 1 << 10}
+
+	w := httptest.NewRecorder()
+	if !s.ParseUploadForm(w, uploadRequest(t, map[string]string{"small.jpg": "jpeg"})) {
+		t.Fatalf("small upload refused: %d %s", w.Code, w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	if s.ParseUploadForm(w, uploadRequest(t, map[string]string{"large.pdf": strings.Repeat("x", 2<<10)})) {
+		t.Fatal("upload over MaxUploadSize accepted")
+	}
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("upload over MaxUploadSize got %d, want 413", w.Code)
+	}
+}
+
+func TestReadUploadFileLimitsFiles(t *testing.T) {
+	s := &Server{MaxUploadFileSize: 100}
+	r := uploadRequest(t, map[string]string{"small.jpg": "jpeg", "large.zip": strings.Repeat("x", 101)})
+	if !s.ParseUploadForm(httptest.NewRecorder(), r) {
+		t.Fatal("upload refused")
+	}
+
+	for _, header := range r.MultipartForm.File["file"] {
+		data, err := s.ReadUploadFile(header)
+		switch header.Filename {
+		case "small.jpg":
+			if err != nil || string(data) != "jpeg" {
+				t.Errorf("small.jpg = %q, %v", data, err)
+			}
+		case "large.zip":
+			if err != ErrUploadTooLarge {
+				t.Errorf("large.zip: %v, want ErrUploadTooLarge", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package internal
+
+import (
+	"database/sql"
+	"time"
+)
+
+// LegacyHouseholdUser owns every receipt uploaded before accounts existed
+const LegacyHouseholdUser = "household"
+
+// EmailUploader is recorded as the uploader of receipts emailed in for
+// members without an account. The sender is not, since anyone can put
+// anything in From.
+const EmailUploader = "email"
+
+// reservedUsername reports whether name is one of the uploader names above,
+// which no account may take
+func reservedUsername(name string) bool {
+	return name == LegacyHouseholdUser || name == EmailUploader
+}
+
+const userColumns = `u.id, u.username, u.password_hash, u.email, u.created_at`
+
+func scanUser(row rowScanner) (*User, error) {
+	var u User
+	if err := row.Scan(&u.ID, &u.Username, &u.PasswordHash, &u.Email, &u.CreatedAt); err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+func (db *Database) CreateUser(user *User) error {
+	query := `
+        INSERT INTO users (username, password_hash, email, created_at)
+        VALUES ($1, $2, $3, NOW())
+        RETURNING id, created_at
+    `
+
+	return db.conn.QueryRow(query, user.Username, user.PasswordHash, user.Email).Scan(&user.ID, &user.CreatedAt)
+}
+
+func (db *Database) GetUserByUsername(username string) (*User, error) {
+	query := `
+        SELECT ` + userColumns + `
+        FROM users u
+        WHERE u.username = $1
+    `
+
+	u, err := scanUser(db.conn.QueryRow(query, username))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return u, err
+}
+
+func (db *Database) GetUserByID(id int) (*User, error) {
+	query := `
+        SELECT ` + userColumns + `
+        FROM users u
+        WHERE u.id = $1
+    `
+
+	u, err := scanUser(db.conn.QueryRow(query, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return u, err
+}
+
+func (db *Database) GetUserByEmail(email string) (*User, error) {
+	query := `
+        SELECT ` + userColumns + `
+        FROM users u
+        WHERE LOWER(u.email) = LOWER($1)
+    `
+
+	u, err := scanUser(db.conn.QueryRow(query, email))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return u, err
+}
+
+func (db *Database) CountUsers() (int, error) {
+	var count int
+	err := db.conn.QueryRow("SELECT COUNT(*) FROM users").Scan(&count)
+	return count, err
+}
+
+// AdoptLegacyReceipts moves receipts owned by LegacyHouseholdUser into
+// member's household, attributed to member and uploaded by username
+func (db *Database) AdoptLegacyReceipts(username string, member *HouseholdMember) (int64, error) {
+	query := `
+        UPDATE receipts
+        SET user_id = $1, household_id = $2, member_id = $3
+        WHERE user_id = $4 AND household_id IS NULL
+    `
+
+	result, err := db.conn.Exec(query, username, member.HouseholdID, member.ID, LegacyHouseholdUser)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (db *Database) CreateSession(userID int, tokenHash string, expiresAt time.Time) error {
+	query := `
+        INSERT INTO sessions (token_hash, user_id, expires_at, created_at)
+        VALUES ($1, $2, $3, NOW())
+    `
+
+	_, err := db.conn.Exec(query, tokenHash, userID, expiresAt)
+	return err
+}
+
+// GetUserBySession returns the user owning an unexpired session, or nil
+func (db *Database) GetUserBySession(tokenHash string) (*User, error) {
+	query := `
+        SELECT ` + userColumns + `
+        FROM sessions s
+        JOIN users u ON u.id = s.user_id
+        WHERE s.token_hash = $1 AND s.expires_at > NOW()
+    `
+
+	u, err := scanUser(db.conn.QueryRow(query, tokenHash))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return u, err
+}
+
+func (db *Database) DeleteSession(tokenHash string) error {
+	_, err := db.conn.Exec("DELETE FROM sessions WHERE token_hash = $1", tokenHash)
+	return err
+}
+
+func (db *Database) DeleteExpiredSessions() error {
+	_, err := db.conn.Exec("DELETE FROM sessions WHERE expires_at <= NOW()")
+	return err
+}
@@ -0,0 +1,267 @@
+package internal
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// VendorAlias maps a normalized vendor key to the vendor's canonical name
+type VendorAlias struct {
+	ID        int       `json:"id"`
+	Alias     string    `json:"alias"`
+	Canonical string    `json:"canonical"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+var (
+	// vendorStoreNumber matches store numbers: "#1234", "store 56", "no. 7"
+	vendorStoreNumber = regexp.MustCompile(`(?i)#\s*\d+|\b(?:store|str|no|unit)\.?\s*#?\s*\d+\b`)
+
+	// vendorNoiseWords are left out of vendor keys
+	vendorNoiseWords = map[string]bool{
+		"the": true, "inc": true, "llc": true, "ltd": true, "co": true, "corp": true,
+		"corporation": true, "company": true,
+	}
+)
+
+// NormalizeVendor reduces a vendor name to the key used to compare vendors:
+// lower case, store numbers, punctuation and words like "Inc." removed, so
+// "WALGREENS #1234" and "Walgreens" both become "walgreens"
+func NormalizeVendor(name string) string {
+	name = vendorStoreNumber.ReplaceAllString(name, " ")
+	name = strings.NewReplacer("&", " and ", "'", "", "’", "").Replace(strings.ToLower(name))
+
+	var words []string
+	for _, word := range strings.FieldsFunc(name, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) }) {
+		if vendorNoiseWords[word] {
+			continue
+		}
+		// Long runs of digits are store or terminal numbers
+		if len(word) >= 3 && strings.IndexFunc(word, func(r rune) bool { return !unicode.IsDigit(r) }) < 0 {
+			continue
+		}
+		words = append(words, word)
+	}
+	return strings.Join(words, " ")
+}
+
+// VendorAliases looks up canonical vendor names by normalized key
+type VendorAliases map[string]string
+
+// Canonical returns the canonical name of a vendor, or "" when no alias
+// matches. An alias matches the whole key or its leading words, so
+// "walgreens" matches "WALGREENS #1234 SEATTLE WA"; the longest alias wins.
+func (va VendorAliases) Canonical(vendor string) string {
+	key := NormalizeVendor(vendor)
+	if canonical, ok := va[key]; ok {
+		return canonical
+	}
+
+	best, bestLen := "", 0
+	for alias, canonical := range va {
+		if len(alias) > bestLen && strings.HasPrefix(key, alias+" ") {
+			best, bestLen = canonical, len(alias)
+		}
+	}
+	return best
+}
+
+// Key returns the key a vendor is compared by: its canonical name's when an
+// alias matches, its own otherwise
+func (va VendorAliases) Key(vendor string) string {
+	if canonical := va.Canonical(vendor); canonical != "" {
+		return NormalizeVendor(canonical)
+	}
+	return NormalizeVendor(vendor)
+}
+
+// Similarity scores how alike two vendors are, from 0 to 1. Vendors with
+// the same key score 1, keys that differ only in spacing ("rite aid",
+// "riteaid") 0.95, and a key that is the leading words of the other
+// ("acme dental" and "acme dental seattle") 0.85. Anything else is scored
+// by edit distance, so an OCR misread costs only a little.
+func (va VendorAliases) Similarity(a, b string) float64 {
+	ka, kb := va.Key(a), va.Key(b)
+	switch {
+	case ka == "" || kb == "":
+		return 0
+	case ka == kb:
+		return 1
+	case strings.ReplaceAll(ka, " ", "") == strings.ReplaceAll(kb, " ", ""):
+		return 0.95
+	case strings.HasPrefix(ka, kb+" "), strings.HasPrefix(kb, ka+" "):
+		return 0.85
+	}
+
+	ra, rb := []rune(ka), []rune(kb)
+	longest := len(ra)
+	if len(rb) > longest {
+		longest = len(rb)
+	}
+	return 1 - float64(levenshtein(ra, rb))/float64(longest)
+}
+
+// levenshtein counts the single-character edits turning a into b
+func levenshtein(a, b []rune) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(b)]
+}
+
+// GetVendorAliases loads every alias
+func (db *Database) GetVendorAliases() (VendorAliases, error) {
+	aliases, err := db.ListVendorAliases()
+	if err != nil {
+		return nil, err
+	}
+	va := VendorAliases{}
+	for _, a := range aliases {
+		va[a.Alias] = a.Canonical
+	}
+	return va, nil
+}
+
+func (db *Database) ListVendorAliases() ([]VendorAlias, error) {
+	rows, err := db.conn.Query(`
+        SELECT id, alias, canonical, created_at
+        FROM vendor_aliases
+        ORDER BY canonical, alias
+    `)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	aliases := []VendorAlias{}
+	for rows.Next() {
+		var a VendorAlias
+		if err := rows.Scan(&a.ID, &a.Alias, &a.Canonical, &a.CreatedAt); err != nil {
+			return nil, err
+		}
+		aliases = append(aliases, a)
+	}
+	return aliases, rows.Err()
+}
+
+// SaveVendorAlias adds an alias, or points an existing one at a new
+// canonical name. The alias is normalized first.
+func (db *Database) SaveVendorAlias(alias *VendorAlias) error {
+	alias.Alias = NormalizeVendor(alias.Alias)
+	return db.conn.QueryRow(`
+        INSERT INTO vendor_aliases (alias, canonical)
+        VALUES ($1, $2)
+        ON CONFLICT (alias) DO UPDATE SET canonical = EXCLUDED.canonical
+        RETURNING id, created_at
+    `, alias.Alias, alias.Canonical).Scan(&alias.ID, &alias.CreatedAt)
+}
+
+func (db *Database) DeleteVendorAlias(id int) error {
+	result, err := db.conn.Exec("DELETE FROM vendor_aliases WHERE id = $1", id)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// VendorAliasesHandler lists the vendor aliases (GET /api/vendors/aliases)
+// and, for server administrators, adds or changes one (POST)
+func (s *Server) VendorAliasesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		aliases, err := s.DB.ListVendorAliases()
+		if err != nil {
+			log.Printf("Failed to list vendor aliases: %v", err)
+			http.Error(w, "Failed to list vendor aliases", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(aliases)
+	case http.MethodPost:
+		user := CurrentUser(r)
+		if !s.IsAdmin(user) {
+			http.Error(w, "Only server administrators can change vendor aliases", http.StatusForbidden)
+			return
+		}
+
+		var alias VendorAlias
+		if err := json.NewDecoder(r.Body).Decode(&alias); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		alias.Canonical = strings.TrimSpace(alias.Canonical)
+		if NormalizeVendor(alias.Alias) == "" || alias.Canonical == "" {
+			http.Error(w, "alias and canonical are required", http.StatusBadRequest)
+			return
+		}
+
+		if err := s.DB.SaveVendorAlias(&alias); err != nil {
+			log.Printf("Failed to save vendor alias: %v", err)
+			http.Error(w, "Failed to save vendor alias", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("User %s mapped vendor alias %q to %q", user.Username, alias.Alias, alias.Canonical)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(alias)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// VendorAliasByIDHandler removes an alias: DELETE /api/vendors/aliases/{id}
+func (s *Server) VendorAliasByIDHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.IsAdmin(CurrentUser(r)) {
+		http.Error(w, "Only server administrators can change vendor aliases", http.StatusForbidden)
+		return
+	}
+
+	id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/api/vendors/aliases/"))
+	if err != nil {
+		http.Error(w, "Invalid alias ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.DB.DeleteVendorAlias(id); err == sql.ErrNoRows {
+		http.Error(w, "Alias not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Failed to delete vendor alias: %v", err)
+		http.Error(w, "Failed to delete vendor alias", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Alias deleted successfully"})
+}
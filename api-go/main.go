@@ -1,13 +1,11 @@
 package main
 
 import (
-	"bytes"
-	"crypto/sha256"
-	"encoding/hex"
 	"encoding/json"
+	"flag"
 	"fmt"
-	"io"
 	"log"
+	"mime"
 	"mime/multipart"
 	"net/http"
 	"os"
@@ -20,14 +18,8 @@ import (
 	"hsa-app/internal"
 )
 
-type OCRResponse struct {
-	Vendor       string  `json:"vendor"`
-	Amount       float64 `json:"amount"`
-	Date         string  `json:"date"`
-	HSAQualified bool    `json:"hsa_qualified"`
-	HSAStatus    string  `json:"hsa_status"` // "Yes", "No", or "Partially"
-	RawText      string  `json:"raw_text"`
-}
+// migrationsDir holds the numbered NNN_name.sql (and .down.sql) files
+const migrationsDir = "./migrations"
 
 func main() {
 	cfg := config.Load()
@@ -35,10 +27,27 @@ func main() {
 	log.Println("Starting HSA Receipt Management System")
 	log.Printf("Configuration loaded:")
 	log.Printf("  - Database: %s", maskConnectionString(cfg.DatabaseURL))
-	log.Printf("  - OCR Service: %s", cfg.OCRServiceURL)
+	switch cfg.OCRProvider {
+	case "fixture":
+		log.Printf("  - OCR: fixtures in %s", cfg.OCRFixtureDir)
+	case "text":
+		log.Printf("  - OCR: built-in text parser")
+	default:
+		log.Printf("  - OCR Service: %s", cfg.OCRServiceURL)
+	}
 	log.Printf("  - HSA Directory: %s", cfg.HSADir)
+	if cfg.StorageBackend == "s3" {
+		log.Printf("  - Storage: s3 (bucket %s at %s)", cfg.S3Bucket, cfg.S3Endpoint)
+	} else {
+		log.Printf("  - Storage: %s", cfg.StorageBackend)
+	}
 	log.Printf("  - Port: %s", cfg.Port)
 	log.Printf("  - Claude Model: %s", cfg.ClaudeModel)
+	log.Printf("  - Registration: %v", cfg.AllowRegistration)
+	log.Printf("  - CORS Origins: %s", cfg.CORSAllowedOrigins)
+	if cfg.OIDCIssuerURL != "" {
+		log.Printf("  - OIDC Issuer: %s (client %s)", cfg.OIDCIssuerURL, cfg.OIDCClientID)
+	}
 
 	db, err := internal.NewDatabase(cfg.DatabaseURL)
 	if err != nil {
@@ -46,37 +55,188 @@ func main() {
 	}
 	log.Println("Connected to database successfully")
 
-	// Run migrations on startup
-	if err := db.RunMigrations("./migrations"); err != nil {
-		log.Printf("Warning: Failed to run migrations: %v", err)
+	// `hsa-api migrate ...` manages the schema and exits
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		runMigrateCommand(db, migrationsDir, os.Args[2:])
+		return
 	}
 
-	// Create base HSA directory and subdirectories
-	if err := os.MkdirAll(cfg.HSADir, 0755); err != nil {
-		log.Printf("Warning: Could not create HSA directory: %v", err)
+	// Run migrations on startup; replicas wait on each other's lock
+	if err := db.RunMigrations(migrationsDir); err != nil {
+		log.Fatalf("Failed to run migrations: %v", err)
 	}
-	
-	// Create unused and used directories
-	unusedDir := filepath.Join(cfg.HSADir, "unused")
-	usedDir := filepath.Join(cfg.HSADir, "used")
-	if err := os.MkdirAll(unusedDir, 0755); err != nil {
-		log.Printf("Warning: Could not create unused directory: %v", err)
+
+	store, err := internal.NewBlobStore(internal.StorageConfig{
+		Backend:           cfg.StorageBackend,
+		LocalDir:          cfg.HSADir,
+		S3Endpoint:        cfg.S3Endpoint,
+		S3Region:          cfg.S3Region,
+		S3Bucket:          cfg.S3Bucket,
+		S3AccessKeyID:     cfg.S3AccessKeyID,
+		S3SecretAccessKey: cfg.S3SecretAccessKey,
+		S3ForcePathStyle:  cfg.S3ForcePathStyle,
+	})
+	if err != nil {
+		log.Fatalf("Failed to configure receipt storage: %v", err)
+	}
+
+	// Create base HSA directory for local storage
+	if _, ok := store.(*internal.LocalStore); ok {
+		if err := os.MkdirAll(cfg.HSADir, 0755); err != nil {
+			log.Printf("Warning: Could not create HSA directory: %v", err)
+		}
 	}
-	if err := os.MkdirAll(usedDir, 0755); err != nil {
-		log.Printf("Warning: Could not create used directory: %v", err)
+
+	extractor, err := internal.NewExtractor(internal.ExtractorConfig{
+		Provider:      cfg.OCRProvider,
+		ServiceURL:    cfg.OCRServiceURL,
+		FixtureDir:    cfg.OCRFixtureDir,
+		FixtureRecord: cfg.OCRFixtureRecord,
+	})
+	if err != nil {
+		log.Fatalf("Failed to configure OCR: %v", err)
 	}
 
 	server := &internal.Server{
-		DB:            db,
-		OCRServiceURL: cfg.OCRServiceURL,
-		ReceiptDir:    cfg.HSADir,
+		DB:         db,
+		Extractor:  extractor,
+		ReceiptDir: cfg.HSADir,
+		Store:      store,
+
+		PresignDownloads:  cfg.StoragePresignedDownloads,
+		AllowRegistration: cfg.AllowRegistration,
+		AdminUsers:        cfg.AdminUsers,
+		OCRMaxAttempts:    cfg.OCRMaxAttempts,
+
+		DuplicateImageDistance: cfg.DuplicateImageDistance,
+		MaxUploadSize:          int64(cfg.MaxUploadSize) << 20,
+		MaxUploadFileSize:      int64(cfg.MaxUploadFileSize) << 20,
+	}
+	if !cfg.DuplicateImageCheck {
+		server.DuplicateImageDistance = -1
+	}
+
+	if cfg.OIDCIssuerURL != "" {
+		server.OIDC = internal.NewOIDCProvider(internal.OIDCConfig{
+			IssuerURL:       cfg.OIDCIssuerURL,
+			ClientID:        cfg.OIDCClientID,
+			ClientSecret:    cfg.OIDCClientSecret,
+			RedirectURL:     cfg.OIDCRedirectURL,
+			Scopes:          cfg.OIDCScopes,
+			PostLoginURL:    cfg.OIDCPostLoginURL,
+			AutoCreateUsers: cfg.OIDCAutoCreateUsers,
+		})
+	}
+
+	// `hsa-api export-tree ...` writes the browsable used/unused tree and exits
+	if len(os.Args) > 1 && os.Args[1] == "export-tree" {
+		runExportCommand(server, os.Args[2:])
+		return
+	}
+
+	// `hsa-api fsck ...` reconciles the receipts table with the store and exits
+	if len(os.Args) > 1 && os.Args[1] == "fsck" {
+		runFsckCommand(server, os.Args[2:])
+		return
+	}
+
+	// Move files from the old used/<year> layout to content-addressed keys
+	if n, err := server.MigrateReceiptFiles(); err != nil {
+		log.Printf("Warning: Failed to re-key receipt files: %v", err)
+	} else if n > 0 {
+		log.Printf("Re-keyed %d receipt files by content hash", n)
+	}
+
+	// Hash images uploaded before perceptual hashes were kept
+	go func() {
+		if n, err := server.BackfillPerceptualHashes(); err != nil {
+			log.Printf("Warning: Failed to compute perceptual hashes: %v", err)
+		} else if n > 0 {
+			log.Printf("Computed perceptual hashes of %d receipt images", n)
+		}
+	}()
+
+	// Count the pages of PDFs uploaded before page counts were kept
+	go func() {
+		if n, err := server.BackfillPageCounts(); err != nil {
+			log.Printf("Warning: Failed to count receipt pages: %v", err)
+		} else if n > 0 {
+			log.Printf("Counted the pages of %d receipt files", n)
+		}
+	}()
+
+	// Background workers for OCR; every replica runs its own pool
+	server.Jobs = internal.NewJobRunner(server, cfg.OCRWorkers)
+	server.Jobs.Start()
+	log.Printf("Started %d OCR workers", cfg.OCRWorkers)
+
+	// Import files dropped into the inbox folder, e.g. by a network scanner
+	if cfg.InboxUser != "" {
+		inboxDir := filepath.Join(cfg.HSADir, "inbox")
+		inbox := internal.NewInboxWatcher(server, internal.InboxConfig{
+			Dir:          inboxDir,
+			Username:     cfg.InboxUser,
+			HouseholdID:  cfg.InboxHouseholdID,
+			PollInterval: time.Duration(cfg.InboxPollInterval) * time.Second,
+		})
+		if err := inbox.Start(); err != nil {
+			log.Printf("Warning: Could not start the inbox watcher: %v", err)
+		} else {
+			log.Printf("Watching inbox %s for %s's receipts", inboxDir, cfg.InboxUser)
+		}
+	}
+
+	// Receive emailed receipts at the members' receipt addresses
+	if cfg.SMTPAddr != "" {
+		if cfg.SMTPDomain == "" {
+			log.Printf("Warning: SMTP_ADDR is set but SMTP_DOMAIN is not; not receiving emailed receipts")
+		} else {
+			server.ReceiptEmailDomain = cfg.SMTPDomain
+			smtpServer := internal.NewSMTPServer(server, internal.SMTPConfig{
+				Addr:           cfg.SMTPAddr,
+				Domain:         cfg.SMTPDomain,
+				MaxMessageSize: int64(cfg.SMTPMaxMessageSize) << 20,
+			})
+			go func() {
+				if err := smtpServer.ListenAndServe(); err != nil {
+					log.Printf("Warning: SMTP receiver stopped: %v", err)
+				}
+			}()
+			log.Printf("Receiving emailed receipts for @%s on %s", cfg.SMTPDomain, cfg.SMTPAddr)
+		}
 	}
 
 	http.HandleFunc("/api/health", HealthHandler)
+	http.HandleFunc("/api/auth/register", server.RegisterHandler)
+	http.HandleFunc("/api/auth/login", server.LoginHandler)
+	http.HandleFunc("/api/auth/logout", server.LogoutHandler)
+	http.HandleFunc("/api/auth/me", server.MeHandler)
+	http.HandleFunc("/api/auth/oidc", server.OIDCInfoHandler)
+	http.HandleFunc("/api/auth/oidc/login", server.OIDCLoginHandler)
+	http.HandleFunc("/api/auth/oidc/callback", server.OIDCCallbackHandler)
+	http.HandleFunc("/api/tokens", server.TokensHandler)
+	http.HandleFunc("/api/tokens/", server.TokenByIDHandler)
+	http.HandleFunc("/api/households", server.HouseholdsHandler)
+	http.HandleFunc("/api/households/default", server.DefaultHouseholdHandler)
+	http.HandleFunc("/api/invitations", server.InvitationsHandler)
+	http.HandleFunc("/api/invitations/", server.InvitationByIDHandler)
+	http.HandleFunc("/api/household", server.HouseholdHandler)
+	http.HandleFunc("/api/household/members", server.MembersHandler)
+	http.HandleFunc("/api/household/members/", server.MemberByIDHandler)
+	http.HandleFunc("/api/household/report", server.HouseholdReportHandler)
 	http.HandleFunc("/api/receipts/upload", func(w http.ResponseWriter, r *http.Request) {
 		UploadHandler(w, r, server)
 	})
 	http.HandleFunc("/api/receipts/deduct", server.DeductHandler)
+	http.HandleFunc("/api/receipts/merge", server.MergeReceiptsHandler)
+	http.HandleFunc("/api/reimbursements", server.ReimbursementsHandler)
+	http.HandleFunc("/api/reimbursements/", server.ReimbursementByIDHandler)
+	http.HandleFunc("/api/admin/fsck", server.FsckHandler)
+	http.HandleFunc("/api/jobs/", server.JobByIDHandler)
+	http.HandleFunc("/api/eligibility/rules", server.EligibilityRulesHandler)
+	http.HandleFunc("/api/eligibility/rules/versions", server.EligibilityRuleVersionsHandler)
+	http.HandleFunc("/api/vendors/aliases", server.VendorAliasesHandler)
+	http.HandleFunc("/api/vendors/aliases/", server.VendorAliasByIDHandler)
 	http.HandleFunc("/api/receipts", func(w http.ResponseWriter, r *http.Request) {
 		ReceiptsHandler(w, r, server)
 	})
@@ -88,73 +248,117 @@ func main() {
 	})
 
 	log.Printf("Server starting on :%s", cfg.Port)
-	log.Fatal(http.ListenAndServe(":"+cfg.Port, enableCORS(http.DefaultServeMux)))
+	handler := enableCORS(server.Authenticate(http.DefaultServeMux), cfg.CORSAllowedOrigins)
+	log.Fatal(http.ListenAndServe(":"+cfg.Port, handler))
 }
 
-// getReceiptFilePath constructs the file path based on receipt status and year
-func getReceiptFilePath(baseDir string, year int, filename string, used bool) string {
-	var subdir string
-	if used {
-		subdir = filepath.Join("used", fmt.Sprintf("%d", year))
-	} else {
-		subdir = filepath.Join("unused", fmt.Sprintf("%d", year))
+// runExportCommand handles `hsa-api export-tree [-household N] [-copy] DIR`
+func runExportCommand(server *internal.Server, args []string) {
+	flags := flag.NewFlagSet("export-tree", flag.ExitOnError)
+	householdID := flags.Int("household", 0, "export only this household (default: all, one folder each)")
+	copyFiles := flags.Bool("copy", false, "copy files instead of hard linking them")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: hsa-api export-tree [-household N] [-copy] DIR")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
 	}
 
-	fullDir := filepath.Join(baseDir, subdir)
-	return filepath.Join(fullDir, filename)
+	n, err := server.ExportReceiptTree(flags.Arg(0), *householdID, !*copyFiles)
+	if err != nil {
+		log.Fatalf("Failed to export receipts: %v", err)
+	}
+	log.Printf("Exported %d receipt files to %s", n, flags.Arg(0))
 }
 
-// ensureDirectoryExists creates directory structure if it doesn't exist
-func ensureDirectoryExists(path string) error {
-	dir := filepath.Dir(path)
-	return os.MkdirAll(dir, 0755)
-}
+// runFsckCommand handles `hsa-api fsck [-repair] [-skip-hashes] [-json]`. It
+// exits with status 1 when issues remain, so it can alert from cron.
+func runFsckCommand(server *internal.Server, args []string) {
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	repair := flags.Bool("repair", false, "fix what can be fixed safely")
+	skipHashes := flags.Bool("skip-hashes", false, "do not read every file to verify image_hash")
+	asJSON := flags.Bool("json", false, "print the report as JSON")
+	flags.Parse(args)
 
-// moveReceiptFile moves a receipt file between unused and used directories
-func moveReceiptFile(oldPath, baseDir string, year int, filename string, toUsed bool) (string, error) {
-	newPath := getReceiptFilePath(baseDir, year, filename, toUsed)
+	report, err := server.CheckStorage(internal.FsckOptions{Repair: *repair, VerifyHashes: !*skipHashes})
+	if err != nil {
+		log.Fatalf("Storage check failed: %v", err)
+	}
 
-	// If the paths are the same, no need to move
-	if oldPath == newPath {
-		return newPath, nil
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+	} else {
+		for _, issue := range report.Issues {
+			receipt := "-"
+			if issue.ReceiptID != 0 {
+				receipt = fmt.Sprintf("receipt %d", issue.ReceiptID)
+			}
+			fmt.Printf("%-15s %-12s %s: %s\n", issue.Kind, receipt, issue.Key, issue.Detail)
+			if issue.Repair != "" {
+				fmt.Printf("%-15s %-12s repaired: %s\n", "", "", issue.Repair)
+			}
+		}
+		fmt.Printf("Checked %d receipts and %d files: %d issues, %d repaired\n",
+			report.ReceiptsChecked, report.FilesChecked, len(report.Issues), report.Repaired)
 	}
 
-	// Ensure the destination directory exists
-	if err := ensureDirectoryExists(newPath); err != nil {
-		return "", fmt.Errorf("failed to create destination directory: %v", err)
+	if report.Unrepaired() > 0 {
+		os.Exit(1)
 	}
+}
 
-	// Try to move the file using os.Rename first (fastest)
-	if err := os.Rename(oldPath, newPath); err != nil {
-		// If rename fails (possibly cross-device), do copy + delete
-		log.Printf("os.Rename failed, using copy+delete: %v", err)
-		
-		// Copy the file
-		src, err := os.Open(oldPath)
-		if err != nil {
-			return "", fmt.Errorf("failed to open source file: %v", err)
-		}
-		defer src.Close()
+// runMigrateCommand handles `migrate up`, `migrate down [steps]` and
+// `migrate status`
+func runMigrateCommand(db *internal.Database, dir string, args []string) {
+	command := "up"
+	if len(args) > 0 {
+		command = args[0]
+	}
 
-		dst, err := os.Create(newPath)
-		if err != nil {
-			return "", fmt.Errorf("failed to create destination file: %v", err)
+	switch command {
+	case "up":
+		if err := db.RunMigrations(dir); err != nil {
+			log.Fatalf("Failed to run migrations: %v", err)
 		}
-		defer dst.Close()
-
-		if _, err := io.Copy(dst, src); err != nil {
-			return "", fmt.Errorf("failed to copy file: %v", err)
+	case "down", "rollback":
+		steps := 1
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				log.Fatalf("Invalid number of migrations to roll back: %q", args[1])
+			}
+			steps = n
 		}
-
-		// Delete the original file after successful copy
-		if err := os.Remove(oldPath); err != nil {
-			log.Printf("Warning: Failed to delete original file after copy: %v", err)
-			// Don't fail the operation, the file was at least copied
+		if err := db.RollbackMigrations(dir, steps); err != nil {
+			log.Fatalf("Failed to roll back migrations: %v", err)
+		}
+	case "status":
+		states, err := db.MigrationStatus(dir)
+		if err != nil {
+			log.Fatalf("Failed to read migration status: %v", err)
+		}
+		for _, s := range states {
+			status := "pending"
+			switch {
+			case s.AppliedAt != nil && s.Up == "":
+				status = "applied, file missing"
+			case s.AppliedAt != nil && s.AppliedChecksum != s.Checksum:
+				status = "applied, file modified since"
+			case s.AppliedAt != nil:
+				status = "applied " + s.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%03d  %-24s  %s\n", s.Version, s.Name, status)
 		}
+	default:
+		log.Fatalf("Unknown migrate command %q, expected up, down [steps] or status", command)
 	}
-
-	return newPath, nil
 }
+
 func maskConnectionString(connStr string) string {
 	if idx := strings.Index(connStr, "@"); idx > 0 {
 		return "postgres://****:****" + connStr[idx:]
@@ -162,11 +366,23 @@ func maskConnectionString(connStr string) string {
 	return connStr
 }
 
-func enableCORS(next http.Handler) http.Handler {
+// enableCORS answers preflight requests before authentication runs. Origins
+// is a comma-separated allow list, or "*" for any origin.
+func enableCORS(next http.Handler, origins string) http.Handler {
+	allowed := map[string]bool{}
+	for _, origin := range strings.Split(origins, ",") {
+		allowed[strings.TrimSpace(origin)] = true
+	}
+
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
+		if allowed["*"] {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else if origin := r.Header.Get("Origin"); allowed[origin] {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Add("Vary", "Origin")
+		}
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Household-ID")
 
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
@@ -191,196 +407,173 @@ func UploadHandler(w http.ResponseWriter, r *http.Request, s *internal.Server) {
 		return
 	}
 
-	if err := r.ParseMultipartForm(32 << 20); err != nil {
-		http.Error(w, "Failed to parse form", http.StatusBadRequest)
-		return
-	}
-
-	file, header, err := r.FormFile("file")
-	if err != nil {
-		http.Error(w, "Failed to get file from request", http.StatusBadRequest)
+	user := internal.CurrentUser(r)
+	membership := internal.CurrentMembership(r)
+	if !membership.CanWrite() {
+		http.Error(w, "Viewers cannot upload receipts", http.StatusForbidden)
 		return
 	}
-	defer file.Close()
 
-	fileData, err := io.ReadAll(file)
-	if err != nil {
-		http.Error(w, "Failed to read file", http.StatusInternalServerError)
+	if !s.ParseUploadForm(w, r) {
 		return
 	}
 
-	hash := sha256.Sum256(fileData)
-	imageHash := hex.EncodeToString(hash[:])
-
-	if existingReceipt, err := s.DB.GetReceiptByImageHash(imageHash); err == nil && existingReceipt != nil {
-		log.Printf("Duplicate receipt detected (by hash): %s", imageHash)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusConflict)
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"error":   "duplicate",
-			"message": "This receipt has already been uploaded",
-			"receipt": existingReceipt,
-		})
-		return
-	}
-
-	filename := fmt.Sprintf("%d_%s", time.Now().Unix(), header.Filename)
-
-	// Determine receipt year and construct path in unused directory
-	receiptYear := time.Now().Year()
-	savePath := getReceiptFilePath(s.ReceiptDir, receiptYear, filename, false)
-
-	// Ensure directory exists
-	if err := ensureDirectoryExists(savePath); err != nil {
-		log.Printf("Failed to create directory: %v", err)
-		http.Error(w, "Failed to create directory", http.StatusInternalServerError)
-		return
+	// Attribute the receipt to the uploader unless another member is named
+	memberID := membership.ID
+	if value := r.FormValue("member_id"); value != "" {
+		id, err := strconv.Atoi(value)
+		if err != nil {
+			http.Error(w, "Invalid member ID", http.StatusBadRequest)
+			return
+		}
+		if _, err := s.DB.GetMember(membership.HouseholdID, id); err != nil {
+			http.Error(w, "Member not found", http.StatusBadRequest)
+			return
+		}
+		memberID = id
 	}
 
-	outFile, err := os.Create(savePath)
-	if err != nil {
-		log.Printf("Failed to create file: %v", err)
-		http.Error(w, "Failed to save file", http.StatusInternalServerError)
-		return
+	// Several receipts can be sent at once, as repeated file (or files)
+	// fields or as ZIP archives; each is saved on its own
+	var headers []*multipart.FileHeader
+	if r.MultipartForm != nil {
+		headers = append(headers, r.MultipartForm.File["file"]...)
+		headers = append(headers, r.MultipartForm.File["files"]...)
 	}
-	defer outFile.Close()
-
-	if _, err := outFile.Write(fileData); err != nil {
-		log.Printf("Failed to write file: %v", err)
-		http.Error(w, "Failed to save file", http.StatusInternalServerError)
+	if len(headers) == 0 {
+		http.Error(w, "Failed to get file from request", http.StatusBadRequest)
 		return
 	}
-
-	log.Printf("File saved to: %s", savePath)
-
-	ocrResult, err := callOCRService(savePath, s.OCRServiceURL)
-	if err != nil {
-		log.Printf("OCR processing failed: %v", err)
-		http.Error(w, fmt.Sprintf("OCR processing failed: %v", err), http.StatusInternalServerError)
+	allowDuplicate, _ := strconv.ParseBool(r.FormValue("allow_duplicate"))
+
+	// merge=true combines the files into one multi-page receipt instead,
+	// e.g. photos of a long receipt or pages of a statement scanned apart
+	if merge, _ := strconv.ParseBool(r.FormValue("merge")); merge && len(headers) > 1 {
+		var files []internal.DocumentFile
+		for _, header := range headers {
+			fileData, err := s.ReadUploadFile(header)
+			if err == internal.ErrUploadTooLarge {
+				http.Error(w, fmt.Sprintf("%s is larger than %d MB", header.Filename, s.MaxUploadFileSize>>20),
+					http.StatusRequestEntityTooLarge)
+				return
+			} else if err != nil {
+				log.Printf("Failed to read uploaded file %s: %v", header.Filename, err)
+				http.Error(w, "Failed to read file", http.StatusInternalServerError)
+				return
+			}
+			files = append(files, internal.DocumentFile{Filename: header.Filename, Data: fileData})
+		}
+		merged, err := internal.MergeDocuments(files)
+		if err != nil {
+			http.Error(w, "Cannot combine the files: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeUploadResult(w, s.IngestReceipt(internal.ReceiptUpload{
+			Username:       user.Username,
+			HouseholdID:    membership.HouseholdID,
+			MemberID:       memberID,
+			Filename:       strings.TrimSuffix(headers[0].Filename, filepath.Ext(headers[0].Filename)) + ".pdf",
+			Data:           merged,
+			AllowDuplicate: allowDuplicate,
+		}))
 		return
 	}
 
-	log.Printf("OCR Result: Vendor=%s, Amount=%.2f, Date=%s, HSAStatus=%s",
-		ocrResult.Vendor, ocrResult.Amount, ocrResult.Date, ocrResult.HSAStatus)
+	var results []internal.UploadResult
+	for _, header := range headers {
+		upload := internal.ReceiptUpload{
+			Username:       user.Username,
+			HouseholdID:    membership.HouseholdID,
+			MemberID:       memberID,
+			Filename:       header.Filename,
+			AllowDuplicate: allowDuplicate,
+		}
 
-	var receiptDate time.Time
-	if ocrResult.Date != "" {
-		receiptDate, err = time.Parse("01/02/2006", ocrResult.Date)
+		fileData, err := s.ReadUploadFile(header)
 		if err != nil {
-			log.Printf("Failed to parse date '%s': %v", ocrResult.Date, err)
-			receiptDate = time.Now()
+			status, message := http.StatusInternalServerError, "Failed to read file"
+			if err == internal.ErrUploadTooLarge {
+				status, message = http.StatusRequestEntityTooLarge, fmt.Sprintf("File is larger than %d MB", s.MaxUploadFileSize>>20)
+			} else {
+				log.Printf("Failed to read uploaded file %s: %v", header.Filename, err)
+			}
+			if len(headers) == 1 {
+				http.Error(w, message, status)
+				return
+			}
+			results = append(results, internal.UploadResult{
+				Filename: header.Filename,
+				Status:   internal.UploadFailed,
+				Message:  message,
+			})
+			continue
 		}
-	} else {
-		receiptDate = time.Now()
-	}
+		upload.Data = fileData
 
-	// Normalize HSA status
-	hsaStatus := ocrResult.HSAStatus
-	if hsaStatus == "" {
-		if ocrResult.HSAQualified {
-			hsaStatus = internal.HSAStatusYes
-		} else {
-			hsaStatus = internal.HSAStatusNo
+		// A single receipt gets the single-receipt response
+		if len(headers) == 1 && !internal.IsZipArchive(header.Filename, fileData) {
+			if len(fileData) == 0 {
+				http.Error(w, "File is empty", http.StatusBadRequest)
+				return
+			}
+			writeUploadResult(w, s.IngestReceipt(upload))
+			return
 		}
+		results = append(results, s.IngestUpload(upload)...)
 	}
 
-	// Check for duplicates by vendor/amount/date
-	if existingReceipt, err := s.DB.GetDuplicateReceipt(ocrResult.Vendor, ocrResult.Amount, receiptDate); err == nil && existingReceipt != nil {
-		log.Printf("Duplicate receipt detected (by data): vendor=%s, amount=%.2f, date=%s",
-			ocrResult.Vendor, ocrResult.Amount, receiptDate.Format("2006-01-02"))
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusConflict)
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"error":   "duplicate",
-			"message": "A similar receipt already exists (same vendor, amount, and date)",
-			"receipt": existingReceipt,
-		})
-		return
+	summary := map[string]int{
+		internal.UploadCreated:           0,
+		internal.UploadDuplicate:         0,
+		internal.UploadPossibleDuplicate: 0,
+		internal.UploadFailed:            0,
 	}
-
-	receipt := &internal.Receipt{
-		UserID:       internal.HOUSEHOLD_USER,
-		Vendor:       ocrResult.Vendor,
-		TotalAmount:  ocrResult.Amount,
-		Date:         receiptDate,
-		HSAQualified: hsaStatus == internal.HSAStatusYes || hsaStatus == internal.HSAStatusPartially,
-		HSAStatus:    hsaStatus,
-		ImagePath:    savePath,
-		ImageHash:    imageHash,
-		RawText:      ocrResult.RawText,
-		Used:         false,
-	}
-
-	err = s.DB.CreateReceipt(receipt)
-	if err != nil {
-		log.Printf("Failed to save receipt to database: %v", err)
-		http.Error(w, "Failed to save receipt", http.StatusInternalServerError)
-		return
+	for _, result := range results {
+		summary[result.Status]++
 	}
-
-	log.Printf("Receipt saved to database with ID: %d", receipt.ID)
+	log.Printf("Bulk upload by %s: %d files, %d created, %d failed",
+		user.Username, len(results), summary[internal.UploadCreated], summary[internal.UploadFailed])
 
 	w.Header().Set("Content-Type", "application/json")
-	response := map[string]interface{}{
-		"id":            receipt.ID,
-		"vendor":        receipt.Vendor,
-		"amount":        receipt.TotalAmount,
-		"date":          receipt.Date.Format("2006-01-02"),
-		"hsa_qualified": receipt.HSAQualified,
-		"hsa_status":    receipt.HSAStatus,
-		"message":       "Receipt uploaded successfully",
-	}
-	json.NewEncoder(w).Encode(response)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"results": results,
+		"summary": summary,
+	})
 }
 
-func callOCRService(imagePath string, ocrServiceURL string) (*OCRResponse, error) {
-	file, err := os.Open(imagePath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open file: %v", err)
-	}
-	defer file.Close()
-
-	body := &bytes.Buffer{}
-	writer := multipart.NewWriter(body)
-
-	part, err := writer.CreateFormFile("file", filepath.Base(imagePath))
-	if err != nil {
-		return nil, fmt.Errorf("failed to create form file: %v", err)
-	}
-
-	if _, err := io.Copy(part, file); err != nil {
-		return nil, fmt.Errorf("failed to copy file: %v", err)
-	}
-
-	writer.Close()
-
-	url := fmt.Sprintf("%s/parse", ocrServiceURL)
-	req, err := http.NewRequest("POST", url, body)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %v", err)
-	}
-
-	req.Header.Set("Content-Type", writer.FormDataContentType())
-
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("failed to call OCR service: %v", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		bodyBytes, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("OCR service returned status %d: %s",
-			resp.StatusCode, string(bodyBytes))
-	}
-
-	var ocrResult OCRResponse
-	if err := json.NewDecoder(resp.Body).Decode(&ocrResult); err != nil {
-		return nil, fmt.Errorf("failed to parse OCR response: %v", err)
+// writeUploadResult answers a single-file upload: 202 Accepted with the new
+// receipt and its OCR job, or 409 Conflict for a duplicate
+func writeUploadResult(w http.ResponseWriter, result internal.UploadResult) {
+	switch result.Status {
+	case internal.UploadCreated:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"id":         result.ReceiptID,
+			"member_id":  result.MemberID,
+			"job_id":     result.JobID,
+			"ocr_status": result.OCRStatus,
+			"message":    result.Message,
+		})
+	case internal.UploadDuplicate:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":   "duplicate",
+			"message": result.Message,
+			"receipt": result.Receipt,
+		})
+	case internal.UploadPossibleDuplicate:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":   "possible_duplicate",
+			"message": result.Message,
+			"matches": result.Matches,
+		})
+	default:
+		http.Error(w, result.Message, http.StatusInternalServerError)
 	}
-
-	return &ocrResult, nil
 }
 
 func ReceiptsHandler(w http.ResponseWriter, r *http.Request, s *internal.Server) {
@@ -389,7 +582,17 @@ func ReceiptsHandler(w http.ResponseWriter, r *http.Request, s *internal.Server)
 		return
 	}
 
-	receipts, err := s.DB.GetAllReceipts(internal.HOUSEHOLD_USER)
+	memberID := 0
+	if value := r.URL.Query().Get("member_id"); value != "" {
+		id, err := strconv.Atoi(value)
+		if err != nil {
+			http.Error(w, "Invalid member ID", http.StatusBadRequest)
+			return
+		}
+		memberID = id
+	}
+
+	receipts, err := s.DB.GetAllReceipts(internal.CurrentMembership(r).HouseholdID, memberID)
 	if err != nil {
 		log.Printf("Failed to get receipts: %v", err)
 		http.Error(w, "Failed to retrieve receipts", http.StatusInternalServerError)
@@ -401,13 +604,64 @@ func ReceiptsHandler(w http.ResponseWriter, r *http.Request, s *internal.Server)
 }
 
 func ReceiptByIDHandler(w http.ResponseWriter, r *http.Request, s *internal.Server) {
-	path := strings.TrimPrefix(r.URL.Path, "/api/receipts/")
-	id, err := strconv.Atoi(path)
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/receipts/"), "/")
+	id, err := strconv.Atoi(parts[0])
 	if err != nil {
 		http.Error(w, "Invalid receipt ID", http.StatusBadRequest)
 		return
 	}
 
+	// Sub-resources: /ocr re-runs OCR, /items and /items/{item_id} are the
+	// receipt's line items, /eligibility runs the eligibility rules,
+	// /duplicates ranks the receipts that may be the same purchase, /split
+	// cuts a multi-page PDF into several receipts, /attachments and
+	// /attachments/{attachment_id} are the documents kept with the receipt
+	switch {
+	case len(parts) == 1:
+	case len(parts) == 2 && parts[1] == "ocr":
+		s.RerunOCRHandler(w, r, id)
+		return
+	case len(parts) == 2 && parts[1] == "split":
+		s.ReceiptSplitHandler(w, r, id)
+		return
+	case len(parts) == 2 && parts[1] == "eligibility":
+		s.ReceiptEligibilityHandler(w, r, id)
+		return
+	case len(parts) == 2 && parts[1] == "duplicates":
+		s.ReceiptDuplicatesHandler(w, r, id)
+		return
+	case len(parts) == 2 && parts[1] == "items":
+		s.ReceiptItemsHandler(w, r, id)
+		return
+	case len(parts) == 3 && parts[1] == "items":
+		itemID, err := strconv.Atoi(parts[2])
+		if err != nil {
+			http.Error(w, "Invalid item ID", http.StatusBadRequest)
+			return
+		}
+		s.ReceiptItemHandler(w, r, id, itemID)
+		return
+	case len(parts) == 2 && parts[1] == "attachments":
+		s.ReceiptAttachmentsHandler(w, r, id)
+		return
+	case len(parts) == 3 && parts[1] == "attachments":
+		attachmentID, err := strconv.Atoi(parts[2])
+		if err != nil {
+			http.Error(w, "Invalid attachment ID", http.StatusBadRequest)
+			return
+		}
+		s.ReceiptAttachmentHandler(w, r, id, attachmentID)
+		return
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.Method != http.MethodGet && !internal.CurrentMembership(r).CanWrite() {
+		http.Error(w, "Viewers cannot change receipts", http.StatusForbidden)
+		return
+	}
+
 	switch r.Method {
 	case http.MethodGet:
 		GetReceiptHandler(w, r, s, id)
@@ -421,42 +675,89 @@ func ReceiptByIDHandler(w http.ResponseWriter, r *http.Request, s *internal.Serv
 }
 
 func GetReceiptHandler(w http.ResponseWriter, r *http.Request, s *internal.Server, id int) {
-	receipt, err := s.DB.GetReceiptByID(id)
+	receipt, err := s.DB.GetReceiptByID(internal.CurrentMembership(r).HouseholdID, id)
 	if err != nil {
 		log.Printf("Failed to get receipt: %v", err)
 		http.Error(w, "Receipt not found", http.StatusNotFound)
 		return
 	}
 
+	if receipt.Items, err = s.DB.GetReceiptItems(id); err != nil {
+		log.Printf("Failed to get receipt items: %v", err)
+		http.Error(w, "Failed to get receipt", http.StatusInternalServerError)
+		return
+	}
+	if receipt.Attachments, err = s.DB.GetReceiptAttachments(id); err != nil {
+		log.Printf("Failed to get receipt attachments: %v", err)
+		http.Error(w, "Failed to get receipt", http.StatusInternalServerError)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(receipt)
 }
 
 func UpdateReceiptHandler(w http.ResponseWriter, r *http.Request, s *internal.Server, id int) {
-	receipt, err := s.DB.GetReceiptByID(id)
+	receipt, err := s.DB.GetReceiptByID(internal.CurrentMembership(r).HouseholdID, id)
 	if err != nil {
 		log.Printf("Failed to get receipt: %v", err)
 		http.Error(w, "Receipt not found", http.StatusNotFound)
 		return
 	}
 
+	// Numbers stay json.Number so amounts are parsed exactly, never via float64
 	var updates map[string]interface{}
-	if err := json.NewDecoder(r.Body).Decode(&updates); err != nil {
+	decoder := json.NewDecoder(r.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(&updates); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
-	// Track if we're changing the used status
-	wasUsed := receipt.Used
-	willBeUsed := receipt.Used
-
-	log.Printf("UpdateReceipt ID=%d: Initial state - wasUsed=%v, ImagePath=%s", id, wasUsed, receipt.ImagePath)
+	log.Printf("UpdateReceipt ID=%d: Initial state - used=%v, remaining=%s", id, receipt.Used, receipt.RemainingAmount)
 
 	if vendor, ok := updates["vendor"].(string); ok {
 		receipt.Vendor = vendor
 	}
-	if amount, ok := updates["total_amount"].(float64); ok {
-		receipt.TotalAmount = amount
+	// total_amount is the qualified amount's name before original totals
+	// were kept, still accepted from older clients
+	if _, ok := updates["qualified_amount"]; !ok {
+		if amount, ok := updates["total_amount"]; ok {
+			updates["qualified_amount"] = amount
+		}
+	}
+	amounts := map[string]*internal.Money{
+		"original_total":  &receipt.OriginalTotal,
+		"tax_amount":      &receipt.TaxAmount,
+		"discount_amount": &receipt.DiscountAmount,
+	}
+	for field, target := range amounts {
+		if amount, ok := updates[field].(json.Number); ok {
+			parsed, err := internal.ParseMoney(amount.String())
+			if err != nil || parsed < 0 {
+				http.Error(w, "Invalid "+field, http.StatusBadRequest)
+				return
+			}
+			*target = parsed
+		}
+	}
+	qualified := receipt.QualifiedAmount
+	_, qualifiedEdited := updates["qualified_amount"]
+	if amount, ok := updates["qualified_amount"].(json.Number); ok {
+		parsed, err := internal.ParseMoney(amount.String())
+		if err != nil || parsed < 0 {
+			http.Error(w, "Invalid qualified_amount", http.StatusBadRequest)
+			return
+		}
+		qualified = parsed
+	}
+	if currency, ok := updates["currency"].(string); ok {
+		normalized, err := internal.NormalizeCurrency(currency)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		receipt.Currency = normalized
 	}
 	if dateStr, ok := updates["date"].(string); ok {
 		if date, err := time.Parse("2006-01-02", dateStr); err == nil {
@@ -470,81 +771,138 @@ func UpdateReceiptHandler(w http.ResponseWriter, r *http.Request, s *internal.Se
 		receipt.HSAStatus = hsaStatus
 		receipt.HSAQualified = hsaStatus == internal.HSAStatusYes || hsaStatus == internal.HSAStatusPartially
 	}
-	if used, ok := updates["used"].(bool); ok {
-		log.Printf("UpdateReceipt ID=%d: Updating 'used' from %v to %v", id, receipt.Used, used)
-		receipt.Used = used
-		willBeUsed = used
-		if used {
-			now := time.Now()
-			receipt.UsedDate = &now
-		} else {
-			receipt.UsedDate = nil
-		}
-	}
 	if useReason, ok := updates["use_reason"].(string); ok {
 		receipt.UseReason = &useReason
 	}
 
-	// Move file if changing used status (either direction)
-	log.Printf("UpdateReceipt ID=%d: Checking file move - wasUsed=%v, willBeUsed=%v, ImagePath=%s", 
-		id, wasUsed, willBeUsed, receipt.ImagePath)
-	
-	if wasUsed != willBeUsed && receipt.ImagePath != "" {
-		log.Printf("UpdateReceipt ID=%d: File move condition met!", id)
-		// Determine the year for the file path
-		fileYear := time.Now().Year()
-		if willBeUsed && receipt.UsedDate != nil {
-			fileYear = receipt.UsedDate.Year()
-		} else if !willBeUsed {
-			// When moving back to unused, use the receipt date year
-			fileYear = receipt.Date.Year()
+	// Only a Partially receipt's qualified amount differs from its original
+	// total, so on other receipts editing either amount moves both
+	_, originalEdited := updates["original_total"]
+	_, statusEdited := updates["hsa_status"].(string)
+	if receipt.HSAStatus != internal.HSAStatusPartially {
+		if qualifiedEdited && !originalEdited {
+			receipt.OriginalTotal = qualified
+		} else if !qualifiedEdited && (originalEdited || statusEdited) {
+			qualified = receipt.OriginalTotal
 		}
+	}
 
-		filename := filepath.Base(receipt.ImagePath)
-		newPath, err := moveReceiptFile(receipt.ImagePath, s.ReceiptDir, fileYear, filename, willBeUsed)
-		if err != nil {
-			log.Printf("Warning: Failed to move receipt file: %v", err)
-			// Don't fail the request, just log the warning
-		} else {
-			receipt.ImagePath = newPath
-			if willBeUsed {
-				log.Printf("Moved receipt file to used: %s", newPath)
-			} else {
-				log.Printf("Moved receipt file back to unused: %s", newPath)
+	// A Partially receipt whose items say which ones qualify takes its
+	// qualified amount from them; setting Yes or No applies to every item
+	items, err := s.DB.GetReceiptItems(id)
+	if err != nil {
+		log.Printf("Failed to get receipt items: %v", err)
+		http.Error(w, "Failed to update receipt", http.StatusInternalServerError)
+		return
+	}
+	syncItems := len(items) > 0 && statusEdited && receipt.HSAStatus != internal.HSAStatusPartially
+	if len(items) > 0 && receipt.HSAStatus == internal.HSAStatusPartially {
+		status, itemsQualified, priced := internal.ItemsHSAStatus(items)
+		if status == internal.HSAStatusPartially && priced {
+			if qualifiedEdited && qualified != itemsQualified {
+				http.Error(w, "The qualified amount of a Partially receipt is the sum of its eligible items; change item eligibility instead",
+					http.StatusBadRequest)
+				return
 			}
+			qualified = itemsQualified
 		}
 	}
 
-	if err := s.DB.UpdateReceipt(receipt); err != nil {
+	if qualified > receipt.OriginalTotal {
+		http.Error(w, "qualified_amount cannot exceed original_total", http.StatusBadRequest)
+		return
+	}
+	receipt.QualifiedAmount = qualified
+
+	// applied_amount claims part of the remaining balance; used=true claims
+	// all of it and used=false releases everything claimed so far. The
+	// balance itself only changes in the database (see UpdateReceipt).
+	var change internal.BalanceChange
+	if value, ok := updates["applied_amount"].(json.Number); ok {
+		parsed, err := internal.ParseMoney(value.String())
+		if err != nil || parsed <= 0 {
+			http.Error(w, "Invalid applied_amount", http.StatusBadRequest)
+			return
+		}
+		change.Apply = parsed
+	}
+	if used, ok := updates["used"].(bool); ok {
+		log.Printf("UpdateReceipt ID=%d: Updating 'used' from %v to %v", id, receipt.Used, used)
+		if used && !receipt.Used && change.Apply == 0 {
+			change.ApplyAll = true
+		} else if !used {
+			change.Release = true
+			change.Apply = 0
+		}
+	}
+	if value, ok := updates["member_id"]; ok {
+		if value == nil {
+			receipt.MemberID = nil
+		} else if id, ok := value.(json.Number); ok {
+			memberID64, err := id.Int64()
+			if err != nil {
+				http.Error(w, "Invalid member ID", http.StatusBadRequest)
+				return
+			}
+			memberID := int(memberID64)
+			if _, err := s.DB.GetMember(receipt.HouseholdID, memberID); err != nil {
+				http.Error(w, "Member not found", http.StatusBadRequest)
+				return
+			}
+			receipt.MemberID = &memberID
+		}
+	}
+
+	err = s.DB.UpdateReceipt(receipt, change)
+	if err == internal.ErrQualifiedBelowClaimed || err == internal.ErrInsufficientBalance || err == internal.ErrReceiptReimbursed {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
 		log.Printf("Failed to update receipt: %v", err)
 		http.Error(w, "Failed to update receipt", http.StatusInternalServerError)
 		return
 	}
 
+	if syncItems {
+		eligible := receipt.HSAStatus == internal.HSAStatusYes
+		if err := s.DB.SetReceiptItemsEligible(id, eligible); err != nil {
+			log.Printf("Warning: Failed to update receipt %d items: %v", id, err)
+		}
+		for i := range items {
+			items[i].HSAEligible = eligible
+		}
+	}
+	receipt.Items = items
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(receipt)
 }
 
 func DeleteReceiptHandler(w http.ResponseWriter, r *http.Request, s *internal.Server, id int) {
-	receipt, err := s.DB.GetReceiptByID(id)
+	receipt, err := s.DB.GetReceiptByID(internal.CurrentMembership(r).HouseholdID, id)
 	if err != nil {
 		log.Printf("Failed to get receipt: %v", err)
 		http.Error(w, "Receipt not found", http.StatusNotFound)
 		return
 	}
 
-	if err := s.DB.DeleteReceipt(id); err != nil {
-		log.Printf("Failed to delete receipt: %v", err)
+	// The attachment rows go with the receipt; their files are deleted after
+	attachments, err := s.DB.GetReceiptAttachments(id)
+	if err != nil {
+		log.Printf("Failed to get receipt attachments: %v", err)
 		http.Error(w, "Failed to delete receipt", http.StatusInternalServerError)
 		return
 	}
 
-	if receipt.ImagePath != "" {
-		if err := os.Remove(receipt.ImagePath); err != nil {
-			log.Printf("Warning: Failed to delete file %s: %v", receipt.ImagePath, err)
-		}
+	if err := s.DB.DeleteReceipt(receipt.HouseholdID, id); err != nil {
+		log.Printf("Failed to delete receipt: %v", err)
+		http.Error(w, "Failed to delete receipt", http.StatusInternalServerError)
+		return
 	}
 
+	s.DeleteReceiptFiles(receipt, attachments)
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{"message": "Receipt deleted successfully"})
 }
@@ -557,31 +915,67 @@ func ServeReceiptFile(w http.ResponseWriter, r *http.Request, s *internal.Server
 		return
 	}
 
-	receipt, err := s.DB.GetReceiptByID(id)
+	receipt, err := s.DB.GetReceiptByID(internal.CurrentMembership(r).HouseholdID, id)
 	if err != nil {
 		log.Printf("Failed to get receipt: %v", err)
 		http.Error(w, "Receipt not found", http.StatusNotFound)
 		return
 	}
 
-	if _, err := os.Stat(receipt.ImagePath); os.IsNotExist(err) {
+	key := s.ReceiptKey(receipt.ImagePath)
+
+	// ?page=N serves one page of a multi-page PDF as a PDF of its own; an
+	// image is its own page 1
+	if value := r.URL.Query().Get("page"); value != "" {
+		page, err := strconv.Atoi(value)
+		if err != nil || page < 1 {
+			http.Error(w, "Invalid page", http.StatusBadRequest)
+			return
+		}
+		if internal.IsPDF(key, nil) {
+			servePDFPage(w, s, receipt, page)
+			return
+		}
+		if page != 1 {
+			http.Error(w, "Page not found", http.StatusNotFound)
+			return
+		}
+	}
+
+	s.ServeStoredFile(w, r, key, internal.ContentTypeForKey(key), receipt.OriginalName)
+}
+
+// servePDFPage sends one page of a receipt's PDF
+func servePDFPage(w http.ResponseWriter, s *internal.Server, receipt *internal.Receipt, page int) {
+	data, err := s.ReadReceiptFile(receipt.ImagePath)
+	if err == internal.ErrBlobNotFound {
 		http.Error(w, "File not found", http.StatusNotFound)
 		return
 	}
+	if err != nil {
+		log.Printf("Failed to read receipt file %s: %v", receipt.ImagePath, err)
+		http.Error(w, "Failed to read file", http.StatusInternalServerError)
+		return
+	}
 
-	ext := strings.ToLower(filepath.Ext(receipt.ImagePath))
-	contentType := "application/octet-stream"
-	switch ext {
-	case ".jpg", ".jpeg":
-		contentType = "image/jpeg"
-	case ".png":
-		contentType = "image/png"
-	case ".pdf":
-		contentType = "application/pdf"
-	case ".heic":
-		contentType = "image/heic"
+	pageCount, err := internal.PDFPageCount(data)
+	if err != nil {
+		http.Error(w, "Cannot read the PDF: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if page > pageCount {
+		http.Error(w, fmt.Sprintf("Page not found, the receipt has %d pages", pageCount), http.StatusNotFound)
+		return
+	}
+	pdf, err := internal.ExtractPDFPages(data, []int{page})
+	if err != nil {
+		http.Error(w, "Cannot read the PDF: "+err.Error(), http.StatusUnprocessableEntity)
+		return
 	}
 
-	w.Header().Set("Content-Type", contentType)
-	http.ServeFile(w, r, receipt.ImagePath)
+	filename := fmt.Sprintf("receipt-%d-page-%d.pdf", receipt.ID, page)
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": filename}))
+	w.Header().Set("Content-Length", strconv.Itoa(len(pdf)))
+	w.Write(pdf)
 }
\ No newline at end of file
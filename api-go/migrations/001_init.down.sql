@@ -0,0 +1,2 @@
+-- Reverts 001_init.sql: drops every receipt
+DROP TABLE IF EXISTS receipts;
@@ -0,0 +1,3 @@
+-- Reverts 002_users.sql
+DROP TABLE IF EXISTS sessions;
+DROP TABLE IF EXISTS users;
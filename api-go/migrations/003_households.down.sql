@@ -0,0 +1,7 @@
+-- Reverts 003_households.sql; receipts keep their uploader's user_id
+DROP INDEX IF EXISTS idx_receipts_member_id;
+DROP INDEX IF EXISTS idx_receipts_household_id;
+ALTER TABLE receipts DROP COLUMN IF EXISTS member_id;
+ALTER TABLE receipts DROP COLUMN IF EXISTS household_id;
+DROP TABLE IF EXISTS household_members;
+DROP TABLE IF EXISTS households;
@@ -0,0 +1,59 @@
+-- Household workspaces with members and per-person receipt attribution
+-- Receipts belong to a household; receipts.user_id keeps the uploader's username
+
+CREATE TABLE IF NOT EXISTS households (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- A member is a person expenses are for. user_id is NULL for dependents
+-- without a login; role only matters for members who can log in.
+CREATE TABLE IF NOT EXISTS household_members (
+    id SERIAL PRIMARY KEY,
+    household_id INTEGER NOT NULL REFERENCES households(id) ON DELETE CASCADE,
+    user_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    name VARCHAR(255) NOT NULL,
+    role VARCHAR(20) NOT NULL DEFAULT 'viewer',  -- 'owner', 'adult', or 'viewer'
+    eligible_from DATE,
+    eligible_until DATE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (household_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_household_members_user_id ON household_members(user_id);
+
+ALTER TABLE receipts ADD COLUMN IF NOT EXISTS household_id INTEGER REFERENCES households(id) ON DELETE CASCADE;
+ALTER TABLE receipts ADD COLUMN IF NOT EXISTS member_id INTEGER REFERENCES household_members(id) ON DELETE SET NULL;
+
+CREATE INDEX IF NOT EXISTS idx_receipts_household_id ON receipts(household_id);
+CREATE INDEX IF NOT EXISTS idx_receipts_member_id ON receipts(member_id);
+
+-- Give every existing user a personal household and move their receipts into it
+DO $$
+DECLARE
+    u RECORD;
+    new_household_id INTEGER;
+    new_member_id INTEGER;
+BEGIN
+    FOR u IN
+        SELECT id, username FROM users
+        WHERE NOT EXISTS (SELECT 1 FROM household_members m WHERE m.user_id = users.id)
+        ORDER BY id
+    LOOP
+        INSERT INTO households (name) VALUES (u.username || '''s household')
+        RETURNING id INTO new_household_id;
+
+        INSERT INTO household_members (household_id, user_id, name, role)
+        VALUES (new_household_id, u.id, u.username, 'owner')
+        RETURNING id INTO new_member_id;
+
+        UPDATE receipts
+        SET household_id = new_household_id, member_id = new_member_id
+        WHERE user_id = u.username AND household_id IS NULL;
+    END LOOP;
+END $$;
+
+-- Notes:
+-- * Receipts still owned by 'household' keep household_id NULL until the
+--   first account is registered and adopts them.
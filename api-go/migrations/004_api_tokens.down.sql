@@ -0,0 +1,2 @@
+-- Reverts 004_api_tokens.sql
+DROP TABLE IF EXISTS api_tokens;
@@ -0,0 +1,6 @@
+-- Reverts 005_oidc.sql
+ALTER TABLE household_members DROP COLUMN IF EXISTS email;
+DROP TABLE IF EXISTS oidc_login_states;
+DROP TABLE IF EXISTS oidc_identities;
+DROP INDEX IF EXISTS idx_users_email;
+ALTER TABLE users DROP COLUMN IF EXISTS email;
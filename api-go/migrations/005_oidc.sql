@@ -0,0 +1,28 @@
+-- OpenID Connect single sign-on
+
+-- Set only from verified email claims; used to match identities to accounts
+ALTER TABLE users ADD COLUMN IF NOT EXISTS email VARCHAR(255);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_email ON users(LOWER(email));
+
+-- Identities linked to local accounts, keyed by issuer and subject ('sub')
+CREATE TABLE IF NOT EXISTS oidc_identities (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    issuer TEXT NOT NULL,
+    subject TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (issuer, subject)
+);
+
+CREATE INDEX IF NOT EXISTS idx_oidc_identities_user_id ON oidc_identities(user_id);
+
+-- In-flight logins: the PKCE verifier and nonce for each state (stored hashed)
+CREATE TABLE IF NOT EXISTS oidc_login_states (
+    state VARCHAR(64) PRIMARY KEY,
+    code_verifier TEXT NOT NULL,
+    nonce TEXT NOT NULL,
+    expires_at TIMESTAMP NOT NULL
+);
+
+-- Household invitations by email, claimed when that person first signs in
+ALTER TABLE household_members ADD COLUMN IF NOT EXISTS email VARCHAR(255);
@@ -0,0 +1,2 @@
+-- Reverts 006_currency.sql
+ALTER TABLE receipts DROP COLUMN IF EXISTS currency;
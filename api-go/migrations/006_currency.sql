@@ -0,0 +1,5 @@
+-- Currency for receipt amounts
+-- Amounts stay DECIMAL(10,2); the API reads and writes them as exact decimal
+-- text (see internal.Money), never as floating point
+
+ALTER TABLE receipts ADD COLUMN IF NOT EXISTS currency CHAR(3) NOT NULL DEFAULT 'USD';
@@ -0,0 +1,3 @@
+-- Reverts 007_receipt_balance.sql; partly claimed receipts become unused
+DROP TABLE IF EXISTS receipt_applications;
+ALTER TABLE receipts DROP COLUMN IF EXISTS remaining_amount;
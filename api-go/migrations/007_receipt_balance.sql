@@ -0,0 +1,22 @@
+-- Partial receipt application
+-- remaining_amount is the part of total_amount not yet claimed; a receipt is
+-- used once it reaches zero. Each claim against a receipt is recorded in
+-- receipt_applications.
+
+ALTER TABLE receipts ADD COLUMN IF NOT EXISTS remaining_amount DECIMAL(10,2);
+
+UPDATE receipts
+SET remaining_amount = CASE WHEN used THEN 0 ELSE total_amount END
+WHERE remaining_amount IS NULL;
+
+ALTER TABLE receipts ALTER COLUMN remaining_amount SET NOT NULL;
+
+CREATE TABLE IF NOT EXISTS receipt_applications (
+    id SERIAL PRIMARY KEY,
+    receipt_id INTEGER NOT NULL REFERENCES receipts(id) ON DELETE CASCADE,
+    applied_amount DECIMAL(10,2) NOT NULL CHECK (applied_amount > 0),
+    use_reason TEXT,
+    applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_receipt_applications_receipt_id ON receipt_applications(receipt_id);
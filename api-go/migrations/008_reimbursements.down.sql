@@ -0,0 +1,3 @@
+-- Reverts 008_reimbursements.sql; the receipt amounts they claimed stay claimed
+ALTER TABLE receipt_applications DROP COLUMN IF EXISTS reimbursement_id;
+DROP TABLE IF EXISTS reimbursements;
@@ -0,0 +1,21 @@
+-- Reimbursements: one HSA withdrawal and the receipt amounts it claimed
+-- Undoing a reimbursement deletes it and its receipt_applications rows
+
+CREATE TABLE IF NOT EXISTS reimbursements (
+    id SERIAL PRIMARY KEY,
+    household_id INTEGER NOT NULL REFERENCES households(id) ON DELETE CASCADE,
+    created_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    amount DECIMAL(10,2) NOT NULL,
+    currency CHAR(3) NOT NULL DEFAULT 'USD',
+    reimbursed_on DATE NOT NULL,
+    transaction_ref VARCHAR(255),
+    notes TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_reimbursements_household_id ON reimbursements(household_id);
+
+ALTER TABLE receipt_applications
+    ADD COLUMN IF NOT EXISTS reimbursement_id INTEGER REFERENCES reimbursements(id) ON DELETE CASCADE;
+
+CREATE INDEX IF NOT EXISTS idx_receipt_applications_reimbursement_id ON receipt_applications(reimbursement_id);
@@ -0,0 +1,4 @@
+-- Reverts 009_content_addressed_files.sql; files already re-keyed stay under
+-- blobs/ and are still found through image_path
+DROP INDEX IF EXISTS idx_receipts_image_path;
+ALTER TABLE receipts DROP COLUMN IF EXISTS original_filename;
@@ -0,0 +1,16 @@
+-- Receipt files are stored by content hash (blobs/ab/<sha256>.<ext>) instead
+-- of under used/<year> and unused/<year>; used status lives only in the
+-- database. Files are re-keyed by the API on startup, so image_path may
+-- still hold a legacy path until then.
+-- original_filename keeps the uploaded name for downloads and the export view
+
+ALTER TABLE receipts ADD COLUMN IF NOT EXISTS original_filename VARCHAR(255) NOT NULL DEFAULT '';
+
+-- Legacy files are named <unix>_<original name>
+UPDATE receipts
+SET original_filename = regexp_replace(regexp_replace(image_path, '^.*/', ''), '^[0-9]+_', '')
+WHERE original_filename = '' AND image_path IS NOT NULL;
+
+-- Identical uploads in different households share one blob, so deleting a
+-- receipt checks whether any other row still points at its file
+CREATE INDEX IF NOT EXISTS idx_receipts_image_path ON receipts(image_path);
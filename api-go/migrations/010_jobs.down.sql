@@ -0,0 +1,3 @@
+-- Reverts 010_jobs.sql; receipts still pending OCR keep their placeholder values
+DROP TABLE IF EXISTS jobs;
+ALTER TABLE receipts DROP COLUMN IF EXISTS ocr_status;
@@ -0,0 +1,28 @@
+-- Background jobs, starting with asynchronous OCR
+-- A receipt is created in ocr_status 'pending_ocr' at upload and becomes
+-- 'ready' when its OCR job succeeds, or 'ocr_failed' when the job is
+-- dead-lettered after its last attempt.
+
+ALTER TABLE receipts ADD COLUMN IF NOT EXISTS ocr_status VARCHAR(20) NOT NULL DEFAULT 'ready';
+
+CREATE TABLE IF NOT EXISTS jobs (
+    id SERIAL PRIMARY KEY,
+    kind VARCHAR(30) NOT NULL,
+    household_id INTEGER NOT NULL REFERENCES households(id) ON DELETE CASCADE,
+    receipt_id INTEGER REFERENCES receipts(id) ON DELETE CASCADE,
+    -- queued, running, succeeded or dead
+    status VARCHAR(20) NOT NULL DEFAULT 'queued',
+    attempts INTEGER NOT NULL DEFAULT 0,
+    max_attempts INTEGER NOT NULL DEFAULT 5,
+    run_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    locked_at TIMESTAMP,
+    last_error TEXT,
+    result JSONB,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    finished_at TIMESTAMP
+);
+
+-- Workers poll for the next runnable job
+CREATE INDEX IF NOT EXISTS idx_jobs_runnable ON jobs(run_at) WHERE status IN ('queued', 'running');
+CREATE INDEX IF NOT EXISTS idx_jobs_receipt_id ON jobs(receipt_id);
@@ -0,0 +1,2 @@
+-- Reverts 011_receipt_items.sql; totals derived from items are kept as they are
+DROP TABLE IF EXISTS receipt_items;
@@ -0,0 +1,17 @@
+-- Line items read from a receipt, each with its own HSA eligibility
+-- A "Partially" receipt's total_amount is the sum of its eligible items
+
+CREATE TABLE IF NOT EXISTS receipt_items (
+    id SERIAL PRIMARY KEY,
+    receipt_id INTEGER NOT NULL REFERENCES receipts(id) ON DELETE CASCADE,
+    position INTEGER NOT NULL DEFAULT 0,
+    description TEXT NOT NULL,
+    quantity NUMERIC(10,3) NOT NULL DEFAULT 1,
+    unit_price DECIMAL(10,2),
+    -- NULL when the receipt does not show a price for the item
+    amount DECIMAL(10,2),
+    hsa_eligible BOOLEAN NOT NULL DEFAULT true,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_receipt_items_receipt_id ON receipt_items(receipt_id);
@@ -0,0 +1,17 @@
+-- Reverts 012_receipt_totals.sql; printed totals, tax and discounts are lost
+DROP INDEX IF EXISTS idx_receipts_duplicate;
+ALTER TABLE receipts DROP COLUMN IF EXISTS discount_amount;
+ALTER TABLE receipts DROP COLUMN IF EXISTS tax_amount;
+ALTER TABLE receipts DROP COLUMN IF EXISTS original_total;
+
+DO $$
+BEGIN
+    IF EXISTS (
+        SELECT 1 FROM information_schema.columns
+        WHERE table_name = 'receipts' AND column_name = 'qualified_amount'
+    ) THEN
+        ALTER TABLE receipts RENAME COLUMN qualified_amount TO total_amount;
+    END IF;
+END $$;
+
+CREATE INDEX IF NOT EXISTS idx_receipts_composite ON receipts(vendor, total_amount, date);
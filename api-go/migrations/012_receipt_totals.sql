@@ -0,0 +1,47 @@
+-- Keep a receipt's printed total apart from its HSA-qualified amount
+-- * original_total is what the receipt says was paid, after tax and discounts;
+--   duplicate detection compares it
+-- * qualified_amount (formerly total_amount) is the HSA-qualified portion that
+--   deductions and reimbursements draw on; remaining_amount is its unclaimed part
+-- * tax_amount and discount_amount are as printed on the receipt
+
+DO $$
+BEGIN
+    IF EXISTS (
+        SELECT 1 FROM information_schema.columns
+        WHERE table_name = 'receipts' AND column_name = 'total_amount'
+    ) THEN
+        ALTER TABLE receipts RENAME COLUMN total_amount TO qualified_amount;
+    END IF;
+END $$;
+
+ALTER TABLE receipts ADD COLUMN IF NOT EXISTS original_total DECIMAL(10,2);
+ALTER TABLE receipts ADD COLUMN IF NOT EXISTS tax_amount DECIMAL(10,2) NOT NULL DEFAULT 0;
+ALTER TABLE receipts ADD COLUMN IF NOT EXISTS discount_amount DECIMAL(10,2) NOT NULL DEFAULT 0;
+
+-- Only Partially receipts lost their printed total. Recover it from the last
+-- successful OCR run, or else from the receipt's priced items, and fall back
+-- to the qualified amount.
+UPDATE receipts r
+SET original_total = CASE WHEN r.hsa_status = 'Partially' THEN COALESCE(
+        (SELECT NULLIF((j.result->>'amount')::numeric, 0)
+         FROM jobs j
+         WHERE j.receipt_id = r.id AND j.status = 'succeeded'
+         ORDER BY j.finished_at DESC
+         LIMIT 1),
+        (SELECT SUM(i.amount)
+         FROM receipt_items i
+         WHERE i.receipt_id = r.id
+         HAVING COUNT(*) = COUNT(i.amount)),
+        r.qualified_amount)
+    ELSE r.qualified_amount END
+WHERE r.original_total IS NULL;
+
+UPDATE receipts SET original_total = qualified_amount WHERE original_total < qualified_amount;
+
+ALTER TABLE receipts ALTER COLUMN original_total SET NOT NULL;
+ALTER TABLE receipts ALTER COLUMN original_total SET DEFAULT 0;
+
+-- Duplicates are now matched on the printed total
+DROP INDEX IF EXISTS idx_receipts_composite;
+CREATE INDEX IF NOT EXISTS idx_receipts_duplicate ON receipts(vendor, original_total, date);
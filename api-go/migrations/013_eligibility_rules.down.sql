@@ -0,0 +1,2 @@
+-- Reverts 013_eligibility_rules.sql; saved rule sets are lost
+DROP TABLE IF EXISTS eligibility_rule_sets;
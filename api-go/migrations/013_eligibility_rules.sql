@@ -0,0 +1,12 @@
+-- Versioned rule sets for the HSA eligibility rules engine
+-- Saving rules adds a version; the highest version is the active one. With
+-- no rows, the built-in IRS Publication 502 rule set applies.
+
+CREATE TABLE IF NOT EXISTS eligibility_rule_sets (
+    version SERIAL PRIMARY KEY,
+    -- {"rules": [{"code", "category", "eligibility", "keywords", "vendors", "reference"}]}
+    rules JSONB NOT NULL,
+    note TEXT,
+    created_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,2 @@
+-- Reverts 014_perceptual_hash.sql
+ALTER TABLE receipts DROP COLUMN IF EXISTS perceptual_hash;
@@ -0,0 +1,6 @@
+-- Perceptual hash (64-bit dHash) of each receipt image, so a second photo of
+-- the same paper receipt is caught even though its file differs. NULL for
+-- PDFs and other files that are not decodable images. Existing images are
+-- hashed in the background when the API starts.
+
+ALTER TABLE receipts ADD COLUMN IF NOT EXISTS perceptual_hash BIGINT;
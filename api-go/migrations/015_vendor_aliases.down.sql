@@ -0,0 +1,4 @@
+-- Reverts 015_vendor_aliases.sql; added aliases are lost
+DROP INDEX IF EXISTS idx_receipts_household_date;
+CREATE INDEX IF NOT EXISTS idx_receipts_duplicate ON receipts(vendor, original_total, date);
+DROP TABLE IF EXISTS vendor_aliases;
@@ -0,0 +1,46 @@
+-- Vendor aliases map the many spellings of a vendor on receipts ("WALGREENS
+-- #1234", "Walgreen Co.") to one canonical name. alias holds the normalized
+-- key (lower case, store numbers and punctuation removed, see
+-- NormalizeVendor); a vendor whose key equals an alias, or starts with one
+-- followed by more words, gets the canonical name. Duplicate detection
+-- compares canonical names.
+
+CREATE TABLE IF NOT EXISTS vendor_aliases (
+    id SERIAL PRIMARY KEY,
+    alias VARCHAR(255) NOT NULL UNIQUE,
+    canonical VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+INSERT INTO vendor_aliases (alias, canonical) VALUES
+    ('walgreens', 'Walgreens'),
+    ('walgreen', 'Walgreens'),
+    ('walgreens pharmacy', 'Walgreens'),
+    ('cvs', 'CVS Pharmacy'),
+    ('cvs pharmacy', 'CVS Pharmacy'),
+    ('cvs caremark', 'CVS Pharmacy'),
+    ('rite aid', 'Rite Aid'),
+    ('riteaid', 'Rite Aid'),
+    ('rite aid pharmacy', 'Rite Aid'),
+    ('walmart', 'Walmart'),
+    ('wal mart', 'Walmart'),
+    ('walmart supercenter', 'Walmart'),
+    ('walmart pharmacy', 'Walmart'),
+    ('wm supercenter', 'Walmart'),
+    ('target', 'Target'),
+    ('costco', 'Costco'),
+    ('costco wholesale', 'Costco'),
+    ('costco pharmacy', 'Costco'),
+    ('sams club', 'Sam''s Club'),
+    ('sam s club', 'Sam''s Club'),
+    ('kroger', 'Kroger'),
+    ('kroger pharmacy', 'Kroger'),
+    ('amazon', 'Amazon'),
+    ('amazon com', 'Amazon'),
+    ('amzn mktp us', 'Amazon'),
+    ('amzn', 'Amazon')
+ON CONFLICT (alias) DO NOTHING;
+
+-- Duplicate candidates are found by household and date range, then scored
+DROP INDEX IF EXISTS idx_receipts_duplicate;
+CREATE INDEX IF NOT EXISTS idx_receipts_household_date ON receipts(household_id, date);
@@ -0,0 +1,3 @@
+-- Reverts 016_member_receipt_email.sql; members' receipt addresses are lost
+DROP INDEX IF EXISTS idx_household_members_email_token;
+ALTER TABLE household_members DROP COLUMN IF EXISTS email_token;
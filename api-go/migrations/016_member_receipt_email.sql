@@ -0,0 +1,9 @@
+-- Each household member gets a private address for emailing receipts in,
+-- <email_token>@SMTP_DOMAIN. The token is random, so the address cannot be
+-- guessed from the member; existing members get one too.
+
+ALTER TABLE household_members
+    ADD COLUMN IF NOT EXISTS email_token VARCHAR(32) NOT NULL
+    DEFAULT substr(md5(random()::text || clock_timestamp()::text), 1, 16);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_household_members_email_token ON household_members(email_token);
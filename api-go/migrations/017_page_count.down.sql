@@ -0,0 +1,3 @@
+-- Reverts 017_page_count.sql
+ALTER TABLE receipt_items DROP COLUMN IF EXISTS page;
+ALTER TABLE receipts DROP COLUMN IF EXISTS page_count;
@@ -0,0 +1,11 @@
+-- Pages in each receipt's file, so multi-page PDFs (hospital statements,
+-- explanations of benefits) can be viewed, split and combined page by page.
+-- NULL until the file is read: PDFs uploaded before page counts were kept
+-- are counted in the background when the API starts.
+
+ALTER TABLE receipts ADD COLUMN IF NOT EXISTS page_count INTEGER;
+UPDATE receipts SET page_count = 1 WHERE page_count IS NULL AND lower(image_path) NOT LIKE '%.pdf';
+
+-- The page of a multi-page receipt each item was read from, NULL when the
+-- extractor did not say
+ALTER TABLE receipt_items ADD COLUMN IF NOT EXISTS page INTEGER;
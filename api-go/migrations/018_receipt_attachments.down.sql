@@ -0,0 +1,4 @@
+-- Reverts 018_receipt_attachments.sql; receipt files stay referenced by
+-- image_path, while the files of other attachments are left in blobs/ for
+-- fsck to report as orphans
+DROP TABLE IF EXISTS receipt_attachments;
@@ -0,0 +1,42 @@
+-- Documents kept with a receipt for an audit: the itemized receipt, the
+-- insurer's Explanation of Benefits, a Letter of Medical Necessity. Every
+-- receipt with a file gets a primary attachment for it, whose storage_key
+-- is the receipt's image_path; the API keeps the two in step. Files are
+-- stored by content hash like receipt files, so one stored file can back
+-- several attachments.
+
+CREATE TABLE IF NOT EXISTS receipt_attachments (
+    id SERIAL PRIMARY KEY,
+    receipt_id INTEGER NOT NULL REFERENCES receipts(id) ON DELETE CASCADE,
+    document_type VARCHAR(20) NOT NULL DEFAULT 'other',  -- 'receipt', 'eob', 'lmn' or 'other'
+    is_primary BOOLEAN NOT NULL DEFAULT false,
+    file_hash VARCHAR(64) NOT NULL DEFAULT '',
+    storage_key TEXT NOT NULL,
+    mime_type VARCHAR(100) NOT NULL DEFAULT 'application/octet-stream',
+    original_filename VARCHAR(255) NOT NULL DEFAULT '',
+    uploaded_by VARCHAR(100) NOT NULL DEFAULT '',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- One primary attachment per receipt, and each file attached only once
+CREATE UNIQUE INDEX IF NOT EXISTS idx_receipt_attachments_primary ON receipt_attachments(receipt_id) WHERE is_primary;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_receipt_attachments_file ON receipt_attachments(receipt_id, file_hash);
+-- Deleting a file checks whether any attachment still points at it
+CREATE INDEX IF NOT EXISTS idx_receipt_attachments_storage_key ON receipt_attachments(storage_key);
+
+-- Existing receipt files become primary attachments
+INSERT INTO receipt_attachments (receipt_id, document_type, is_primary, file_hash, storage_key, mime_type,
+                                 original_filename, uploaded_by, created_at)
+SELECT r.id, 'receipt', true, COALESCE(r.image_hash, ''), r.image_path,
+       CASE lower(substring(r.image_path from '\.([^./]*)$'))
+           WHEN 'jpg' THEN 'image/jpeg'
+           WHEN 'jpeg' THEN 'image/jpeg'
+           WHEN 'png' THEN 'image/png'
+           WHEN 'pdf' THEN 'application/pdf'
+           WHEN 'heic' THEN 'image/heic'
+           ELSE 'application/octet-stream'
+       END,
+       r.original_filename, r.user_id, r.created_at
+FROM receipts r
+WHERE COALESCE(r.image_path, '') <> ''
+  AND NOT EXISTS (SELECT 1 FROM receipt_attachments a WHERE a.receipt_id = r.id AND a.is_primary);
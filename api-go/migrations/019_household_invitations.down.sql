@@ -0,0 +1,4 @@
+-- Reverts 019_household_invitations.sql; pending invitations become dependents
+DROP INDEX IF EXISTS idx_household_members_invited_user;
+ALTER TABLE household_members DROP COLUMN IF EXISTS invited_user_id;
+ALTER TABLE users DROP COLUMN IF EXISTS default_household_id;
@@ -0,0 +1,18 @@
+-- Explicit default households and invitations to existing accounts
+
+-- The household requests act on when none is selected. Set to each user's
+-- current (oldest) household so nobody's default moves.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS default_household_id INTEGER REFERENCES households(id) ON DELETE SET NULL;
+
+UPDATE users u
+SET default_household_id = (
+    SELECT MIN(m.household_id) FROM household_members m WHERE m.user_id = u.id
+)
+WHERE u.default_household_id IS NULL;
+
+-- A member added by username is only invited: user_id stays NULL until the
+-- invited account accepts
+ALTER TABLE household_members ADD COLUMN IF NOT EXISTS invited_user_id INTEGER REFERENCES users(id) ON DELETE SET NULL;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_household_members_invited_user
+    ON household_members(household_id, invited_user_id) WHERE invited_user_id IS NOT NULL;
@@ -2,12 +2,20 @@ import { createRouter, createWebHistory } from "vue-router";
 import UploadReceipt from "../views/UploadReceipt.vue";
 import ReceiptList from "../views/ReceiptList.vue";
 import HSADeduction from "../views/HSADeduction.vue";
+import Login from "../views/Login.vue";
+import api from "../services/api";
 
 const routes = [
   {
     path: "/",
     redirect: "/upload",
   },
+  {
+    path: "/login",
+    name: "Login",
+    component: Login,
+    meta: { public: true },
+  },
   {
     path: "/upload",
     name: "Upload",
@@ -30,4 +38,10 @@ const router = createRouter({
   routes,
 });
 
+router.beforeEach((to) => {
+  if (!to.meta.public && !api.isAuthenticated()) {
+    return { name: "Login", query: { redirect: to.fullPath } };
+  }
+});
+
 export default router;
@@ -24,8 +24,78 @@ const API_URL = getApiUrl();
 
 console.log("Final API_URL:", API_URL);
 
+const TOKEN_KEY = "hsa_session_token";
+
+const getToken = () => localStorage.getItem(TOKEN_KEY);
+
+// Attach the session token to every API call
+axios.interceptors.request.use((config) => {
+  const token = getToken();
+  if (token) {
+    config.headers.Authorization = `Bearer ${token}`;
+  }
+  return config;
+});
+
+// Drop a rejected session and send the user back to the login page
+axios.interceptors.response.use(
+  (response) => response,
+  (error) => {
+    if (error.response?.status === 401 && getToken()) {
+      localStorage.removeItem(TOKEN_KEY);
+      window.location.assign("/login");
+    }
+    return Promise.reject(error);
+  }
+);
+
 export default {
-  async uploadReceipt(file) {
+  isAuthenticated() {
+    return !!getToken();
+  },
+
+  async login(username, password) {
+    const response = await axios.post(`${API_URL}/auth/login`, {
+      username,
+      password,
+    });
+    localStorage.setItem(TOKEN_KEY, response.data.token);
+    return response.data.user;
+  },
+
+  async register(username, password) {
+    const response = await axios.post(`${API_URL}/auth/register`, {
+      username,
+      password,
+    });
+    localStorage.setItem(TOKEN_KEY, response.data.token);
+    return response.data.user;
+  },
+
+  // Single sign-on hands the session token back in the URL fragment
+  setToken(token) {
+    localStorage.setItem(TOKEN_KEY, token);
+  },
+
+  async getSSOInfo() {
+    const response = await axios.get(`${API_URL}/auth/oidc`);
+    return response.data;
+  },
+
+  getSSOLoginUrl() {
+    return `${API_URL}/auth/oidc/login`;
+  },
+
+  async logout() {
+    try {
+      await axios.post(`${API_URL}/auth/logout`);
+    } finally {
+      localStorage.removeItem(TOKEN_KEY);
+    }
+  },
+
+  // allowDuplicate keeps an upload the API flagged as a possible duplicate
+  async uploadReceipt(file, { allowDuplicate = false } = {}) {
     console.log("Uploading to:", `${API_URL}/receipts/upload`);
     console.log("File details:", {
       name: file.name,
@@ -35,6 +105,9 @@ export default {
 
     const formData = new FormData();
     formData.append("file", file);
+    if (allowDuplicate) {
+      formData.append("allow_duplicate", "true");
+    }
 
     try {
       const response = await axios.post(
@@ -60,11 +133,122 @@ export default {
         if (data.error === "duplicate") {
           throw new Error(data.message || "Duplicate receipt detected");
         }
+        if (data.error === "possible_duplicate") {
+          const err = new Error(
+            "This looks like a receipt that has already been uploaded"
+          );
+          err.possibleDuplicates = data.matches || [];
+          throw err;
+        }
       }
       throw error;
     }
   },
 
+  // Uploads several receipts, or ZIP archives of them, in one request;
+  // resolves to { results: [{ filename, status, message, ... }], summary }
+  async uploadReceipts(files, { allowDuplicate = false } = {}) {
+    const formData = new FormData();
+    for (const file of files) {
+      formData.append("file", file);
+    }
+    if (allowDuplicate) {
+      formData.append("allow_duplicate", "true");
+    }
+
+    const response = await axios.post(
+      `${API_URL}/receipts/upload`,
+      formData,
+      {
+        headers: {
+          "Content-Type": "multipart/form-data",
+        },
+      }
+    );
+    return response.data;
+  },
+
+  // Background jobs, e.g. the OCR job queued by an upload
+  async getJob(id) {
+    const response = await axios.get(`${API_URL}/jobs/${id}`);
+    return response.data;
+  },
+
+  // Queues another OCR run; resolves to { id, job_id, ocr_status }
+  async rerunOCR(receiptId) {
+    try {
+      const response = await axios.post(`${API_URL}/receipts/${receiptId}/ocr`);
+      return response.data;
+    } catch (error) {
+      console.error("Re-run OCR error:", error);
+      throw error;
+    }
+  },
+
+  // Polls a job until it succeeds or is dead-lettered
+  async waitForJob(id, intervalMs = 2000) {
+    for (;;) {
+      const job = await this.getJob(id);
+      if (job.status === "succeeded" || job.status === "dead") {
+        return job;
+      }
+      await new Promise((resolve) => setTimeout(resolve, intervalMs));
+    }
+  },
+
+  // Documents kept with a receipt; the first is the receipt's own file
+  async getReceiptAttachments(receiptId) {
+    const response = await axios.get(
+      `${API_URL}/receipts/${receiptId}/attachments`
+    );
+    return response.data || [];
+  },
+
+  // documentType is "receipt", "eob", "lmn" or "other"; resolves to the
+  // new attachment
+  async uploadReceiptAttachment(receiptId, file, documentType = "other") {
+    const formData = new FormData();
+    formData.append("file", file);
+    formData.append("document_type", documentType);
+
+    const response = await axios.post(
+      `${API_URL}/receipts/${receiptId}/attachments`,
+      formData,
+      {
+        headers: {
+          "Content-Type": "multipart/form-data",
+        },
+      }
+    );
+    return response.data;
+  },
+
+  async deleteReceiptAttachment(receiptId, attachmentId) {
+    const response = await axios.delete(
+      `${API_URL}/receipts/${receiptId}/attachments/${attachmentId}`
+    );
+    return response.data;
+  },
+
+  // Cuts a multi-page PDF receipt into one receipt per range, e.g.
+  // ["1-2", "3"]; resolves to { message, results }
+  async splitReceipt(receiptId, pages) {
+    const response = await axios.post(
+      `${API_URL}/receipts/${receiptId}/split`,
+      { pages }
+    );
+    return response.data;
+  },
+
+  // Combines receipts, in the order given, into one multi-page receipt;
+  // resolves to its upload result
+  async mergeReceipts(receiptIds) {
+    const response = await axios.post(`${API_URL}/receipts/merge`, {
+      receipt_ids: receiptIds,
+    });
+    return response.data;
+  },
+
   async getReceipts() {
     console.log("Fetching receipts from:", `${API_URL}/receipts`);
     try {
@@ -87,6 +271,47 @@ export default {
     }
   },
 
+  async getReceiptItems(receiptId) {
+    const response = await axios.get(`${API_URL}/receipts/${receiptId}/items`);
+    return response.data || [];
+  },
+
+  // Resolves to the receipt, with its re-derived status, total and items
+  async updateReceiptItem(receiptId, itemId, data) {
+    try {
+      const response = await axios.put(
+        `${API_URL}/receipts/${receiptId}/items/${itemId}`,
+        data
+      );
+      return response.data;
+    } catch (error) {
+      console.error("Update receipt item error:", error);
+      throw error;
+    }
+  },
+
+  // Resolves to {receipt, suggestion}: how the eligibility rules classify
+  // the receipt, line by line
+  async getReceiptEligibility(receiptId) {
+    const response = await axios.get(
+      `${API_URL}/receipts/${receiptId}/eligibility`
+    );
+    return response.data;
+  },
+
+  // Applies the eligibility rules' suggestion to the receipt and its items
+  async applyReceiptEligibility(receiptId) {
+    try {
+      const response = await axios.post(
+        `${API_URL}/receipts/${receiptId}/eligibility`
+      );
+      return response.data;
+    } catch (error) {
+      console.error("Apply eligibility error:", error);
+      throw error;
+    }
+  },
+
   async deleteReceipt(id) {
     console.log("Deleting receipt:", id);
     try {
@@ -98,10 +323,13 @@ export default {
     }
   },
 
-  async calculateDeduction(amount) {
-    console.log("Calculating deduction for amount:", amount);
+  // options: strategy, member_id, start_date, end_date, tax_year,
+  // exclude_vendors, max_receipts. Resolves to the deduction plan.
+  async calculateDeduction(amount, options = {}) {
+    console.log("Calculating deduction for amount:", amount, options);
     try {
       const response = await axios.post(`${API_URL}/receipts/deduct`, {
+        ...options,
         amount: amount,
       });
       return response.data;
@@ -111,33 +339,61 @@ export default {
     }
   },
 
-async approveDeduction(receiptIds, useReason) {
-  console.log("Approving deduction for receipts:", receiptIds, "Reason:", useReason);
-  try {
-    const promises = receiptIds.map((id) => {
-      const payload = {
-        used: true,
-        use_reason: useReason,
-      };
-      console.log(`Sending PUT request for receipt ${id} with payload:`, payload);
-      return axios.put(`${API_URL}/receipts/${id}`, payload);
-    });
-    
-    const results = await Promise.all(promises);
-    console.log("All receipts updated:", results.map(r => r.data));
-    
-    return results;
-  } catch (error) {
-    console.error("Approve deduction error:", error);
-    throw error;
-  }
-},
+  // Records a reimbursement claiming every allocation in one transaction
+  async approveDeduction(allocations, details = {}) {
+    console.log("Approving deduction allocations:", allocations, details);
+    try {
+      const response = await axios.post(`${API_URL}/reimbursements`, {
+        ...details,
+        allocations: allocations.map((a) => ({
+          receipt_id: a.receipt_id,
+          applied_amount: a.applied_amount,
+        })),
+      });
+      return response.data;
+    } catch (error) {
+      console.error("Approve deduction error:", error);
+      throw error;
+    }
+  },
+
+  async getReimbursements() {
+    try {
+      const response = await axios.get(`${API_URL}/reimbursements`);
+      return response.data || [];
+    } catch (error) {
+      console.error("Get reimbursements error:", error);
+      throw error;
+    }
+  },
+
+  async getReimbursement(id) {
+    try {
+      const response = await axios.get(`${API_URL}/reimbursements/${id}`);
+      return response.data;
+    } catch (error) {
+      console.error("Get reimbursement error:", error);
+      throw error;
+    }
+  },
+
+  async undoReimbursement(id) {
+    try {
+      const response = await axios.delete(`${API_URL}/reimbursements/${id}`);
+      return response.data;
+    } catch (error) {
+      console.error("Undo reimbursement error:", error);
+      throw error;
+    }
+  },
 
   getReceiptImageUrl(receiptId) {
     // Receipt files are served from /receipts/file/{id}
     // Use the same base as API but without /api suffix
     const baseUrl = API_URL.replace("/api", "");
-    const imageUrl = `${baseUrl}/receipts/file/${receiptId}`;
+    // <img> and download links can't send headers, so pass the token in the query
+    const token = encodeURIComponent(getToken() || "");
+    const imageUrl = `${baseUrl}/receipts/file/${receiptId}?token=${token}`;
     console.log("Receipt image URL:", imageUrl);
     return imageUrl;
   },
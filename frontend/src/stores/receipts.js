@@ -13,13 +13,13 @@ export const useReceiptsStore = defineStore("receipts", {
     amountAvailable: (state) => {
       return state.receipts
         .filter((r) => !r.used && r.hsa_qualified)
-        .reduce((sum, r) => sum + r.total_amount, 0);
+        .reduce((sum, r) => sum + r.qualified_amount, 0);
     },
 
     amountUsed: (state) => {
       return state.receipts
         .filter((r) => r.used)
-        .reduce((sum, r) => sum + r.total_amount, 0);
+        .reduce((sum, r) => sum + r.qualified_amount, 0);
     },
 
     eligibleReceipts: (state) => {
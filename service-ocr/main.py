@@ -20,17 +20,19 @@ pillow_heif.register_heif_opener()
 USE_CLAUDE = os.getenv("USE_CLAUDE_API", "true").lower() == "true"
 CLAUDE_API_KEY = os.getenv("CLAUDE_API_KEY", "")
 CLAUDE_MODEL = os.getenv("CLAUDE_MODEL", "claude-3-5-haiku-20241022")
+# Pages of a PDF read at most; hospital statements and EOBs run several pages
+MAX_PDF_PAGES = int(os.getenv("MAX_PDF_PAGES", "20"))
 
 
-async def extract_with_claude(image_data: bytes, mime_type: str) -> dict:
-    """Extract receipt data using Claude API with vision - assumes full HSA qualification"""
+async def extract_with_claude(pages: list) -> dict:
+    """Extract receipt data using Claude API with vision - assumes full HSA qualification
+
+    pages is a list of (image bytes, MIME type), one per page, all sent in one request
+    """
 
     if not CLAUDE_API_KEY:
         raise HTTPException(status_code=500, detail="Claude API key not configured")
 
-    # Encode image to base64
-    image_b64 = base64.standard_b64encode(image_data).decode("utf-8")
-
     # Prepare Claude API request
     headers = {
         "x-api-key": CLAUDE_API_KEY,
@@ -38,54 +40,74 @@ async def extract_with_claude(image_data: bytes, mime_type: str) -> dict:
         "content-type": "application/json",
     }
 
-    prompt = """Analyze this receipt image and extract the following information in JSON format:
+    prompt = """Analyze this receipt (the images above are its pages, in order) and extract the following information in JSON format:
 {
   "vendor": "store name",
   "amount": 0.00,
+  "tax": 0.00,
+  "discount": 0.00,
   "date": "MM/DD/YYYY",
-  "items": ["item1", "item2"],
+  "total_page": 1,
+  "items": [
+    {"description": "item name", "quantity": 1, "unit_price": 0.00, "amount": 0.00, "page": 1}
+  ],
   "raw_text": "full receipt text"
 }
 
 IMPORTANT INSTRUCTIONS:
 - Extract the TOTAL amount from the receipt (after tax, all discounts applied)
 - This should be the final amount paid
+- tax is the total tax charged and discount the total of all discounts and coupons, as positive numbers (0.00 when none)
 - Date should be in MM/DD/YYYY format
-- List all visible items from the receipt in the items array
-- Provide the complete text from the receipt in raw_text
-- Do NOT try to determine if items are HSA-qualified - the user will do that manually
+- List all visible items from the receipt in the items array, one object per line
+- amount is the line total as printed (quantity x unit_price, after any line discount)
+- Use null for a quantity, unit_price or amount that is not printed
+- Do NOT list subtotal, tax, total, payment or change lines as items
+- page is the page number (1 for the first image) an item appears on, and total_page the page showing the total
+- For a statement of several pages, take the total from the summary (the amount the patient owes or paid), not from a single page's subtotal
+- Provide the complete text from the receipt in raw_text, starting each page after the first with a line "--- Page N ---"
+- Do NOT try to determine if items are HSA-qualified - the API's eligibility rules do that
 
 Example response:
 {
   "vendor": "Walgreens",
   "amount": 24.99,
+  "tax": 1.51,
+  "discount": 0.00,
   "date": "11/07/2025",
-  "items": ["Band-Aids", "Ibuprofen", "Paper towels"],
+  "total_page": 1,
+  "items": [
+    {"description": "Band-Aids", "quantity": 1, "unit_price": 5.49, "amount": 5.49, "page": 1},
+    {"description": "Ibuprofen", "quantity": 2, "unit_price": 7.00, "amount": 14.00, "page": 1},
+    {"description": "Paper towels", "quantity": 1, "unit_price": 3.99, "amount": 3.99, "page": 1}
+  ],
   "raw_text": "WALGREENS\\nStore #1234\\n..."
 }"""
 
-    payload = {
-        "model": CLAUDE_MODEL,
-        "max_tokens": 1024,
-        "messages": [
+    # Each page is labeled so items can cite it
+    content = []
+    for number, (image_data, mime_type) in enumerate(pages, start=1):
+        if len(pages) > 1:
+            content.append({"type": "text", "text": f"Page {number}:"})
+        content.append(
             {
-                "role": "user",
-                "content": [
-                    {
-                        "type": "image",
-                        "source": {
-                            "type": "base64",
-                            "media_type": mime_type,
-                            "data": image_b64,
-                        },
-                    },
-                    {"type": "text", "text": prompt},
-                ],
+                "type": "image",
+                "source": {
+                    "type": "base64",
+                    "media_type": mime_type,
+                    "data": base64.standard_b64encode(image_data).decode("utf-8"),
+                },
             }
-        ],
+        )
+    content.append({"type": "text", "text": prompt})
+
+    payload = {
+        "model": CLAUDE_MODEL,
+        "max_tokens": 4096 if len(pages) > 1 else 2048,
+        "messages": [{"role": "user", "content": content}],
     }
 
-    async with httpx.AsyncClient(timeout=30.0) as client:
+    async with httpx.AsyncClient(timeout=120.0) as client:
         response = await client.post(
             "https://api.anthropic.com/v1/messages",
             headers=headers,
@@ -139,14 +161,27 @@ def extract_field(text: str, field: str, default: str = "") -> str:
     return match.group(1) if match else default
 
 
-def extract_with_tesseract(image: Image.Image) -> dict:
-    """Extract receipt data using Tesseract OCR (free/local) - basic fallback"""
-    text = pytesseract.image_to_string(image)
+def extract_with_tesseract(images: list) -> dict:
+    """Extract receipt data using Tesseract OCR (free/local) - basic fallback
+
+    Each page is read on its own; raw_text marks where each page after the first starts
+    """
+    page_texts = [pytesseract.image_to_string(image) for image in images]
+    text = "\n".join(
+        page_text if number == 1 else f"--- Page {number} ---\n{page_text}"
+        for number, page_text in enumerate(page_texts, start=1)
+    )
 
     vendor = re.search(r"(Walgreens|CVS|Costco|Walmart|Target|Kroger|Safeway|Rite Aid)", text, re.I)
     amount = re.search(r"\$?\s*([0-9]+[,.]?[0-9]*\.[0-9]{2})", text)
     date = re.search(r"(\d{1,2}[-/]\d{1,2}[-/]\d{2,4})", text)
 
+    total_page = None
+    if amount:
+        total_page = next(
+            (number for number, page_text in enumerate(page_texts, start=1) if amount.group(0) in page_text), None
+        )
+
     parsed_amount = 0.0
     if amount:
         amount_str = amount.group(1).replace(",", "")
@@ -171,7 +206,9 @@ def extract_with_tesseract(image: Image.Image) -> dict:
         "date": parsed_date,
         "hsa_status": "Yes",  # Always assume qualified
         "hsa_qualified": True,
+        "items": [],
         "raw_text": text,
+        "total_page": total_page,
     }
 
 
@@ -216,27 +253,37 @@ async def parse_receipt(file: UploadFile = File(...)):
                 tmp.write(content)
                 tmp_path = tmp.name
 
-            images = pdf2image.convert_from_path(tmp_path)
-            os.unlink(tmp_path)
+            try:
+                # Long statements are read up to MAX_PDF_PAGES pages
+                images = pdf2image.convert_from_path(tmp_path, last_page=MAX_PDF_PAGES)
+            finally:
+                os.unlink(tmp_path)
 
             if not images:
                 raise HTTPException(status_code=400, detail="No pages found in PDF")
-
-            # Convert first page to bytes
-            buffer = io.BytesIO()
-            images[0].save(buffer, format="JPEG")
-            content = buffer.getvalue()
-            mime_type = "image/jpeg"
+        except HTTPException:
+            raise
         except Exception as e:
             raise HTTPException(status_code=400, detail=f"Failed to process PDF: {str(e)}")
+    else:
+        images = [Image.open(io.BytesIO(content))]
 
     # Extract data
     if USE_CLAUDE:
-        result = await extract_with_claude(content, mime_type)
+        if mime_type == "application/pdf":
+            pages = []
+            for image in images:
+                buffer = io.BytesIO()
+                image.convert("RGB").save(buffer, format="JPEG")
+                pages.append((buffer.getvalue(), "image/jpeg"))
+        else:
+            pages = [(content, mime_type)]
+        result = await extract_with_claude(pages)
     else:
-        image = Image.open(io.BytesIO(content))
-        result = extract_with_tesseract(image)
+        result = extract_with_tesseract(images)
 
+    # The number of pages read, so the API can tell when a long PDF was cut short
+    result["page_count"] = len(images)
     return result
 
 